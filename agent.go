@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/agent"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// agentLoad tries to get the master key for "args.config" from
+// gocryptfs-agent. Returns a nil masterkey if the agent does not have it or
+// is not running.
+// Calls os.Exit on failure.
+func agentLoad(args *argContainer) (masterkey []byte, confFile *configfile.ConfFile) {
+	sock := agent.SocketPath()
+	if sock == "" {
+		tlog.Warn.Printf("-use_agent: neither $%s nor $XDG_RUNTIME_DIR is set", agent.SocketEnv)
+		return nil, nil
+	}
+	_, confFile, err := configfile.LoadConfFile(args.config, nil)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	// Same restriction as for the kernel keyring
+	if !keyringUsable(confFile) {
+		return nil, nil
+	}
+	// Like for the kernel keyring, the ID covers the settings that the master
+	// key is bound to
+	masterkey, err = agent.Get(sock, keyring.Description(confFile.KeyID()))
+	if err != nil {
+		if err != agent.ErrNotFound {
+			tlog.Info.Printf("gocryptfs-agent: %v", err)
+		}
+		return nil, nil
+	}
+	if len(masterkey) != cryptocore.KeyLen {
+		tlog.Warn.Printf("Ignoring master key of length %d from gocryptfs-agent", len(masterkey))
+		return nil, nil
+	}
+	tlog.Info.Printf("Using master key from gocryptfs-agent")
+	if confFile.Expired(time.Now()) {
+		if err = confirmExpired(args, confFile); err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+	}
+	return masterkey, confFile
+}
+
+// agentStore hands "masterkey" to gocryptfs-agent. Failures are not fatal.
+func agentStore(confFile *configfile.ConfFile, masterkey []byte) {
+	sock := agent.SocketPath()
+	if sock == "" || !keyringUsable(confFile) {
+		return
+	}
+	err := agent.Put(sock, keyring.Description(confFile.KeyID()), masterkey)
+	if err != nil {
+		tlog.Warn.Printf("Could not store the master key in gocryptfs-agent: %v", err)
+	}
+}
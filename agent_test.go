@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/agent"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+// TestAgentTamper checks that gocryptfs-agent does not hand out the master
+// key once the "Sealed" flag or the expiry time has been edited
+func TestAgentTamper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAgentTamper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go agent.NewServer(time.Hour).Serve(l)
+	oldSock := os.Getenv(agent.SocketEnv)
+	os.Setenv(agent.SocketEnv, sock)
+	defer os.Setenv(agent.SocketEnv, oldSock)
+	for _, expiry := range []bool{false, true} {
+		masterkey, confFile := keyTestConf(t, dir)
+		args := &argContainer{config: filepath.Join(dir, configfile.ConfDefaultName)}
+		agentStore(confFile, masterkey)
+		if have, _ := agentLoad(args); string(have) != string(masterkey) {
+			t.Fatalf("master key not found in the agent")
+		}
+		keyTestTamper(t, confFile, expiry)
+		if have, _ := agentLoad(args); have != nil {
+			t.Errorf("expiry=%v: edited config file got the master key from the agent", expiry)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/archivefs"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// openArchive opens CIPHERDIR when it is a .tar or .zip file instead of a
+// directory. Archives are always mounted read-only.
+// Calls os.Exit on errors.
+func openArchive(args *argContainer) {
+	if args.init || args.passwd || args.fsck || args.seal || args.unseal || args.reverse || args.metadata_dir != "" {
+		tlog.Fatal.Printf("The options -init, -passwd, -fsck, -seal, -unseal, -reverse and -metadata_dir " +
+			"cannot be used with an archive")
+		os.Exit(exitcodes.Usage)
+	}
+	a, err := archivefs.Open(args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	args._archive = a
+	if !args.ro {
+		tlog.Info.Printf("CIPHERDIR is an archive, mounting read-only")
+		args.ro = true
+	}
+}
+
+// archiveConfig returns a file name for the gocryptfs.conf inside the
+// archive, as the config file code works with file names. The config file
+// is copied to a temporary file that is deleted right away, and we refer
+// to it through /dev/fd. The *os.File is stored in args._archiveConf so that
+// the garbage collector does not close it behind our back. The caller must
+// keep args alive for as long as the config file is used.
+// If the archive has no config file, a non-existing path is returned so that
+// loading the config fails like it does for directories.
+func archiveConfig(args *argContainer) string {
+	missing := filepath.Join(args.cipherdir, configfile.ConfDefaultName)
+	js, err := args._archive.ReadFile(configfile.ConfDefaultName)
+	if err != nil {
+		return missing
+	}
+	f, err := ioutil.TempFile("", "gocryptfs.conf")
+	if err != nil {
+		tlog.Fatal.Printf("Cannot copy config file out of the archive: %v", err)
+		os.Exit(exitcodes.OpenConf)
+	}
+	os.Remove(f.Name())
+	if _, err = f.Write(js); err != nil {
+		tlog.Fatal.Printf("Cannot copy config file out of the archive: %v", err)
+		os.Exit(exitcodes.OpenConf)
+	}
+	args._archiveConf = f
+	return fmt.Sprintf("/dev/fd/%d", f.Fd())
+}
@@ -61,6 +61,9 @@ LDFLAGS="-X main.GitVersion=$GITVERSION -X main.GitVersionFuse=$GITVERSIONFUSE -
 go build "-ldflags=$LDFLAGS" $@
 
 (cd gocryptfs-xray; go build $@)
+(cd gocryptfs-ctl; go build $@)
+(cd gocryptfs-agent; go build $@)
+(cd gocryptfs-replay; go build $@)
 
 ./gocryptfs -version
 
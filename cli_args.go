@@ -4,16 +4,31 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rfjakob/gocryptfs/internal/archivefs"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/desktopnotify"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/faultinject"
+	"github.com/rfjakob/gocryptfs/internal/freeze"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/guard"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/pathexclude"
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
+	"github.com/rfjakob/gocryptfs/internal/progress"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/webhook"
 )
 
 // argContainer stores the parsed CLI options and arguments
@@ -21,20 +36,81 @@ type argContainer struct {
 	debug, init, zerokey, fusedebug, openssl, passwd, fg, version,
 	plaintextnames, quiet, nosyslog, wpanic,
 	longnames, allow_other, ro, reverse, aessiv, nonempty, raw64,
-	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom, fsck bool
+	noprealloc, nocreatewrite, speed, bench_suite, hkdf, serialize_reads, serialize_writes, forcedecode, hh, info,
+	sharedstorage, devrandom, fsck, cipherdf, follow_symlinks, xchacha, seal, unseal,
+	allow_expired, dualcontrol, duress, tpm2, use_keyring, use_agent, detect_conflicts, conflict_eio,
+	raw_access, external_headers, writeback, desktop_notify, expose_control_files, discard, one_file_system, writable, export_tar, repair, write_barriers, ino_namespace, strict_posix, dirty_ranges, progress_json bool
 	masterkey, mountpoint, cipherdir, cpuprofile, extpass,
-	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace string
+	memprofile, ko, nocache_glob, passfile, ctlsock, fsname, force_owner, trace, record_trace,
+	fault_inject, metadata_dir, ctlsock_mode, ctlsock_acl, kdf, expiry, fido2, tpm2_pcrs, webhook, guard, exclude_from, scratch_glob, as_of, ctlsock_http, profile, mirror string
+	// Progress file of -fsck, "-fsck_checkpoint", and whether to continue
+	// from it, "-fsck_resume"
+	fsck_checkpoint string
+	fsck_resume     bool
+	// Only check names, headers and xattrs, "-fsck_fast"
+	fsck_fast bool
+	// Content hash manifests of -fsck, "-write_manifest" and
+	// "-verify_manifest"
+	write_manifest, verify_manifest string
 	// Configuration file name override
-	config             string
-	notifypid, scryptn int
+	config                                                                     string
+	notifypid, scryptn, longnameretries, readahead, blocksize, keyring_timeout int
+	// Memory budget in MiB for decrypted blocks, "-plaintext_cache_size"
+	plaintext_cache_size int
+	// Memory limit in MiB for "-scratch_glob" files, "-scratch_size"
+	scratch_size int
+	// Number of overwrite passes for deleted files, "-shred"
+	shred int
+	// Number of files that -fsck reads in parallel, "-fsck_workers"
+	fsck_workers int
+	// Unmount after this time without activity, "-idle"
+	idle time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _ctlsockHTTP is the listener of "-ctlsock_http"
+	_ctlsockHTTP net.Listener
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _ctlsockMode is the parsed "-ctlsock_mode", or -1 if not set. 0 is a
+	// valid mode.
+	_ctlsockMode int
+	// _ctlsockACL is the parsed "-ctlsock_acl", or nil if not set
+	_ctlsockACL ctlsock.ACL
+	// _faultInject is the parsed "-fault_inject", or nil if not set
+	_faultInject *faultinject.Injector
+	// _archive is set when CIPHERDIR is a .tar or .zip file
+	_archive *archivefs.Archive
+	// _archiveConf is the unlinked temporary copy of the config file inside
+	// the archive that args.config points to, see archiveConfig()
+	_archiveConf *os.File
+	// _expiry is the parsed "-expiry" in Unix seconds, or 0 for "none"
+	_expiry int64
+	// _asOf is the parsed "-as-of" in Unix seconds, or 0 if not set
+	_asOf int64
+	// _keyringDesc is the description of the master key in the kernel
+	// keyring, or empty if it is not stored there
+	_keyringDesc string
+	// _webhook delivers "-webhook" events, or is nil if not set
+	_webhook *webhook.Notifier
+	// _desktopNotify shows "-desktop_notify" notifications, or is nil if not
+	// set
+	_desktopNotify *desktopnotify.Notifier
+	// _guard is the parsed "-guard", or nil if not set
+	_guard *guard.Guard
+	// _freezer implements the "freeze" and "thaw" control socket commands,
+	// or is nil if not available
+	_freezer *freeze.Freezer
+	// _exclude holds the rules from "-exclude-from", or is nil if not set
+	_exclude *pathexclude.Matcher
+	// _mirror is the connection to the primary mount of "-mirror", or nil
+	// if not set
+	_mirror *mirror
+	// _manifestKey is the HMAC key for "-write_manifest" and
+	// "-verify_manifest", or nil if neither is set
+	_manifestKey []byte
 }
 
 var flagSet *flag.FlagSet
@@ -121,34 +197,139 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
+	flagSet.BoolVar(&args.xchacha, "xchacha", false, "XChaCha20-Poly1305 encryption")
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
+	flagSet.BoolVar(&args.write_barriers, "write_barriers", false, "Flush new file headers to disk before the data that uses them")
+	flagSet.BoolVar(&args.write_barriers, "write-barriers", false, "")
+	flagSet.BoolVar(&args.strict_posix, "strict_posix", false, "Disable caching and convenience features that deviate from POSIX")
+	flagSet.BoolVar(&args.strict_posix, "strict-posix", false, "")
+	flagSet.BoolVar(&args.nocreatewrite, "nocreatewrite", false, "Disable combined header and data write for new files")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
+	flagSet.BoolVar(&args.bench_suite, "bench_suite", false, "Run the benchmark matrix and print the results as JSON")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
+	flagSet.BoolVar(&args.serialize_writes, "serialize_writes", false, "Encrypt large writes on a single CPU")
 	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
 		" Requires gocryptfs to be compiled with openssl support and implies -openssl true")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.seal, "seal", false, "Seal CIPHERDIR: force all future mounts to be read-only")
+	flagSet.BoolVar(&args.unseal, "unseal", false, "Unseal CIPHERDIR")
+	flagSet.BoolVar(&args.allow_expired, "allow_expired", false, "Allow access to a filesystem that has passed its expiry date")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
+	flagSet.BoolVar(&args.detect_conflicts, "detect_conflicts", false, "Detect files in CIPHERDIR that are modified behind our back")
+	flagSet.BoolVar(&args.conflict_eio, "conflict_eio", false, "Return EIO on files that have been modified behind our back. Implies -detect_conflicts")
+	flagSet.BoolVar(&args.raw_access, "raw_access", false, "Show the ciphertext read-only in the hidden directory "+
+		"\""+fusefrontend.RawDirName+"\" in the root of the mount")
+	flagSet.BoolVar(&args.external_headers, "external_headers", false, "Store file headers in an xattr instead of "+
+		"at the start of each file (with -init)")
+	flagSet.BoolVar(&args.ino_namespace, "ino_namespace", false, "Move the inode numbers into a range that depends on the filesystem")
+	flagSet.BoolVar(&args.writeback, "writeback", false, "Keep the kernel page cache when files are closed and opened again")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.repair, "repair", false, "Move corrupt files into quarantine and recover what is left (with -fsck)")
+	flagSet.BoolVar(&args.progress_json, "progress_json", false, "Print the progress of -fsck and -export_tar as JSON lines to stderr")
+	flagSet.BoolVar(&args.progress_json, "progress-json", false, "")
+	flagSet.BoolVar(&args.export_tar, "export_tar", false, "Write the encrypted view of CIPHERDIR as a tar stream to stdout (with -reverse)")
+	flagSet.BoolVar(&args.cipherdf, "cipherdf", false, "Report predicted ciphertext size in df (reverse mode only)")
+	flagSet.BoolVar(&args.follow_symlinks, "follow_symlinks", false, "Present symlinks as their targets (reverse mode only)")
+	flagSet.BoolVar(&args.one_file_system, "one_file_system", false, "Hide the filesystems that are mounted inside "+
+		"the plaintext directory (reverse mode only)")
+	flagSet.BoolVar(&args.one_file_system, "one-file-system", false, "")
+	flagSet.BoolVar(&args.writable, "writable", false, "Decrypt ciphertext that is written to the mount into the "+
+		"plaintext directory (reverse mode only)")
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.extpass, "extpass", "", "Use external program for the password prompt")
 	flagSet.StringVar(&args.passfile, "passfile", "", "Read password from file")
+	flagSet.BoolVar(&args.dualcontrol, "dualcontrol", false, "Require two passwords, or a password and the -fido2 token, to unlock (with -init)")
+	flagSet.BoolVar(&args.duress, "duress", false, "Set a duress password that destroys the master key (with -init or -passwd)")
+	flagSet.BoolVar(&args.use_keyring, "use_keyring", false, "Cache the master key in the kernel keyring and use it for later mounts")
+	flagSet.BoolVar(&args.use_keyring, "use-keyring", false, "")
+	flagSet.BoolVar(&args.use_agent, "use_agent", false, "Get the master key from gocryptfs-agent, and hand it to the agent after asking for the password")
+	flagSet.BoolVar(&args.use_agent, "use-agent", false, "")
+	flagSet.BoolVar(&args.tpm2, "tpm2", false, "Seal the master key to the TPM (with -init or -passwd), "+
+		"or unseal it from the TPM instead of asking for the password")
+	flagSet.StringVar(&args.tpm2_pcrs, "tpm2_pcrs", "", "Bind the TPM-sealed master key to these PCRs, example: sha256:0,7")
+	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the master key using the FIDO2 token at the specified device path")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
+	flagSet.StringVar(&args.nocache_glob, "nocache_glob", "", "Bypass the kernel page cache for files matching these "+
+		"patterns, comma-separated list, example: \"*.sqlite*,*.db\"")
+	flagSet.StringVar(&args.as_of, "as_of", "", "Show CIPHERDIR as it was at this time, using the versioned copies "+
+		"of the backing store (read-only). Format: YYYY-MM-DD or RFC3339")
+	flagSet.StringVar(&args.as_of, "as-of", "", "")
+	flagSet.StringVar(&args.mirror, "mirror", "", "Mount read-only next to the read-write mount that has this "+
+		"control socket, and drop our caches when it changes CIPHERDIR")
+	flagSet.StringVar(&args.scratch_glob, "scratch_glob", "", "Keep new files matching these patterns in memory instead of "+
+		"writing them to CIPHERDIR, comma-separated list, example: \"*.swp,*.tmp\"")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
+	flagSet.StringVar(&args.ctlsock_mode, "ctlsock_mode", "", "File permissions of the control socket (octal)")
+	flagSet.StringVar(&args.ctlsock_acl, "ctlsock_acl", "", "Restrict control socket requests per user, "+
+		"example: \"0:encrypt+decrypt,1000:encrypt\"")
+	flagSet.StringVar(&args.ctlsock_http, "ctlsock_http", "", "Serve the control socket requests as JSON over HTTP "+
+		"on this localhost address, example: \"127.0.0.1:8471\"")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.record_trace, "record_trace", "", "Record anonymized FUSE operations to file, for gocryptfs-replay")
+	flagSet.StringVar(&args.metadata_dir, "metadata_dir", "", "Store gocryptfs.diriv and long name files in this "+
+		"directory instead of CIPHERDIR")
+	flagSet.StringVar(&args.fault_inject, "fault_inject", "", "Developer option: randomly fail backing-store I/O, "+
+		"example: \"eio=0.01,short=0.05,latency=0.1:50ms,seed=1\"")
+	flagSet.BoolVar(&args.expose_control_files, "expose_control_files", false, "Allow access to gocryptfs.conf through the "+
+		"mount when file names are not encrypted")
+	flagSet.BoolVar(&args.expose_control_files, "expose-control-files", false, "")
+	flagSet.BoolVar(&args.desktop_notify, "desktop_notify", false, "Show desktop notifications when corruption is found or the filesystem is unmounted because it was idle")
+	flagSet.StringVar(&args.exclude_from, "exclude_from", "", "Hide the plaintext paths matching the gitignore-style "+
+		"rules in this file (reverse mode only)")
+	flagSet.StringVar(&args.exclude_from, "exclude-from", "", "")
+	flagSet.StringVar(&args.guard, "guard", "", "Report and freeze the mount when other users open many files quickly, "+
+		"example: \"opens=100,window=10s,allow=33,action=lock\"")
+	flagSet.StringVar(&args.webhook, "webhook", "", "POST JSON events like mount, unmount and detected corruption to this URL")
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	flagSet.IntVar(&args.scryptn, "scryptn", configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
+	flagSet.StringVar(&args.kdf, "kdf", configfile.KDFScrypt, "Password hashing algorithm (with -init). Possible values: scrypt, argon2id")
+	flagSet.IntVar(&args.blocksize, "blocksize", contentenc.DefaultBS, "Plaintext block size in bytes for file content encryption (with -init)")
+	flagSet.StringVar(&args.profile, "profile", "", "Take the defaults for -init from a profile. Possible values: "+
+		strings.Join(configfile.ProfileNames(), ", "))
+	flagSet.StringVar(&args.expiry, "expiry", "", "Refuse to mount after this date (with -init or -passwd). "+
+		"Format: YYYY-MM-DD or RFC3339, \"none\" clears the expiry date")
+	flagSet.IntVar(&args.keyring_timeout, "keyring_timeout", 600, "Seconds until the master key in the kernel keyring expires. 0 means never")
+	flagSet.IntVar(&args.keyring_timeout, "keyring-timeout", 600, "")
+	flagSet.IntVar(&args.readahead, "readahead", 0, "Maximum readahead window in KiB for sequential reads. 0 disables readahead")
+	flagSet.IntVar(&args.plaintext_cache_size, "plaintext_cache_size", 0, "Memory budget in MiB for caching decrypted file blocks. 0 disables the cache")
+	flagSet.IntVar(&args.plaintext_cache_size, "plaintext-cache-size", 0, "")
+	flagSet.IntVar(&args.scratch_size, "scratch_size", 256, "Memory limit in MiB for -scratch_glob files. "+
+		"Writes beyond it fail with ENOSPC. 0 means no limit")
+	flagSet.IntVar(&args.scratch_size, "scratch-size", 256, "")
+	flagSet.IntVar(&args.shred, "shred", 0, "Overwrite deleted files this many times with random data. "+
+		"Refused on copy-on-write filesystems")
+	flagSet.BoolVar(&args.discard, "discard", false, "Ask the backing device to discard the space freed by deleting and "+
+		"truncating files (FITRIM, needs root)")
+	flagSet.BoolVar(&args.dirty_ranges, "dirty_ranges", false, "Track the modified ciphertext ranges of each file for sync clients")
+	flagSet.BoolVar(&args.dirty_ranges, "dirty-ranges", false, "")
+	flagSet.DurationVar(&args.idle, "idle", 0, "Unmount after this duration without activity and open files. "+
+		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.IntVar(&args.fsck_workers, "fsck_workers", 1, "Number of files that -fsck reads in parallel")
+	flagSet.IntVar(&args.fsck_workers, "fsck-workers", 1, "")
+	flagSet.StringVar(&args.fsck_checkpoint, "fsck_checkpoint", "", "Save the progress of -fsck to this file every minute")
+	flagSet.StringVar(&args.fsck_checkpoint, "fsck-checkpoint", "", "")
+	flagSet.BoolVar(&args.fsck_resume, "fsck_resume", false, "Continue -fsck where the -fsck_checkpoint file says it stopped")
+	flagSet.BoolVar(&args.fsck_resume, "fsck-resume", false, "")
+	flagSet.BoolVar(&args.fsck_fast, "fsck_fast", false, "Only check names, file headers and xattrs, not the file content (with -fsck)")
+	flagSet.BoolVar(&args.fsck_fast, "fsck-fast", false, "")
+	flagSet.StringVar(&args.write_manifest, "write_manifest", "", "Write a manifest of the file content hashes to this file (with -fsck)")
+	flagSet.StringVar(&args.write_manifest, "write-manifest", "", "")
+	flagSet.StringVar(&args.verify_manifest, "verify_manifest", "", "Compare the file contents with the manifest in this file (with -fsck)")
+	flagSet.StringVar(&args.verify_manifest, "verify-manifest", "", "")
+	flagSet.IntVar(&args.longnameretries, "longnameretries", 0, "Number of alternative hashes to try "+
+		"when a long file name collides with an existing file. 0 disables collision handling.")
 	// Ignored otions
 	var dummyBool bool
 	ignoreText := "(ignored for compatibility)"
@@ -167,6 +348,13 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("%v", err)
 		os.Exit(exitcodes.Usage)
 	}
+	if args.profile != "" {
+		if !args.init {
+			tlog.Fatal.Printf("The -profile option requires -init")
+			os.Exit(exitcodes.Usage)
+		}
+		applyProfile(&args, flagSet)
+	}
 	// "-openssl" needs some post-processing
 	if opensslAuto == "auto" {
 		args.openssl = prefer_openssl.PreferOpenSSL()
@@ -187,6 +375,10 @@ func parseCliOpts() (args argContainer) {
 			tlog.Fatal.Printf("The -forcedecode and -aessiv flags are incompatible because they use different crypto libs (openssl vs native Go)")
 			os.Exit(exitcodes.Usage)
 		}
+		if args.xchacha == true {
+			tlog.Fatal.Printf("The -forcedecode and -xchacha flags are incompatible because they use different crypto libs (openssl vs native Go)")
+			os.Exit(exitcodes.Usage)
+		}
 		if args.reverse == true {
 			tlog.Fatal.Printf("The reverse mode and the -forcedecode option are not compatible")
 			os.Exit(exitcodes.Usage)
@@ -203,6 +395,306 @@ func parseCliOpts() (args argContainer) {
 		args.allow_other = false
 		args.ko = "noexec"
 	}
+	if args.as_of != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -as_of option is incompatible with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		args._asOf, err = parseExpiry(args.as_of)
+		if err == nil && args._asOf == 0 {
+			err = fmt.Errorf("\"none\" is not a point in time")
+		}
+		if err != nil {
+			tlog.Fatal.Printf("-as_of: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		// The past cannot be changed
+		args.ro = true
+	}
+	if args.mirror != "" {
+		if args.reverse || args.writeback {
+			tlog.Fatal.Printf("The -mirror option is incompatible with -reverse and -writeback")
+			os.Exit(exitcodes.Usage)
+		}
+		// Two writers would get in each other's way
+		args.ro = true
+	}
+	if args.xchacha && (args.aessiv || args.reverse) {
+		tlog.Fatal.Printf("The -xchacha option is not compatible with -aessiv and -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.xchacha && !args.hkdf {
+		tlog.Fatal.Printf("The -xchacha option requires -hkdf")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.cipherdf && !args.reverse {
+		tlog.Fatal.Printf("The -cipherdf option requires -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.follow_symlinks && !args.reverse {
+		tlog.Fatal.Printf("The -follow_symlinks option requires -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.one_file_system && !args.reverse {
+		tlog.Fatal.Printf("The -one_file_system option requires -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.export_tar && !args.reverse {
+		tlog.Fatal.Printf("The -export_tar option requires -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.progress_json && !args.fsck && !args.export_tar {
+		tlog.Fatal.Printf("The -progress_json option requires -fsck or -export_tar")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.repair && !args.fsck {
+		tlog.Fatal.Printf("The -repair option requires -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.repair && (args.reverse || args.ro) {
+		tlog.Fatal.Printf("The -repair option is incompatible with -reverse and -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.writable && !args.reverse {
+		tlog.Fatal.Printf("The -writable option requires -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.writable && (args.ro || args.follow_symlinks) {
+		tlog.Fatal.Printf("The -writable option is incompatible with -ro and -follow_symlinks")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.conflict_eio {
+		args.detect_conflicts = true
+	}
+	if args.expose_control_files && args.reverse {
+		tlog.Fatal.Printf("The -expose_control_files option is incompatible with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.raw_access && args.reverse {
+		tlog.Fatal.Printf("The -raw_access option is incompatible with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.detect_conflicts && args.reverse {
+		tlog.Fatal.Printf("The -detect_conflicts and -conflict_eio options are incompatible with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.nocache_glob != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -nocache_glob option is incompatible with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		for _, g := range strings.Split(args.nocache_glob, ",") {
+			if _, err = filepath.Match(g, ""); err != nil || g == "" {
+				tlog.Fatal.Printf("-nocache_glob: invalid pattern %q", g)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+	}
+	if args.scratch_glob != "" {
+		if args.reverse || args.ro {
+			tlog.Fatal.Printf("The -scratch_glob option is incompatible with -reverse and -ro")
+			os.Exit(exitcodes.Usage)
+		}
+		for _, g := range strings.Split(args.scratch_glob, ",") {
+			if _, err = filepath.Match(g, ""); err != nil || g == "" {
+				tlog.Fatal.Printf("-scratch_glob: invalid pattern %q", g)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+	}
+	if args.scratch_size < 0 {
+		tlog.Fatal.Printf("-scratch_size must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.kdf != configfile.KDFScrypt && args.kdf != configfile.KDFArgon2id {
+		tlog.Fatal.Printf("Invalid \"-kdf\" setting %q. Possible values: %s, %s",
+			args.kdf, configfile.KDFScrypt, configfile.KDFArgon2id)
+		os.Exit(exitcodes.Usage)
+	}
+	if contentenc.CheckBlockSize(uint64(args.blocksize)) != nil {
+		tlog.Fatal.Printf("-blocksize must be a power of two between %d and %d",
+			contentenc.DefaultBS, fuse.MAX_KERNEL_WRITE)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.readahead < 0 || args.readahead > 16*1024 {
+		tlog.Fatal.Printf("-readahead must be between 0 and %d", 16*1024)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.readahead > 0 && args.sharedstorage {
+		tlog.Fatal.Printf("The -readahead option is incompatible with -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.shred < 0 {
+		tlog.Fatal.Printf("-shred must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.shred > 0 && (args.reverse || args.ro) {
+		tlog.Fatal.Printf("The -shred option is incompatible with -reverse and -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dirty_ranges && (args.reverse || args.ro) {
+		tlog.Fatal.Printf("The -dirty_ranges option is incompatible with -reverse and -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.discard && (args.reverse || args.ro) {
+		tlog.Fatal.Printf("The -discard option is incompatible with -reverse and -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.plaintext_cache_size < 0 {
+		tlog.Fatal.Printf("-plaintext_cache_size must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.plaintext_cache_size > 0 && (args.reverse || args.sharedstorage) {
+		tlog.Fatal.Printf("The -plaintext_cache_size option is incompatible with -reverse and -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.write_barriers && (args.reverse || args.ro) {
+		tlog.Fatal.Printf("The -write_barriers option is incompatible with -reverse and -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.strict_posix && args.reverse {
+		tlog.Fatal.Printf("The -strict_posix option is incompatible with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.writeback && (args.reverse || args.sharedstorage) {
+		tlog.Fatal.Printf("The -writeback option is incompatible with -reverse and -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsck_workers < 1 {
+		tlog.Fatal.Printf("-fsck_workers must be at least 1")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsck_checkpoint != "" && (!args.fsck || args.reverse) {
+		tlog.Fatal.Printf("The -fsck_checkpoint option requires -fsck and is incompatible with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsck_resume && args.fsck_checkpoint == "" {
+		tlog.Fatal.Printf("The -fsck_resume option requires -fsck_checkpoint")
+		os.Exit(exitcodes.Usage)
+	}
+	// A checkpoint of a fast check would let a full check skip files whose
+	// content has not been read
+	if args.fsck_fast && (!args.fsck || args.reverse || args.fsck_checkpoint != "") {
+		tlog.Fatal.Printf("The -fsck_fast option requires -fsck and is incompatible with -reverse and -fsck_checkpoint")
+		os.Exit(exitcodes.Usage)
+	}
+	// The manifest needs the content of every file
+	if (args.write_manifest != "" || args.verify_manifest != "") &&
+		(!args.fsck || args.reverse || args.fsck_fast || args.fsck_checkpoint != "") {
+		tlog.Fatal.Printf("The -write_manifest and -verify_manifest options require -fsck and are incompatible with " +
+			"-reverse, -fsck_fast and -fsck_checkpoint")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.idle < 0 {
+		tlog.Fatal.Printf("-idle must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.longnameretries < 0 || args.longnameretries > nametransform.LongNameMaxRetries {
+		tlog.Fatal.Printf("-longnameretries must be between 0 and %d", nametransform.LongNameMaxRetries)
+		os.Exit(exitcodes.Usage)
+	}
+	args._ctlsockMode = -1
+	if args.ctlsock_mode != "" {
+		mode, err := strconv.ParseUint(args.ctlsock_mode, 8, 32)
+		if err != nil || mode > 0777 {
+			tlog.Fatal.Printf("-ctlsock_mode: invalid octal permissions %q", args.ctlsock_mode)
+			os.Exit(exitcodes.Usage)
+		}
+		args._ctlsockMode = int(mode)
+	}
+	if args.ctlsock_acl != "" {
+		args._ctlsockACL, err = ctlsock.ParseACL(args.ctlsock_acl)
+		if err != nil {
+			tlog.Fatal.Printf("-ctlsock_acl: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.fault_inject != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -fault_inject option is incompatible with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		args._faultInject, err = faultinject.Parse(args.fault_inject)
+		if err != nil {
+			tlog.Fatal.Printf("-fault_inject: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.exclude_from != "" {
+		if !args.reverse {
+			tlog.Fatal.Printf("The -exclude_from option requires -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		args._exclude, err = pathexclude.LoadFile(args.exclude_from)
+		if err != nil {
+			tlog.Fatal.Printf("-exclude_from: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.guard != "" {
+		args._guard, err = guard.Parse(args.guard, uint32(os.Getuid()))
+		if err != nil {
+			tlog.Fatal.Printf("-guard: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.webhook != "" {
+		u, err := url.Parse(args.webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			tlog.Fatal.Printf("-webhook: invalid URL %q, must start with http:// or https://", args.webhook)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.external_headers && args.reverse {
+		tlog.Fatal.Printf("The -external_headers option is incompatible with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.metadata_dir != "" && (args.reverse || args.plaintextnames) {
+		tlog.Fatal.Printf("The -metadata_dir option is incompatible with -reverse and -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ctlsock_mode != "" && args.ctlsock == "" {
+		tlog.Fatal.Printf("-ctlsock_mode requires -ctlsock")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ctlsock_acl != "" && args.ctlsock == "" && args.ctlsock_http == "" {
+		tlog.Fatal.Printf("-ctlsock_acl requires -ctlsock or -ctlsock_http")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ctlsock_http != "" {
+		// Every local user can connect to the port, so the access has to be
+		// granted explicitly
+		if args.ctlsock_acl == "" {
+			tlog.Fatal.Printf("-ctlsock_http requires -ctlsock_acl, for example \"*:decrypt\"")
+			os.Exit(exitcodes.Usage)
+		}
+		host, _, err := net.SplitHostPort(args.ctlsock_http)
+		if err != nil {
+			tlog.Fatal.Printf("-ctlsock_http: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		if !ctlsock.IsLoopback(host) {
+			tlog.Fatal.Printf("-ctlsock_http: %q is not a loopback address", host)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.expiry != "" {
+		if !args.init && !args.passwd {
+			tlog.Fatal.Printf("The -expiry option requires -init or -passwd")
+			os.Exit(exitcodes.Usage)
+		}
+		args._expiry, err = parseExpiry(args.expiry)
+		if err != nil {
+			tlog.Fatal.Printf("-expiry: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.ko != "" {
+		if err = checkKernelOptions(args.ko); err != nil {
+			tlog.Fatal.Printf("-ko: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// '-passfile FILE' is a shortcut for -extpass='/bin/cat -- FILE'
 	if args.passfile != "" {
 		args.extpass = "/bin/cat -- " + args.passfile
@@ -211,9 +703,117 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("The options -extpass and -masterkey cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.dualcontrol && !args.init {
+		tlog.Fatal.Printf("The -dualcontrol option requires -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.duress && !args.init && !args.passwd {
+		tlog.Fatal.Printf("The -duress option requires -init or -passwd")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.duress && (args.dualcontrol || args.fido2 != "") {
+		tlog.Fatal.Printf("The -duress option cannot be used with -dualcontrol and -fido2")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.use_keyring && (args.init || args.passwd || args.seal || args.unseal || args.masterkey != "" || args.tpm2) {
+		tlog.Fatal.Printf("The -use_keyring option can only be used when mounting with a password")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.use_agent && (args.init || args.passwd || args.seal || args.unseal || args.masterkey != "" || args.tpm2) {
+		tlog.Fatal.Printf("The -use_agent option can only be used when mounting with a password")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keyring_timeout < 0 {
+		tlog.Fatal.Printf("-keyring_timeout must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.tpm2 && (args.dualcontrol || args.fido2 != "") {
+		tlog.Fatal.Printf("The -tpm2 option cannot be used with -dualcontrol and -fido2")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.tpm2_pcrs != "" && !(args.tpm2 && (args.init || args.passwd)) {
+		tlog.Fatal.Printf("The -tpm2_pcrs option requires -tpm2 together with -init or -passwd")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.tpm2 && (args.masterkey != "" || args.extpass != "") && !args.init && !args.passwd {
+		tlog.Fatal.Printf("The -tpm2 option cannot be used with -masterkey and -extpass when mounting")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fido2 != "" && args.extpass != "" {
+		tlog.Fatal.Printf("The options -fido2 and -extpass/-passfile cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
 	return args
 }
 
+// parseExpiry parses the argument to "-expiry" (and "-as_of") and returns
+// it as Unix seconds. Dates without a time refer to midnight local time.
+// "none" returns 0.
+func parseExpiry(s string) (int64, error) {
+	if s == "none" {
+		return 0, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q, use YYYY-MM-DD or RFC3339", s)
+	}
+	if t.Unix() <= 0 {
+		return 0, fmt.Errorf("%q is before 1970", s)
+	}
+	return t.Unix(), nil
+}
+
+// checkKernelOptions sanity-checks the argument to "-ko". The options are
+// passed to the kernel as-is, so we only catch mistakes that would otherwise
+// show up as an obscure mount failure or as I/O errors later on.
+func checkKernelOptions(ko string) error {
+	for _, o := range strings.Split(ko, ",") {
+		if o == "" {
+			return fmt.Errorf("empty option in %q", ko)
+		}
+		if !strings.HasPrefix(o, "max_read=") {
+			continue
+		}
+		// gocryptfs rejects reads larger than MAX_KERNEL_WRITE, so the kernel
+		// must never send them.
+		n, err := strconv.ParseUint(o[len("max_read="):], 10, 32)
+		if err != nil || n == 0 || n > fuse.MAX_KERNEL_WRITE {
+			return fmt.Errorf("%q: max_read must be between 1 and %d", o, fuse.MAX_KERNEL_WRITE)
+		}
+	}
+	return nil
+}
+
+// applyProfile sets the options of the "-profile" that have not been
+// passed explicitly
+func applyProfile(args *argContainer, flagSet *flag.FlagSet) {
+	p, err := configfile.GetProfile(args.profile)
+	if err != nil {
+		tlog.Fatal.Printf("-profile: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	passed := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+	if !passed["kdf"] {
+		args.kdf = p.KDF
+	}
+	if !passed["scryptn"] {
+		args.scryptn = p.LogN
+	}
+	if !passed["aessiv"] {
+		args.aessiv = p.AESSIV
+	}
+	if !passed["blocksize"] {
+		args.blocksize = int(p.BlockSize)
+	}
+	if !passed["devrandom"] {
+		args.devrandom = p.DevRandom
+	}
+}
+
 // prettyArgs pretty-prints the command-line arguments.
 func prettyArgs() string {
 	pa := fmt.Sprintf("%q", os.Args[1:])
@@ -237,5 +837,26 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.seal {
+		count++
+	}
+	if args.unseal {
+		count++
+	}
+	if args.export_tar {
+		count++
+	}
 	return count
 }
+
+// progressMode returns how long-running operations report their progress.
+// "-quiet" turns off the text output, but not an explicit "-progress_json".
+func progressMode(args *argContainer) progress.Mode {
+	if args.progress_json {
+		return progress.JSON
+	}
+	if args.quiet {
+		return progress.Off
+	}
+	return progress.Text
+}
@@ -69,3 +69,18 @@ func TestPrefixOArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckKernelOptions(t *testing.T) {
+	good := []string{"noexec", "dev,suid", "max_read=4096", "max_read=131072"}
+	for _, ko := range good {
+		if err := checkKernelOptions(ko); err != nil {
+			t.Errorf("%q: %v", ko, err)
+		}
+	}
+	bad := []string{",", "noexec,", "max_read=", "max_read=0", "max_read=131073", "max_read=x"}
+	for _, ko := range bad {
+		if err := checkKernelOptions(ko); err == nil {
+			t.Errorf("%q should have been rejected", ko)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Package ctlsock is a Go client library for the gocryptfs control socket
+// that is enabled by passing "-ctlsock" to gocryptfs.
+//
+// Example:
+//
+//	c, err := ctlsock.New("/run/user/1000/gocryptfs.sock")
+//	if err != nil {
+//		...
+//	}
+//	defer c.Close()
+//	cipherPath, err := c.EncryptPath("foo/bar")
+package ctlsock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// CtlSock is a connection to the control socket of a running gocryptfs
+// process. It is not safe for concurrent use.
+type CtlSock struct {
+	// Conn is the underlying socket connection.
+	Conn net.Conn
+	// Version is the protocol version spoken by the server. Servers that
+	// predate the versioned protocol report version 1.
+	Version int
+	// Commands are the commands supported by the server (version 2+).
+	Commands []string
+	// MaxRequestSize is the size in bytes of the largest request the server
+	// accepts.
+	MaxRequestSize int
+	// Timeout is applied to each request. Zero means no timeout.
+	Timeout time.Duration
+	dec     *json.Decoder
+	lastID  uint64
+}
+
+// DefaultTimeout is the request timeout set by New.
+const DefaultTimeout = 10 * time.Second
+
+// New connects to the control socket at "socketPath" and performs the
+// version handshake.
+func New(socketPath string) (*CtlSock, error) {
+	conn, err := net.DialTimeout("unix", socketPath, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &CtlSock{
+		Conn:           conn,
+		Timeout:        DefaultTimeout,
+		MaxRequestSize: ReadBufSize - 1,
+		dec:            json.NewDecoder(conn),
+	}
+	resp, err := c.query(&RequestStruct{Version: ProtocolVersion, Command: CmdHello})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp[0].Version < 2 {
+		// A version 1 server answers our "hello" with an "Empty input"
+		// error.
+		c.Version = 1
+		c.Commands = []string{CmdEncrypt, CmdDecrypt}
+	} else {
+		c.Version = resp[0].Version
+		c.Commands = resp[0].Commands
+		if resp[0].MaxRequestSize > 0 {
+			c.MaxRequestSize = resp[0].MaxRequestSize
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *CtlSock) Close() error {
+	return c.Conn.Close()
+}
+
+// Supports returns true if the server understands command "cmd".
+func (c *CtlSock) Supports(cmd string) bool {
+	for _, x := range c.Commands {
+		if x == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// query sends "req" and collects all responses to it.
+func (c *CtlSock) query(req *RequestStruct) ([]ResponseStruct, error) {
+	if req.Version >= 2 {
+		c.lastID++
+		req.ID = c.lastID
+	}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > c.MaxRequestSize {
+		return nil, fmt.Errorf("request too big (%d bytes, max = %d bytes)", len(msg), c.MaxRequestSize)
+	}
+	if c.Timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.Timeout))
+		defer c.Conn.SetDeadline(time.Time{})
+	}
+	_, err = c.Conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+	var out []ResponseStruct
+	for {
+		var resp ResponseStruct
+		err = c.dec.Decode(&resp)
+		if err != nil {
+			return nil, err
+		}
+		// Version 1 servers do not know about IDs
+		if resp.Version >= 2 && resp.ID != req.ID {
+			return nil, fmt.Errorf("response ID mismatch: want %d, got %d", req.ID, resp.ID)
+		}
+		out = append(out, resp)
+		if !resp.More {
+			return out, nil
+		}
+	}
+}
+
+// Query sends a raw request and returns all responses to it. For version 2+
+// requests, the ID field is filled in automatically.
+func (c *CtlSock) Query(req *RequestStruct) ([]ResponseStruct, error) {
+	return c.query(req)
+}
+
+// EncryptPath encrypts the plaintext path "path". The result is relative
+// to CIPHERDIR.
+func (c *CtlSock) EncryptPath(path string) (string, error) {
+	return c.translate(CmdEncrypt, path)
+}
+
+// DecryptPath decrypts the path "path", relative to CIPHERDIR.
+func (c *CtlSock) DecryptPath(path string) (string, error) {
+	return c.translate(CmdDecrypt, path)
+}
+
+func (c *CtlSock) translate(cmd string, path string) (string, error) {
+	req := &RequestStruct{EncryptPath: path}
+	if cmd == CmdDecrypt {
+		req = &RequestStruct{DecryptPath: path}
+	}
+	resp, err := c.query(req)
+	if err != nil {
+		return "", err
+	}
+	return resp[0].Result, toError(resp[0].ErrNo, resp[0].ErrText)
+}
+
+// RevokeKey revokes the master key that the server has stored in the kernel
+// keyring, so the next mount asks for the password again. The running
+// mount is not affected.
+func (c *CtlSock) RevokeKey() error {
+	if !c.Supports(CmdRevokeKey) {
+		return syscall.ENOSYS
+	}
+	resp, err := c.query(&RequestStruct{Version: ProtocolVersion, Command: CmdRevokeKey})
+	if err != nil {
+		return err
+	}
+	return toError(resp[0].ErrNo, resp[0].ErrText)
+}
+
+// ChangePassword changes the password of the mounted filesystem from
+// "oldPw" to "newPw". The filesystem stays mounted.
+func (c *CtlSock) ChangePassword(oldPw string, newPw string) error {
+	if !c.Supports(CmdChangePassword) {
+		return syscall.ENOSYS
+	}
+	resp, err := c.query(&RequestStruct{
+		Version:     ProtocolVersion,
+		Command:     CmdChangePassword,
+		OldPassword: oldPw,
+		NewPassword: newPw,
+	})
+	if err != nil {
+		return err
+	}
+	return toError(resp[0].ErrNo, resp[0].ErrText)
+}
+
+// Unfreeze makes the filesystem usable again after "-guard" has frozen it
+func (c *CtlSock) Unfreeze() error {
+	if !c.Supports(CmdUnfreeze) {
+		return syscall.ENOSYS
+	}
+	resp, err := c.query(&RequestStruct{Version: ProtocolVersion, Command: CmdUnfreeze})
+	if err != nil {
+		return err
+	}
+	return toError(resp[0].ErrNo, resp[0].ErrText)
+}
+
+// Freeze blocks all write operations on the filesystem and syncs CIPHERDIR
+// to disk. It stays frozen until Thaw is called, also if this connection is
+// closed.
+func (c *CtlSock) Freeze() error {
+	return c.simpleCommand(CmdFreeze)
+}
+
+// Thaw lets the write operations blocked by Freeze continue
+func (c *CtlSock) Thaw() error {
+	return c.simpleCommand(CmdThaw)
+}
+
+// Changes returns the epoch and the number of modifying operations of the
+// filesystem. When the epoch is the same as in an earlier call and the
+// number has not grown, CIPHERDIR has not been modified in between.
+func (c *CtlSock) Changes() (epoch string, n uint64, err error) {
+	if !c.Supports(CmdChanges) {
+		return "", 0, syscall.ENOSYS
+	}
+	resp, err := c.query(&RequestStruct{Version: ProtocolVersion, Command: CmdChanges})
+	if err != nil {
+		return "", 0, err
+	}
+	if err = toError(resp[0].ErrNo, resp[0].ErrText); err != nil {
+		return "", 0, err
+	}
+	return resp[0].Epoch, resp[0].Changes, nil
+}
+
+// simpleCommand sends "cmd", which takes no arguments
+func (c *CtlSock) simpleCommand(cmd string) error {
+	if !c.Supports(cmd) {
+		return syscall.ENOSYS
+	}
+	resp, err := c.query(&RequestStruct{Version: ProtocolVersion, Command: cmd})
+	if err != nil {
+		return err
+	}
+	return toError(resp[0].ErrNo, resp[0].ErrText)
+}
+
+// EncryptPaths encrypts all "paths". They are sent in as few requests as
+// the server's MaxRequestSize allows. The per-path errors are contained in
+// the results, which are returned in input order.
+func (c *CtlSock) EncryptPaths(paths []string) ([]ResultStruct, error) {
+	return c.translateBatch(CmdEncrypt, paths)
+}
+
+// DecryptPaths decrypts all "paths" in one request, see EncryptPaths.
+func (c *CtlSock) DecryptPaths(paths []string) ([]ResultStruct, error) {
+	return c.translateBatch(CmdDecrypt, paths)
+}
+
+func (c *CtlSock) translateBatch(cmd string, paths []string) ([]ResultStruct, error) {
+	if c.Version < 2 {
+		// Emulate using single requests
+		out := make([]ResultStruct, len(paths))
+		for i, p := range paths {
+			resp, err := c.query(&RequestStruct{EncryptPath: p})
+			if cmd == CmdDecrypt {
+				resp, err = c.query(&RequestStruct{DecryptPath: p})
+			}
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ResultStruct{
+				Result:   resp[0].Result,
+				ErrNo:    resp[0].ErrNo,
+				ErrText:  resp[0].ErrText,
+				WarnText: resp[0].WarnText,
+			}
+		}
+		return out, nil
+	}
+	var out []ResultStruct
+	for len(paths) > 0 {
+		n := c.batchLen(paths)
+		resp, err := c.query(&RequestStruct{Version: ProtocolVersion, Command: cmd, Paths: paths[:n]})
+		if err != nil {
+			return nil, err
+		}
+		var results []ResultStruct
+		for _, r := range resp {
+			if err = toError(r.ErrNo, r.ErrText); err != nil {
+				return nil, err
+			}
+			results = append(results, r.Results...)
+		}
+		if len(results) != n {
+			return nil, fmt.Errorf("got %d results for %d paths", len(results), n)
+		}
+		out = append(out, results...)
+		paths = paths[n:]
+	}
+	return out, nil
+}
+
+// batchLen returns how many of "paths" fit into one request. At least one
+// path is always returned so that overlong paths get a proper error.
+func (c *CtlSock) batchLen(paths []string) int {
+	// Leave room for the other fields of the request
+	budget := c.MaxRequestSize - 200
+	for i, p := range paths {
+		// Quotes and comma
+		budget -= jsonLen(p) + 1
+		if budget < 0 {
+			if i == 0 {
+				return 1
+			}
+			return i
+		}
+	}
+	return len(paths)
+}
+
+// jsonLen returns the length of "s" as a JSON string
+func jsonLen(s string) int {
+	b, _ := json.Marshal(s)
+	return len(b)
+}
+
+// Err returns the error contained in the result, or nil.
+func (r *ResultStruct) Err() error {
+	return toError(r.ErrNo, r.ErrText)
+}
+
+// toError converts an error number and message from a response to an error.
+// Known error numbers are returned as syscall.Errno.
+func toError(errNo int32, errText string) error {
+	if errNo == 0 {
+		return nil
+	}
+	if errNo > 0 {
+		return syscall.Errno(errNo)
+	}
+	return errors.New(errText)
+}
@@ -0,0 +1,335 @@
+package ctlsock_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	server "github.com/rfjakob/gocryptfs/internal/ctlsock"
+)
+
+// fakeFS "encrypts" by upper-casing and "decrypts" by lower-casing
+type fakeFS struct{}
+
+func (fakeFS) EncryptPath(p string) (string, error) {
+	return strings.ToUpper(p), nil
+}
+
+func (fakeFS) DecryptPath(p string) (string, error) {
+	if p == "MISSING" {
+		return "", syscall.ENOENT
+	}
+	return strings.ToLower(p), nil
+}
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go server.Serve(sock, fakeFS{}, nil)
+
+	c, err := ctlsock.New(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Version != ctlsock.ProtocolVersion || !c.Supports(ctlsock.CmdDecrypt) {
+		t.Errorf("handshake failed: version=%d commands=%v", c.Version, c.Commands)
+	}
+	out, err := c.EncryptPath("foo/bar")
+	if err != nil || out != "FOO/BAR" {
+		t.Errorf("EncryptPath: out=%q err=%v", out, err)
+	}
+	_, err = c.DecryptPath("MISSING")
+	if err != syscall.ENOENT {
+		t.Errorf("DecryptPath: want ENOENT, got %v", err)
+	}
+	var paths []string
+	for i := 0; i < 250; i++ {
+		paths = append(paths, fmt.Sprintf("P%d", i))
+	}
+	paths[7] = "MISSING"
+	results, err := c.DecryptPaths(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(paths) || results[249].Result != "p249" {
+		t.Fatalf("wrong results: %d", len(results))
+	}
+	if results[7].Err() != syscall.ENOENT {
+		t.Errorf("wrong error for MISSING: %v", results[7].Err())
+	}
+	// More than fits into one request
+	if c.MaxRequestSize != ctlsock.MaxRequestSize {
+		t.Errorf("MaxRequestSize=%d", c.MaxRequestSize)
+	}
+	paths = nil
+	for i := 0; i < 20000; i++ {
+		paths = append(paths, fmt.Sprintf("%0100d", i))
+	}
+	results, err = c.EncryptPaths(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(paths) || results[19999].Result != paths[19999] {
+		t.Fatalf("wrong results: %d", len(results))
+	}
+}
+
+// revokerFS counts RevokeKey calls
+type revokerFS struct {
+	fakeFS
+	revoked *int
+}
+
+func (r revokerFS) RevokeKey() error {
+	*r.revoked++
+	return nil
+}
+
+func TestRevokeKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, withKeyring := range []bool{false, true} {
+		sockPath := filepath.Join(dir, fmt.Sprintf("sock%v", withKeyring))
+		sock, err := net.Listen("unix", sockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sock.Close()
+		var revoked int
+		if withKeyring {
+			go server.Serve(sock, revokerFS{revoked: &revoked}, nil)
+		} else {
+			go server.Serve(sock, fakeFS{}, nil)
+		}
+		c, err := ctlsock.New(sockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if c.Supports(ctlsock.CmdRevokeKey) != withKeyring {
+			t.Errorf("withKeyring=%v: commands=%v", withKeyring, c.Commands)
+		}
+		err = c.RevokeKey()
+		if withKeyring && (err != nil || revoked != 1) {
+			t.Errorf("RevokeKey: err=%v revoked=%d", err, revoked)
+		}
+		if !withKeyring && err != syscall.ENOSYS {
+			t.Errorf("RevokeKey: want ENOSYS, got %v", err)
+		}
+	}
+}
+
+type passwdFS struct {
+	fakeFS
+	pw *string
+}
+
+func (p passwdFS) ChangePassword(oldPw []byte, newPw []byte) error {
+	if string(oldPw) != *p.pw {
+		return errors.New("Password incorrect.")
+	}
+	*p.pw = string(newPw)
+	return nil
+}
+
+func TestChangePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	pw := "test"
+	acl, err := server.ParseACL("*:changepasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(sock, passwdFS{pw: &pw}, acl)
+	c, err := ctlsock.New(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Supports(ctlsock.CmdChangePassword) {
+		t.Fatalf("commands=%v", c.Commands)
+	}
+	if err = c.ChangePassword("wrong", "new"); err == nil || pw != "test" {
+		t.Errorf("wrong old password was accepted: err=%v pw=%q", err, pw)
+	}
+	if err = c.ChangePassword("test", ""); err == nil || pw != "test" {
+		t.Errorf("empty new password was accepted: err=%v pw=%q", err, pw)
+	}
+	if err = c.ChangePassword("test", "new"); err != nil || pw != "new" {
+		t.Errorf("err=%v pw=%q", err, pw)
+	}
+	// Without an ACL, changepasswd is not allowed
+	sockPath2 := filepath.Join(dir, "sock2")
+	sock2, err := net.Listen("unix", sockPath2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock2.Close()
+	go server.Serve(sock2, passwdFS{pw: &pw}, nil)
+	c2, err := ctlsock.New(sockPath2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if err = c2.ChangePassword("new", "newer"); err != syscall.EACCES || pw != "new" {
+		t.Errorf("changepasswd without ACL: err=%v pw=%q", err, pw)
+	}
+}
+
+type fakeUnfreezer struct {
+	frozen bool
+}
+
+func (u *fakeUnfreezer) Unfreeze() error {
+	if !u.frozen {
+		return errors.New("not frozen")
+	}
+	u.frozen = false
+	return nil
+}
+
+func TestUnfreeze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	u := &fakeUnfreezer{frozen: true}
+	go server.ServeGuard(sock, fakeFS{}, nil, u)
+	c, err := ctlsock.New(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Supports(ctlsock.CmdUnfreeze) {
+		t.Fatalf("commands=%v", c.Commands)
+	}
+	if err = c.Unfreeze(); err != nil || u.frozen {
+		t.Errorf("err=%v frozen=%v", err, u.frozen)
+	}
+	if err = c.Unfreeze(); err == nil {
+		t.Error("second Unfreeze should have failed")
+	}
+}
+
+type fakeFreezer struct {
+	frozen bool
+}
+
+func (f *fakeFreezer) Freeze() error {
+	if f.frozen {
+		return errors.New("already frozen")
+	}
+	f.frozen = true
+	return nil
+}
+
+func (f *fakeFreezer) Thaw() error {
+	if !f.frozen {
+		return errors.New("not frozen")
+	}
+	f.frozen = false
+	return nil
+}
+
+func TestFreezeThaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	f := &fakeFreezer{}
+	go server.ServeExtras(sock, fakeFS{}, nil, server.Extras{Freezer: f})
+	c, err := ctlsock.New(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Supports(ctlsock.CmdFreeze) || !c.Supports(ctlsock.CmdThaw) || c.Supports(ctlsock.CmdUnfreeze) {
+		t.Fatalf("commands=%v", c.Commands)
+	}
+	if err = c.Freeze(); err != nil || !f.frozen {
+		t.Errorf("err=%v frozen=%v", err, f.frozen)
+	}
+	if err = c.Freeze(); err == nil {
+		t.Error("second Freeze should have failed")
+	}
+	if err = c.Thaw(); err != nil || f.frozen {
+		t.Errorf("err=%v frozen=%v", err, f.frozen)
+	}
+}
+
+type fakeChangeCounter uint64
+
+func (c *fakeChangeCounter) Changes() (string, uint64) {
+	return "epoch", uint64(*c)
+}
+
+func TestChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	cc := fakeChangeCounter(42)
+	go server.ServeExtras(sock, fakeFS{}, nil, server.Extras{Changes: &cc})
+	c, err := ctlsock.New(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Supports(ctlsock.CmdChanges) || c.Supports(ctlsock.CmdFreeze) {
+		t.Fatalf("commands=%v", c.Commands)
+	}
+	epoch, n, err := c.Changes()
+	if err != nil || epoch != "epoch" || n != 42 {
+		t.Errorf("epoch=%q n=%d err=%v", epoch, n, err)
+	}
+}
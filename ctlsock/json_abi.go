@@ -0,0 +1,125 @@
+package ctlsock
+
+// ProtocolVersion is the highest protocol version the server speaks.
+const ProtocolVersion = 2
+
+// Commands understood by protocol version 2.
+const (
+	// CmdHello returns the server protocol version and the list of
+	// supported commands. Clients should send it first.
+	CmdHello = "hello"
+	// CmdEncrypt encrypts all paths in RequestStruct.Paths.
+	CmdEncrypt = "encrypt"
+	// CmdDecrypt decrypts all paths in RequestStruct.Paths.
+	CmdDecrypt = "decrypt"
+	// CmdRevokeKey revokes the master key that gocryptfs has stored in the
+	// kernel keyring ("-use_keyring"). Only supported if listed in the reply
+	// to CmdHello.
+	CmdRevokeKey = "revoke_key"
+	// CmdChangePassword re-encrypts the master key in the config file with
+	// RequestStruct.NewPassword. RequestStruct.OldPassword must be the
+	// current password. Only supported if listed in the reply to CmdHello.
+	CmdChangePassword = "changepasswd"
+	// CmdUnfreeze lifts the freeze imposed by "-guard" after it detected
+	// mass file access by foreign users. Only supported if listed in the
+	// reply to CmdHello.
+	CmdUnfreeze = "unfreeze"
+	// CmdFreeze waits for running write operations to finish, blocks new
+	// ones and syncs CIPHERDIR to disk, so that it can be snapshotted.
+	// Reading continues to work. Only supported if listed in the reply to
+	// CmdHello.
+	CmdFreeze = "freeze"
+	// CmdThaw lets the operations blocked by CmdFreeze continue.
+	CmdThaw = "thaw"
+	// CmdChanges returns ResponseStruct.Epoch and ResponseStruct.Changes,
+	// which tell a "-mirror" mount whether CIPHERDIR has been modified
+	// since it last asked. Only supported if listed in the reply to
+	// CmdHello.
+	CmdChanges = "changes"
+)
+
+// RequestStruct is sent by a client
+type RequestStruct struct {
+	EncryptPath string
+	DecryptPath string
+	// Version selects the protocol version. Zero or one means version 1,
+	// and only EncryptPath and DecryptPath are looked at.
+	Version int `json:",omitempty"`
+	// ID is an arbitrary number chosen by the client that is copied into
+	// all responses to this request (version 2+).
+	ID uint64 `json:",omitempty"`
+	// Command is the requested operation, one of the Cmd* constants
+	// (version 2+).
+	Command string `json:",omitempty"`
+	// Paths are the arguments for the encrypt and decrypt commands
+	// (version 2+).
+	Paths []string `json:",omitempty"`
+	// OldPassword and NewPassword are the arguments for the changepasswd
+	// command (version 2+).
+	OldPassword string `json:",omitempty"`
+	NewPassword string `json:",omitempty"`
+}
+
+// ResponseStruct is sent by the server as response to a request
+type ResponseStruct struct {
+	// Result is the resulting decrypted or encrypted path. Empty on error.
+	Result string
+	// ErrNo is the error number as defined in errno.h.
+	// 0 means success and -1 means that the error number is not known
+	// (look at ErrText in this case).
+	ErrNo int32
+	// ErrText is a detailed error message.
+	ErrText string
+	// WarnText contains warnings that may have been encountered while
+	// processing the message.
+	WarnText string
+	// Version is the protocol version the server speaks. Only set in
+	// responses to version 2+ requests, like all fields below.
+	Version int `json:",omitempty"`
+	// ID is copied from the request.
+	ID uint64 `json:",omitempty"`
+	// Results holds one entry per input path, in request order. Long
+	// result lists are split over several responses.
+	Results []ResultStruct `json:",omitempty"`
+	// More is true if more responses for the same request will follow.
+	More bool `json:",omitempty"`
+	// Commands lists the supported commands (reply to CmdHello).
+	Commands []string `json:",omitempty"`
+	// Epoch is a random string that changes when the filesystem is mounted
+	// again (reply to CmdChanges).
+	Epoch string `json:",omitempty"`
+	// Changes is the number of modifying operations since the filesystem
+	// has been mounted (reply to CmdChanges). It only grows as long as
+	// Epoch stays the same.
+	Changes uint64 `json:",omitempty"`
+	// MaxRequestSize is the size in bytes of the largest request the server
+	// accepts (reply to CmdHello). Zero means ReadBufSize-1.
+	MaxRequestSize int `json:",omitempty"`
+}
+
+// ResultStruct is the result for a single path in a version 2 response
+type ResultStruct struct {
+	// Result is the encrypted or decrypted path. Empty on error.
+	Result string
+	// ErrNo and ErrText have the same meaning as in ResponseStruct.
+	ErrNo   int32  `json:",omitempty"`
+	ErrText string `json:",omitempty"`
+	// WarnText has the same meaning as in ResponseStruct.
+	WarnText string `json:",omitempty"`
+}
+
+// ReadBufSize is the size of the request read buffer.
+// The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
+// 5000 bytes should be enough to hold the whole JSON request. This
+// assumes that the path does not contain too many characters that had to be
+// be escaped in JSON (for example, a null byte blows up to "\u0000").
+// Older servers abort the connection if the request is bigger than this.
+//
+// Current servers grow the buffer up to MaxRequestSize and report that in
+// ResponseStruct.MaxRequestSize, so that the encrypt and decrypt commands
+// can translate thousands of paths in one request.
+const ReadBufSize = 5000
+
+// MaxRequestSize is the size limit of a request on current servers. A
+// request may arrive in several reads. It ends where the JSON object ends.
+const MaxRequestSize = 1024 * 1024
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// passwdFailDelay is how long ChangePassword sleeps after an incorrect old
+// password. The lock is held meanwhile, so this limits guessing to one
+// password per passwdFailDelay.
+const passwdFailDelay = 2 * time.Second
+
+// passwdCtlsock enables the changepasswd control socket command
+type passwdCtlsock struct {
+	ctlsock.Interface
+	args *argContainer
+	// lock serializes password changes and protects args._keyringDesc
+	lock sync.Mutex
+}
+
+// ChangePassword implements ctlsock.PasswordChanger. It works like
+// "gocryptfs -passwd", except that the filesystem stays mounted and
+// the settings in the config file are kept as they are.
+func (p *passwdCtlsock) ChangePassword(oldPw []byte, newPw []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	defer func() {
+		for i := range oldPw {
+			oldPw[i] = 0
+		}
+		for i := range newPw {
+			newPw[i] = 0
+		}
+	}()
+	_, confFile, err := configfile.LoadConfFile(p.args.config, nil)
+	if err != nil {
+		return err
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagDualControl) || confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		return errors.New("Dual control and FIDO2 filesystems do not support changepasswd, use -passwd")
+	}
+	// The duress password must not destroy the key here. It would give
+	// whoever can reach the socket a way to do so without knowing the
+	// real password.
+	masterkey, confFile, err := configfile.LoadConfFileNoDuress(p.args.config, oldPw)
+	if err != nil {
+		tlog.Info.Printf("ctlsock: changepasswd failed: %v", err)
+		time.Sleep(passwdFailDelay)
+		return err
+	}
+	defer func() {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+	}()
+	confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
+	// WriteFile replaces the config file atomically via rename
+	if err = confFile.WriteFile(); err != nil {
+		return err
+	}
+	tlog.Info.Printf("Password changed via control socket")
+	// The keyring entry is named after EncryptedKey, which has just changed.
+	// The old entry would never be found again, so drop it.
+	if p.args._keyringDesc != "" {
+		keyring.Revoke(p.args._keyringDesc)
+		desc := keyring.Description(confFile.KeyID())
+		if err = keyring.Store(desc, masterkey, p.args.keyring_timeout); err != nil {
+			tlog.Warn.Printf("Could not store the master key in the kernel keyring: %v", err)
+		}
+		p.args._keyringDesc = desc
+	}
+	return nil
+}
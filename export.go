@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/progress"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// exportTar writes the ciphertext view of CIPHERDIR as a tar stream to
+// stdout, without mounting it. This is called when you pass
+// "-reverse -export_tar".
+// The stream only depends on the plaintext tree: entries are sorted, and the
+// reverse mode encrypts deterministically. Backup tools that deduplicate
+// with content-defined chunking, like "borg import-tar" or
+// "restic backup --stdin", only store the changed parts again.
+func exportTar(args *argContainer) {
+	args.allow_other = false
+	fs, wipeKeys := initFuseFrontend(args)
+	// The tar stream usually goes into a backup tool that runs from cron.
+	// Only show the progress on a terminal, unless JSON was requested.
+	mode := progressMode(args)
+	pr := progress.New(mode, "export_tar")
+	if mode == progress.Text && !pr.Interactive() {
+		pr = progress.New(progress.Off, "export_tar")
+	}
+	written := &progress.Counter{}
+	stop := pr.Start("export", "", written)
+	bw := bufio.NewWriterSize(written.Writer(os.Stdout), 128*1024)
+	tw := tar.NewWriter(bw)
+	err := exportDir(fs, tw, "")
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	stop()
+	wipeKeys()
+	if err != nil {
+		tlog.Fatal.Printf("-export_tar: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+}
+
+// exportDir recursively adds the contents of the ciphertext directory
+// "cDir" to "tw"
+func exportDir(fs pathfs.FileSystem, tw *tar.Writer, cDir string) error {
+	entries, status := fs.OpenDir(cDir, nil)
+	if !status.Ok() {
+		return fmt.Errorf("OpenDir %q: %v", cDir, status)
+	}
+	sort.Sort(sortableDirEntries(entries))
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		cPath := filepath.Join(cDir, e.Name)
+		if err := exportEntry(fs, tw, cPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportEntry adds the ciphertext path "cPath" to "tw"
+func exportEntry(fs pathfs.FileSystem, tw *tar.Writer, cPath string) error {
+	a, status := fs.GetAttr(cPath, nil)
+	if status == fuse.ENOENT {
+		// Deleted while we were running
+		return nil
+	}
+	if !status.Ok() {
+		return fmt.Errorf("GetAttr %q: %v", cPath, status)
+	}
+	hdr := &tar.Header{
+		Name: cPath,
+		Mode: int64(a.Mode & 07777),
+		Uid:  int(a.Uid),
+		Gid:  int(a.Gid),
+		// Sub-second timestamps would need PAX records
+		ModTime: time.Unix(int64(a.Mtime), 0),
+	}
+	switch a.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return exportDir(fs, tw, cPath)
+	case syscall.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(a.Size)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return exportFile(fs, tw, cPath, a.Size)
+	case syscall.S_IFLNK:
+		target, status := fs.Readlink(cPath, nil)
+		if !status.Ok() {
+			return fmt.Errorf("Readlink %q: %v", cPath, status)
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+	case syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		hdr.Typeflag = tar.TypeChar
+		if a.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = int64(a.Rdev >> 8 & 0xfff)
+		hdr.Devminor = int64(a.Rdev&0xff | a.Rdev>>12&0xfff00)
+	default:
+		tlog.Warn.Printf("-export_tar: skipping %q: tar cannot store file type %#o", cPath, a.Mode&syscall.S_IFMT)
+		return nil
+	}
+	return tw.WriteHeader(hdr)
+}
+
+// exportFile copies "size" bytes of the ciphertext file "cPath" to "w"
+func exportFile(fs pathfs.FileSystem, w io.Writer, cPath string, size uint64) error {
+	f, status := fs.Open(cPath, uint32(os.O_RDONLY), nil)
+	if !status.Ok() {
+		return fmt.Errorf("Open %q: %v", cPath, status)
+	}
+	defer f.Release()
+	buf := make([]byte, 128*1024)
+	for off := uint64(0); off < size; {
+		res, status := f.Read(buf, int64(off))
+		if !status.Ok() {
+			return fmt.Errorf("Read %q: %v", cPath, status)
+		}
+		data, status := res.Bytes(buf)
+		if !status.Ok() {
+			return fmt.Errorf("Read %q: %v", cPath, status)
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("%q: file shrank during export", cPath)
+		}
+		if uint64(len(data)) > size-off {
+			data = data[:size-off]
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		off += uint64(len(data))
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"os"
 	"path/filepath"
 	"sort"
@@ -13,15 +15,62 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/progress"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 type fsckObj struct {
 	fs *fusefrontend.FS
+	// cipherdir is the absolute path to CIPHERDIR
+	cipherdir string
 	// List of corrupt files
 	corruptList []string
 	// Protects corruptList
 	corruptListLock sync.Mutex
+	// List of orphaned .name files (ciphertext paths)
+	orphanList []string
+	// List of long name files whose .name file is missing (ciphertext
+	// paths). Their content is intact, but the name is lost.
+	namelessList []string
+	// List of gocryptfs.diriv files that are usable, but have the wrong
+	// permissions or are stray copies (ciphertext paths)
+	dirIVList []string
+	// repair is set by "-repair"
+	repair bool
+	// Corrupt files, symlinks and directories (plaintext paths) that
+	// "-repair" moves into quarantine
+	repairPaths []string
+	// Entries whose names cannot be decrypted (ciphertext paths) that
+	// "-repair" moves into quarantine
+	repairNames []string
+	// Files (plaintext paths) whose content is checked by checkFiles()
+	files []string
+	// fast only checks the file headers instead of reading the whole
+	// files, "-fsck_fast"
+	fast bool
+	// workers is the number of files that are read in parallel,
+	// "-fsck_workers"
+	workers int
+	// progress reports the progress of the phases. "scanned" counts the
+	// files found by dir(), "checked" the files and bytes checked by
+	// checkFiles().
+	progress         *progress.Reporter
+	scanned, checked *progress.Counter
+	// checkpointPath is the "-fsck_checkpoint" file
+	checkpointPath string
+	// resumeFrom is the checkpoint that "-fsck_resume" has read, or nil
+	resumeFrom *fsckCheckpoint
+	// manifestKey is the HMAC key of the manifest, or nil if neither
+	// "-write_manifest" nor "-verify_manifest" is set
+	manifestKey []byte
+	// writeManifest is the "-write_manifest" file
+	writeManifest string
+	// verifyFrom is the manifest that "-verify_manifest" has read, or nil
+	verifyFrom *fsckManifest
+	// List of files (plaintext paths) that do not match the manifest, and
+	// of files from the manifest that are missing (ciphertext paths)
+	manifestList []string
 }
 
 func (ck *fsckObj) markCorrupt(path string) {
@@ -34,13 +83,27 @@ func (ck *fsckObj) markCorrupt(path string) {
 func (ck *fsckObj) dir(path string) {
 	//fmt.Printf("ck.dir %q\n", path)
 	ck.xattrs(path)
+	usable, renewed := ck.checkDirIV(path)
+	if !usable {
+		// Nothing in here can be decrypted
+		return
+	}
+	// Long name files without a .name file show up as corrupt entries in
+	// OpenDir(). They are reported by longNameOrphans() instead.
+	nameless := ck.longNameOrphans(path)
 	done := make(chan struct{})
 	go func() {
 		for {
 			select {
 			case item := <-ck.fs.CorruptItems:
+				if nameless[item] {
+					continue
+				}
 				fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
 				ck.markCorrupt(filepath.Join(path, item))
+				if ck.repair {
+					ck.repairName(path, item)
+				}
 			case <-done:
 				return
 			}
@@ -49,8 +112,16 @@ func (ck *fsckObj) dir(path string) {
 	entries, status := ck.fs.OpenDir(path, nil)
 	done <- struct{}{}
 	if !status.Ok() {
+		if renewed && status == fuse.EIO {
+			// All names were encrypted with the old IV. The entries have
+			// been reported as corrupt already.
+			return
+		}
 		ck.markCorrupt(path)
 		fmt.Printf("fsck: error opening dir %q: %v\n", path, status)
+		if path != "" && ck.repair {
+			ck.repairPaths = append(ck.repairPaths, path)
+		}
 		return
 	}
 	// Sort alphabetically
@@ -59,6 +130,10 @@ func (ck *fsckObj) dir(path string) {
 		if entry.Name == "." || entry.Name == ".." {
 			continue
 		}
+		if path == "" && entry.Name == fusefrontend.QuarantineDirName {
+			// Only visible with -plaintextnames
+			continue
+		}
 		nextPath := filepath.Join(path, entry.Name)
 		filetype := entry.Mode & syscall.S_IFMT
 		//fmt.Printf("  %q %x\n", entry.Name, entry.Mode)
@@ -77,55 +152,290 @@ func (ck *fsckObj) dir(path string) {
 	}
 }
 
+// longNameOrphans cross-references the "gocryptfs.longname.*" files in the
+// ciphertext directory of "path" with their ".name" files.
+//
+// A .name file that does not belong to any file is left behind when a
+// Rename() or Create() is interrupted. These orphans are harmless, as
+// OpenDir() ignores them.
+// A long name file without its .name file cannot be listed, so it counts as
+// corrupt. Their names are returned.
+func (ck *fsckObj) longNameOrphans(path string) (nameless map[string]bool) {
+	cPath, err := ck.fs.EncryptPath(path)
+	if err != nil {
+		return nil
+	}
+	cDir := filepath.Join(ck.cipherdir, cPath)
+	// With -plaintextnames, there is no gocryptfs.diriv, and a file called
+	// "gocryptfs.longname.foo.name" is just a file.
+	if _, err = os.Stat(nametransform.MetaPath(cDir, nametransform.DirIVFilename)); err != nil {
+		return nil
+	}
+	names, err := readDirNames(cDir)
+	if err != nil {
+		fmt.Printf("fsck: error reading ciphertext dir %q: %v\n", cDir, err)
+		return nil
+	}
+	have := make(map[string]bool, len(names))
+	for _, n := range names {
+		have[n] = true
+	}
+	// With "-metadata_dir", the .name files are stored separately
+	mDir := nametransform.MetaPath(cDir, "")
+	nameFiles := names
+	if mDir != cDir {
+		nameFiles, err = readDirNames(mDir)
+		if err != nil {
+			fmt.Printf("fsck: error reading metadata dir %q: %v\n", mDir, err)
+			return nil
+		}
+	}
+	haveNameFile := make(map[string]bool, len(nameFiles))
+	sort.Strings(nameFiles)
+	for _, n := range nameFiles {
+		if nametransform.NameType(n) != nametransform.LongNameFilename {
+			continue
+		}
+		haveNameFile[n] = true
+		if !have[strings.TrimSuffix(n, nametransform.LongNameSuffix)] {
+			fmt.Printf("fsck: orphaned long name file in dir %q: %q\n", path, n)
+			ck.orphanList = append(ck.orphanList, filepath.Join(mDir, n))
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if nametransform.NameType(n) != nametransform.LongNameContent || haveNameFile[n+nametransform.LongNameSuffix] {
+			continue
+		}
+		fmt.Printf("fsck: long name file without .name file in dir %q: %q\n", path, n)
+		ck.namelessList = append(ck.namelessList, filepath.Join(cDir, n))
+		ck.markCorrupt(filepath.Join(path, n))
+		if ck.repair {
+			ck.repairName(path, n)
+		}
+		if nameless == nil {
+			nameless = make(map[string]bool)
+		}
+		nameless[n] = true
+	}
+	return nameless
+}
+
+// readDirNames returns the names of all entries in "dir"
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
+
 func (ck *fsckObj) symlink(path string) {
 	_, status := ck.fs.Readlink(path, nil)
 	if !status.Ok() {
 		ck.markCorrupt(path)
 		fmt.Printf("fsck: error reading symlink %q: %v\n", path, status)
+		if ck.repair {
+			ck.repairPaths = append(ck.repairPaths, path)
+		}
 	}
 }
 
-// check file for corruption
+// file checks the xattrs of a file and queues its content for
+// checkFiles()
 func (ck *fsckObj) file(path string) {
 	//fmt.Printf("ck.file %q\n", path)
 	ck.xattrs(path)
-	f, status := ck.fs.Open(path, syscall.O_RDONLY, nil)
-	if !status.Ok() {
-		ck.markCorrupt(path)
-		fmt.Printf("fsck: error opening file %q: %v\n", path, status)
-		return
+	ck.files = append(ck.files, path)
+	ck.scanned.Add(1, 0)
+}
+
+// fsckFileResult is what checkFiles() found out about one file
+type fsckFileResult struct {
+	// Error message from reading the file, written by the worker
+	readErr string
+	// Corrupt items (inode numbers) reported by fusefrontend, written by
+	// the collector goroutine
+	items []string
+	// HMAC of the content for the manifest, written by the worker
+	hash string
+}
+
+// checkFiles reads the files that dir() has queued, "ck.workers" at a time.
+// The problems are printed in the order the files were found, so the
+// report does not depend on the number of workers.
+func (ck *fsckObj) checkFiles() {
+	// fusefrontend reports corrupt file headers by inode number
+	inoFiles := make(map[string][]int)
+	cPaths := make([]string, len(ck.files))
+	sizes := make([]uint64, len(ck.files))
+	for i, path := range ck.files {
+		cPath, err := ck.fs.EncryptPath(path)
+		if err != nil {
+			continue
+		}
+		cPaths[i] = cPath
+		var st syscall.Stat_t
+		if err = syscall.Lstat(filepath.Join(ck.cipherdir, cPath), &st); err != nil {
+			continue
+		}
+		ino := fmt.Sprint(st.Ino)
+		inoFiles[ino] = append(inoFiles[ino], i)
+		sizes[i] = ck.fs.PlainSize(uint64(st.Size))
 	}
-	defer f.Release()
-	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
-	var off int64
+	ckp := newFsckCheckpointer(ck.checkpointPath, ck.cipherdir, cPaths)
+	skip, skippedCorrupt := ckp.resume(ck.resumeFrom)
+	if ck.resumeFrom != nil {
+		if skip > 0 {
+			fmt.Printf("fsck: resuming after %d of %d files\n", skip, len(ck.files))
+		} else if ck.resumeFrom.Done > 0 {
+			fmt.Printf("fsck: the checkpoint does not match the files in CIPHERDIR, starting from the beginning\n")
+		}
+	}
+	// Plaintext bytes to check, for the progress report. With "-fsck_fast",
+	// the progress is estimated by files.
+	ck.checked.ItemsTotal = uint64(len(ck.files) - skip)
+	if !ck.fast {
+		for _, size := range sizes[skip:] {
+			ck.checked.BytesTotal += size
+		}
+	}
+	stop := ck.progress.Start("check", "files", ck.checked)
+	stopCheckpoints := ckp.start()
+	results := make([]fsckFileResult, len(ck.files))
 	done := make(chan struct{})
 	go func() {
 		for {
 			select {
 			case item := <-ck.fs.CorruptItems:
-				fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-				ck.markCorrupt(path)
+				for _, i := range inoFiles[item] {
+					results[i].items = append(results[i].items, item)
+				}
 			case <-done:
 				return
 			}
 		}
 	}()
-	defer func() { done <- struct{}{} }()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < ck.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+			for i := range jobs {
+				var h hash.Hash
+				if ck.manifestKey != nil {
+					h = newManifestHash(ck.manifestKey)
+				}
+				if ck.fast {
+					results[i].readErr = ck.checkHeader(ck.files[i])
+				} else {
+					results[i].readErr = ck.readFile(ck.files[i], buf, h)
+				}
+				if h != nil && results[i].readErr == "" {
+					results[i].hash = hex.EncodeToString(h.Sum(nil))
+				}
+				ckp.finish(i, results[i].readErr != "")
+				ck.checked.Add(1, 0)
+			}
+		}()
+	}
+	for i := skip; i < len(ck.files); i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	stop()
+	stopCheckpoints()
+	// Every item has been received by now, as reportCorruptItem() only
+	// returns after that. Wait until the last one has been stored.
+	done <- struct{}{}
+	// Hashes of the files that are not corrupt, for the manifest
+	hashes := make([]string, len(ck.files))
+	for i, path := range ck.files {
+		if i < skip {
+			if skippedCorrupt[cPaths[i]] {
+				fmt.Printf("fsck: corrupt file %q (found before resuming)\n", path)
+				ck.markCorrupt(path)
+				if ck.repair {
+					ck.repairPaths = append(ck.repairPaths, path)
+				}
+			}
+			continue
+		}
+		r := results[i]
+		for _, item := range r.items {
+			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
+		}
+		if r.readErr != "" {
+			fmt.Printf("fsck: %s\n", r.readErr)
+		}
+		if len(r.items) == 0 && r.readErr == "" {
+			hashes[i] = r.hash
+			continue
+		}
+		ck.markCorrupt(path)
+		if ck.repair {
+			ck.repairPaths = append(ck.repairPaths, path)
+		}
+	}
+	if ck.verifyFrom != nil {
+		ck.verifyManifest(cPaths, hashes)
+	}
+	if ck.writeManifest != "" {
+		m := &fsckManifest{Check: manifestCheck(ck.manifestKey), Files: make(map[string]string)}
+		for i, h := range hashes {
+			if h != "" {
+				m.Files[cPaths[i]] = h
+			}
+		}
+		if err := m.write(ck.writeManifest); err != nil {
+			tlog.Fatal.Printf("fsck: could not write manifest: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		fmt.Printf("fsck: wrote the hashes of %d files to %q\n", len(m.Files), ck.writeManifest)
+	}
+}
+
+// readFile reads the whole file "path" into "buf", piece by piece, and
+// writes the content to "h" unless it is nil. Returns a description of the
+// problem, or "" if the file could be read.
+func (ck *fsckObj) readFile(path string, buf []byte, h hash.Hash) string {
+	f, status := ck.fs.Open(path, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		return fmt.Sprintf("error opening file %q: %v", path, status)
+	}
+	defer f.Release()
+	var off int64
 	for {
 		result, status := f.Read(buf, off)
 		if !status.Ok() {
-			ck.markCorrupt(path)
-			fmt.Printf("fsck: error reading file %q at offset %d: %v\n", path, off, status)
-			return
+			return fmt.Sprintf("error reading file %q at offset %d: %v", path, off, status)
 		}
 		// EOF
 		if result.Size() == 0 {
-			return
+			return ""
+		}
+		if h != nil {
+			data, _ := result.Bytes(buf)
+			h.Write(data)
 		}
 		off += int64(result.Size())
+		ck.checked.Add(0, uint64(result.Size()))
 	}
 }
 
+// checkHeader only checks the file header of "path", for "-fsck_fast".
+// Returns a description of the problem, or "" if the header is valid.
+func (ck *fsckObj) checkHeader(path string) string {
+	if err := ck.fs.CheckHeader(path); err != nil {
+		return fmt.Sprintf("error reading header of file %q: %v", path, err)
+	}
+	return ""
+}
+
 // Check xattrs on file/dir at path
 func (ck *fsckObj) xattrs(path string) {
 	done := make(chan struct{})
@@ -158,23 +468,89 @@ func (ck *fsckObj) xattrs(path string) {
 
 func fsck(args *argContainer) {
 	if args.reverse {
-		tlog.Fatal.Printf("Running -fsck with -reverse is not supported")
-		os.Exit(exitcodes.Usage)
+		fsckReverse(args)
+		return
 	}
 	args.allow_other = false
 	pfs, wipeKeys := initFuseFrontend(args)
 	fs := pfs.(*fusefrontend.FS)
 	fs.CorruptItems = make(chan string)
 	ck := fsckObj{
-		fs: fs,
+		fs:             fs,
+		cipherdir:      args.cipherdir,
+		repair:         args.repair,
+		fast:           args.fsck_fast,
+		workers:        args.fsck_workers,
+		progress:       progress.New(progressMode(args), "fsck"),
+		scanned:        &progress.Counter{},
+		checked:        &progress.Counter{},
+		checkpointPath: args.fsck_checkpoint,
+		manifestKey:    args._manifestKey,
+		writeManifest:  args.write_manifest,
+	}
+	if args.verify_manifest != "" {
+		m, err := readFsckManifest(args.verify_manifest, args._manifestKey)
+		if err != nil {
+			tlog.Fatal.Printf("fsck: could not read manifest: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		ck.verifyFrom = m
 	}
+	if args.fsck_resume {
+		cp, err := readFsckCheckpoint(args.fsck_checkpoint)
+		if err != nil {
+			tlog.Fatal.Printf("fsck: could not read checkpoint: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		if cp == nil {
+			fmt.Printf("fsck: no checkpoint found, starting from the beginning\n")
+		} else if cp.Cipherdir != args.cipherdir {
+			tlog.Fatal.Printf("fsck: the checkpoint %q belongs to %q", args.fsck_checkpoint, cp.Cipherdir)
+			os.Exit(exitcodes.Usage)
+		}
+		ck.resumeFrom = cp
+	}
+	stop := ck.progress.Start("scan", "files", ck.scanned)
 	ck.dir("")
+	stop()
+	ck.checkFiles()
+	var quarantined int
+	if ck.repair {
+		quarantined = ck.repairAll()
+	}
 	wipeKeys()
-	if len(ck.corruptList) == 0 {
+	if len(ck.orphanList) > 0 {
+		// Not an error: the plaintext view is not affected
+		fmt.Printf("fsck: found %d orphaned long name files, probably left over from interrupted renames. "+
+			"They are harmless and can be deleted.\n", len(ck.orphanList))
+	}
+	if len(ck.dirIVList) > 0 {
+		// Not an error either
+		fix := "They work, but should be fixed with -repair."
+		if ck.repair {
+			fix = "They have been fixed."
+		}
+		fmt.Printf("fsck: found %d gocryptfs.diriv files with wrong permissions or in the wrong place. %s\n",
+			len(ck.dirIVList), fix)
+	}
+	if len(ck.namelessList) > 0 {
+		fmt.Printf("fsck: found %d long name files without .name file. Their content is intact, "+
+			"but their names are lost.\n", len(ck.namelessList))
+	}
+	if len(ck.corruptList) == 0 && len(ck.manifestList) == 0 {
 		fmt.Printf("fsck summary: no problems found\n")
 		return
 	}
-	fmt.Printf("fsck summary: %d corrupt files\n", len(ck.corruptList))
+	if len(ck.corruptList) > 0 {
+		fmt.Printf("fsck summary: %d corrupt files\n", len(ck.corruptList))
+	}
+	if len(ck.manifestList) > 0 {
+		fmt.Printf("fsck summary: %d files do not match the manifest or are missing\n", len(ck.manifestList))
+	}
+	if quarantined > 0 {
+		fmt.Printf("fsck: moved %d entries to %q\n", quarantined,
+			filepath.Join(ck.cipherdir, fusefrontend.QuarantineDirName))
+	}
 	os.Exit(exitcodes.FsckErrors)
 }
 
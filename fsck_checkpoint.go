@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fsckCheckpointInterval is how often fsck writes its checkpoint file
+var fsckCheckpointInterval = time.Minute
+
+// fsckCheckpoint is the content of the "-fsck_checkpoint" file. Only
+// ciphertext paths are stored, so the file does not leak plaintext names.
+type fsckCheckpoint struct {
+	// Cipherdir is the absolute path to the checked CIPHERDIR
+	Cipherdir string
+	// Done is the number of files, in the order dir() finds them, whose
+	// content has been checked
+	Done int
+	// Last is the ciphertext path of the last checked file
+	Last string
+	// Corrupt are the ciphertext paths of the corrupt files among them
+	Corrupt []string
+}
+
+// fsckCheckpointer keeps track of which files checkFiles() has finished.
+// The workers finish the files out of order, so the checkpoint is the end
+// of the longest run of finished files from the start.
+// All methods can be called on a nil *fsckCheckpointer, which disables
+// checkpoints.
+type fsckCheckpointer struct {
+	// path is the checkpoint file
+	path      string
+	cipherdir string
+	// cPaths are the ciphertext paths of ck.files
+	cPaths []string
+	// lock protects everything below
+	lock     sync.Mutex
+	finished []bool
+	corrupt  []bool
+	// Every file before "next" is finished
+	next int
+	// Ciphertext paths of the corrupt files before "next"
+	corruptList []string
+}
+
+func newFsckCheckpointer(path string, cipherdir string, cPaths []string) *fsckCheckpointer {
+	if path == "" {
+		return nil
+	}
+	return &fsckCheckpointer{
+		path:      path,
+		cipherdir: cipherdir,
+		cPaths:    cPaths,
+		finished:  make([]bool, len(cPaths)),
+		corrupt:   make([]bool, len(cPaths)),
+	}
+}
+
+// readFsckCheckpoint reads the checkpoint file "path". Returns nil if it
+// does not exist.
+func readFsckCheckpoint(path string) (*fsckCheckpoint, error) {
+	js, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cp fsckCheckpoint
+	if err = json.Unmarshal(js, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &cp, nil
+}
+
+// resume skips the files that "cp" says have been checked already.
+// Returns how many files at the start of cPaths are skipped. The skipped
+// files that were corrupt are returned in "corrupt".
+func (c *fsckCheckpointer) resume(cp *fsckCheckpoint) (skip int, corrupt map[string]bool) {
+	if c == nil || cp == nil || cp.Done == 0 {
+		return 0, nil
+	}
+	if cp.Done <= len(c.cPaths) && c.cPaths[cp.Done-1] == cp.Last {
+		skip = cp.Done
+	} else {
+		// Files have been created or deleted in between, look for the last
+		// checked file
+		for i, cPath := range c.cPaths {
+			if cPath == cp.Last {
+				skip = i + 1
+				break
+			}
+		}
+		if skip == 0 {
+			return 0, nil
+		}
+	}
+	corrupt = make(map[string]bool, len(cp.Corrupt))
+	for _, cPath := range cp.Corrupt {
+		corrupt[cPath] = true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := 0; i < skip; i++ {
+		c.finished[i] = true
+		if corrupt[c.cPaths[i]] {
+			c.corrupt[i] = true
+			c.corruptList = append(c.corruptList, c.cPaths[i])
+		}
+	}
+	c.next = skip
+	return skip, corrupt
+}
+
+// finish marks file number "i" as checked
+func (c *fsckCheckpointer) finish(i int, corrupt bool) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.finished[i] = true
+	c.corrupt[i] = corrupt
+	for c.next < len(c.finished) && c.finished[c.next] {
+		if c.corrupt[c.next] {
+			c.corruptList = append(c.corruptList, c.cPaths[c.next])
+		}
+		c.next++
+	}
+}
+
+// checkpoint returns the current state
+func (c *fsckCheckpointer) checkpoint() fsckCheckpoint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cp := fsckCheckpoint{
+		Cipherdir: c.cipherdir,
+		Done:      c.next,
+		Corrupt:   append([]string(nil), c.corruptList...),
+	}
+	if c.next > 0 {
+		cp.Last = c.cPaths[c.next-1]
+	}
+	return cp
+}
+
+// write writes the checkpoint file. It is replaced atomically, so an
+// interruption leaves the old or the new checkpoint behind.
+func (c *fsckCheckpointer) write() {
+	if c == nil {
+		return
+	}
+	js, err := json.MarshalIndent(c.checkpoint(), "", "\t")
+	if err != nil {
+		tlog.Warn.Printf("fsck: checkpoint: %v", err)
+		return
+	}
+	tmp := c.path + ".tmp"
+	err = ioutil.WriteFile(tmp, append(js, '\n'), 0600)
+	if err == nil {
+		err = os.Rename(tmp, c.path)
+	}
+	if err != nil {
+		tlog.Warn.Printf("fsck: could not write checkpoint: %v", err)
+	}
+}
+
+// start writes the checkpoint file every fsckCheckpointInterval until the
+// returned function is called. Call it when all files have been checked, it
+// deletes the checkpoint file.
+func (c *fsckCheckpointer) start() (stop func()) {
+	if c == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(fsckCheckpointInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.write()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+			tlog.Warn.Printf("fsck: could not delete checkpoint: %v", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestFsckCheckpoint checks that files finished out of order only count
+// once all files before them are finished, and that the checkpoint can be
+// resumed from
+func TestFsckCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFsckCheckpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+	cPaths := []string{"a", "b", "c", "d"}
+	c := newFsckCheckpointer(path, "/cipherdir", cPaths)
+	c.finish(1, true)
+	c.finish(2, false)
+	if cp := c.checkpoint(); cp.Done != 0 || cp.Last != "" {
+		t.Errorf("file 0 is not finished, but the checkpoint is %+v", cp)
+	}
+	c.finish(0, false)
+	c.write()
+	cp, err := readFsckCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &fsckCheckpoint{Cipherdir: "/cipherdir", Done: 3, Last: "c", Corrupt: []string{"b"}}
+	if !reflect.DeepEqual(cp, want) {
+		t.Errorf("have %+v, want %+v", cp, want)
+	}
+	// Resume after "e" has been created before "c"
+	c2 := newFsckCheckpointer(path, "/cipherdir", []string{"a", "b", "e", "c", "d"})
+	skip, corrupt := c2.resume(cp)
+	if skip != 4 || !corrupt["b"] {
+		t.Errorf("skip=%d corrupt=%v", skip, corrupt)
+	}
+	c2.finish(4, true)
+	if cp := c2.checkpoint(); cp.Done != 5 || !reflect.DeepEqual(cp.Corrupt, []string{"b", "d"}) {
+		t.Errorf("after resume: %+v", cp)
+	}
+	// The last checked file is gone, start from the beginning
+	c3 := newFsckCheckpointer(path, "/cipherdir", []string{"a", "b"})
+	if skip, _ := c3.resume(cp); skip != 0 {
+		t.Errorf("skip=%d, want 0", skip)
+	}
+	stop := c.start()
+	stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint file has not been deleted: %v", err)
+	}
+	// A missing checkpoint file is not an error
+	if cp, err := readFsckCheckpoint(path); cp != nil || err != nil {
+		t.Errorf("cp=%v err=%v", cp, err)
+	}
+}
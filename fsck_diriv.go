@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// dirIVPerms are the permissions that WriteDirIV gives gocryptfs.diriv
+const dirIVPerms = 0400
+
+// checkDirIV checks that the directory "path" has exactly one usable
+// gocryptfs.diriv. Without it, none of the names in the directory can be
+// decrypted. Returns usable=false if the directory cannot be read because of
+// that, and renewed=true if "-repair" has replaced the file.
+//
+// With "-repair", a missing or broken gocryptfs.diriv is replaced by a new
+// one. The names in the directory were encrypted with the old IV, so the
+// entries then show up as corrupt in OpenDir() and are moved into
+// quarantine. Their content, and everything below them, stays intact.
+func (ck *fsckObj) checkDirIV(path string) (usable bool, renewed bool) {
+	if ck.fs.PlaintextNames() {
+		return true, false
+	}
+	cPath, err := ck.fs.EncryptPath(path)
+	if err != nil {
+		return true, false
+	}
+	cDir := filepath.Join(ck.cipherdir, cPath)
+	ivPath := nametransform.MetaPath(cDir, nametransform.DirIVFilename)
+	if stray := filepath.Join(cDir, nametransform.DirIVFilename); stray != ivPath {
+		// With "-metadata_dir", a copy in CIPHERDIR is never read
+		if _, err = os.Lstat(stray); err == nil {
+			fmt.Printf("fsck: stray gocryptfs.diriv in dir %q, the one in the metadata directory is used\n", path)
+			ck.dirIVList = append(ck.dirIVList, stray)
+			if ck.repair {
+				if err = os.Remove(stray); err != nil {
+					fmt.Printf("fsck: could not delete %q: %v\n", stray, err)
+				}
+			}
+		}
+	}
+	var problem string
+	st, err := os.Lstat(ivPath)
+	if os.IsNotExist(err) {
+		problem = "missing gocryptfs.diriv"
+	} else if err != nil {
+		problem = fmt.Sprintf("unreadable gocryptfs.diriv (%v)", err)
+	} else if !st.Mode().IsRegular() {
+		problem = fmt.Sprintf("gocryptfs.diriv is not a regular file (%v)", st.Mode())
+	} else {
+		// Only the owner has to read it, and others must not be able to
+		// change it. Group write permissions are common in git checkouts.
+		if perm := st.Mode().Perm(); perm&0400 == 0 || perm&0002 != 0 {
+			fmt.Printf("fsck: gocryptfs.diriv in dir %q has permissions %#o, want %#o\n", path, perm, dirIVPerms)
+			ck.dirIVList = append(ck.dirIVList, ivPath)
+			if ck.repair {
+				if err = os.Chmod(ivPath, dirIVPerms); err != nil {
+					fmt.Printf("fsck: could not chmod %q: %v\n", ivPath, err)
+				}
+			}
+		}
+		if _, err = nametransform.ReadDirIV(cDir); err != nil {
+			problem = fmt.Sprintf("broken gocryptfs.diriv (%v)", err)
+		}
+	}
+	if problem == "" {
+		return true, false
+	}
+	ck.markCorrupt(path)
+	if !ck.repair {
+		n := ck.countEntries(path, cDir)
+		if n == 0 {
+			fmt.Printf("fsck: %s in dir %q. The directory is empty: "+
+				"-repair creates a new one without losing anything.\n", problem, path)
+		} else {
+			fmt.Printf("fsck: %s in dir %q. The names of its %d entries cannot be decrypted: "+
+				"-repair creates a new one and moves the entries into quarantine, "+
+				"where their content stays intact.\n", problem, path, n)
+		}
+		return false, false
+	}
+	fmt.Printf("fsck: %s in dir %q\n", problem, path)
+	if err = os.Remove(ivPath); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("fsck: could not delete %q: %v\n", ivPath, err)
+		return false, false
+	}
+	if err = nametransform.WriteDirIV(nil, cDir); err != nil {
+		fmt.Printf("fsck: could not create gocryptfs.diriv in dir %q: %v\n", path, err)
+		return false, false
+	}
+	fmt.Printf("fsck: created new gocryptfs.diriv in dir %q\n", path)
+	return true, true
+}
+
+// countEntries returns how many entries the ciphertext directory "cDir" of
+// the plaintext directory "path" has, not counting the files that are not
+// visible in the mount
+func (ck *fsckObj) countEntries(path string, cDir string) (n int) {
+	names, err := readDirNames(cDir)
+	if err != nil {
+		return 0
+	}
+	for _, name := range names {
+		if name == nametransform.DirIVFilename || nametransform.NameType(name) == nametransform.LongNameFilename {
+			continue
+		}
+		if path == "" && (name == configfile.ConfDefaultName || name == fusefrontend.QuarantineDirName) {
+			continue
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// manifestCheckString is hashed into fsckManifest.Check
+const manifestCheckString = "gocryptfs fsck manifest"
+
+// fsckManifest is the content of the "-write_manifest" file. Per-block
+// authentication cannot tell if a whole file has been replaced by an older
+// version of itself, or swapped with another file. Comparing with a
+// manifest from an earlier check can.
+//
+// The hashes are HMACs with a key derived from the master key, so the
+// manifest does not reveal anything about the file contents. Like the
+// "-fsck_checkpoint" file, only ciphertext paths are stored.
+type fsckManifest struct {
+	// Check is the HMAC of manifestCheckString. It tells if the manifest
+	// belongs to this filesystem.
+	Check string
+	// Files maps ciphertext paths to the HMAC of the plaintext content
+	Files map[string]string
+}
+
+// newManifestHash returns the HMAC that file contents are hashed with
+func newManifestHash(key []byte) hash.Hash {
+	return hmac.New(sha256.New, key)
+}
+
+// manifestCheck returns the value of fsckManifest.Check for "key"
+func manifestCheck(key []byte) string {
+	h := newManifestHash(key)
+	h.Write([]byte(manifestCheckString))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readFsckManifest reads the manifest file "path" and checks that it has
+// been written with "key"
+func readFsckManifest(path string, key []byte) (*fsckManifest, error) {
+	js, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m fsckManifest
+	if err = json.Unmarshal(js, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if !hmac.Equal([]byte(m.Check), []byte(manifestCheck(key))) {
+		return nil, fmt.Errorf("%s: the manifest belongs to a different filesystem", path)
+	}
+	return &m, nil
+}
+
+// write writes the manifest to "path". It is replaced atomically, so an
+// interruption leaves the old or the new manifest behind.
+func (m *fsckManifest) write(path string) error {
+	js, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, append(js, '\n'), 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	return err
+}
+
+// verifyManifest compares the hashes of the files that checkFiles() has
+// read with ck.verifyFrom. "cPaths" and "hashes" are indexed like ck.files.
+// An empty hash means the file could not be read and has been reported
+// already.
+func (ck *fsckObj) verifyManifest(cPaths []string, hashes []string) {
+	seen := make(map[string]bool, len(cPaths))
+	var added int
+	for i, path := range ck.files {
+		seen[cPaths[i]] = true
+		if hashes[i] == "" {
+			continue
+		}
+		want, ok := ck.verifyFrom.Files[cPaths[i]]
+		if !ok {
+			added++
+			continue
+		}
+		if want != hashes[i] {
+			fmt.Printf("fsck: file %q does not match the manifest\n", path)
+			ck.manifestList = append(ck.manifestList, path)
+		}
+	}
+	var missing []string
+	for cPath := range ck.verifyFrom.Files {
+		if !seen[cPath] {
+			missing = append(missing, cPath)
+		}
+	}
+	sort.Strings(missing)
+	for _, cPath := range missing {
+		// The plaintext name cannot be recovered without the file
+		fmt.Printf("fsck: file with ciphertext path %q from the manifest is missing\n", cPath)
+		ck.manifestList = append(ck.manifestList, cPath)
+	}
+	if added > 0 {
+		// Not an error: files are created all the time
+		fmt.Printf("fsck: %d files are not in the manifest\n", added)
+	}
+}
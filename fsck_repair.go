@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// repairName remembers the entry "cName" in the plaintext directory "dir",
+// whose name cannot be decrypted, for repairAll()
+func (ck *fsckObj) repairName(dir string, cName string) {
+	cDir, err := ck.fs.EncryptPath(dir)
+	if err != nil {
+		return
+	}
+	ck.repairNames = append(ck.repairNames, filepath.Join(cDir, cName))
+}
+
+// repairAll moves everything that was found to be corrupt into quarantine,
+// and writes what can be recovered from corrupt files back to their old
+// place. Returns the number of entries that have been moved.
+// This is called when you pass "-fsck -repair".
+func (ck *fsckObj) repairAll() (moved int) {
+	// Nobody reads from the channel anymore
+	ck.fs.CorruptItems = nil
+	for _, cPath := range ck.repairNames {
+		dst, err := ck.quarantine(cPath)
+		if err != nil {
+			fmt.Printf("fsck: could not quarantine %q: %v\n", cPath, err)
+			continue
+		}
+		fmt.Printf("fsck: corrupt entry %q: moved to %q\n", cPath, dst)
+		moved++
+	}
+	for _, path := range ck.repairPaths {
+		if ck.repairPath(path) {
+			moved++
+		}
+	}
+	return moved
+}
+
+// repairPath moves the corrupt file, symlink or directory "path" into
+// quarantine. For a regular file, the blocks that can still be decrypted
+// are written to a new file at the same path.
+func (ck *fsckObj) repairPath(path string) bool {
+	cPath, err := ck.fs.EncryptPath(path)
+	if err != nil {
+		fmt.Printf("fsck: could not quarantine %q: %v\n", path, err)
+		return false
+	}
+	st, err := os.Lstat(filepath.Join(ck.cipherdir, cPath))
+	if err != nil {
+		fmt.Printf("fsck: could not quarantine %q: %v\n", path, err)
+		return false
+	}
+	// Open the old file before it is moved. The file handle stays valid.
+	var old nodefs.File
+	var a *fuse.Attr
+	if st.Mode().IsRegular() {
+		var status fuse.Status
+		a, status = ck.fs.GetAttr(path, nil)
+		if status.Ok() {
+			old, status = ck.fs.Open(path, syscall.O_RDONLY, nil)
+		}
+		if !status.Ok() {
+			old = nil
+		}
+	}
+	dst, err := ck.quarantine(cPath)
+	if err != nil {
+		fmt.Printf("fsck: could not quarantine %q: %v\n", path, err)
+		if old != nil {
+			old.Release()
+		}
+		return false
+	}
+	fmt.Printf("fsck: %q: moved to %q\n", path, dst)
+	if old != nil {
+		ck.recoverBlocks(path, old, a)
+		old.Release()
+	}
+	return true
+}
+
+// quarantine moves the ciphertext path "cPath" into the quarantine
+// directory, keeping its encrypted name and the path of its parent
+// directory. Returns the new absolute path.
+func (ck *fsckObj) quarantine(cPath string) (string, error) {
+	src := filepath.Join(ck.cipherdir, cPath)
+	dst := filepath.Join(ck.cipherdir, fusefrontend.QuarantineDirName, cPath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return "", err
+	}
+	// An earlier repair may have quarantined an entry of the same name
+	for i, base := 1, dst; ; i++ {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = fmt.Sprintf("%s.%d", base, i)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return "", err
+	}
+	cName := filepath.Base(cPath)
+	if nametransform.IsLongContent(cName) {
+		nameFile := nametransform.MetaPath(filepath.Dir(src), cName+nametransform.LongNameSuffix)
+		err := os.Rename(nameFile, dst+nametransform.LongNameSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return dst, err
+		}
+	}
+	if nametransform.HaveMetadataDir() {
+		// Take gocryptfs.diriv and the .name files along
+		if err := os.MkdirAll(nametransform.MetaPath(filepath.Dir(dst), ""), 0700); err != nil {
+			return dst, err
+		}
+		if err := nametransform.RenameMetaDir(src, dst); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// recoverBlocks copies the blocks of "old" that can still be decrypted to a
+// new file at "path", and prints the byte ranges that have been lost.
+// The lost ranges read as zeros in the new file. "a" are the attributes of
+// "old".
+func (ck *fsckObj) recoverBlocks(path string, old nodefs.File, a *fuse.Attr) {
+	bs := ck.fs.PlainBS()
+	buf := make([]byte, bs)
+	var newFile nodefs.File
+	var recovered uint64
+	// Current range of lost bytes
+	var lostStart, lostEnd uint64
+	printLost := func() {
+		if lostEnd > lostStart {
+			fmt.Printf("fsck: %q: lost bytes %d-%d\n", path, lostStart, lostEnd-1)
+		}
+	}
+	for off := uint64(0); off < a.Size; off += bs {
+		end := off + bs
+		if end > a.Size {
+			end = a.Size
+		}
+		res, status := old.Read(buf, int64(off))
+		var data []byte
+		if status.Ok() {
+			data, status = res.Bytes(buf)
+		}
+		if !status.Ok() || len(data) == 0 {
+			if lostEnd != off {
+				printLost()
+				lostStart = off
+			}
+			lostEnd = end
+			continue
+		}
+		if newFile == nil {
+			ctx := &fuse.Context{Owner: fuse.Owner{Uid: a.Uid, Gid: a.Gid}}
+			newFile, status = ck.fs.Create(path, uint32(os.O_WRONLY), a.Mode&07777, ctx)
+			if !status.Ok() {
+				fmt.Printf("fsck: %q: could not create recovered file: %v\n", path, status)
+				return
+			}
+			defer newFile.Release()
+		}
+		if _, status = newFile.Write(data, int64(off)); !status.Ok() {
+			fmt.Printf("fsck: %q: could not write recovered file: %v\n", path, status)
+			return
+		}
+		recovered += uint64(len(data))
+	}
+	printLost()
+	if newFile == nil {
+		fmt.Printf("fsck: %q: nothing could be recovered\n", path)
+		return
+	}
+	newFile.Truncate(a.Size)
+	atime := time.Unix(int64(a.Atime), int64(a.Atimensec))
+	mtime := time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+	newFile.Utimens(&atime, &mtime)
+	if status := newFile.Flush(); !status.Ok() {
+		fmt.Printf("fsck: %q: could not write recovered file: %v\n", path, status)
+		return
+	}
+	fmt.Printf("fsck: %q: recovered %d of %d bytes\n", path, recovered, a.Size)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/progress"
+)
+
+// pathMax is the maximum length of a path that the kernel accepts.
+// Not defined on Darwin.
+const pathMax = 4096
+
+// fsckReverseObj checks that everything in a reverse mode CIPHERDIR can be
+// represented in the ciphertext view
+type fsckReverseObj struct {
+	fs *fusefrontend_reverse.ReverseFS
+	// plaindir is the absolute path to CIPHERDIR, which holds the plaintext
+	// in reverse mode
+	plaindir string
+	// List of plaintext paths that cannot be represented
+	problemList []string
+	// List of plaintext paths that are not part of the ciphertext view
+	skippedList []string
+	// checked counts the files and bytes that have been read
+	checked *progress.Counter
+}
+
+func (ck *fsckReverseObj) markProblem(path string, format string, a ...interface{}) {
+	fmt.Printf("fsck: %q: %s\n", path, fmt.Sprintf(format, a...))
+	ck.problemList = append(ck.problemList, path)
+}
+
+// Recursively check the plaintext dir "pDir" against its ciphertext
+// view "cDir"
+func (ck *fsckReverseObj) dir(pDir string, cDir string) {
+	names, err := readDirNames(filepath.Join(ck.plaindir, pDir))
+	if err != nil {
+		ck.markProblem(pDir, "cannot read directory: %v", err)
+		return
+	}
+	entries, status := ck.fs.OpenDir(cDir, nil)
+	if !status.Ok() {
+		ck.markProblem(pDir, "cannot list encrypted directory: %v", status)
+		return
+	}
+	visible := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		visible[e.Name] = true
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pPath := filepath.Join(pDir, name)
+		if pDir == "" && name == configfile.ConfReverseName {
+			// Shows up as gocryptfs.conf
+			continue
+		}
+		cPath, err := ck.fs.EncryptPath(pPath)
+		if err != nil {
+			ck.markProblem(pPath, "cannot encrypt name: %v", err)
+			continue
+		}
+		cName := filepath.Base(cPath)
+		if len(cName) > unix.NAME_MAX {
+			ck.markProblem(pPath, "encrypted name is %d bytes long, the maximum is %d", len(cName), unix.NAME_MAX)
+			continue
+		}
+		if !visible[cName] {
+			// Excluded, on another filesystem ("-one_file_system") or a
+			// dangling symlink ("-follow_symlinks")
+			fmt.Printf("fsck: %q: not part of the encrypted view\n", pPath)
+			ck.skippedList = append(ck.skippedList, pPath)
+			continue
+		}
+		if len(cPath) > pathMax {
+			ck.markProblem(pPath, "encrypted path is %d bytes long, the maximum is %d", len(cPath), pathMax)
+			continue
+		}
+		ck.entry(pPath, cPath)
+	}
+}
+
+// entry checks that the ciphertext view of "pPath" can be read
+func (ck *fsckReverseObj) entry(pPath string, cPath string) {
+	a, status := ck.fs.GetAttr(cPath, nil)
+	if status == fuse.Status(syscall.ENAMETOOLONG) {
+		// GetAttr reads symlinks to report the size of the encrypted target
+		ck.markProblem(pPath, "encrypted symlink target is longer than %d bytes", pathMax)
+		return
+	}
+	if !status.Ok() {
+		ck.markProblem(pPath, "GetAttr failed: %v", status)
+		return
+	}
+	switch a.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		ck.dir(pPath, cPath)
+	case syscall.S_IFREG:
+		if err := exportFile(ck.fs, ck.checked.Writer(ioutil.Discard), cPath, a.Size); err != nil {
+			ck.markProblem(pPath, "%v", err)
+		}
+		ck.checked.Add(1, 0)
+	case syscall.S_IFLNK:
+		if _, status = ck.fs.Readlink(cPath, nil); !status.Ok() {
+			ck.markProblem(pPath, "Readlink failed: %v", status)
+		}
+	case syscall.S_IFSOCK:
+		ck.markProblem(pPath, "sockets have no content that could be backed up")
+	}
+}
+
+// fsckReverse checks that the plaintext tree of a reverse mode CIPHERDIR is
+// fully represented in the ciphertext view. This is called when you pass
+// "-reverse -fsck".
+func fsckReverse(args *argContainer) {
+	args.allow_other = false
+	pfs, wipeKeys := initFuseFrontend(args)
+	ck := fsckReverseObj{
+		fs:       pfs.(*fusefrontend_reverse.ReverseFS),
+		plaindir: args.cipherdir,
+		checked:  &progress.Counter{},
+	}
+	// The files are read while walking the tree, so there are no totals
+	stop := progress.New(progressMode(args), "fsck").Start("check", "files", ck.checked)
+	ck.dir("", "")
+	stop()
+	wipeKeys()
+	if len(ck.skippedList) > 0 {
+		// Not an error: this is what the options asked for
+		fmt.Printf("fsck: %d paths are not part of the encrypted view because of -exclude_from, -one_file_system or -follow_symlinks\n",
+			len(ck.skippedList))
+	}
+	if len(ck.problemList) == 0 {
+		fmt.Printf("fsck summary: no problems found\n")
+		return
+	}
+	fmt.Printf("fsck summary: %d paths cannot be represented in the encrypted view\n", len(ck.problemList))
+	os.Exit(exitcodes.FsckErrors)
+}
@@ -0,0 +1,94 @@
+// gocryptfs-agent caches unlocked master keys for "gocryptfs -use_agent",
+// so that mounting again within the TTL does not ask for the password.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/agent"
+)
+
+const myName = "gocryptfs-agent"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n"+
+		"\n"+
+		"Without -lock, runs the agent in the foreground and prints the shell\n"+
+		"command that points gocryptfs to it. This is only needed if the\n"+
+		"socket is not in the default location.\n"+
+		"\n"+
+		"Options:\n", myName)
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\n"+
+		"Examples:\n"+
+		"  gocryptfs-agent -ttl 1h &\n"+
+		"  gocryptfs -use_agent CIPHERDIR MOUNTPOINT\n"+
+		"  gocryptfs-agent -lock\n")
+	os.Exit(1)
+}
+
+func errExit(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", myName, err)
+	os.Exit(1)
+}
+
+func main() {
+	ttl := flag.Duration("ttl", 15*time.Minute, "Forget keys this long after they have been stored")
+	sock := flag.String("socket", agent.SocketPath(), "Socket path. Default: $"+agent.SocketEnv+
+		" or $XDG_RUNTIME_DIR/gocryptfs-agent.sock")
+	lock := flag.Bool("lock", false, "Make the running agent wipe all keys")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+	if *sock == "" {
+		errExit(fmt.Errorf("neither $%s nor $XDG_RUNTIME_DIR is set, please pass -socket", agent.SocketEnv))
+	}
+	if *lock {
+		if err := agent.Lock(*sock); err != nil {
+			errExit(err)
+		}
+		return
+	}
+	if *ttl <= 0 {
+		errExit(fmt.Errorf("-ttl must be positive"))
+	}
+	serve(*sock, *ttl)
+}
+
+// serve runs the agent on "sock" until we get SIGINT or SIGTERM
+func serve(sock string, ttl time.Duration) {
+	if _, err := os.Stat(sock); err == nil {
+		if c, err := net.Dial("unix", sock); err == nil {
+			c.Close()
+			errExit(fmt.Errorf("an agent is already running on %s", sock))
+		}
+		// Left behind by an agent that was killed
+		os.Remove(sock)
+	}
+	// Only our own user may connect
+	syscall.Umask(0077)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		errExit(err)
+	}
+	s := agent.NewServer(ttl)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		s.Wipe()
+		// Close also deletes the socket file
+		l.Close()
+		os.Exit(0)
+	}()
+	fmt.Printf("%s=%s; export %s;\n", agent.SocketEnv, sock, agent.SocketEnv)
+	s.Serve(l)
+}
@@ -0,0 +1,158 @@
+// gocryptfs-ctl talks to the control socket of a running gocryptfs
+// process ("-ctlsock").
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+)
+
+const myName = "gocryptfs-ctl"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] SOCKET COMMAND [PATH ...]\n"+
+		"\n"+
+		"Commands:\n"+
+		"  encrypt    Encrypt plaintext paths\n"+
+		"  decrypt    Decrypt ciphertext paths\n"+
+		"  info       Show protocol version and supported commands\n"+
+		"  revoke_key Remove the master key from the kernel keyring\n"+
+		"  changepasswd\n"+
+		"             Change the password without unmounting\n"+
+		"  unfreeze   Make the filesystem usable again after -guard froze it\n"+
+		"  freeze     Block writes and sync CIPHERDIR, for taking a snapshot\n"+
+		"  thaw       Unblock writes after freeze\n"+
+		"  changes    Show how many write operations there have been\n"+
+		"\n"+
+		"If no PATH is given, paths are read from stdin, one per line.\n"+
+		"\n"+
+		"Options:\n", myName)
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\n"+
+		"Examples:\n"+
+		"  gocryptfs-ctl /run/user/1000/gcfs.sock encrypt foo/bar\n"+
+		"  find . | gocryptfs-ctl /run/user/1000/gcfs.sock decrypt\n")
+	os.Exit(1)
+}
+
+func errExit(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", myName, err)
+	os.Exit(1)
+}
+
+func main() {
+	jsonOut := flag.Bool("json", false, "Print raw JSON results")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+	}
+	c, err := ctlsock.New(flag.Arg(0))
+	if err != nil {
+		errExit(err)
+	}
+	defer c.Close()
+	cmd := flag.Arg(1)
+	switch cmd {
+	case "info":
+		fmt.Printf("Protocol version: %d\n", c.Version)
+		fmt.Printf("Commands: %s\n", strings.Join(c.Commands, " "))
+	case ctlsock.CmdEncrypt, ctlsock.CmdDecrypt:
+		paths := flag.Args()[2:]
+		if len(paths) == 0 {
+			paths = readStdin()
+		}
+		if !translate(c, cmd, paths, *jsonOut) {
+			os.Exit(1)
+		}
+	case ctlsock.CmdRevokeKey:
+		if err = c.RevokeKey(); err != nil {
+			errExit(err)
+		}
+	case ctlsock.CmdChangePassword:
+		oldPw := readpassword.Once("", "Old password")
+		fmt.Fprintf(os.Stderr, "Please enter your new password.\n")
+		newPw := readpassword.Twice("")
+		if err = c.ChangePassword(string(oldPw), string(newPw)); err != nil {
+			errExit(err)
+		}
+		fmt.Fprintf(os.Stderr, "Password changed.\n")
+	case ctlsock.CmdUnfreeze:
+		if err = c.Unfreeze(); err != nil {
+			errExit(err)
+		}
+	case ctlsock.CmdFreeze:
+		if err = c.Freeze(); err != nil {
+			errExit(err)
+		}
+	case ctlsock.CmdThaw:
+		if err = c.Thaw(); err != nil {
+			errExit(err)
+		}
+	case ctlsock.CmdChanges:
+		epoch, n, err := c.Changes()
+		if err != nil {
+			errExit(err)
+		}
+		fmt.Printf("Epoch: %s\nChanges: %d\n", epoch, n)
+	default:
+		errExit(fmt.Errorf("unknown command %q", cmd))
+	}
+}
+
+func readStdin() (paths []string) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errExit(err)
+	}
+	return paths
+}
+
+// translate encrypts or decrypts "paths" and prints the results. The
+// ctlsock package sends them in as few requests as the server allows.
+// Returns false if any of the paths failed.
+func translate(c *ctlsock.CtlSock, cmd string, paths []string, jsonOut bool) (ok bool) {
+	var results []ctlsock.ResultStruct
+	var err error
+	if cmd == ctlsock.CmdEncrypt {
+		results, err = c.EncryptPaths(paths)
+	} else {
+		results, err = c.DecryptPaths(paths)
+	}
+	if err != nil {
+		errExit(err)
+	}
+	ok = true
+	enc := json.NewEncoder(os.Stdout)
+	for i, r := range results {
+		err := r.Err()
+		if err != nil {
+			ok = false
+		}
+		if jsonOut {
+			enc.Encode(r)
+			continue
+		}
+		if r.WarnText != "" {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s\n", paths[i], r.WarnText)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", paths[i], err)
+			continue
+		}
+		fmt.Println(r.Result)
+	}
+	return ok
+}
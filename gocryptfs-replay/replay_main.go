@@ -0,0 +1,63 @@
+// gocryptfs-replay re-executes a trace recorded with "gocryptfs
+// -record_trace" against a directory, usually a test mount.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/optrace"
+)
+
+const myName = "gocryptfs-replay"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] TRACEFILE DIR\n"+
+		"\n"+
+		"Replays the operations recorded with \"gocryptfs -record_trace\" in DIR.\n"+
+		"DIR should be an empty test mount. File contents are replaced by\n"+
+		"random data.\n"+
+		"\n"+
+		"Options:\n", myName)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func errExit(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", myName, err)
+	os.Exit(1)
+}
+
+func main() {
+	realtime := flag.Bool("realtime", false, "Keep the original timing instead of running as fast as possible")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		errExit(err)
+	}
+	defer f.Close()
+	t := time.Now()
+	stats, err := optrace.Replay(f, flag.Arg(1), *realtime)
+	total := time.Since(t)
+	var ops []string
+	for op := range stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	fmt.Printf("%-10s %8s %7s %12s %12s\n", "OP", "COUNT", "ERRORS", "REPLAYED", "RECORDED")
+	for _, op := range ops {
+		s := stats[op]
+		fmt.Printf("%-10s %8d %7d %12v %12v\n", op, s.N, s.Errors, s.Dur, s.RecordedDur)
+	}
+	fmt.Printf("Total time: %v\n", total)
+	if err != nil {
+		errExit(err)
+	}
+}
@@ -0,0 +1,251 @@
+// Package gocryptfstest helps writing integration tests against real
+// gocryptfs mounts. It is meant for projects that embed or wrap gocryptfs
+// and want to test the result end-to-end.
+//
+// The functions run the gocryptfs binary (see Binary), so gocryptfs and a
+// working FUSE setup must be available on the test machine.
+//
+// A typical test looks like this:
+//
+//	func TestFoo(t *testing.T) {
+//		cDir := gocryptfstest.Init(t)
+//		pDir := cDir + ".mnt"
+//		gocryptfstest.Mount(t, cDir, pDir)
+//		defer gocryptfstest.Unmount(t, pDir)
+//		...
+//	}
+package gocryptfstest
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Password is the password of the filesystems created by Init.
+const Password = "test"
+
+// ZeroKeyDirIV is the root directory IV written by InitZeroKey. Together
+// with the all-zero master key it makes the encrypted file names
+// reproducible across test runs.
+var ZeroKeyDirIV = []byte{
+	0x67, 0x6f, 0x63, 0x72, 0x79, 0x70, 0x74, 0x66,
+	0x73, 0x74, 0x65, 0x73, 0x74, 0x64, 0x69, 0x76,
+}
+
+// dirIVFilename is nametransform.DirIVFilename. We do not import the
+// internal package so that this package stays usable from outside the
+// repository.
+const dirIVFilename = "gocryptfs.diriv"
+
+// Binary is the gocryptfs executable that is run. It defaults to the
+// value of the GOCRYPTFS_BINARY environment variable, or "gocryptfs"
+// from $PATH if that is not set.
+var Binary = defaultBinary()
+
+// TmpDir is the directory where Init and InitZeroKey create cipherdirs.
+// Empty means os.TempDir().
+var TmpDir string
+
+// unmountRetries is how often UnmountErr tries before giving up
+const unmountRetries = 10
+
+func defaultBinary() string {
+	if b := os.Getenv("GOCRYPTFS_BINARY"); b != "" {
+		return b
+	}
+	return "gocryptfs"
+}
+
+// InitErr calls "gocryptfs -init" on the existing empty directory "dir",
+// passing "extraArgs" in addition to defaults that make the call fast and
+// non-interactive. The password is Password.
+func InitErr(dir string, extraArgs ...string) error {
+	args := []string{"-q", "-init", "-extpass", "echo " + Password, "-scryptn=10"}
+	args = append(args, extraArgs...)
+	args = append(args, dir)
+	cmd := exec.Command(Binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gocryptfs %v failed: %v", args, err)
+	}
+	return nil
+}
+
+// Init creates a new directory in TmpDir and initializes it as a gocryptfs
+// cipherdir using InitErr. It calls t.Fatal on failure.
+//
+// The returned path has no trailing slash. The caller is responsible for
+// deleting it.
+func Init(t testing.TB, extraArgs ...string) string {
+	dir, err := ioutil.TempDir(TmpDir, "gocryptfstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitErr(dir, extraArgs...); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// InitZeroKey creates a new cipherdir in TmpDir that is meant to be
+// mounted with "-zerokey". It has no config file and the root directory IV
+// is ZeroKeyDirIV, so the same operations always produce the same
+// encrypted file names. File contents still use random nonces.
+func InitZeroKey(t testing.TB) string {
+	dir, err := ioutil.TempDir(TmpDir, "gocryptfstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteDirIV(dir, ZeroKeyDirIV); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// WriteDirIV writes "iv" as the directory IV file into "dir", with the same
+// permissions gocryptfs uses.
+func WriteDirIV(dir string, iv []byte) error {
+	if len(iv) != len(ZeroKeyDirIV) {
+		return fmt.Errorf("invalid dir IV length %d", len(iv))
+	}
+	return ioutil.WriteFile(filepath.Join(dir, dirIVFilename), iv, 0400)
+}
+
+// ZeroKeyHex returns the all-zero master key in the format that
+// "-masterkey" accepts. This allows to access a "-zerokey" filesystem with
+// options that need an explicit key, like "-passwd -masterkey".
+func ZeroKeyHex() string {
+	s := hex.EncodeToString(make([]byte, 32))
+	var parts []string
+	for i := 0; i < len(s); i += 8 {
+		parts = append(parts, s[i:i+8])
+	}
+	return strings.Join(parts, "-")
+}
+
+// hasKeyArg returns true if "args" already tell gocryptfs where to get the
+// key from, so MountErr should not add "-extpass".
+func hasKeyArg(args []string) bool {
+	for _, a := range args {
+		a = strings.TrimLeft(a, "-")
+		if i := strings.Index(a, "="); i >= 0 {
+			a = a[:i]
+		}
+		switch a {
+		case "extpass", "passfile", "masterkey", "zerokey", "fido2":
+			return true
+		}
+	}
+	return false
+}
+
+// MountErr mounts CIPHERDIR "c" on PLAINDIR "p" and returns the error from
+// running gocryptfs. "p" is created if it does not exist.
+//
+// Unless "extraArgs" already contain a key source like "-masterkey" or
+// "-zerokey", the password Password is passed via "-extpass".
+// If "showOutput" is set, the output of gocryptfs is copied to our stdout.
+func MountErr(c string, p string, showOutput bool, extraArgs ...string) error {
+	args := []string{"-q", "-wpanic", "-nosyslog"}
+	if !hasKeyArg(extraArgs) {
+		args = append(args, "-extpass", "echo "+Password)
+	}
+	args = append(args, extraArgs...)
+	args = append(args, c, p)
+
+	if _, err := os.Stat(p); err != nil {
+		err = os.Mkdir(p, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command(Binary, args...)
+	if showOutput {
+		// The Go test logic waits for our stdout to close, and when we share
+		// it with the subprocess, it will wait for it to close it as well.
+		// Use an intermediate pipe so the tests do not hang when unmouting
+		// fails.
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		// We can close the fd after cmd.Run() has executed
+		defer pw.Close()
+		cmd.Stderr = pw
+		cmd.Stdout = pw
+		go func() {
+			io.Copy(os.Stdout, pr)
+			pr.Close()
+		}()
+	}
+	return cmd.Run()
+}
+
+// Mount calls MountErr and calls t.Fatal on failure.
+func Mount(t testing.TB, c string, p string, extraArgs ...string) {
+	if err := MountErr(c, p, true, extraArgs...); err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+}
+
+// unmountCmd returns the command that unmounts "dir" on this platform
+func unmountCmd(dir string) *exec.Cmd {
+	if runtime.GOOS == "linux" {
+		return exec.Command("fusermount", "-u", dir)
+	}
+	return exec.Command("umount", dir)
+}
+
+// UnmountErr tries to unmount "dir", retrying 10 times, and returns the
+// resulting error.
+func UnmountErr(dir string) (err error) {
+	// When a new filesystem is mounted, Gnome tries to read files like
+	// .xdg-volume-info, autorun.inf, .Trash.
+	// If we try to unmount before Gnome is done, the unmount fails with
+	// "Device or resource busy", causing spurious test failures.
+	// Retry a few times to hide that problem.
+	for i := 1; i <= unmountRetries; i++ {
+		cmd := unmountCmd(dir)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+// Unmount calls UnmountErr and calls t.Fatal on failure.
+func Unmount(t testing.TB, dir string) {
+	if err := UnmountErr(dir); err != nil {
+		t.Fatalf("unmount failed: %v", err)
+	}
+}
+
+// ExtractCmdExitCode extracts the exit code from an error value that was
+// returned from exec / cmd.Run(). It returns -1 if "err" does not carry an
+// exit code.
+func ExtractCmdExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	err2, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1
+	}
+	return err2.Sys().(syscall.WaitStatus).ExitStatus()
+}
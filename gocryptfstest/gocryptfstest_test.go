@@ -0,0 +1,105 @@
+package gocryptfstest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// The package does not import nametransform, make sure the copies agree.
+func TestDirIVConstants(t *testing.T) {
+	if dirIVFilename != nametransform.DirIVFilename {
+		t.Errorf("dirIVFilename=%q", dirIVFilename)
+	}
+	if len(ZeroKeyDirIV) != nametransform.DirIVLen {
+		t.Errorf("len(ZeroKeyDirIV)=%d", len(ZeroKeyDirIV))
+	}
+}
+
+func TestInitZeroKey(t *testing.T) {
+	dir := InitZeroKey(t)
+	defer os.RemoveAll(dir)
+	iv, err := nametransform.ReadDirIV(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(iv, ZeroKeyDirIV) {
+		t.Errorf("got %x", iv)
+	}
+	fi, err := os.Stat(filepath.Join(dir, nametransform.DirIVFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0400 {
+		t.Errorf("wrong mode %o", fi.Mode().Perm())
+	}
+	if err = WriteDirIV(dir, []byte{1, 2, 3}); err == nil {
+		t.Error("short dir IV should be rejected")
+	}
+}
+
+func TestZeroKeyHex(t *testing.T) {
+	s := ZeroKeyHex()
+	key, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, make([]byte, 32)) {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestHasKeyArg(t *testing.T) {
+	testCases := []struct {
+		args []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"-ro", "-allow_other"}, false},
+		{[]string{"-zerokey"}, true},
+		{[]string{"-extpass", "echo foo"}, true},
+		{[]string{"-extpass=echo foo"}, true},
+		{[]string{"--masterkey=stdin"}, true},
+		{[]string{"-passfile", "/tmp/pw"}, true},
+	}
+	for _, tc := range testCases {
+		if have := hasKeyArg(tc.args); have != tc.want {
+			t.Errorf("%v: want %v, have %v", tc.args, tc.want, have)
+		}
+	}
+}
+
+func TestExtractCmdExitCode(t *testing.T) {
+	if c := ExtractCmdExitCode(nil); c != 0 {
+		t.Errorf("nil: got %d", c)
+	}
+	err := exec.Command("sh", "-c", "exit 7").Run()
+	if c := ExtractCmdExitCode(err); c != 7 {
+		t.Errorf("exit 7: got %d", c)
+	}
+	err = exec.Command("/nonexistent/binary").Run()
+	if c := ExtractCmdExitCode(err); c != -1 {
+		t.Errorf("nonexistent: got %d", c)
+	}
+}
+
+func TestInitErrMissingBinary(t *testing.T) {
+	old := Binary
+	Binary = "/nonexistent/gocryptfs"
+	defer func() { Binary = old }()
+	dir, err := ioutil.TempDir("", "TestInitErrMissingBinary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = InitErr(dir); err == nil {
+		t.Error("should have failed")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/agent"
+	"github.com/rfjakob/gocryptfs/internal/guard"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/webhook"
+)
+
+// guardTriggered is called when "-guard" has detected mass file access by
+// foreign users. It reports the event and, for action=lock, removes the
+// master key from the kernel keyring and from gocryptfs-agent.
+func guardTriggered(args *argContainer, detail string) {
+	tlog.Warn.Printf("guard: %s", detail)
+	args._webhook.Send(webhook.EventIntrusion, detail)
+	args._desktopNotify.Intrusion(detail)
+	if args._guard.Action != guard.ActionLock {
+		return
+	}
+	if args._keyringDesc != "" {
+		if err := keyring.Revoke(args._keyringDesc); err != nil {
+			tlog.Warn.Printf("guard: could not revoke the master key in the kernel keyring: %v", err)
+		} else {
+			tlog.Info.Printf("guard: revoked the master key in the kernel keyring")
+			args._webhook.Send(webhook.EventKeyLocked, "")
+		}
+	}
+	if args.use_agent {
+		if sock := agent.SocketPath(); sock != "" {
+			if err := agent.Lock(sock); err != nil {
+				tlog.Warn.Printf("guard: could not lock gocryptfs-agent: %v", err)
+			}
+		}
+	}
+}
@@ -39,6 +39,7 @@ Common Options (use -hh to show all):
   -ro                Mount read-only
   -speed             Run crypto speed test
   -version           Print version information
+  -xchacha           Use XChaCha20-Poly1305 encryption (with -init)
   --                 Stop option parsing
 `)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/desktopnotify"
+	"github.com/rfjakob/gocryptfs/internal/filewrap"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// idleMonitor implements "-idle". It wraps the forward or reverse frontend to
+// count the open files, and gets called by go-fuse after every FUSE operation
+// (as a fuse.LatencyMap) to record the time of the last activity.
+type idleMonitor struct {
+	// lastOp is the time of the last FUSE operation in Unix nanoseconds.
+	// Accessed atomically, must be the first element of the struct to
+	// guarantee 64-bit alignment.
+	lastOp int64
+	// openFiles is the number of open file handles. Accessed atomically.
+	openFiles int64
+	// notify shows a desktop notification when we unmount, "-desktop_notify"
+	notify *desktopnotify.Notifier
+	pathfs.FileSystem
+}
+
+var _ fuse.LatencyMap = &idleMonitor{}
+
+func newIdleMonitor(fs pathfs.FileSystem) *idleMonitor {
+	return &idleMonitor{
+		lastOp:     time.Now().UnixNano(),
+		FileSystem: fs,
+	}
+}
+
+// Add implements fuse.LatencyMap
+func (m *idleMonitor) Add(name string, dt time.Duration) {
+	atomic.StoreInt64(&m.lastOp, time.Now().UnixNano())
+}
+
+// Open implements pathfs.FileSystem
+func (m *idleMonitor) Open(path string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, status := m.FileSystem.Open(path, flags, context)
+	return m.track(f), status
+}
+
+// Create implements pathfs.FileSystem
+func (m *idleMonitor) Create(path string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, status := m.FileSystem.Create(path, flags, mode, context)
+	return m.track(f), status
+}
+
+// track counts "f" as open until it is released
+func (m *idleMonitor) track(f nodefs.File) nodefs.File {
+	return filewrap.Wrap(f, func(f nodefs.File) nodefs.File {
+		atomic.AddInt64(&m.openFiles, 1)
+		return &idleFile{File: f, m: m}
+	})
+}
+
+type idleFile struct {
+	nodefs.File
+	m *idleMonitor
+}
+
+// Release implements nodefs.File
+func (f *idleFile) Release() {
+	f.File.Release()
+	atomic.AddInt64(&f.m.openFiles, -1)
+}
+
+// run unmounts "srv" once there have been no FUSE operations for "timeout"
+// and no files are open. If unmounting fails, for example because a process
+// has its working directory inside the mount, we try again after another
+// "timeout".
+func (m *idleMonitor) run(srv *fuse.Server, timeout time.Duration) {
+	interval := timeout / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		last := time.Unix(0, atomic.LoadInt64(&m.lastOp))
+		if atomic.LoadInt64(&m.openFiles) > 0 || time.Since(last) < timeout {
+			continue
+		}
+		tlog.Info.Printf("Filesystem has been idle for %v, unmounting", timeout)
+		err := srv.Unmount()
+		if err == nil {
+			m.notify.IdleUnmount(timeout)
+			// srv.Serve() returns and the keys are wiped
+			return
+		}
+		tlog.Warn.Printf("idle: unmount failed: %v", err)
+		atomic.StoreInt64(&m.lastOp, time.Now().UnixNano())
+	}
+}
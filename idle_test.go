@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func TestIdleMonitorOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIdleMonitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "foo"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := newIdleMonitor(pathfs.NewLoopbackFileSystem(dir))
+	f1, status := m.Open("foo", uint32(os.O_RDONLY), nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f2, status := m.Create("bar", uint32(os.O_RDWR), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = m.Open("missing", uint32(os.O_RDONLY), nil); status.Ok() {
+		t.Fatal("opening a missing file succeeded")
+	}
+	if m.openFiles != 2 {
+		t.Errorf("want 2 open files, have %d", m.openFiles)
+	}
+	f1.Release()
+	f2.Release()
+	if m.openFiles != 0 {
+		t.Errorf("want 0 open files, have %d", m.openFiles)
+	}
+}
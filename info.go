@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
@@ -36,8 +37,32 @@ func info(filename string) {
 	}
 	// Pretty-print
 	fmt.Printf("Creator:      %s\n", cf.Creator)
+	if cf.Profile != "" {
+		fmt.Printf("Profile:      %s\n", cf.Profile)
+	}
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
+	if cf.BlockSize != 0 {
+		fmt.Printf("BlockSize:    %d\n", cf.BlockSize)
+	}
+	if cf.Expiry != 0 {
+		fmt.Printf("Expiry:       %s\n", time.Unix(cf.Expiry, 0).Format(time.RFC3339))
+	}
+	if cf.FIDO2 != nil {
+		fmt.Printf("FIDO2:        CredentialID=%dB HMACSalt=%dB\n", len(cf.FIDO2.CredentialID), len(cf.FIDO2.HMACSalt))
+	}
+	if d := cf.DuressObject; d != nil {
+		fmt.Printf("DuressObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
+			len(d.ScryptObject.Salt), d.ScryptObject.N, d.ScryptObject.R, d.ScryptObject.P, d.ScryptObject.KeyLen)
+	}
+	if t := cf.TPM2Object; t != nil {
+		fmt.Printf("TPM2Object:   Public=%dB Private=%dB PCRs=%q\n", len(t.Public), len(t.Private), t.PCRs)
+	}
 	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
+	if a := cf.Argon2idObject; a != nil {
+		fmt.Printf("Argon2idObject: Salt=%dB Time=%d Memory=%dKiB Threads=%d KeyLen=%d\n",
+			len(a.Salt), a.Time, a.Memory, a.Threads, a.KeyLen)
+		return
+	}
 	s := cf.ScryptObject
 	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
 		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
@@ -8,7 +8,9 @@ import (
 	"strings"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fido2"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -63,22 +65,75 @@ func initDir(args *argContainer) {
 			os.Exit(exitcodes.Init)
 		}
 	}
+	if args.profile != "" {
+		p, _ := configfile.GetProfile(args.profile)
+		tlog.Info.Printf("Using profile %q: %s", p.Name, p.Description)
+	}
 	// Choose password for config file
-	if args.extpass == "" {
+	if args.extpass == "" && args.fido2 == "" && !args.dualcontrol {
 		tlog.Info.Printf("Choose a password for protecting your files.")
 	}
 	{
 		creator := tlog.ProgramName + " " + GitVersion
-		password := readpassword.Twice(args.extpass)
+		var fido2Params *configfile.FIDO2Params
+		if args.fido2 != "" {
+			// The password is the hmac-secret of a new FIDO2 credential
+			fido2Params = &configfile.FIDO2Params{
+				CredentialID: fido2.Register(args.fido2, filepath.Base(args.cipherdir)),
+				HMACSalt:     cryptocore.RandBytes(32),
+			}
+		}
+		password := readNewPassword(args, fido2Params, args.dualcontrol)
+		var duressPassword []byte
+		if args.duress {
+			duressPassword = readDuressPassword(args, password)
+		}
 		readpassword.CheckTrailingGarbage()
-		err = configfile.CreateConfFile(args.config, password, args.plaintextnames, args.scryptn, creator, args.aessiv, args.devrandom)
+		err = configfile.CreateConfFile(&configfile.CreateArgs{
+			Filename:        args.config,
+			Password:        password,
+			PlaintextNames:  args.plaintextnames,
+			LogN:            args.scryptn,
+			KDF:             args.kdf,
+			Creator:         creator,
+			AESSIV:          args.aessiv,
+			XChaCha:         args.xchacha,
+			BlockSize:       uint64(args.blocksize),
+			Expiry:          args._expiry,
+			FIDO2:           fido2Params,
+			DualControl:     args.dualcontrol,
+			DuressPassword:  duressPassword,
+			DevRandom:       args.devrandom,
+			ExternalHeaders: args.external_headers,
+			Profile:         args.profile,
+		})
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.WriteConf)
 		}
+		if args.tpm2 {
+			// CreateConfFile() does not hand out the master key, so decrypt
+			// it again
+			masterkey, confFile, err := configfile.LoadConfFile(args.config, password)
+			if err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.LoadConf)
+			}
+			tpm2SealKey(args, confFile, masterkey)
+			for i := range masterkey {
+				masterkey[i] = 0
+			}
+			if err = confFile.WriteFile(); err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.WriteConf)
+			}
+		}
 		for i := range password {
 			password[i] = 0
 		}
+		for i := range duressPassword {
+			duressPassword[i] = 0
+		}
 		// password runs out of scope here
 	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv
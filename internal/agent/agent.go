@@ -0,0 +1,121 @@
+// Package agent implements gocryptfs-agent, a process that caches unlocked
+// master keys for a limited time, like ssh-agent does for SSH keys, and the
+// client side that "gocryptfs -use_agent" uses to talk to it.
+//
+// The agent listens on a Unix socket. Each connection carries one JSON
+// request and one JSON response.
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SocketEnv is the environment variable that holds the socket path, like
+// SSH_AUTH_SOCK for ssh-agent
+const SocketEnv = "GOCRYPTFS_AGENT_SOCK"
+
+// Commands
+const (
+	// CmdGet returns the key stored under Request.ID
+	CmdGet = "get"
+	// CmdPut stores Request.Key under Request.ID
+	CmdPut = "put"
+	// CmdDelete wipes the key stored under Request.ID
+	CmdDelete = "delete"
+	// CmdLock wipes all stored keys
+	CmdLock = "lock"
+)
+
+// ErrNotFound is returned by Get if the agent has no key for the ID
+var ErrNotFound = errors.New("key not found")
+
+// Request is sent by a client
+type Request struct {
+	Command string
+	// ID identifies the filesystem and the settings that its master key is
+	// bound to, see keyring.Description()
+	ID  string `json:",omitempty"`
+	Key []byte `json:",omitempty"`
+}
+
+// Response is sent by the agent
+type Response struct {
+	Key []byte `json:",omitempty"`
+	// Error is empty on success
+	Error string `json:",omitempty"`
+	// NotFound is set if CmdGet found no key
+	NotFound bool `json:",omitempty"`
+}
+
+// dialTimeout limits how long a client waits for an unresponsive agent
+const dialTimeout = 5 * time.Second
+
+// SocketPath returns the agent socket path from $GOCRYPTFS_AGENT_SOCK, or
+// the default location in $XDG_RUNTIME_DIR. It returns an empty string if
+// neither is set.
+func SocketPath() string {
+	if p := os.Getenv(SocketEnv); p != "" {
+		return p
+	}
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		return filepath.Join(d, "gocryptfs-agent.sock")
+	}
+	return ""
+}
+
+// call sends "req" to the agent at "sock" and returns the response
+func call(sock string, req Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", sock, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// Get returns the key stored under "id", or ErrNotFound
+func Get(sock string, id string) ([]byte, error) {
+	resp, err := call(sock, Request{Command: CmdGet, ID: id})
+	if err != nil {
+		return nil, err
+	}
+	if resp.NotFound {
+		return nil, ErrNotFound
+	}
+	return resp.Key, nil
+}
+
+// Put stores "key" under "id". The agent forgets it after its TTL.
+func Put(sock string, id string, key []byte) error {
+	_, err := call(sock, Request{Command: CmdPut, ID: id, Key: key})
+	return err
+}
+
+// Delete makes the agent wipe the key stored under "id". It is not an error
+// if there is no such key.
+func Delete(sock string, id string) error {
+	_, err := call(sock, Request{Command: CmdDelete, ID: id})
+	return err
+}
+
+// Lock makes the agent wipe all stored keys
+func Lock(sock string) error {
+	_, err := call(sock, Request{Command: CmdLock})
+	return err
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startServer starts an agent with "ttl" on a temporary socket and returns
+// the socket path
+func startServer(t *testing.T, ttl time.Duration) (sock string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "TestAgent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock = filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(ttl).Serve(l)
+	return sock, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPutGetLock(t *testing.T) {
+	sock, cleanup := startServer(t, time.Hour)
+	defer cleanup()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if _, err := Get(sock, "a"); err != ErrNotFound {
+		t.Errorf("want ErrNotFound, have %v", err)
+	}
+	if err := Put(sock, "a", key); err != nil {
+		t.Fatal(err)
+	}
+	have, err := Get(sock, "a")
+	if err != nil || !bytes.Equal(have, key) {
+		t.Errorf("have=%x err=%v", have, err)
+	}
+	if err := Put(sock, "", key); err == nil {
+		t.Error("empty ID was accepted")
+	}
+	if err := Lock(sock); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(sock, "a"); err != ErrNotFound {
+		t.Errorf("key survived lock: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	sock, cleanup := startServer(t, time.Hour)
+	defer cleanup()
+	if err := Put(sock, "a", []byte("key a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Put(sock, "b", []byte("key b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(sock, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(sock, "a"); err != ErrNotFound {
+		t.Errorf("key survived delete: %v", err)
+	}
+	if _, err := Get(sock, "b"); err != nil {
+		t.Errorf("wrong key was deleted: %v", err)
+	}
+	// Deleting a key that does not exist is not an error
+	if err := Delete(sock, "a"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	sock, cleanup := startServer(t, 50*time.Millisecond)
+	defer cleanup()
+	if err := Put(sock, "a", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := Get(sock, "a"); err != ErrNotFound {
+		t.Errorf("key did not expire: %v", err)
+	}
+}
+
+func TestNoAgent(t *testing.T) {
+	if _, err := Get("/nonexisting/gocryptfs-agent.sock", "a"); err == nil || err == ErrNotFound {
+		t.Errorf("want connection error, have %v", err)
+	}
+}
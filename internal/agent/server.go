@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// maxRequestSize limits the size of a JSON request
+const maxRequestSize = 4096
+
+type entry struct {
+	key   []byte
+	timer *time.Timer
+}
+
+// Server holds the cached keys
+type Server struct {
+	// ttl is how long a key is kept after it has been stored
+	ttl time.Duration
+	// uid is the user we serve. Connections from other users are rejected.
+	uid int
+
+	lock sync.Mutex
+	keys map[string]*entry
+}
+
+// NewServer returns a Server that keeps keys for "ttl"
+func NewServer(ttl time.Duration) *Server {
+	return &Server{
+		ttl:  ttl,
+		uid:  os.Getuid(),
+		keys: make(map[string]*entry),
+	}
+}
+
+// Serve serves incoming connections on "sock". It blocks until "sock" is
+// closed.
+func (s *Server) Serve(sock *net.UnixListener) {
+	for {
+		conn, err := sock.AcceptUnix()
+		if err != nil {
+			tlog.Debug.Printf("agent: Accept error: %v", err)
+			return
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *Server) handleConnection(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	// Make sure that only our own user gets the keys, even if the socket
+	// permissions are too open. If we cannot tell who is connecting, the
+	// connection is rejected as well.
+	uid, err := syscallcompat.PeerUID(conn)
+	if err != nil {
+		tlog.Warn.Printf("agent: rejecting connection: cannot get peer credentials: %v", err)
+		return
+	}
+	if uid != s.uid && uid != 0 {
+		tlog.Warn.Printf("agent: rejecting connection from uid %d", uid)
+		return
+	}
+	var req Request
+	err = json.NewDecoder(&limitedReader{conn, maxRequestSize}).Decode(&req)
+	if err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: err.Error()})
+		return
+	}
+	resp := s.handleRequest(&req)
+	json.NewEncoder(conn).Encode(resp)
+	wipe(req.Key)
+	wipe(resp.Key)
+}
+
+func (s *Server) handleRequest(req *Request) Response {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch req.Command {
+	case CmdGet:
+		e := s.keys[req.ID]
+		if e == nil {
+			return Response{NotFound: true}
+		}
+		// Copy the key, it may be wiped while the response is sent
+		return Response{Key: append([]byte{}, e.key...)}
+	case CmdPut:
+		if req.ID == "" || len(req.Key) == 0 {
+			return Response{Error: "ID and Key are required"}
+		}
+		s.forget(req.ID)
+		id := req.ID
+		e := &entry{key: append([]byte{}, req.Key...)}
+		e.timer = time.AfterFunc(s.ttl, func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			// The key may have been replaced in the meantime
+			if s.keys[id] == e {
+				tlog.Info.Printf("agent: key %s expired", id)
+				s.forget(id)
+			}
+		})
+		s.keys[id] = e
+		tlog.Info.Printf("agent: stored key %s for %v", id, s.ttl)
+		return Response{}
+	case CmdDelete:
+		if s.keys[req.ID] != nil {
+			s.forget(req.ID)
+			tlog.Info.Printf("agent: deleted key %s", req.ID)
+		}
+		return Response{}
+	case CmdLock:
+		s.wipeAll()
+		tlog.Info.Printf("agent: locked, all keys wiped")
+		return Response{}
+	default:
+		return Response{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+}
+
+// forget wipes and removes the key stored under "id". The caller must hold
+// the lock.
+func (s *Server) forget(id string) {
+	e := s.keys[id]
+	if e == nil {
+		return
+	}
+	e.timer.Stop()
+	wipe(e.key)
+	delete(s.keys, id)
+}
+
+// wipeAll wipes all keys. The caller must hold the lock.
+func (s *Server) wipeAll() {
+	for id := range s.keys {
+		s.forget(id)
+	}
+}
+
+// Wipe wipes all keys. Call it before exiting.
+func (s *Server) Wipe() {
+	s.lock.Lock()
+	s.wipeAll()
+	s.lock.Unlock()
+}
+
+// wipe overwrites "b" with zeros
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// limitedReader fails if more than "n" bytes are read, so a client cannot
+// make us buffer unlimited amounts of data
+type limitedReader struct {
+	conn *net.UnixConn
+	n    int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, fmt.Errorf("request too big (max = %d bytes)", maxRequestSize)
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.conn.Read(p)
+	l.n -= n
+	return n, err
+}
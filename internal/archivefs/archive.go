@@ -0,0 +1,339 @@
+// Package archivefs mounts a gocryptfs CIPHERDIR that is stored inside a
+// .tar or .zip file, read-only and without extracting it first.
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Entry is a file, directory or symlink in the archive
+type Entry struct {
+	// Mode contains the permission bits and os.ModeDir or os.ModeSymlink
+	Mode     os.FileMode
+	Size     int64
+	Mtime    time.Time
+	Uid      int
+	Gid      int
+	Linkname string
+	// Children are the names of the directory entries, sorted
+	Children []string
+	// open returns the content of a regular file
+	open func() (io.ReaderAt, error)
+}
+
+// Open returns the content of the regular file "e"
+func (e *Entry) Open() (io.ReaderAt, error) {
+	if e.open == nil {
+		return bytes.NewReader(nil), nil
+	}
+	return e.open()
+}
+
+// Archive is the index of a .tar or .zip file. The paths are relative to
+// the CIPHERDIR inside the archive, which is "".
+type Archive struct {
+	f       *os.File
+	entries map[string]*Entry
+	// Root is the path of the CIPHERDIR inside the archive, "" if it is
+	// the top level
+	Root string
+}
+
+// IsArchive returns true if "fn" is a regular file that looks like an
+// archive we can mount.
+func IsArchive(fn string) bool {
+	fi, err := os.Stat(fn)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(fn))
+	return ext == ".tar" || ext == ".zip"
+}
+
+// Open reads the index of the archive "fn". The file stays open until
+// Close is called.
+func Open(fn string) (*Archive, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]*Entry)
+	if strings.ToLower(path.Ext(fn)) == ".zip" {
+		err = loadZip(f, raw)
+	} else {
+		err = loadTar(f, raw)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	a := &Archive{f: f, entries: make(map[string]*Entry)}
+	a.Root = findRoot(raw)
+	for name, e := range raw {
+		if name == a.Root {
+			a.entries[""] = e
+		} else if a.Root == "" {
+			a.entries[name] = e
+		} else if strings.HasPrefix(name, a.Root+"/") {
+			a.entries[name[len(a.Root)+1:]] = e
+		}
+	}
+	a.linkDirs()
+	if a.Root != "" {
+		tlog.Info.Printf("Using CIPHERDIR %q inside the archive", a.Root)
+	}
+	return a, nil
+}
+
+// Close closes the archive file
+func (a *Archive) Close() error {
+	return a.f.Close()
+}
+
+// Lookup returns the entry at "p", or nil
+func (a *Archive) Lookup(p string) *Entry {
+	return a.entries[p]
+}
+
+// ReadFile returns the content of the regular file at "p"
+func (a *Archive) ReadFile(p string) ([]byte, error) {
+	e := a.entries[p]
+	if e == nil || !e.Mode.IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	ra, err := e.Open()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.NewSectionReader(ra, 0, e.Size))
+}
+
+// cleanName turns an archive member name like "./foo/bar/" into "foo/bar"
+func cleanName(n string) string {
+	n = path.Clean("/" + n)
+	return strings.TrimPrefix(n, "/")
+}
+
+// findRoot returns the shortest directory that contains gocryptfs.conf or,
+// failing that, gocryptfs.diriv. Returns "" if there is neither.
+func findRoot(raw map[string]*Entry) string {
+	for _, marker := range []string{configfile.ConfDefaultName, nametransform.DirIVFilename} {
+		root := ""
+		found := false
+		for name := range raw {
+			if path.Base(name) != marker {
+				continue
+			}
+			dir := path.Dir(name)
+			if dir == "." {
+				dir = ""
+			}
+			if !found || len(dir) < len(root) {
+				root = dir
+				found = true
+			}
+		}
+		if found {
+			return root
+		}
+	}
+	return ""
+}
+
+// linkDirs creates missing parent directories and fills in the Children
+// lists. Archives do not have to contain entries for directories.
+func (a *Archive) linkDirs() {
+	if a.entries[""] == nil {
+		a.entries[""] = &Entry{Mode: os.ModeDir | 0755}
+	}
+	var names []string
+	for name := range a.entries {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		for name != "" {
+			dir := path.Dir(name)
+			if dir == "." {
+				dir = ""
+			}
+			if a.entries[dir] == nil {
+				a.entries[dir] = &Entry{Mode: os.ModeDir | 0755}
+			}
+			name = dir
+		}
+	}
+	for name := range a.entries {
+		if name == "" {
+			continue
+		}
+		dir := path.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		d := a.entries[dir]
+		d.Children = append(d.Children, path.Base(name))
+	}
+	for _, e := range a.entries {
+		sort.Strings(e.Children)
+	}
+}
+
+// countingReader counts the bytes read, so we know where the data of each
+// tar member starts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func loadTar(f *os.File, raw map[string]*Entry) error {
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		e := &Entry{
+			Mode:  os.FileMode(hdr.Mode).Perm(),
+			Size:  hdr.Size,
+			Mtime: hdr.ModTime,
+			Uid:   hdr.Uid,
+			Gid:   hdr.Gid,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.Mode |= os.ModeDir
+			e.Size = 0
+		case tar.TypeSymlink:
+			e.Mode |= os.ModeSymlink
+			e.Linkname = hdr.Linkname
+			e.Size = 0
+		case tar.TypeLink:
+			target := raw[cleanName(hdr.Linkname)]
+			if target == nil {
+				tlog.Warn.Printf("archive: ignoring hard link %q to unknown target %q", hdr.Name, hdr.Linkname)
+				continue
+			}
+			raw[name] = target
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			if hdr.Size == 0 {
+				break
+			}
+			// The data follows the header, so we can read it in place
+			off, size := cr.n, hdr.Size
+			e.open = func() (io.ReaderAt, error) {
+				return io.NewSectionReader(f, off, size), nil
+			}
+		case tar.TypeGNUSparse:
+			// The data is not stored in one piece. Expand it into memory.
+			buf, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			e.Size = int64(len(buf))
+			e.open = func() (io.ReaderAt, error) {
+				return bytes.NewReader(buf), nil
+			}
+		default:
+			tlog.Warn.Printf("archive: ignoring %q of unsupported type %q", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		raw[name] = e
+	}
+}
+
+func loadZip(f *os.File, raw map[string]*Entry) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	for _, zf := range zr.File {
+		zf := zf
+		mode := zf.Mode()
+		e := &Entry{
+			Mode:  mode & (os.ModePerm | os.ModeDir | os.ModeSymlink),
+			Size:  int64(zf.UncompressedSize64),
+			Mtime: zf.ModTime(),
+			Uid:   uid,
+			Gid:   gid,
+		}
+		switch {
+		case mode.IsDir():
+			e.Size = 0
+		case mode&os.ModeSymlink != 0:
+			// The link target is stored as the content
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			target, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			e.Linkname = string(target)
+			e.Size = 0
+		case mode.IsRegular():
+			if zf.Method == zip.Store {
+				off, err := zf.DataOffset()
+				if err != nil {
+					return err
+				}
+				size := e.Size
+				e.open = func() (io.ReaderAt, error) {
+					return io.NewSectionReader(f, off, size), nil
+				}
+			} else {
+				// Compressed data cannot be read at random offsets.
+				// Decompress the whole file on open.
+				e.open = func() (io.ReaderAt, error) {
+					rc, err := zf.Open()
+					if err != nil {
+						return nil, err
+					}
+					defer rc.Close()
+					buf, err := ioutil.ReadAll(rc)
+					if err != nil {
+						return nil, err
+					}
+					return bytes.NewReader(buf), nil
+				}
+			}
+		default:
+			tlog.Warn.Printf("archive: ignoring %q of unsupported type %v", zf.Name, mode)
+			continue
+		}
+		raw[cleanName(zf.Name)] = e
+	}
+	return nil
+}
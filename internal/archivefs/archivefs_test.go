@@ -0,0 +1,294 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+func newCrypto() (*contentenc.ContentEnc, *nametransform.NameTransform) {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	return contentenc.New(cCore, contentenc.DefaultBS, false), nametransform.New(cCore.EMECipher, true, true)
+}
+
+var longName = strings.Repeat("L", 200)
+
+// makeCipherdir creates an encrypted tree in "dir" using fusefrontend and
+// returns the plaintext content of the regular files.
+func makeCipherdir(t *testing.T, dir string) map[string][]byte {
+	if err := nametransform.WriteDirIV(nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	cEnc, nt := newCrypto()
+	fs := fusefrontend.NewFS(fusefrontend.Args{Cipherdir: dir}, cEnc, nt)
+	if status := fs.Mkdir("sub", 0755, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	big := make([]byte, 100000)
+	rand.Read(big)
+	files := map[string][]byte{
+		"empty":           nil,
+		"sub/big":         big,
+		"sub/small":       []byte("hello world"),
+		longName:          []byte("long name"),
+		"sub/" + longName: []byte("long name in subdir"),
+	}
+	for name, content := range files {
+		f, status := fs.Create(name, uint32(os.O_RDWR), 0640, nil)
+		if !status.Ok() {
+			t.Fatalf("Create %q: %v", name, status)
+		}
+		for off := 0; off < len(content); off += fuse.MAX_KERNEL_WRITE {
+			end := off + fuse.MAX_KERNEL_WRITE
+			if end > len(content) {
+				end = len(content)
+			}
+			if _, status = f.Write(content[off:end], int64(off)); !status.Ok() {
+				t.Fatal(status)
+			}
+		}
+		f.Release()
+	}
+	if status := fs.Symlink("sub/small", "link", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	return files
+}
+
+// writeTar packs "dir" into a tar file below "prefix"
+func writeTar(t *testing.T, dir string, prefix string, out string) {
+	fd, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	tw := tar.NewWriter(fd)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, _ = os.Readlink(p)
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.Join(prefix, rel)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			content, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(content)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeZip packs "dir" into a zip file using compression "method"
+func writeZip(t *testing.T, dir string, method uint16, out string) {
+	fd, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	zw := zip.NewWriter(fd)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.Method = method
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, _ := os.Readlink(p)
+			_, err = io.WriteString(w, link)
+		case fi.Mode().IsRegular():
+			content, err2 := ioutil.ReadFile(p)
+			if err2 != nil {
+				return err2
+			}
+			_, err = w.Write(content)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, fs *FS, name string) []byte {
+	f, status := fs.Open(name, uint32(os.O_RDONLY), nil)
+	if !status.Ok() {
+		t.Fatalf("Open %q: %v", name, status)
+	}
+	defer f.Release()
+	var out []byte
+	buf := make([]byte, 5000)
+	for {
+		res, status := f.Read(buf, int64(len(out)))
+		if !status.Ok() {
+			t.Fatalf("Read %q: %v", name, status)
+		}
+		data, _ := res.Bytes(buf)
+		out = append(out, data...)
+		if len(data) < len(buf) {
+			return out
+		}
+	}
+}
+
+func checkFS(t *testing.T, fn string, files map[string][]byte) {
+	a, err := Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	cEnc, nt := newCrypto()
+	fs := NewFS(a, fusefrontend.Args{LongNames: true}, cEnc, nt)
+
+	root, status := fs.OpenDir("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	var names []string
+	for _, e := range root {
+		names = append(names, e.Name)
+	}
+	if len(names) != 4 {
+		t.Errorf("wrong root dir content: %v", names)
+	}
+	for name, want := range files {
+		a, status := fs.GetAttr(name, nil)
+		if !status.Ok() {
+			t.Errorf("GetAttr %q: %v", name, status)
+			continue
+		}
+		if a.Size != uint64(len(want)) {
+			t.Errorf("%q: wrong size %d", name, a.Size)
+		}
+		if have := readAll(t, fs, name); !bytes.Equal(have, want) {
+			t.Errorf("%q: content mismatch", name)
+		}
+	}
+	if target, status := fs.Readlink("link", nil); target != "sub/small" {
+		t.Errorf("Readlink: %q %v", target, status)
+	}
+	if _, status := fs.Open("sub/small", uint32(os.O_RDWR), nil); status != fuse.EROFS {
+		t.Errorf("Open O_RDWR: want EROFS, got %v", status)
+	}
+	if _, status := fs.GetAttr("gocryptfs.diriv", nil); status != fuse.ENOENT {
+		t.Errorf("gocryptfs.diriv should be hidden, got %v", status)
+	}
+	cPath, err := fs.EncryptPath("sub/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pPath, err := fs.DecryptPath(cPath); pPath != "sub/small" {
+		t.Errorf("DecryptPath: %q %v", pPath, err)
+	}
+	if _, err := fs.EncryptPath("nonexistent"); err != syscall.ENOENT {
+		t.Errorf("EncryptPath: want ENOENT, got %v", err)
+	}
+}
+
+func TestArchives(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "TestArchives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cDir := filepath.Join(tmp, "cipher")
+	os.Mkdir(cDir, 0700)
+	files := makeCipherdir(t, cDir)
+	// A config file marks the root of the CIPHERDIR inside the archive
+	ioutil.WriteFile(filepath.Join(cDir, "gocryptfs.conf"), []byte("{}"), 0400)
+
+	fn := filepath.Join(tmp, "a.tar")
+	writeTar(t, cDir, "backup/2020", fn)
+	a, err := Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Root != "backup/2020" {
+		t.Errorf("wrong root %q", a.Root)
+	}
+	if js, err := a.ReadFile("gocryptfs.conf"); string(js) != "{}" {
+		t.Errorf("ReadFile: %q %v", js, err)
+	}
+	a.Close()
+	checkFS(t, fn, files)
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		fn := filepath.Join(tmp, fmt.Sprintf("method%d.zip", method))
+		writeZip(t, cDir, method, fn)
+		checkFS(t, fn, files)
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "TestIsArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ioutil.WriteFile(filepath.Join(tmp, "x.TAR"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(tmp, "x.txt"), nil, 0600)
+	os.Mkdir(filepath.Join(tmp, "d.zip"), 0700)
+	testCases := map[string]bool{
+		"x.TAR":   true,
+		"x.txt":   false,
+		"d.zip":   false,
+		"missing": false,
+	}
+	for name, want := range testCases {
+		if have := IsArchive(filepath.Join(tmp, name)); have != want {
+			t.Errorf("%s: want %v, have %v", name, want, have)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package archivefs
+
+import (
+	"io"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// file is an open regular file inside the archive
+type file struct {
+	// Returns ENOSYS for everything we do not implement
+	nodefs.File
+	fs *FS
+	nd *node
+	ra io.ReaderAt
+	// fileID from the header, nil if the file is empty
+	fileID []byte
+}
+
+func newFile(fs *FS, nd *node) (nodefs.File, fuse.Status) {
+	ra, err := nd.entry.Open()
+	if err != nil {
+		tlog.Warn.Printf("archive: open %q: %v", nd.cPath, err)
+		return nil, fuse.EIO
+	}
+	f := &file{File: nodefs.NewDefaultFile(), fs: fs, nd: nd, ra: ra}
+	// Header-only files count as empty, like in fusefrontend
+	if nd.entry.Size > contentenc.HeaderLen {
+		buf := make([]byte, contentenc.HeaderLen)
+		if _, err = ra.ReadAt(buf, 0); err != nil {
+			tlog.Warn.Printf("archive: %q: reading header: %v", nd.cPath, err)
+			return nil, fuse.EIO
+		}
+		h, err := contentenc.ParseHeader(buf)
+		if err != nil {
+			tlog.Warn.Printf("archive: %q: corrupt header: %v", nd.cPath, err)
+			return nil, fuse.EIO
+		}
+		f.fileID = h.ID
+	}
+	return f, fuse.OK
+}
+
+// Read implements nodefs.File
+func (f *file) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if f.fileID == nil || len(buf) == 0 {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	cEnc := f.fs.contentEnc
+	blocks := cEnc.ExplodePlainRange(uint64(off), uint64(len(buf)))
+	cOff, cLen := blocks[0].JointCiphertextRange(blocks)
+	ciphertext := make([]byte, cLen)
+	n, err := f.ra.ReadAt(ciphertext, int64(cOff))
+	if err != nil && err != io.EOF {
+		tlog.Warn.Printf("archive: %q: read: %v", f.nd.cPath, err)
+		return nil, fuse.EIO
+	}
+	if n == 0 {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	plaintext, err := cEnc.DecryptBlocks(ciphertext[:n], blocks[0].BlockNo, f.fileID)
+	if err != nil {
+		tlog.Warn.Printf("archive: %q: corrupt block: %v", f.nd.cPath, err)
+		return nil, fuse.EIO
+	}
+	skip := int(blocks[0].Skip)
+	if skip >= len(plaintext) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	plaintext = plaintext[skip:]
+	if len(plaintext) > len(buf) {
+		plaintext = plaintext[:len(buf)]
+	}
+	return fuse.ReadResultData(plaintext), fuse.OK
+}
+
+// GetAttr implements nodefs.File
+func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
+	*a = *f.fs.attr(f.nd)
+	return fuse.OK
+}
+
+// Flush implements nodefs.File. There is nothing to write back.
+func (f *file) Flush() fuse.Status {
+	return fuse.OK
+}
+
+// Release implements nodefs.File
+func (f *file) Release() {}
+
+// Fsync implements nodefs.File
+func (f *file) Fsync(flags int) fuse.Status {
+	return fuse.OK
+}
+
+// String implements nodefs.File
+func (f *file) String() string {
+	return "archivefs.file(" + f.nd.cPath + ")"
+}
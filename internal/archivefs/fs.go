@@ -0,0 +1,296 @@
+package archivefs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// node is a decrypted entry of the archive
+type node struct {
+	cPath string
+	entry *Entry
+	ino   uint64
+	// children of a directory, in archive order
+	children []fuse.DirEntry
+}
+
+// FS is the read-only plaintext view of an archive. All names are
+// decrypted when it is created, so lookups do not need any crypto.
+type FS struct {
+	// Returns ENOSYS for everything we do not implement
+	pathfs.FileSystem
+	archive       *Archive
+	args          fusefrontend.Args
+	contentEnc    *contentenc.ContentEnc
+	nameTransform *nametransform.NameTransform
+	// nodes maps plaintext paths to nodes
+	nodes map[string]*node
+	// plainPaths maps ciphertext paths to plaintext paths
+	plainPaths map[string]string
+}
+
+var _ pathfs.FileSystem = &FS{}
+var _ ctlsock.Interface = &FS{}
+
+// NewFS returns the plaintext view of archive "a". Entries whose names
+// cannot be decrypted are skipped with a warning.
+func NewFS(a *Archive, args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransform.NameTransform) *FS {
+	fs := &FS{
+		FileSystem:    pathfs.NewDefaultFileSystem(),
+		archive:       a,
+		args:          args,
+		contentEnc:    c,
+		nameTransform: n,
+		nodes:         make(map[string]*node),
+		plainPaths:    make(map[string]string),
+	}
+	fs.add("", "", a.Lookup(""))
+	return fs
+}
+
+// add inserts the entry "e" and, if it is a directory, its children
+func (fs *FS) add(pPath string, cPath string, e *Entry) {
+	nd := &node{cPath: cPath, entry: e, ino: uint64(len(fs.nodes) + 1)}
+	fs.nodes[pPath] = nd
+	fs.plainPaths[cPath] = pPath
+	if !e.Mode.IsDir() {
+		return
+	}
+	var iv []byte
+	if !fs.args.PlaintextNames {
+		var err error
+		iv, err = fs.archive.ReadFile(path.Join(cPath, nametransform.DirIVFilename))
+		if err != nil || len(iv) != nametransform.DirIVLen {
+			tlog.Warn.Printf("archive: directory %q has no valid %s, skipping its contents",
+				cPath, nametransform.DirIVFilename)
+			return
+		}
+	}
+	for _, cName := range e.Children {
+		pName, err := fs.decryptName(cPath, cName, iv)
+		if err != nil {
+			tlog.Warn.Printf("archive: invalid entry %q in %q: %v", cName, cPath, err)
+			continue
+		}
+		if pName == "" {
+			continue
+		}
+		child := fs.archive.Lookup(path.Join(cPath, cName))
+		nd.children = append(nd.children, fuse.DirEntry{Name: pName, Mode: fuseMode(child.Mode)})
+		fs.add(path.Join(pPath, pName), path.Join(cPath, cName), child)
+	}
+}
+
+// decryptName returns the plaintext name of "cName" in directory "cDir",
+// or "" if the entry is internal to gocryptfs and should be hidden.
+func (fs *FS) decryptName(cDir string, cName string, iv []byte) (string, error) {
+	if cDir == "" && cName == configfile.ConfDefaultName {
+		return "", nil
+	}
+	if fs.args.PlaintextNames {
+		return cName, nil
+	}
+	if cName == nametransform.DirIVFilename {
+		return "", nil
+	}
+	if fs.args.LongNames {
+		switch nametransform.NameType(cName) {
+		case nametransform.LongNameFilename:
+			return "", nil
+		case nametransform.LongNameContent:
+			content, err := fs.archive.ReadFile(path.Join(cDir, cName+nametransform.LongNameSuffix))
+			if err != nil {
+				return "", err
+			}
+			cNameLong, salt, err := nametransform.ParseLongName(string(content))
+			if err != nil {
+				return "", err
+			}
+			if fs.nameTransform.HashLongNameSalt(cNameLong, salt) != cName {
+				return "", fmt.Errorf("hash does not match .name content (salt %d)", salt)
+			}
+			cName = cNameLong
+		}
+	}
+	return fs.nameTransform.DecryptName(cName, iv)
+}
+
+// fuseMode converts os.FileMode type bits to S_IF* bits
+func fuseMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= syscall.S_IFDIR
+	case m&os.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	return mode
+}
+
+// attr builds the plaintext attributes of "nd"
+func (fs *FS) attr(nd *node) *fuse.Attr {
+	e := nd.entry
+	a := &fuse.Attr{
+		Ino:   nd.ino,
+		Mode:  fuseMode(e.Mode),
+		Nlink: 1,
+		Owner: fuse.Owner{Uid: uint32(e.Uid), Gid: uint32(e.Gid)},
+	}
+	switch {
+	case e.Mode.IsDir():
+		a.Nlink = 2
+	case e.Mode&os.ModeSymlink != 0:
+		if target, err := fs.readlink(nd); err == nil {
+			a.Size = uint64(len(target))
+		}
+	default:
+		a.Size = fs.contentEnc.CipherSizeToPlainSize(uint64(e.Size))
+	}
+	a.Blocks = (a.Size + 511) / 512
+	a.SetTimes(&e.Mtime, &e.Mtime, &e.Mtime)
+	if fs.args.ForceOwner != nil {
+		a.Owner = *fs.args.ForceOwner
+	}
+	return a
+}
+
+// GetAttr implements pathfs.FileSystem
+func (fs *FS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	nd := fs.nodes[relPath]
+	if nd == nil {
+		return nil, fuse.ENOENT
+	}
+	return fs.attr(nd), fuse.OK
+}
+
+// OpenDir implements pathfs.FileSystem
+func (fs *FS) OpenDir(relPath string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	nd := fs.nodes[relPath]
+	if nd == nil {
+		return nil, fuse.ENOENT
+	}
+	if !nd.entry.Mode.IsDir() {
+		return nil, fuse.ENOTDIR
+	}
+	return nd.children, fuse.OK
+}
+
+// Open implements pathfs.FileSystem
+func (fs *FS) Open(relPath string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, fuse.EROFS
+	}
+	nd := fs.nodes[relPath]
+	if nd == nil {
+		return nil, fuse.ENOENT
+	}
+	if !nd.entry.Mode.IsRegular() {
+		return nil, fuse.EINVAL
+	}
+	return newFile(fs, nd)
+}
+
+// readlink decrypts the target of symlink "nd"
+func (fs *FS) readlink(nd *node) (string, error) {
+	cTarget := nd.entry.Linkname
+	if fs.args.PlaintextNames || cTarget == "" {
+		return cTarget, nil
+	}
+	// Symlinks are encrypted like file contents (GCM) and base64-encoded
+	cData, err := fs.nameTransform.B64.DecodeString(cTarget)
+	if err != nil {
+		return "", err
+	}
+	data, err := fs.contentEnc.DecryptBlock(cData, 0, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Readlink implements pathfs.FileSystem
+func (fs *FS) Readlink(relPath string, context *fuse.Context) (string, fuse.Status) {
+	nd := fs.nodes[relPath]
+	if nd == nil {
+		return "", fuse.ENOENT
+	}
+	if nd.entry.Mode&os.ModeSymlink == 0 {
+		return "", fuse.EINVAL
+	}
+	target, err := fs.readlink(nd)
+	if err != nil {
+		tlog.Warn.Printf("Readlink %q: decrypting target failed: %v", nd.cPath, err)
+		return "", fuse.EIO
+	}
+	return target, fuse.OK
+}
+
+// Access implements pathfs.FileSystem
+func (fs *FS) Access(relPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.nodes[relPath] == nil {
+		return fuse.ENOENT
+	}
+	if mode&unix.W_OK != 0 {
+		return fuse.EROFS
+	}
+	return fuse.OK
+}
+
+// StatFs implements pathfs.FileSystem. It reports the plaintext size of
+// the archive contents as used space.
+func (fs *FS) StatFs(relPath string) *fuse.StatfsOut {
+	bs := fs.contentEnc.PlainBS()
+	var used uint64
+	for _, nd := range fs.nodes {
+		if nd.entry.Mode.IsRegular() {
+			used += (fs.contentEnc.CipherSizeToPlainSize(uint64(nd.entry.Size)) + bs - 1) / bs
+		}
+	}
+	return &fuse.StatfsOut{
+		Blocks:  used,
+		Files:   uint64(len(fs.nodes)),
+		Bsize:   uint32(bs),
+		Frsize:  uint32(bs),
+		NameLen: 255,
+	}
+}
+
+// String implements pathfs.FileSystem
+func (fs *FS) String() string {
+	return "archivefs"
+}
+
+// EncryptPath implements ctlsock.Interface
+func (fs *FS) EncryptPath(plainPath string) (string, error) {
+	nd := fs.nodes[plainPath]
+	if nd == nil {
+		return "", syscall.ENOENT
+	}
+	return nd.cPath, nil
+}
+
+// DecryptPath implements ctlsock.Interface
+func (fs *FS) DecryptPath(cipherPath string) (string, error) {
+	pPath, ok := fs.plainPaths[cipherPath]
+	if !ok {
+		return "", syscall.ENOENT
+	}
+	return pPath, nil
+}
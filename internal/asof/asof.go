@@ -0,0 +1,171 @@
+// Package asof implements "-as-of": a read-only view of CIPHERDIR as it was
+// at a point in time, composed from the versioned copies that the backing
+// store keeps of each file.
+//
+// The versions are expected in the format that rclone uses to expose the
+// object versioning of S3 and B2 ("--s3-versions", "--b2-versions"): the
+// old versions of "name.ext" show up next to it as
+// "name-v2006-01-02-150405-000.ext", where the timestamp is in UTC. The
+// current file counts as the version from its modification time.
+// Directories are not versioned.
+package asof
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// versionLayout is the time format in version names
+const versionLayout = "2006-01-02-150405.000"
+
+// versionRe matches a version name and captures the name without the
+// extension, the timestamp, and the extension
+var versionRe = regexp.MustCompile(`^(.+)-v(\d{4}-\d{2}-\d{2}-\d{6}-\d{3})(\.[^.]*)?$`)
+
+// maxCachedDirs limits the memory used for the directory cache
+const maxCachedDirs = 10000
+
+// View selects the file versions that were current at a point in time
+type View struct {
+	t time.Time
+
+	lock sync.Mutex
+	// dirs caches the selection for each absolute ciphertext directory
+	// path: file name -> name of the selected version
+	dirs map[string]map[string]string
+}
+
+// New returns a View of the state at time "t"
+func New(t time.Time) *View {
+	return &View{
+		t:    t,
+		dirs: make(map[string]map[string]string),
+	}
+}
+
+// ParseVersion splits a version name into the name of the file it belongs
+// to and the version timestamp. Returns ok=false if "name" is not a version
+// name.
+func ParseVersion(name string) (base string, t time.Time, ok bool) {
+	m := versionRe.FindStringSubmatch(name)
+	if m == nil {
+		return "", time.Time{}, false
+	}
+	// "2006-01-02-150405-000" -> "2006-01-02-150405.000"
+	ts := m[2][:len(m[2])-4] + "." + m[2][len(m[2])-3:]
+	t, err := time.Parse(versionLayout, ts)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return m[1] + m[3], t, true
+}
+
+// dir returns the selection for the absolute ciphertext directory "cDirAbs"
+func (v *View) dir(cDirAbs string) (map[string]string, error) {
+	v.lock.Lock()
+	sel := v.dirs[cDirAbs]
+	v.lock.Unlock()
+	if sel != nil {
+		return sel, nil
+	}
+	f, err := os.Open(cDirAbs)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sel = make(map[string]string)
+	// best holds the timestamp of the selected version of each file
+	best := make(map[string]time.Time)
+	for _, name := range names {
+		fi, err := os.Lstat(filepath.Join(cDirAbs, name))
+		if err != nil {
+			continue
+		}
+		base, t, ok := ParseVersion(name)
+		if !ok || fi.IsDir() {
+			base = name
+			t = fi.ModTime()
+		}
+		if fi.IsDir() {
+			// Directories are always there
+			sel[base] = name
+			best[base] = time.Time{}
+			continue
+		}
+		if t.After(v.t) {
+			continue
+		}
+		if old, ok := best[base]; ok && !t.After(old) {
+			continue
+		}
+		sel[base] = name
+		best[base] = t
+	}
+	v.lock.Lock()
+	if len(v.dirs) >= maxCachedDirs {
+		v.dirs = make(map[string]map[string]string)
+	}
+	v.dirs[cDirAbs] = sel
+	v.lock.Unlock()
+	return sel, nil
+}
+
+// Translate maps the relative ciphertext path "cPath" below "cipherdir" to
+// the path of the selected version. Returns ENOENT if the file did not
+// exist at the time. A nil View returns "cPath" unchanged.
+func (v *View) Translate(cipherdir string, cPath string) (string, error) {
+	if v == nil || cPath == "" {
+		return cPath, nil
+	}
+	parts := strings.Split(cPath, "/")
+	dir := cipherdir
+	for i, p := range parts {
+		sel, err := v.dir(dir)
+		if err != nil {
+			return "", err
+		}
+		actual, ok := sel[p]
+		if !ok {
+			return "", syscall.ENOENT
+		}
+		parts[i] = actual
+		dir = filepath.Join(dir, actual)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// Filter replaces the entries of the absolute ciphertext directory
+// "cDirAbs" with the files that existed at the time, under their normal
+// names. A nil View returns "entries" unchanged.
+func (v *View) Filter(cDirAbs string, entries []fuse.DirEntry) ([]fuse.DirEntry, error) {
+	if v == nil {
+		return entries, nil
+	}
+	sel, err := v.dir(cDirAbs)
+	if err != nil {
+		return nil, err
+	}
+	bases := make(map[string]string, len(sel))
+	for base, actual := range sel {
+		bases[actual] = base
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if base, ok := bases[e.Name]; ok {
+			e.Name = base
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package asof
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestParseVersion(t *testing.T) {
+	base, ts, ok := ParseVersion("foo-v2001-02-03-040506-789.txt")
+	if !ok || base != "foo.txt" || !ts.Equal(time.Date(2001, 2, 3, 4, 5, 6, 789e6, time.UTC)) {
+		t.Errorf("have %q %v %v", base, ts, ok)
+	}
+	base, _, ok = ParseVersion("gocryptfs.longname-v2001-02-03-040506-789.AbC")
+	if !ok || base != "gocryptfs.longname.AbC" {
+		t.Errorf("have %q %v", base, ok)
+	}
+	base, _, ok = ParseVersion("AbCd-v2001-02-03-040506-789")
+	if !ok || base != "AbCd" {
+		t.Errorf("have %q %v", base, ok)
+	}
+	for _, n := range []string{"foo", "foo.txt", "-v2001-02-03-040506-789", "foo-v2001-13-03-040506-789"} {
+		if _, _, ok := ParseVersion(n); ok {
+			t.Errorf("%q is not a version", n)
+		}
+	}
+}
+
+func TestView(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestView")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := map[string]time.Time{
+		// Current version of "a", modified at t0+3h
+		"a":                        t0.Add(3 * time.Hour),
+		"a-v2020-01-01-010000-000": t0,
+		"a-v2020-01-01-020000-000": t0,
+		// Created after the view time
+		"new": t0.Add(3 * time.Hour),
+		// Deleted after the view time
+		"gone-v2020-01-01-003000-000": t0,
+	}
+	for name, mtime := range files {
+		if err = ioutil.WriteFile(dir+"/"+name, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(dir+"/"+name, mtime, mtime)
+	}
+	os.Mkdir(dir+"/d", 0700)
+	v := New(t0.Add(90 * time.Minute))
+	want := map[string]string{
+		"a":    "a-v2020-01-01-010000-000",
+		"gone": "gone-v2020-01-01-003000-000",
+		"d":    "d",
+	}
+	for name, w := range want {
+		if have, err := v.Translate(dir, name); have != w || err != nil {
+			t.Errorf("%q: have %q %v, want %q", name, have, err, w)
+		}
+	}
+	if _, err = v.Translate(dir, "new"); err != syscall.ENOENT {
+		t.Errorf("new: want ENOENT, have %v", err)
+	}
+	var entries []fuse.DirEntry
+	for name := range files {
+		entries = append(entries, fuse.DirEntry{Name: name})
+	}
+	entries = append(entries, fuse.DirEntry{Name: "d"})
+	entries, err = v.Filter(dir, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Errorf("wrong entries: %v", entries)
+	}
+	for _, e := range entries {
+		if _, ok := want[e.Name]; !ok {
+			t.Errorf("unexpected entry %q", e.Name)
+		}
+	}
+	// A nil View changes nothing
+	var nilView *View
+	if p, _ := nilView.Translate(dir, "new"); p != "new" {
+		t.Error("nil View translated the path")
+	}
+}
@@ -0,0 +1,88 @@
+package configfile
+
+import (
+	"os"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// Argon2idDefaultTime is the default number of passes over the memory.
+	// Together with the memory default this follows the second recommended
+	// option from the Argon2 RFC draft.
+	Argon2idDefaultTime = 3
+	// Argon2idDefaultMemory is the default memory usage in KiB (64 MiB).
+	Argon2idDefaultMemory = 64 * 1024
+	// Argon2idDefaultThreads is the default degree of parallelism.
+	Argon2idDefaultThreads = 4
+	// We reject all lower values that we might get through modified config
+	// files.
+	argon2idMinTime    = 1
+	argon2idMinMemory  = 8 * 1024
+	argon2idMinThreads = 1
+	// We always generate 32-byte salts. Anything smaller than that is rejected.
+	argon2idMinSaltLen = 32
+)
+
+// Argon2idKDF is an instance of the Argon2id key deriviation function.
+type Argon2idKDF struct {
+	// Salt is the random salt that is passed to Argon2id
+	Salt []byte
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the memory usage in KiB
+	Memory uint32
+	// Threads is the degree of parallelism
+	Threads uint8
+	// KeyLen is the output data length
+	KeyLen uint32
+}
+
+// NewArgon2idKDF returns a new instance of Argon2idKDF with the default
+// parameters.
+func NewArgon2idKDF() *Argon2idKDF {
+	return &Argon2idKDF{
+		Salt:    cryptocore.RandBytes(cryptocore.KeyLen),
+		Time:    Argon2idDefaultTime,
+		Memory:  Argon2idDefaultMemory,
+		Threads: Argon2idDefaultThreads,
+		KeyLen:  cryptocore.KeyLen,
+	}
+}
+
+// DeriveKey returns a new key from a supplied password.
+func (a *Argon2idKDF) DeriveKey(pw []byte) []byte {
+	a.validateParams()
+	return argon2.IDKey(pw, a.Salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+}
+
+// validateParams checks that all parameters are at or above hardcoded limits.
+// If not, it exists with an error message.
+// This makes sure we do not get weak parameters passed through a
+// rougue gocryptfs.conf.
+func (a *Argon2idKDF) validateParams() {
+	if a.Time < argon2idMinTime {
+		tlog.Fatal.Printf("Fatal: argon2id parameter Time below minimum: value=%d, min=%d", a.Time, argon2idMinTime)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if a.Memory < argon2idMinMemory {
+		tlog.Fatal.Printf("Fatal: argon2id parameter Memory below minimum: value=%d, min=%d", a.Memory, argon2idMinMemory)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if a.Threads < argon2idMinThreads {
+		tlog.Fatal.Printf("Fatal: argon2id parameter Threads below minimum: value=%d, min=%d", a.Threads, argon2idMinThreads)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if len(a.Salt) < argon2idMinSaltLen {
+		tlog.Fatal.Printf("Fatal: argon2id salt length below minimum: value=%d, min=%d", len(a.Salt), argon2idMinSaltLen)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if a.KeyLen < cryptocore.KeyLen {
+		tlog.Fatal.Printf("Fatal: argon2id parameter KeyLen below minimum: value=%d, min=%d", a.KeyLen, cryptocore.KeyLen)
+		os.Exit(exitcodes.ScryptParams)
+	}
+}
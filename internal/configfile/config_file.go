@@ -3,11 +3,14 @@
 package configfile
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -38,6 +41,10 @@ type ConfFile struct {
 	EncryptedKey []byte
 	// ScryptObject stores parameters for scrypt hashing (key derivation)
 	ScryptObject ScryptKDF
+	// Argon2idObject stores parameters for Argon2id hashing. If it is set
+	// (together with the "Argon2id" feature flag), it is used instead of
+	// ScryptObject.
+	Argon2idObject *Argon2idKDF `json:",omitempty"`
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
@@ -45,10 +52,61 @@ type ConfFile struct {
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
 	// stored in the superblock.
 	FeatureFlags []string
+	// BlockSize is the plaintext block size for file content encryption.
+	// Only set (together with the "BlockSize" feature flag) if it differs
+	// from contentenc.DefaultBS.
+	BlockSize uint64 `json:",omitempty"`
+	// Expiry is the time (Unix seconds) after which mounting is refused
+	// unless explicitly overridden. Only set together with the "Expiry"
+	// feature flag.
+	Expiry int64 `json:",omitempty"`
+	// FIDO2 stores the FIDO2 credential whose hmac-secret is used as the
+	// password. Only set together with the "FIDO2" feature flag.
+	FIDO2 *FIDO2Params `json:",omitempty"`
+	// DuressObject stores the hash of the duress password. Only set together
+	// with the "Duress" feature flag.
+	DuressObject *DuressSlot `json:",omitempty"`
+	// TPM2Object stores a copy of the master key that is sealed to the
+	// local TPM. It is optional and needs no feature flag because the
+	// password-encrypted EncryptedKey keeps working.
+	TPM2Object *TPM2Params `json:",omitempty"`
+	// Policy lists per-file options like caching and preallocation, see
+	// PolicyRule. Edited by hand.
+	Policy []PolicyRule `json:",omitempty"`
+	// Limits restricts file sizes, names and directory depth, see Limits.
+	// Edited by hand.
+	Limits *Limits `json:",omitempty"`
+	// Passthrough lists file names, like ".nomedia" or "desktop.ini", that
+	// are stored unencrypted and under their plaintext name, in every
+	// directory. Edited by hand.
+	Passthrough []string `json:",omitempty"`
+	// Profile is the name of the profile that was selected with
+	// "-init -profile". Only documents the choice for "-info".
+	Profile string `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
 
+// FIDO2Params identifies the FIDO2 credential and the hmac-secret salt
+// that is used to get the password.
+type FIDO2Params struct {
+	// CredentialID is the credential ID returned by the authenticator
+	CredentialID []byte
+	// HMACSalt is the salt passed to the hmac-secret extension
+	HMACSalt []byte
+}
+
+// TPM2Params is a master key copy that is sealed to a TPM 2.0.
+type TPM2Params struct {
+	// Public is the public part of the sealed object (TPM2B_PUBLIC)
+	Public []byte
+	// Private is the private part of the sealed object (TPM2B_PRIVATE)
+	Private []byte
+	// PCRs is the PCR selection the object is bound to, like "sha256:0,7".
+	// Empty if not bound to PCRs.
+	PCRs string `json:",omitempty"`
+}
+
 // randBytesDevRandom gets "n" random bytes from /dev/random or panics
 func randBytesDevRandom(n int) []byte {
 	f, err := os.Open("/dev/random")
@@ -64,19 +122,56 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateArgs exists because the argument list to CreateConfFile became
+// too long.
+type CreateArgs struct {
+	Filename       string
+	Password       []byte
+	PlaintextNames bool
+	// LogN is the scrypt cost parameter
+	LogN    int
+	Creator string
+	// KDF is the password hashing algorithm, "scrypt" (default) or
+	// "argon2id"
+	KDF     string
+	AESSIV  bool
+	XChaCha bool
+	// BlockSize is the plaintext block size. Zero means contentenc.DefaultBS.
+	BlockSize uint64
+	// Expiry is the expiry time in Unix seconds. Zero means never.
+	Expiry int64
+	// FIDO2 is the FIDO2 credential if the password is a FIDO2 hmac-secret
+	FIDO2 *FIDO2Params
+	// DualControl marks the password as combined from two secrets
+	DualControl bool
+	// DuressPassword is the optional duress password, see SetDuressPassword()
+	DuressPassword []byte
+	// DevRandom makes us read the master key from /dev/random
+	DevRandom bool
+	// ExternalHeaders stores the file headers in an xattr
+	ExternalHeaders bool
+	// Passthrough lists file names, like ".nomedia" or "desktop.ini", that
+	// are stored unencrypted and under their plaintext name, in every
+	// directory. Edited by hand.
+	Passthrough []string `json:",omitempty"`
+	// Profile is the name of the profile the settings were taken from
+	Profile string
+}
+
 // CreateConfFile - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func CreateConfFile(filename string, password []byte, plaintextNames bool, logN int, creator string, aessiv bool, devrandom bool) error {
+// "a.Password" and write it to "a.Filename".
+// Uses scrypt with cost parameter "a.LogN".
+func CreateConfFile(a *CreateArgs) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = a.Filename
+	cf.Creator = a.Creator
+	cf.Profile = a.Profile
 	cf.Version = contentenc.CurrentVersion
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if a.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
@@ -84,13 +179,44 @@ func CreateConfFile(filename string, password []byte, plaintextNames bool, logN
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
 	}
-	if aessiv {
+	if a.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
+	switch a.KDF {
+	case "", KDFScrypt:
+	case KDFArgon2id:
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagArgon2id])
+	default:
+		return fmt.Errorf("unknown KDF %q", a.KDF)
+	}
+	if a.XChaCha {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXChaCha20Poly1305])
+	}
+	if a.BlockSize != 0 && a.BlockSize != contentenc.DefaultBS {
+		if err := contentenc.CheckBlockSize(a.BlockSize); err != nil {
+			return err
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagBlockSize])
+		cf.BlockSize = a.BlockSize
+	}
+	cf.SetExpiry(a.Expiry)
+	if a.FIDO2 != nil {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFIDO2])
+		cf.FIDO2 = a.FIDO2
+	}
+	if a.DualControl {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDualControl])
+	}
+	if a.ExternalHeaders {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagExternalHeaders])
+	}
+	if len(a.DuressPassword) > 0 {
+		cf.SetDuressPassword(a.DuressPassword, a.LogN)
+	}
 	{
 		// Generate new random master key
 		var key []byte
-		if devrandom {
+		if a.DevRandom {
 			key = randBytesDevRandom(cryptocore.KeyLen)
 		} else {
 			key = cryptocore.RandBytes(cryptocore.KeyLen)
@@ -98,7 +224,7 @@ func CreateConfFile(filename string, password []byte, plaintextNames bool, logN
 		// Encrypt it using the password
 		// This sets ScryptObject and EncryptedKey
 		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		cf.EncryptKey(key, password, logN)
+		cf.EncryptKey(key, a.Password, a.LogN)
 		for i := range key {
 			key[i] = 0
 		}
@@ -115,6 +241,18 @@ func CreateConfFile(filename string, password []byte, plaintextNames bool, logN
 // If "password" is empty, the config file is read
 // but the key is not decrypted (returns nil in its place).
 func LoadConfFile(filename string, password []byte) ([]byte, *ConfFile, error) {
+	return loadConfFile(filename, password, true)
+}
+
+// LoadConfFileNoDuress works like LoadConfFile, but the duress password is
+// treated like any other incorrect password and does not destroy the key.
+// Use it where the password does not come from the user at the terminal,
+// like the changepasswd control socket command.
+func LoadConfFileNoDuress(filename string, password []byte) ([]byte, *ConfFile, error) {
+	return loadConfFile(filename, password, false)
+}
+
+func loadConfFile(filename string, password []byte, duress bool) ([]byte, *ConfFile, error) {
 	var cf ConfFile
 	cf.filename = filename
 
@@ -143,6 +281,46 @@ func LoadConfFile(filename string, password []byte) ([]byte, *ConfFile, error) {
 		}
 	}
 
+	// Check that the KDF parameters match the feature flags
+	if cf.IsFeatureFlagSet(FlagArgon2id) != (cf.Argon2idObject != nil) {
+		return nil, nil, fmt.Errorf("Argon2idObject and the %q feature flag must be set together", knownFlags[FlagArgon2id])
+	}
+
+	// Check the block size
+	if cf.IsFeatureFlagSet(FlagBlockSize) {
+		if err = contentenc.CheckBlockSize(cf.BlockSize); err != nil {
+			return nil, nil, err
+		}
+	} else if cf.BlockSize != 0 {
+		return nil, nil, fmt.Errorf("BlockSize is set but the %q feature flag is not", knownFlags[FlagBlockSize])
+	}
+
+	// Check the FIDO2 credential
+	if cf.IsFeatureFlagSet(FlagFIDO2) != (cf.FIDO2 != nil) {
+		return nil, nil, fmt.Errorf("FIDO2 and the %q feature flag must be set together", knownFlags[FlagFIDO2])
+	}
+
+	// Check the duress slot
+	if cf.IsFeatureFlagSet(FlagDuress) != (cf.DuressObject != nil) {
+		return nil, nil, fmt.Errorf("DuressObject and the %q feature flag must be set together", knownFlags[FlagDuress])
+	}
+
+	// Check the expiry time
+	if cf.IsFeatureFlagSet(FlagExpiry) != (cf.Expiry != 0) {
+		return nil, nil, fmt.Errorf("Expiry and the %q feature flag must be set together", knownFlags[FlagExpiry])
+	}
+
+	// Check the per-file policy
+	if err = cf.checkPolicy(); err != nil {
+		return nil, nil, err
+	}
+	if err = cf.checkLimits(); err != nil {
+		return nil, nil, err
+	}
+	if err = cf.checkPassthrough(); err != nil {
+		return nil, nil, err
+	}
+
 	// Check that all required feature flags are set
 	var requiredFlags []flagIota
 	if cf.IsFeatureFlagSet(FlagPlaintextNames) {
@@ -178,41 +356,160 @@ func LoadConfFile(filename string, password []byte) ([]byte, *ConfFile, error) {
 	}
 
 	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	pwHash := cf.deriveKey(password)
 
 	// Unlock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
-	ce := getKeyEncrypter(scryptHash, useHKDF)
+	ce := getKeyEncrypter(pwHash, useHKDF)
+	for i := range pwHash {
+		pwHash[i] = 0
+	}
 
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	key, err := ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	key, err := ce.DecryptBlock(cf.EncryptedKey, 0, cf.keyAD())
 	tlog.Warn.Enabled = true
 	if err != nil {
 		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
+		if duress && cf.isDuressPassword(password) {
+			// Look exactly like an incorrect password to the outside
+			cf.destroyKey()
+		}
 		return nil, nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
 	}
 
 	return key, &cf, err
 }
 
-// EncryptKey - encrypt "key" using an scrypt hash generated from "password"
+// EncryptKey - encrypt "key" using a password hash generated from "password"
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
+// cf.ScryptObject, or, if the "Argon2id" feature flag is set, Argon2id with
+// a fresh salt and the parameters in cf.Argon2idObject (defaults if unset).
 func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
-	// Generate scrypt-derived key from password
-	cf.ScryptObject = NewScryptKDF(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		a := NewArgon2idKDF()
+		if old := cf.Argon2idObject; old != nil {
+			a.Time, a.Memory, a.Threads = old.Time, old.Memory, old.Threads
+		}
+		cf.Argon2idObject = a
+	} else {
+		cf.ScryptObject = NewScryptKDF(logN)
+	}
+	// Generate password-derived key
+	pwHash := cf.deriveKey(password)
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
-	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
-	// Purge scrypt-derived key
-	for i := range scryptHash {
-		scryptHash[i] = 0
+	ce := getKeyEncrypter(pwHash, useHKDF)
+	cf.EncryptedKey = ce.EncryptBlock(key, 0, cf.keyAD())
+	// Purge password-derived key
+	for i := range pwHash {
+		pwHash[i] = 0
 	}
 }
 
+// sealedAD is the additional authenticated data for EncryptedKey on sealed
+// filesystems.
+var sealedAD = []byte("gocryptfs sealed")
+
+// keyAD returns the additional authenticated data that EncryptedKey is
+// bound to. It takes the place of the 16-byte file ID. Filesystems that are
+// neither sealed nor have an expiry time use none, which is what all older
+// versions used.
+func (cf *ConfFile) keyAD() []byte {
+	var ad []byte
+	if cf.IsFeatureFlagSet(FlagSealed) {
+		ad = sealedAD
+	}
+	if cf.IsFeatureFlagSet(FlagExpiry) {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%sgocryptfs expiry=%d", ad, cf.Expiry)))
+		ad = h[:len(sealedAD)]
+	}
+	return ad
+}
+
+// KeyAD returns the additional authenticated data of EncryptedKey, see
+// keyAD(). Copies of the master key that are unlocked without the password
+// (TPM, kernel keyring, gocryptfs-agent) must be bound to it as well.
+// Otherwise, removing the "Sealed" flag or the expiry time from the config
+// file would go unnoticed.
+func (cf *ConfFile) KeyAD() []byte {
+	return cf.keyAD()
+}
+
+// KeyID identifies the master key together with the settings in KeyAD().
+// Caches of the master key store it under this ID, so that a cached copy
+// cannot be found any more once these settings are changed.
+func (cf *ConfFile) KeyID() []byte {
+	h := sha256.Sum256(cf.EncryptedKey)
+	return append(h[:], cf.keyAD()...)
+}
+
+// setFeatureFlag sets or clears "flag".
+func (cf *ConfFile) setFeatureFlag(flag flagIota, on bool) {
+	if cf.IsFeatureFlagSet(flag) == on {
+		return
+	}
+	if on {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[flag])
+		return
+	}
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[flag] {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+}
+
+// SetSealed sets or clears the "Sealed" feature flag and re-encrypts "key"
+// accordingly. "password" must be the current password, which keeps working
+// (the KDF parameters and salt do not change).
+func (cf *ConfFile) SetSealed(key []byte, password []byte, sealed bool) {
+	if cf.IsFeatureFlagSet(FlagSealed) == sealed {
+		return
+	}
+	cf.setFeatureFlag(FlagSealed, sealed)
+	pwHash := cf.deriveKey(password)
+	ce := getKeyEncrypter(pwHash, cf.IsFeatureFlagSet(FlagHKDF))
+	cf.EncryptedKey = ce.EncryptBlock(key, 0, cf.keyAD())
+	for i := range pwHash {
+		pwHash[i] = 0
+	}
+}
+
+// SetExpiry sets the expiry time to "t" (Unix seconds), or clears it if "t"
+// is zero. Like the "Sealed" flag, the expiry time is bound to EncryptedKey,
+// so the caller must call EncryptKey() afterwards.
+func (cf *ConfFile) SetExpiry(t int64) {
+	cf.Expiry = t
+	cf.setFeatureFlag(FlagExpiry, t != 0)
+}
+
+// Expired returns true if the filesystem has an expiry time that is not after
+// "now".
+func (cf *ConfFile) Expired(now time.Time) bool {
+	return cf.IsFeatureFlagSet(FlagExpiry) && now.Unix() >= cf.Expiry
+}
+
+// CombinePasswords combines the two secrets of a dual control filesystem into
+// the password that is passed to the KDF. The length prefix makes sure that
+// shifting bytes from one secret to the other changes the result.
+func CombinePasswords(pw1 []byte, pw2 []byte) []byte {
+	out := make([]byte, 4, 4+len(pw1)+len(pw2))
+	binary.BigEndian.PutUint32(out, uint32(len(pw1)))
+	out = append(out, pw1...)
+	return append(out, pw2...)
+}
+
+// deriveKey hashes "password" with the KDF selected by the feature flags.
+func (cf *ConfFile) deriveKey(password []byte) []byte {
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		return cf.Argon2idObject.DeriveKey(password)
+	}
+	return cf.ScryptObject.DeriveKey(password)
+}
+
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
 // This way a password change atomically replaces the file.
@@ -245,16 +542,24 @@ func (cf *ConfFile) WriteFile() error {
 	return err
 }
 
+// PlainBS returns the plaintext block size of the filesystem.
+func (cf *ConfFile) PlainBS() uint64 {
+	if cf.BlockSize == 0 {
+		return contentenc.DefaultBS
+	}
+	return cf.BlockSize
+}
+
 // getKeyEncrypter is a helper function that returns the right ContentEnc
 // instance for the "useHKDF" setting.
-func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
+func getKeyEncrypter(pwHash []byte, useHKDF bool) *contentenc.ContentEnc {
 	IVLen := 96
 	// gocryptfs v1.2 and older used 96-bit IVs for master key encryption.
 	// v1.3 adds the "HKDF" feature flag, which also enables 128-bit nonces.
 	if useHKDF {
 		IVLen = contentenc.DefaultIVBits
 	}
-	cc := cryptocore.New(scryptHash, cryptocore.BackendGoGCM, IVLen, useHKDF, false)
+	cc := cryptocore.New(pwHash, cryptocore.BackendGoGCM, IVLen, useHKDF, false)
 	ce := contentenc.New(cc, 4096, false)
 	return ce
 }
@@ -1,7 +1,9 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
@@ -62,7 +64,7 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", testPw, false, 10, "test", false, false)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,14 +85,14 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", testPw, false, 10, "test", false, true)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", DevRandom: true})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", testPw, true, 10, "test", false, false)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, PlaintextNames: true, LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,7 +113,7 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", testPw, false, 10, "test", true, false)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", AESSIV: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,3 +147,493 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestCreateConfFileXChaCha(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", XChaCha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagXChaCha20Poly1305) {
+		t.Error("XChaCha20Poly1305 flag should be set but is not")
+	}
+	if c.IsFeatureFlagSet(FlagAESSIV) {
+		t.Error("AESSIV flag should not be set")
+	}
+}
+
+func TestCreateConfFileBlockSize(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", BlockSize: 65536})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagBlockSize) || c.PlainBS() != 65536 {
+		t.Errorf("BlockSize flag=%v PlainBS=%d", c.IsFeatureFlagSet(FlagBlockSize), c.PlainBS())
+	}
+	// Invalid block sizes must be rejected
+	err = CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", BlockSize: 5000})
+	if err == nil {
+		t.Error("block size 5000 should have been rejected")
+	}
+}
+
+func TestCreateConfFileArgon2id(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", KDF: KDFArgon2id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagArgon2id) || c.Argon2idObject == nil {
+		t.Fatal("Argon2id flag or parameters missing")
+	}
+	// Changing the password must keep the KDF and its parameters, but use
+	// a new salt
+	oldSalt := c.Argon2idObject.Salt
+	c.Argon2idObject.Time = Argon2idDefaultTime + 1
+	c.EncryptKey(key, []byte("newPassword"), 10)
+	if c.Argon2idObject.Time != Argon2idDefaultTime+1 {
+		t.Error("Time parameter was not preserved")
+	}
+	if string(c.Argon2idObject.Salt) == string(oldSalt) {
+		t.Error("salt was not renewed")
+	}
+	// The Argon2id flag without parameters must be rejected
+	c.Argon2idObject = nil
+	c.filename = "config_test/tmp2.conf"
+	os.Remove(c.filename)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(c.filename)
+	_, _, err = LoadConfFile(c.filename, testPw)
+	if err == nil {
+		t.Error("missing Argon2idObject should have been rejected")
+	}
+}
+
+func TestCreateConfFileUnknownKDF(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", KDF: "bcrypt"})
+	if err == nil {
+		t.Error("unknown KDF should have been rejected")
+	}
+}
+
+// Every profile must create a config file that loads, and remember its name
+func TestProfiles(t *testing.T) {
+	for _, name := range ProfileNames() {
+		p, err := GetProfile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keep the test fast and do not block on /dev/random
+		err = CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+			KDF: p.KDF, AESSIV: p.AESSIV, BlockSize: p.BlockSize, Profile: p.Name})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if c.Profile != name {
+			t.Errorf("%s: Profile=%q", name, c.Profile)
+		}
+		if name != "compat" {
+			continue
+		}
+		// gocryptfs 1.3 knows these
+		old := map[string]bool{"GCMIV128": true, "HKDF": true, "DirIV": true, "EMENames": true, "LongNames": true, "Raw64": true}
+		for _, f := range c.FeatureFlags {
+			if !old[f] {
+				t.Errorf("compat: unexpected feature flag %q", f)
+			}
+		}
+	}
+	if _, err := GetProfile("turbo"); err == nil {
+		t.Error("unknown profile should have been rejected")
+	}
+}
+
+func TestSealed(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetSealed(key, testPw, true)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	key2, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagSealed) || string(key2) != string(key) {
+		t.Fatal("sealing failed")
+	}
+	// Toggling the flag by hand must make the key undecryptable
+	c.SetSealed(key, testPw, false)
+	c.FeatureFlags = append(c.FeatureFlags, knownFlags[FlagSealed])
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err == nil {
+		t.Error("tampered seal flag was accepted")
+	}
+	// Unsealing with the password works
+	c.SetSealed(key, testPw, false)
+	c.SetSealed(key, testPw, true)
+	c.SetSealed(key, testPw, false)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil || c.IsFeatureFlagSet(FlagSealed) {
+		t.Errorf("unsealing failed: err=%v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+		Expiry: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagExpiry) || c.Expiry != 1000 {
+		t.Fatalf("expiry not set: %v %d", c.FeatureFlags, c.Expiry)
+	}
+	if !c.Expired(time.Unix(1000, 0)) || c.Expired(time.Unix(999, 0)) {
+		t.Error("Expired() returned the wrong result")
+	}
+	// Changing the expiry time by hand must make the key undecryptable
+	c.Expiry = 2000
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err == nil {
+		t.Error("tampered expiry time was accepted")
+	}
+	// Clearing it with the password works
+	c.SetExpiry(0)
+	c.EncryptKey(key, testPw, 10)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil || c.IsFeatureFlagSet(FlagExpiry) || c.Expired(time.Now()) {
+		t.Errorf("clearing the expiry time failed: err=%v", err)
+	}
+}
+
+func TestFIDO2(t *testing.T) {
+	p := &FIDO2Params{CredentialID: []byte("credential"), HMACSalt: []byte("salt")}
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+		FIDO2: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagFIDO2) || string(c.FIDO2.CredentialID) != "credential" || string(c.FIDO2.HMACSalt) != "salt" {
+		t.Errorf("FIDO2 parameters were not stored: %v %v", c.FeatureFlags, c.FIDO2)
+	}
+	c.FIDO2 = nil
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err == nil {
+		t.Error("FIDO2 flag without parameters was accepted")
+	}
+}
+
+func TestCombinePasswords(t *testing.T) {
+	a := CombinePasswords([]byte("ab"), []byte("c"))
+	b := CombinePasswords([]byte("a"), []byte("bc"))
+	if string(a) == string(b) {
+		t.Error("different splits must give different results")
+	}
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: a, LogN: 10, Creator: "test",
+		DualControl: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagDualControl) {
+		t.Error("DualControl flag should be set but is not")
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", b)
+	if err == nil {
+		t.Error("wrong password split was accepted")
+	}
+}
+
+func TestDuress(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+		DuressPassword: []byte("duress")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A wrong password must not touch the key
+	_, _, err = LoadConfFile("config_test/tmp.conf", []byte("wrong"))
+	if err == nil {
+		t.Fatal("wrong password was accepted")
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LoadConfFileNoDuress treats the duress password as a wrong password
+	_, _, err = LoadConfFileNoDuress("config_test/tmp.conf", []byte("duress"))
+	if err == nil {
+		t.Fatal("duress password was accepted")
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal("LoadConfFileNoDuress destroyed the key")
+	}
+	// The duress password fails like a wrong password and destroys the key
+	_, _, err = LoadConfFile("config_test/tmp.conf", []byte("duress"))
+	if err == nil {
+		t.Fatal("duress password was accepted")
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err == nil {
+		t.Error("key was not destroyed")
+	}
+}
+
+// TestDuressOutput checks that the duress password prints the same messages
+// as a wrong password, also when the config file cannot be written.
+func TestDuressOutput(t *testing.T) {
+	const conf = "config_test/tmp.conf"
+	err := CreateConfFile(&CreateArgs{Filename: conf, Password: testPw, LogN: 10, Creator: "test",
+		DuressPassword: []byte("duress")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile creates the temporary file with O_EXCL, so this makes it fail
+	if err = os.Mkdir(conf+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(conf + ".tmp")
+	var out bytes.Buffer
+	tlog.Info.Logger.SetOutput(&out)
+	tlog.Warn.Logger.SetOutput(&out)
+	defer tlog.Info.Logger.SetOutput(os.Stdout)
+	defer tlog.Warn.Logger.SetOutput(os.Stderr)
+	var outputs []string
+	for _, pw := range []string{"wrong", "duress"} {
+		out.Reset()
+		_, _, err = LoadConfFile(conf, []byte(pw))
+		if err == nil {
+			t.Fatalf("%q was accepted", pw)
+		}
+		outputs = append(outputs, out.String()+err.Error())
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("output differs:\nwrong:  %q\nduress: %q", outputs[0], outputs[1])
+	}
+}
+
+// TestKeyID checks that editing the settings that are bound to the master
+// key changes KeyAD() and KeyID()
+func TestKeyID(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetSealed(key, testPw, true)
+	c.SetExpiry(1000)
+	c.EncryptKey(key, testPw, 10)
+	ad := string(c.KeyAD())
+	id := string(c.KeyID())
+	// Remove the flags by hand, EncryptedKey stays the same
+	c.setFeatureFlag(FlagSealed, false)
+	if string(c.KeyAD()) == ad || string(c.KeyID()) == id {
+		t.Error("removing the Sealed flag did not change KeyAD/KeyID")
+	}
+	c.setFeatureFlag(FlagSealed, true)
+	c.Expiry = 2000
+	if string(c.KeyAD()) == ad || string(c.KeyID()) == id {
+		t.Error("changing the expiry time did not change KeyAD/KeyID")
+	}
+	c.Expiry = 1000
+	if string(c.KeyAD()) != ad || string(c.KeyID()) != id {
+		t.Error("KeyAD/KeyID are not deterministic")
+	}
+}
+
+func TestTPM2Object(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+		DuressPassword: []byte("duress")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.TPM2Object = &TPM2Params{Public: []byte("pub"), Private: []byte("priv"), PCRs: "sha256:0,7"}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// The TPM-sealed copy needs no feature flag
+	_, c, err = LoadConfFile("config_test/tmp.conf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TPM2Object == nil || c.TPM2Object.PCRs != "sha256:0,7" {
+		t.Fatalf("TPM2Object was not stored: %v", c.TPM2Object)
+	}
+	// The duress password must also drop the TPM-sealed copy
+	LoadConfFile("config_test/tmp.conf", []byte("duress"))
+	_, c, err = LoadConfFile("config_test/tmp.conf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TPM2Object != nil {
+		t.Error("TPM2Object survived the duress password")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	no := false
+	c.Policy = []PolicyRule{{Glob: "*.sqlite*", Cache: &no}}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Policy) != 1 || c.Policy[0].Cache == nil || *c.Policy[0].Cache || c.Policy[0].Prealloc != nil {
+		t.Fatalf("policy did not survive a round trip: %+v", c.Policy)
+	}
+	if !c.Policy[0].Match("dir/x.sqlite-wal") || c.Policy[0].Match("x.db") {
+		t.Error("Match returned the wrong result")
+	}
+	c.Policy[0].Glob = "[x"
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadConfFile("config_test/tmp.conf", testPw); err == nil {
+		t.Error("invalid glob was accepted")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Limits.Forbidden("a/b/c/d") || c.Limits.TooBig(1<<62) {
+		t.Error("nil Limits must not restrict anything")
+	}
+	c.Limits = &Limits{MaxFileSize: 1000, ForbiddenNames: []string{"*.exe", "incoming/.*"}, MaxDepth: 2}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := c.Limits
+	if l == nil || l.MaxFileSize != 1000 || len(l.ForbiddenNames) != 2 || l.MaxDepth != 2 {
+		t.Fatalf("limits did not survive a round trip: %+v", l)
+	}
+	testcases := map[string]bool{
+		"a.txt":          false,
+		"dir/a.exe":      true,
+		"incoming/.x":    true,
+		"other/.x":       false,
+		"incoming/sub/x": true,
+	}
+	for path, want := range testcases {
+		if have := l.Forbidden(path); have != want {
+			t.Errorf("%q: want %v, have %v", path, want, have)
+		}
+	}
+	if l.TooBig(1000) || !l.TooBig(1001) {
+		t.Error("TooBig returned the wrong result")
+	}
+	c.Limits.ForbiddenNames = []string{"[x"}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadConfFile("config_test/tmp.conf", testPw); err == nil {
+		t.Error("invalid pattern was accepted")
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Passthrough = []string{".nomedia", "desktop.ini"}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadConfFile("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Passthrough) != 2 {
+		t.Fatalf("passthrough names did not survive a round trip: %v", c.Passthrough)
+	}
+	// Names that could clash with encrypted names or control files
+	for _, name := range []string{"", "a/b", "..", "gocryptfs.diriv", "gocryptfs.longname.x", "abc", "YWJj==", "gocryptfs.conf"} {
+		c.Passthrough = []string{name}
+		if err = c.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = LoadConfFile("config_test/tmp.conf", testPw); err == nil {
+			t.Errorf("%q was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package configfile
+
+import (
+	"crypto/subtle"
+
+	"github.com/rfjakob/gocryptfs/internal/agent"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// DuressSlot stores the scrypt hash of the duress password.
+type DuressSlot struct {
+	// ScryptObject stores the parameters used to hash the duress password
+	ScryptObject ScryptKDF
+	// Hash is the scrypt hash of the duress password
+	Hash []byte
+}
+
+// SetDuressPassword sets "pw" as the duress password, hashed with scrypt
+// cost parameter "logN". When LoadConfFile() is called with the duress
+// password, it overwrites EncryptedKey with random data and writes the
+// config file to disk, which makes the filesystem inaccessible without the
+// master key.
+func (cf *ConfFile) SetDuressPassword(pw []byte, logN int) {
+	s := NewScryptKDF(logN)
+	cf.DuressObject = &DuressSlot{
+		ScryptObject: s,
+		Hash:         s.DeriveKey(pw),
+	}
+	cf.setFeatureFlag(FlagDuress, true)
+}
+
+// isDuressPassword returns true if "pw" is the duress password.
+func (cf *ConfFile) isDuressPassword(pw []byte) bool {
+	if !cf.IsFeatureFlagSet(FlagDuress) {
+		return false
+	}
+	d := cf.DuressObject
+	h := d.ScryptObject.DeriveKey(pw)
+	return subtle.ConstantTimeCompare(h, d.Hash) == 1
+}
+
+// destroyKey overwrites EncryptedKey with random data of the same length,
+// drops the TPM-sealed copy of the master key and writes the config file to
+// disk. Everything else, including the duress slot, stays as it is.
+// Copies of the master key cached in the kernel keyring ("-use_keyring") or
+// in gocryptfs-agent ("-use_agent") are removed as well.
+func (cf *ConfFile) destroyKey() {
+	// The cached copies are stored under a description derived from the
+	// old EncryptedKey
+	desc := keyring.Description(cf.KeyID())
+	cf.EncryptedKey = cryptocore.RandBytes(len(cf.EncryptedKey))
+	cf.TPM2Object = nil
+	// A warning here would tell the attacker that the duress password was
+	// used, so all errors are only logged at debug level. Errors from
+	// keyring and agent are expected anyway when nothing was cached.
+	if err := cf.WriteFile(); err != nil {
+		tlog.Debug.Printf("destroyKey: WriteFile: %v", err)
+	}
+	if err := keyring.Revoke(desc); err != nil {
+		tlog.Debug.Printf("destroyKey: keyring: %v", err)
+	}
+	if sock := agent.SocketPath(); sock != "" {
+		if err := agent.Delete(sock, desc); err != nil {
+			tlog.Debug.Printf("destroyKey: agent: %v", err)
+		}
+	}
+}
@@ -1,5 +1,9 @@
 package configfile
 
+import (
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
 type flagIota int
 
 const (
@@ -25,18 +29,60 @@ const (
 	// Note that this flag does not change the password hashing algorithm
 	// which always is scrypt.
 	FlagHKDF
+	// FlagXChaCha20Poly1305 selects an XChaCha20-Poly1305 based crypto
+	// backend. It implies 192-bit nonces.
+	FlagXChaCha20Poly1305
+	// FlagBlockSize indicates a non-default content block size, which is
+	// stored in ConfFile.BlockSize.
+	FlagBlockSize
+	// FlagArgon2id indicates that the master key is encrypted using an
+	// Argon2id password hash instead of scrypt.
+	FlagArgon2id
+	// FlagSealed forces read-only mounts. The flag is bound to
+	// EncryptedKey, so it cannot be removed without the password.
+	FlagSealed
+	// FlagExpiry indicates that ConfFile.Expiry is set. Like FlagSealed,
+	// it is bound to EncryptedKey.
+	FlagExpiry
+	// FlagFIDO2 means that the password is the hmac-secret of the FIDO2
+	// credential stored in ConfFile.FIDO2.
+	FlagFIDO2
+	// FlagDualControl means that the password is made up of two secrets
+	// held by different persons, see CombinePasswords().
+	FlagDualControl
+	// FlagDuress indicates that ConfFile.DuressObject is set. Entering the
+	// duress password destroys EncryptedKey.
+	FlagDuress
+	// FlagExternalHeaders means that the file header is stored in an xattr
+	// of the ciphertext file instead of in its first bytes.
+	FlagExternalHeaders
+)
+
+// Password hashing algorithms for CreateArgs.KDF
+const (
+	KDFScrypt   = "scrypt"
+	KDFArgon2id = "argon2id"
 )
 
 // knownFlags stores the known feature flags and their string representation
 var knownFlags = map[flagIota]string{
-	FlagPlaintextNames: "PlaintextNames",
-	FlagDirIV:          "DirIV",
-	FlagEMENames:       "EMENames",
-	FlagGCMIV128:       "GCMIV128",
-	FlagLongNames:      "LongNames",
-	FlagAESSIV:         "AESSIV",
-	FlagRaw64:          "Raw64",
-	FlagHKDF:           "HKDF",
+	FlagPlaintextNames:    "PlaintextNames",
+	FlagDirIV:             "DirIV",
+	FlagEMENames:          "EMENames",
+	FlagGCMIV128:          "GCMIV128",
+	FlagLongNames:         "LongNames",
+	FlagAESSIV:            "AESSIV",
+	FlagRaw64:             "Raw64",
+	FlagHKDF:              "HKDF",
+	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagBlockSize:         "BlockSize",
+	FlagArgon2id:          "Argon2id",
+	FlagSealed:            "Sealed",
+	FlagExpiry:            "Expiry",
+	FlagFIDO2:             "FIDO2",
+	FlagDualControl:       "DualControl",
+	FlagDuress:            "Duress",
+	FlagExternalHeaders:   "ExternalHeaders",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -53,13 +99,27 @@ var requiredFlagsPlaintextNames = []flagIota{
 }
 
 // isFeatureFlagKnown verifies that we understand a feature flag.
+// Flags that select a content encryption backend registered with
+// cryptocore.RegisterAEADBackend are known as well.
 func (cf *ConfFile) isFeatureFlagKnown(flag string) bool {
 	for _, knownFlag := range knownFlags {
 		if knownFlag == flag {
 			return true
 		}
 	}
-	return false
+	_, ok := cryptocore.BackendForFeatureFlag(flag)
+	return ok
+}
+
+// AEADBackend returns the content encryption backend selected by the
+// feature flags, and false if no flag selects one (use AES-GCM).
+func (cf *ConfFile) AEADBackend() (cryptocore.AEADTypeEnum, bool) {
+	for _, flag := range cf.FeatureFlags {
+		if t, ok := cryptocore.BackendForFeatureFlag(flag); ok {
+			return t, true
+		}
+	}
+	return 0, false
 }
 
 // IsFeatureFlagSet returns true if the feature flag "flagWant" is enabled.
@@ -0,0 +1,67 @@
+package configfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Limits restricts what can be created in the filesystem. This is meant
+// for directories that are exposed to semi-trusted writers, like an
+// encrypted inbox. Zero values mean "no limit".
+// Like the Policy, the limits need no feature flag. Older gocryptfs versions
+// ignore them.
+type Limits struct {
+	// MaxFileSize is the maximum plaintext size of a file in bytes. Writes
+	// and truncates beyond it fail with EFBIG.
+	MaxFileSize uint64 `json:",omitempty"`
+	// ForbiddenNames lists glob patterns with the syntax of
+	// PolicyRule.Glob. Creating or renaming to a matching path fails with
+	// EPERM.
+	ForbiddenNames []string `json:",omitempty"`
+	// MaxDepth is the maximum number of path components, counted from the
+	// root of the filesystem. "a/b/c" has a depth of 3. Creating or
+	// renaming to a deeper path fails with EPERM.
+	MaxDepth int `json:",omitempty"`
+}
+
+// Forbidden returns true if the plaintext path "path" matches one of the
+// ForbiddenNames patterns or is deeper than MaxDepth.
+func (l *Limits) Forbidden(path string) bool {
+	if l == nil {
+		return false
+	}
+	if l.MaxDepth > 0 && strings.Count(path, "/")+1 > l.MaxDepth {
+		return true
+	}
+	for _, g := range l.ForbiddenNames {
+		if MatchGlob(g, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// TooBig returns true if "size" exceeds MaxFileSize
+func (l *Limits) TooBig(size uint64) bool {
+	return l != nil && l.MaxFileSize > 0 && size > l.MaxFileSize
+}
+
+// checkLimits validates the Limits
+func (cf *ConfFile) checkLimits() error {
+	if cf.Limits == nil {
+		return nil
+	}
+	if cf.Limits.MaxDepth < 0 {
+		return fmt.Errorf("Limits: negative MaxDepth %d", cf.Limits.MaxDepth)
+	}
+	for _, g := range cf.Limits.ForbiddenNames {
+		if g == "" {
+			return fmt.Errorf("Limits: empty ForbiddenNames pattern")
+		}
+		if _, err := filepath.Match(g, ""); err != nil {
+			return fmt.Errorf("Limits: invalid ForbiddenNames pattern %q: %v", g, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package configfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// passthroughReserved are names that gocryptfs uses itself
+var passthroughReserved = []string{ConfDefaultName, ConfReverseName}
+
+// checkPassthrough validates the Passthrough names. They are stored as they
+// are in CIPHERDIR, so they must not look like an encrypted name: those only
+// use the base64url alphabet and "=", and the long names and the
+// gocryptfs.diriv file start with "gocryptfs.".
+func (cf *ConfFile) checkPassthrough() error {
+	for _, name := range cf.Passthrough {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("Passthrough: invalid file name %q", name)
+		}
+		if strings.HasPrefix(name, "gocryptfs.") {
+			return fmt.Errorf("Passthrough: file name %q is reserved", name)
+		}
+		for _, r := range passthroughReserved {
+			if name == r {
+				return fmt.Errorf("Passthrough: file name %q is reserved", name)
+			}
+		}
+		if strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_=") == "" {
+			return fmt.Errorf("Passthrough: file name %q could be an encrypted name. "+
+				"It must contain a character like \".\" or \" \"", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package configfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PolicyRule sets per-file options for the files matching Glob. The rules
+// are evaluated in order when a file is opened or created, and for every
+// option the first matching rule that sets it wins. Options that no rule
+// sets keep the defaults from the command line.
+// The rules do not change the on-disk format, so they need no feature flag
+// and older gocryptfs versions simply ignore them.
+type PolicyRule struct {
+	// Glob uses the syntax of filepath.Match. Patterns without a "/" are
+	// matched against the file name, patterns with a "/" against the path
+	// relative to the root of the filesystem.
+	Glob string
+	// Compress is reserved for file content compression. It is accepted
+	// but has no effect yet.
+	Compress *bool `json:",omitempty"`
+	// Cache set to false bypasses the kernel page cache
+	Cache *bool `json:",omitempty"`
+	// Prealloc enables or disables preallocation before writing
+	Prealloc *bool `json:",omitempty"`
+}
+
+// Match returns true if the plaintext path "path" matches the rule
+func (r *PolicyRule) Match(path string) bool {
+	return MatchGlob(r.Glob, path)
+}
+
+// MatchGlob matches "path" against "glob" as described for PolicyRule.Glob
+func MatchGlob(glob string, path string) bool {
+	if !strings.Contains(glob, "/") {
+		path = filepath.Base(path)
+	}
+	m, _ := filepath.Match(glob, path)
+	return m
+}
+
+// checkPolicy validates the Policy rules
+func (cf *ConfFile) checkPolicy() error {
+	for i, r := range cf.Policy {
+		if r.Glob == "" {
+			return fmt.Errorf("Policy rule %d: empty Glob", i)
+		}
+		if _, err := filepath.Match(r.Glob, ""); err != nil {
+			return fmt.Errorf("Policy rule %d: invalid Glob %q: %v", i, r.Glob, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package configfile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// Profile is a named bundle of settings for creating a new filesystem,
+// selected with "-init -profile NAME". Options that are given explicitly on
+// the command line take precedence over the profile.
+type Profile struct {
+	// Name is what the user passes to "-profile"
+	Name string
+	// Description is printed when the profile is used
+	Description string
+	// KDF is the password hashing algorithm, see CreateArgs.KDF
+	KDF string
+	// LogN is the scrypt cost parameter
+	LogN int
+	// AESSIV selects AES-SIV instead of AES-GCM
+	AESSIV bool
+	// BlockSize is the plaintext block size
+	BlockSize uint64
+	// DevRandom reads the master key from /dev/random
+	DevRandom bool
+}
+
+// profiles lists the available profiles
+var profiles = []Profile{
+	{
+		Name:        "paranoid",
+		Description: "Argon2id, AES-SIV, master key from /dev/random",
+		KDF:         KDFArgon2id,
+		LogN:        ScryptDefaultLogN + 2,
+		AESSIV:      true,
+		BlockSize:   contentenc.DefaultBS,
+		DevRandom:   true,
+	},
+	{
+		Name:        "fast",
+		Description: "AES-GCM with 64 KiB blocks",
+		KDF:         KDFScrypt,
+		LogN:        ScryptDefaultLogN,
+		BlockSize:   64 * 1024,
+	},
+	{
+		Name:        "compat",
+		Description: "only feature flags that gocryptfs 1.3 and later understand",
+		KDF:         KDFScrypt,
+		LogN:        ScryptDefaultLogN,
+		BlockSize:   contentenc.DefaultBS,
+	},
+}
+
+// GetProfile returns the profile called "name"
+func GetProfile(name string) (*Profile, error) {
+	for i := range profiles {
+		if profiles[i].Name == name {
+			p := profiles[i]
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown profile %q. Possible values: %s", name, strings.Join(ProfileNames(), ", "))
+}
+
+// ProfileNames returns the names of all profiles
+func ProfileNames() []string {
+	var names []string
+	for _, p := range profiles {
+		names = append(names, p.Name)
+	}
+	return names
+}
@@ -6,9 +6,8 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
-	"runtime"
-	"sync"
 
 	"github.com/hanwen/go-fuse/fuse"
 
@@ -24,7 +23,7 @@ const (
 	// DefaultBS is the default plaintext block size
 	DefaultBS = 4096
 	// DefaultIVBits is the default length of IV, in bits.
-	// We always use 128-bit IVs for file content, but the
+	// We use 128-bit IVs for file content (192-bit with XChaCha20-Poly1305), but the
 	// master key in the config file is encrypted with a 96-bit IV for
 	// gocryptfs v1.2 and earlier. v1.3 switched to 128 bit.
 	DefaultIVBits = 128
@@ -53,6 +52,12 @@ type ContentEnc struct {
 	allZeroNonce []byte
 	// Force decode even if integrity check fails (openSSL only)
 	forceDecode bool
+	// Size of the file header at the start of each ciphertext file. Zero
+	// if the header is stored outside of the file, see SetExternalHeaders.
+	headerLen uint64
+	// Encrypt large writes in the calling goroutine instead of splitting
+	// them between the workers, see SetSerializeWrites
+	serializeWrites bool
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
@@ -69,6 +74,17 @@ type ContentEnc struct {
 	PReqPool bPool
 }
 
+// CheckBlockSize returns an error if "bs" cannot be used as the plaintext
+// block size. It must be a power of two between DefaultBS and
+// fuse.MAX_KERNEL_WRITE.
+func CheckBlockSize(bs uint64) error {
+	if bs < DefaultBS || bs > fuse.MAX_KERNEL_WRITE || bs&(bs-1) != 0 {
+		return fmt.Errorf("invalid block size %d: must be a power of two between %d and %d",
+			bs, DefaultBS, fuse.MAX_KERNEL_WRITE)
+	}
+	return nil
+}
+
 // New returns an initialized ContentEnc instance.
 func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
@@ -87,6 +103,7 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		allZeroBlock: make([]byte, cipherBS),
 		allZeroNonce: make([]byte, cc.IVLen),
 		forceDecode:  forceDecode,
+		headerLen:    HeaderLen,
 		cBlockPool:   newBPool(int(cipherBS)),
 		CReqPool:     newBPool(cReqSize),
 		pBlockPool:   newBPool(int(plainBS)),
@@ -105,28 +122,58 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
-// DecryptBlocks decrypts a number of blocks
+// SetExternalHeaders tells the offset calculations that the file header is
+// not stored at the start of the ciphertext file, but somewhere else
+// (configfile.FlagExternalHeaders). Block 0 then starts at offset zero.
+func (be *ContentEnc) SetExternalHeaders() {
+	be.headerLen = 0
+}
+
+// ExternalHeaders returns true if SetExternalHeaders has been called.
+func (be *ContentEnc) ExternalHeaders() bool {
+	return be.headerLen == 0
+}
+
+// SetSerializeWrites disables parallel encryption of large writes
+// ("-serialize_writes").
+func (be *ContentEnc) SetSerializeWrites() {
+	be.serializeWrites = true
+}
+
+// DecryptBlocks decrypts a number of blocks.
+// Returns a byte slice from PReqPool - so don't forget to return it
+// to the pool.
 func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
-	cBuf := bytes.NewBuffer(ciphertext)
 	var err error
-	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
-	blockNo := firstBlockNo
-	for cBuf.Len() > 0 {
-		cBlock := cBuf.Next(int(be.cipherBS))
-		var pBlock []byte
-		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
+	// The blocks are decrypted directly into the output buffer, and the
+	// associated data is only updated from block to block, so there are no
+	// per-block allocations.
+	plaintext := be.PReqPool.Get()[:0]
+	aData := concatAD(firstBlockNo, fileID)
+	for blockNo := firstBlockNo; len(ciphertext) > 0; blockNo++ {
+		n := int(be.cipherBS)
+		if n > len(ciphertext) {
+			n = len(ciphertext)
+		}
+		binary.BigEndian.PutUint64(aData, blockNo)
+		plaintext, err = be.doDecryptBlock(plaintext, ciphertext[:n], aData)
+		ciphertext = ciphertext[n:]
 		if err != nil {
 			if be.forceDecode && err == stupidgcm.ErrAuth {
-				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
+				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", blockNo)
 			} else {
 				break
 			}
 		}
-		pBuf.Write(pBlock)
-		be.pBlockPool.Put(pBlock)
-		blockNo++
 	}
-	return pBuf.Bytes(), err
+	return plaintext, err
+}
+
+// IsZeroBlock returns true if "plaintext" is a full-sized block of zeros.
+// Such blocks can be stored as file holes, which DecryptBlock translates
+// back to zeros.
+func (be *ContentEnc) IsZeroBlock(plaintext []byte) bool {
+	return uint64(len(plaintext)) == be.plainBS && bytes.Equal(plaintext, be.allZeroBlock[:be.plainBS])
 }
 
 // concatAD concatenates the block number and the file ID to a byte blob
@@ -151,21 +198,36 @@ func concatAD(blockNo uint64, fileID []byte) (aData []byte) {
 // Corner case: A full-sized block of all-zero ciphertext bytes is translated
 // to an all-zero plaintext block, i.e. file hole passtrough.
 func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []byte) ([]byte, error) {
-
 	// Empty block?
 	if len(ciphertext) == 0 {
 		return ciphertext, nil
 	}
+	plaintext, err := be.doDecryptBlock(be.pBlockPool.Get()[:0], ciphertext, concatAD(blockNo, fileID))
+	if err != nil && !(be.forceDecode && err == stupidgcm.ErrAuth) {
+		return nil, err
+	}
+	return plaintext, err
+}
+
+// doDecryptBlock decrypts "ciphertext" and appends the plaintext to "dst".
+// "aData" is the associated data from concatAD. On error, "dst" is returned
+// unchanged, except for authentication failures with forcedecode, where the
+// unauthenticated plaintext is appended.
+func (be *ContentEnc) doDecryptBlock(dst []byte, ciphertext []byte, aData []byte) ([]byte, error) {
+	// Empty block?
+	if len(ciphertext) == 0 {
+		return dst, nil
+	}
 
 	// All-zero block?
 	if bytes.Equal(ciphertext, be.allZeroBlock) {
 		tlog.Debug.Printf("DecryptBlock: file hole encountered")
-		return make([]byte, be.plainBS), nil
+		return append(dst, be.allZeroBlock[:be.plainBS]...), nil
 	}
 
 	if len(ciphertext) < be.cryptoCore.IVLen {
 		tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
-		return nil, errors.New("Block is too short")
+		return dst, errors.New("Block is too short")
 	}
 
 	// Extract nonce
@@ -174,79 +236,73 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 		// Bug in tmpfs?
 		// https://github.com/rfjakob/gocryptfs/issues/56
 		// http://www.spinics.net/lists/kernel/msg2370127.html
-		return nil, errors.New("all-zero nonce")
+		return dst, errors.New("all-zero nonce")
 	}
-	ciphertextOrig := ciphertext
-	ciphertext = ciphertext[be.cryptoCore.IVLen:]
 
 	// Decrypt
-	plaintext := be.pBlockPool.Get()
-	plaintext = plaintext[:0]
-	aData := concatAD(blockNo, fileID)
-	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
-
+	plaintext, err := be.cryptoCore.AEADCipher.Open(dst, nonce, ciphertext[be.cryptoCore.IVLen:], aData)
 	if err != nil {
-		tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
-		tlog.Debug.Println(hex.Dump(ciphertextOrig))
+		tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertext))
+		tlog.Debug.Println(hex.Dump(ciphertext))
 		if be.forceDecode && err == stupidgcm.ErrAuth {
 			return plaintext, err
 		}
-		return nil, err
+		return dst, err
 	}
-
 	return plaintext, nil
 }
 
-// At some point, splitting the ciphertext into more groups will not improve
-// performance, as spawning goroutines comes at a cost.
-// 2 seems to work ok for now.
-const encryptMaxSplit = 2
-
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
+// Large writes are encrypted in parallel, see encryptParallel.
 // Returns a byte slice from CReqPool - so don't forget to return it
 // to the pool.
 func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
-	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
-	// For large writes, we parallelize encryption.
-	if len(plaintextBlocks) >= 32 {
-		ncpu := runtime.NumCPU()
-		if ncpu > encryptMaxSplit {
-			ncpu = encryptMaxSplit
+	// Every block is encrypted directly into its place in the output
+	// buffer, so the ciphertext does not have to be copied together
+	// afterwards.
+	overhead := int(be.cipherBS - be.plainBS)
+	size := 0
+	for _, v := range plaintextBlocks {
+		if len(v) > 0 {
+			size += len(v) + overhead
 		}
-		groupSize := len(plaintextBlocks) / ncpu
-		var wg sync.WaitGroup
-		for i := 0; i < ncpu; i++ {
-			wg.Add(1)
-			go func(i int) {
-				low := i * groupSize
-				high := (i + 1) * groupSize
-				if i == ncpu-1 {
-					// Last group, pick up any left-over blocks
-					high = len(plaintextBlocks)
-				}
-				be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
-				wg.Done()
-			}(i)
+	}
+	out := be.CReqPool.Get()
+	if size > len(out) {
+		// Larger than a FUSE request. This does not happen in the
+		// filesystem, and the result cannot be returned to the pool.
+		out = make([]byte, size)
+	}
+	out = out[:size]
+	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
+	off := 0
+	for i, v := range plaintextBlocks {
+		if len(v) > 0 {
+			ciphertextBlocks[i] = out[off : off : off+len(v)+overhead]
+			off += len(v) + overhead
 		}
-		wg.Wait()
+	}
+	if !be.serializeWrites && uint64(len(plaintextBlocks))*be.plainBS >= parallelMinBytes {
+		be.encryptParallel(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
 	} else {
 		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
 	}
-	// Concatenate ciphertext into a single byte array.
-	tmp := be.CReqPool.Get()
-	out := bytes.NewBuffer(tmp[:0])
-	for _, v := range ciphertextBlocks {
-		out.Write(v)
-		// Return the memory to cBlockPool
-		be.cBlockPool.Put(v)
-	}
-	return out.Bytes()
+	return out
 }
 
-// doEncryptBlocks is called by EncryptBlocks to do the actual encryption work
+// doEncryptBlocks is called by EncryptBlocks to do the actual encryption
+// work. Each block in "in" is encrypted into the zero-length slice "out[i]",
+// which must have enough capacity for the nonce, the ciphertext and the tag.
 func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
+	aData := concatAD(firstBlockNo, fileID)
 	for i, v := range in {
-		out[i] = be.EncryptBlock(v, firstBlockNo+uint64(i), fileID)
+		if len(v) == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint64(aData, firstBlockNo+uint64(i))
+		nonce := out[i][:be.cryptoCore.IVLen]
+		be.cryptoCore.IVGenerator.Fill(nonce)
+		out[i] = be.seal(nonce, v, aData)
 	}
 }
 
@@ -262,9 +318,9 @@ func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []by
 // EncryptBlockNonce - Encrypt plaintext using a nonce chosen by the caller.
 // blockNo and fileID are used as associated data.
 // The output is nonce + ciphertext + tag.
-// This function can only be used in SIV mode.
+// This function can only be used with deterministic-safe backends like AES-SIV.
 func (be *ContentEnc) EncryptBlockNonce(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
-	if be.cryptoCore.AEADBackend != cryptocore.BackendAESSIV {
+	if !be.cryptoCore.AEADBackend.Spec().Deterministic {
 		log.Panic("deterministic nonces are only secure in SIV mode")
 	}
 	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
@@ -281,15 +337,19 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 	if len(nonce) != be.cryptoCore.IVLen {
 		log.Panic("wrong nonce length")
 	}
-	// Block is authenticated with block number and file ID
-	aData := concatAD(blockNo, fileID)
 	// Get a cipherBS-sized block of memory, copy the nonce into it and truncate to
 	// nonce length
 	cBlock := be.cBlockPool.Get()
 	copy(cBlock, nonce)
-	cBlock = cBlock[0:len(nonce)]
-	// Encrypt plaintext and append to nonce
-	ciphertext := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, plaintext, aData)
+	// Block is authenticated with block number and file ID
+	return be.seal(cBlock[0:len(nonce)], plaintext, concatAD(blockNo, fileID))
+}
+
+// seal encrypts "plaintext" and appends the ciphertext and the tag to
+// "nonce". The capacity of "nonce" should be large enough to hold the
+// result.
+func (be *ContentEnc) seal(nonce []byte, plaintext []byte, aData []byte) []byte {
+	ciphertext := be.cryptoCore.AEADCipher.Seal(nonce, nonce, plaintext, aData)
 	overhead := int(be.cipherBS - be.plainBS)
 	if len(plaintext)+overhead != len(ciphertext) {
 		log.Panicf("unexpected ciphertext length: plaintext=%d, overhead=%d, ciphertext=%d",
@@ -1,6 +1,7 @@
 package contentenc
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -72,6 +73,31 @@ func TestCiphertextRange(t *testing.T) {
 	}
 }
 
+func TestExternalHeaders(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false)
+	f.SetExternalHeaders()
+	if !f.ExternalHeaders() {
+		t.Fatal("ExternalHeaders() is false")
+	}
+	if off := f.BlockNoToCipherOff(3); off != 3*f.cipherBS {
+		t.Errorf("block 3 starts at %d", off)
+	}
+	if b := f.CipherOffToBlockNo(0); b != 0 {
+		t.Errorf("offset 0 is in block %d", b)
+	}
+	for _, plainSize := range []uint64{0, 1, DefaultBS, DefaultBS + 1, 100000} {
+		cipherSize := f.PlainSizeToCipherSize(plainSize)
+		if have := f.CipherSizeToPlainSize(cipherSize); have != plainSize {
+			t.Errorf("size %d -> %d -> %d", plainSize, cipherSize, have)
+		}
+	}
+	if s := f.PlainSizeToCipherSize(1); s != 1+f.BlockOverhead() {
+		t.Errorf("wrong ciphertext size %d", s)
+	}
+}
+
 func TestBlockNo(t *testing.T) {
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
@@ -94,3 +120,146 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// Encrypt and decrypt with a non-default block size
+func TestBlockSize(t *testing.T) {
+	for _, bs := range []uint64{4097, 2048, 8192 + 4096, 262144} {
+		if CheckBlockSize(bs) == nil {
+			t.Errorf("block size %d should be invalid", bs)
+		}
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	for _, bs := range []uint64{DefaultBS, 65536, 131072} {
+		if err := CheckBlockSize(bs); err != nil {
+			t.Fatal(err)
+		}
+		f := New(cc, bs, false)
+		if f.CipherBS() != bs+32 {
+			t.Errorf("bs=%d: wrong CipherBS %d", bs, f.CipherBS())
+		}
+		// Three full blocks and one partial block
+		plainSize := 3*bs + 100
+		if f.CipherSizeToPlainSize(f.PlainSizeToCipherSize(plainSize)) != plainSize {
+			t.Errorf("bs=%d: size conversion does not round-trip", bs)
+		}
+		plaintext := make([]byte, plainSize)
+		for i := range plaintext {
+			plaintext[i] = byte(i)
+		}
+		var blocks [][]byte
+		for off := uint64(0); off < plainSize; off += bs {
+			end := off + bs
+			if end > plainSize {
+				end = plainSize
+			}
+			blocks = append(blocks, plaintext[off:end])
+		}
+		fileID := make([]byte, 16)
+		ciphertext := f.EncryptBlocks(blocks, 0, fileID)
+		if uint64(len(ciphertext)) != f.PlainSizeToCipherSize(plainSize)-HeaderLen {
+			t.Errorf("bs=%d: wrong ciphertext length %d", bs, len(ciphertext))
+		}
+		out, err := f.DecryptBlocks(ciphertext, 0, fileID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("bs=%d: plaintext mismatch", bs)
+		}
+	}
+}
+
+// TestEncryptBlocksParallel checks that splitting a large write between the
+// workers produces the blocks in the right order
+func TestEncryptBlocksParallel(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false)
+	plaintext := make([]byte, 3*parallelMinBytes+100)
+	for i := range plaintext {
+		plaintext[i] = byte(i / DefaultBS)
+	}
+	var blocks [][]byte
+	for off := 0; off < len(plaintext); off += DefaultBS {
+		end := off + DefaultBS
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		blocks = append(blocks, plaintext[off:end])
+	}
+	fileID := make([]byte, 16)
+	for _, serialize := range []bool{false, true} {
+		f.serializeWrites = serialize
+		ciphertext := f.EncryptBlocks(blocks, 5, fileID)
+		out, err := f.DecryptBlocks(ciphertext, 5, fileID)
+		if err != nil {
+			t.Fatalf("serialize=%v: %v", serialize, err)
+		}
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("serialize=%v: plaintext mismatch", serialize)
+		}
+	}
+}
+
+// benchBlocks returns a ContentEnc and "n" bytes of plaintext split into
+// blocks
+func benchBlocks(n int) (*ContentEnc, [][]byte) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false)
+	plaintext := make([]byte, n)
+	var blocks [][]byte
+	for off := 0; off < n; off += DefaultBS {
+		blocks = append(blocks, plaintext[off:off+DefaultBS])
+	}
+	return f, blocks
+}
+
+func benchmarkEncryptBlocks(b *testing.B, n int, serialize bool) {
+	f, blocks := benchBlocks(n)
+	f.serializeWrites = serialize
+	fileID := make([]byte, 16)
+	b.SetBytes(int64(n))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.CReqPool.Put(f.EncryptBlocks(blocks, 0, fileID))
+	}
+}
+
+func BenchmarkEncryptBlocks4k(b *testing.B) {
+	benchmarkEncryptBlocks(b, 4096, true)
+}
+
+func BenchmarkEncryptBlocks128k(b *testing.B) {
+	benchmarkEncryptBlocks(b, 128*1024, true)
+}
+
+func BenchmarkEncryptBlocks128kParallel(b *testing.B) {
+	benchmarkEncryptBlocks(b, 128*1024, false)
+}
+
+func benchmarkDecryptBlocks(b *testing.B, n int) {
+	f, blocks := benchBlocks(n)
+	fileID := make([]byte, 16)
+	ciphertext := f.EncryptBlocks(blocks, 0, fileID)
+	b.SetBytes(int64(n))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plaintext, err := f.DecryptBlocks(ciphertext, 0, fileID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.PReqPool.Put(plaintext)
+	}
+}
+
+func BenchmarkDecryptBlocks4k(b *testing.B) {
+	benchmarkDecryptBlocks(b, 4096)
+}
+
+func BenchmarkDecryptBlocks128k(b *testing.B) {
+	benchmarkDecryptBlocks(b, 128*1024)
+}
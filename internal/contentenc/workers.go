@@ -0,0 +1,83 @@
+package contentenc
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Large writes are encrypted by a pool of worker goroutines that is shared
+// by all ContentEnc instances. Starting the goroutines once instead of for
+// every write keeps the overhead low enough that it pays off to use all
+// CPUs, not just two.
+
+const (
+	// parallelMinBytes is the plaintext size from which EncryptBlocks
+	// splits the work between the workers. Smaller writes are encrypted
+	// faster than the workers can be woken up.
+	parallelMinBytes = 128 * 1024
+	// parallelMinBlocks is the minimum number of blocks a worker gets
+	parallelMinBlocks = 4
+)
+
+// encryptJob is a group of blocks that a worker encrypts
+type encryptJob struct {
+	be           *ContentEnc
+	in           [][]byte
+	out          [][]byte
+	firstBlockNo uint64
+	fileID       []byte
+	wg           *sync.WaitGroup
+}
+
+var (
+	encryptJobs     chan encryptJob
+	encryptJobsOnce sync.Once
+)
+
+// startWorkers starts one worker per CPU that Go may use
+func startWorkers() {
+	n := runtime.GOMAXPROCS(0)
+	encryptJobs = make(chan encryptJob, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range encryptJobs {
+				j.be.doEncryptBlocks(j.in, j.out, j.firstBlockNo, j.fileID)
+				j.wg.Done()
+			}
+		}()
+	}
+}
+
+// encryptParallel encrypts "in" into "out" like doEncryptBlocks, but splits
+// the blocks into groups that are encrypted concurrently. The calling
+// goroutine encrypts the last group itself.
+func (be *ContentEnc) encryptParallel(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
+	encryptJobsOnce.Do(startWorkers)
+	groups := runtime.GOMAXPROCS(0)
+	if max := len(in) / parallelMinBlocks; groups > max {
+		groups = max
+	}
+	if groups < 2 {
+		be.doEncryptBlocks(in, out, firstBlockNo, fileID)
+		return
+	}
+	groupSize := len(in) / groups
+	var wg sync.WaitGroup
+	wg.Add(groups - 1)
+	for i := 0; i < groups-1; i++ {
+		low := i * groupSize
+		high := low + groupSize
+		encryptJobs <- encryptJob{
+			be:           be,
+			in:           in[low:high],
+			out:          out[low:high],
+			firstBlockNo: firstBlockNo + uint64(low),
+			fileID:       fileID,
+			wg:           &wg,
+		}
+	}
+	// Last group, picks up any left-over blocks
+	low := (groups - 1) * groupSize
+	be.doEncryptBlocks(in[low:], out[low:], firstBlockNo+uint64(low), fileID)
+	wg.Wait()
+}
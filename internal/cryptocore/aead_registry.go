@@ -0,0 +1,189 @@
+package cryptocore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"fmt"
+	"log"
+
+	"github.com/rfjakob/gocryptfs/internal/siv_aead"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/internal/xchacha"
+)
+
+// AEADFactory creates the content encryption AEAD from the master key "key".
+// It should panic if it cannot handle "IVLen" (in bytes) or the other
+// parameters. "useHKDF" tells it to derive its own key from "key" using
+// HKDFDerive instead of using "key" directly.
+type AEADFactory func(key []byte, IVLen int, useHKDF bool, forceDecode bool) cipher.AEAD
+
+// AEADBackendSpec describes a content encryption backend.
+type AEADBackendSpec struct {
+	// Name is a human-readable name for log messages.
+	Name string
+	// FeatureFlag is the gocryptfs.conf feature flag that selects this
+	// backend. Empty for the default AES-GCM backends.
+	FeatureFlag string
+	// IVBits is the nonce length in bits that should be used with this
+	// backend.
+	IVBits int
+	// Deterministic is true if the AEAD stays secure with deterministic
+	// nonces, as used in reverse mode.
+	Deterministic bool
+	// New creates the AEAD.
+	New AEADFactory
+}
+
+// aeadRegistry maps the backend type to its spec. It is populated
+// during initialization and read-only afterwards.
+var aeadRegistry = map[AEADTypeEnum]AEADBackendSpec{}
+
+// RegisterAEADBackend makes a content encryption backend available for
+// use with New. This must be called during initialization, for example
+// from an init() function, and panics on duplicate types or feature
+// flags.
+func RegisterAEADBackend(t AEADTypeEnum, spec AEADBackendSpec) {
+	if _, ok := aeadRegistry[t]; ok {
+		log.Panicf("AEAD backend %d registered twice", t)
+	}
+	if spec.FeatureFlag != "" {
+		if _, ok := BackendForFeatureFlag(spec.FeatureFlag); ok {
+			log.Panicf("AEAD feature flag %q registered twice", spec.FeatureFlag)
+		}
+	}
+	if spec.New == nil || spec.IVBits <= 0 || spec.IVBits%8 != 0 {
+		log.Panicf("invalid spec for AEAD backend %d", t)
+	}
+	aeadRegistry[t] = spec
+}
+
+// BackendForFeatureFlag returns the backend that is selected by the
+// feature flag "flag".
+func BackendForFeatureFlag(flag string) (AEADTypeEnum, bool) {
+	for t, spec := range aeadRegistry {
+		if spec.FeatureFlag != "" && spec.FeatureFlag == flag {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// Spec returns the registered spec for backend "t". It panics if the
+// backend is unknown.
+func (t AEADTypeEnum) Spec() AEADBackendSpec {
+	spec, ok := aeadRegistry[t]
+	if !ok {
+		log.Panicf("unknown AEAD backend %d", t)
+	}
+	return spec
+}
+
+func (t AEADTypeEnum) String() string {
+	if spec, ok := aeadRegistry[t]; ok {
+		return spec.Name
+	}
+	return fmt.Sprintf("AEADTypeEnum(%d)", int(t))
+}
+
+func init() {
+	RegisterAEADBackend(BackendOpenSSL, AEADBackendSpec{
+		Name:   "AES-GCM-256-OpenSSL",
+		IVBits: 128,
+		New:    newOpenSSLGCM,
+	})
+	RegisterAEADBackend(BackendGoGCM, AEADBackendSpec{
+		Name:   "AES-GCM-256-Go",
+		IVBits: 128,
+		New:    newGoGCM,
+	})
+	RegisterAEADBackend(BackendAESSIV, AEADBackendSpec{
+		Name:          "AES-SIV-512-Go",
+		FeatureFlag:   "AESSIV",
+		IVBits:        128,
+		Deterministic: true,
+		New:           newAESSIV,
+	})
+	RegisterAEADBackend(BackendXChaCha20Poly1305, AEADBackendSpec{
+		Name:        "XChaCha20-Poly1305-Go",
+		FeatureFlag: "XChaCha20Poly1305",
+		IVBits:      192,
+		New:         newXChaCha,
+	})
+}
+
+// gcmKey returns the key for the AES-GCM backends
+func gcmKey(key []byte, useHKDF bool) []byte {
+	if useHKDF {
+		return HKDFDerive(key, hkdfInfoGCMContent, KeyLen)
+	}
+	return append([]byte{}, key...)
+}
+
+func newOpenSSLGCM(key []byte, IVLen int, useHKDF bool, forceDecode bool) cipher.AEAD {
+	if IVLen != 16 {
+		log.Panic("stupidgcm only supports 128-bit IVs")
+	}
+	k := gcmKey(key, useHKDF)
+	aeadCipher := stupidgcm.New(k, forceDecode)
+	for i := range k {
+		k[i] = 0
+	}
+	return aeadCipher
+}
+
+func newGoGCM(key []byte, IVLen int, useHKDF bool, forceDecode bool) cipher.AEAD {
+	k := gcmKey(key, useHKDF)
+	goGcmBlockCipher, err := aes.NewCipher(k)
+	for i := range k {
+		k[i] = 0
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	aeadCipher, err := cipher.NewGCMWithNonceSize(goGcmBlockCipher, IVLen)
+	if err != nil {
+		log.Panic(err)
+	}
+	return aeadCipher
+}
+
+func newAESSIV(key []byte, IVLen int, useHKDF bool, forceDecode bool) cipher.AEAD {
+	if IVLen != 16 {
+		// SIV supports any nonce size, but we only use 16.
+		log.Panic("AES-SIV must use 16-byte nonces")
+	}
+	// AES-SIV uses 1/2 of the key for authentication, 1/2 for
+	// encryption, so we need a 64-bytes key for AES-256. Derive it from
+	// the 32-byte master key using HKDF, or, for older filesystems, with
+	// SHA256.
+	var key64 []byte
+	if useHKDF {
+		key64 = HKDFDerive(key, hkdfInfoSIVContent, siv_aead.KeyLen)
+	} else {
+		s := sha512.Sum512(key)
+		key64 = s[:]
+	}
+	aeadCipher := siv_aead.New(key64)
+	for i := range key64 {
+		key64[i] = 0
+	}
+	return aeadCipher
+}
+
+func newXChaCha(key []byte, IVLen int, useHKDF bool, forceDecode bool) cipher.AEAD {
+	if IVLen != xchacha.NonceLen {
+		log.Panicf("XChaCha20-Poly1305 must use %d-byte nonces", xchacha.NonceLen)
+	}
+	// XChaCha20-Poly1305 is only used on new filesystems, so HKDF is
+	// always enabled
+	if !useHKDF {
+		log.Panic("XChaCha20-Poly1305 requires HKDF")
+	}
+	chachaKey := HKDFDerive(key, hkdfInfoXChaChaPoly1305Content, xchacha.KeyLen)
+	aeadCipher := xchacha.New(chachaKey)
+	for i := range chachaKey {
+		chachaKey[i] = 0
+	}
+	return aeadCipher
+}
@@ -0,0 +1,50 @@
+package cryptocore
+
+import (
+	"crypto/cipher"
+	"testing"
+)
+
+// Register a custom backend and check that New picks it up
+func TestRegisterAEADBackend(t *testing.T) {
+	const backendTest AEADTypeEnum = 100
+	called := false
+	RegisterAEADBackend(backendTest, AEADBackendSpec{
+		Name:        "test",
+		FeatureFlag: "TestBackend",
+		IVBits:      128,
+		New: func(key []byte, IVLen int, useHKDF bool, forceDecode bool) cipher.AEAD {
+			called = true
+			return newGoGCM(key, IVLen, useHKDF, forceDecode)
+		},
+	})
+	defer delete(aeadRegistry, backendTest)
+	be, ok := BackendForFeatureFlag("TestBackend")
+	if !ok || be != backendTest {
+		t.Fatalf("BackendForFeatureFlag: be=%d ok=%v", be, ok)
+	}
+	c := New(make([]byte, KeyLen), be, be.Spec().IVBits, true, false)
+	if !called || c.AEADBackend != backendTest || c.IVLen != 16 {
+		t.Errorf("custom backend was not used")
+	}
+	if be.String() != "test" {
+		t.Errorf("wrong name %q", be.String())
+	}
+	if _, ok := BackendForFeatureFlag(""); ok {
+		t.Error("empty feature flag must not match")
+	}
+}
+
+// Registering a feature flag twice should panic
+func TestRegisterAEADBackendDup(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	RegisterAEADBackend(101, AEADBackendSpec{
+		FeatureFlag: "AESSIV",
+		IVBits:      128,
+		New:         newAESSIV,
+	})
+}
@@ -5,15 +5,12 @@ package cryptocore
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha512"
 	"fmt"
 	"log"
 	"runtime"
 
 	"github.com/rfjakob/eme"
 
-	"github.com/rfjakob/gocryptfs/internal/siv_aead"
-	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -34,13 +31,16 @@ const (
 	BackendGoGCM AEADTypeEnum = 4
 	// BackendAESSIV specifies an AESSIV backend.
 	BackendAESSIV AEADTypeEnum = 5
+	// BackendXChaCha20Poly1305 specifies the XChaCha20-Poly1305 backend.
+	BackendXChaCha20Poly1305 AEADTypeEnum = 6
 )
 
 // CryptoCore is the low level crypto implementation.
 type CryptoCore struct {
 	// EME is used for filename encryption.
 	EMECipher *eme.EMECipher
-	// GCM or AES-SIV. This is used for content encryption.
+	// Created by the registered backend (see RegisterAEADBackend). This is
+	// used for content encryption.
 	AEADCipher cipher.AEAD
 	// Which backend is behind AEADCipher?
 	AEADBackend AEADTypeEnum
@@ -70,7 +70,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 	{
 		var emeBlockCipher cipher.Block
 		if useHKDF {
-			emeKey := hkdfDerive(key, hkdfInfoEMENames, KeyLen)
+			emeKey := HKDFDerive(key, hkdfInfoEMENames, KeyLen)
 			emeBlockCipher, err = aes.NewCipher(emeKey)
 			for i := range emeKey {
 				emeKey[i] = 0
@@ -85,56 +85,11 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 	}
 
 	// Initialize an AEAD cipher for file content encryption.
-	var aeadCipher cipher.AEAD
-	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM {
-		var gcmKey []byte
-		if useHKDF {
-			gcmKey = hkdfDerive(key, hkdfInfoGCMContent, KeyLen)
-		} else {
-			gcmKey = append([]byte{}, key...)
-		}
-		switch aeadType {
-		case BackendOpenSSL:
-			if IVLen != 16 {
-				log.Panic("stupidgcm only supports 128-bit IVs")
-			}
-			aeadCipher = stupidgcm.New(gcmKey, forceDecode)
-		case BackendGoGCM:
-			goGcmBlockCipher, err := aes.NewCipher(gcmKey)
-			if err != nil {
-				log.Panic(err)
-			}
-			aeadCipher, err = cipher.NewGCMWithNonceSize(goGcmBlockCipher, IVLen)
-			if err != nil {
-				log.Panic(err)
-			}
-		}
-		for i := range gcmKey {
-			gcmKey[i] = 0
-		}
-	} else if aeadType == BackendAESSIV {
-		if IVLen != 16 {
-			// SIV supports any nonce size, but we only use 16.
-			log.Panic("AES-SIV must use 16-byte nonces")
-		}
-		// AES-SIV uses 1/2 of the key for authentication, 1/2 for
-		// encryption, so we need a 64-bytes key for AES-256. Derive it from
-		// the 32-byte master key using HKDF, or, for older filesystems, with
-		// SHA256.
-		var key64 []byte
-		if useHKDF {
-			key64 = hkdfDerive(key, hkdfInfoSIVContent, siv_aead.KeyLen)
-		} else {
-			s := sha512.Sum512(key)
-			key64 = s[:]
-		}
-		aeadCipher = siv_aead.New(key64)
-		for i := range key64 {
-			key64[i] = 0
-		}
-	} else {
+	spec, ok := aeadRegistry[aeadType]
+	if !ok {
 		log.Panic("unknown backend cipher")
 	}
+	aeadCipher := spec.New(key, IVLen, useHKDF, forceDecode)
 
 	return &CryptoCore{
 		EMECipher:   emeCipher,
@@ -156,11 +111,8 @@ type wiper interface {
 // still raises to bar for extracting the key.
 func (c *CryptoCore) Wipe() {
 	be := c.AEADBackend
-	if be == BackendOpenSSL || be == BackendAESSIV {
+	if w, ok := c.AEADCipher.(wiper); ok {
 		tlog.Debug.Printf("CryptoCore.Wipe: Wiping AEADBackend %d key", be)
-		// We don't use "x, ok :=" because we *want* to crash loudly if the
-		// type assertion fails.
-		w := c.AEADCipher.(wiper)
 		w.Wipe()
 	} else {
 		tlog.Debug.Printf("CryptoCore.Wipe: Only nil'ing stdlib refs")
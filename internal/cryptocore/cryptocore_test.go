@@ -18,6 +18,12 @@ func TestCryptoCoreNew(t *testing.T) {
 		if c.IVLen != 16 {
 			t.Fail()
 		}
+		if useHKDF {
+			c = New(key, BackendXChaCha20Poly1305, 192, useHKDF, false)
+			if c.IVLen != 24 {
+				t.Fail()
+			}
+		}
 		if stupidgcm.BuiltWithoutOpenssl {
 			continue
 		}
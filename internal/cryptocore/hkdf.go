@@ -2,6 +2,7 @@ package cryptocore
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"log"
 
 	"golang.org/x/crypto/hkdf"
@@ -10,20 +11,36 @@ import (
 const (
 	// "info" data that HKDF mixes into the generated key to make it unique.
 	// For convenience, we use a readable string.
-	hkdfInfoEMENames   = "EME filename encryption"
-	hkdfInfoGCMContent = "AES-GCM file content encryption"
-	hkdfInfoSIVContent = "AES-SIV file content encryption"
+	hkdfInfoEMENames               = "EME filename encryption"
+	hkdfInfoGCMContent             = "AES-GCM file content encryption"
+	hkdfInfoSIVContent             = "AES-SIV file content encryption"
+	hkdfInfoXChaChaPoly1305Content = "XChaCha20-Poly1305 file content encryption"
+	hkdfInfoInoNamespace           = "inode number namespace"
+	hkdfInfoManifest               = "fsck content manifest"
 )
 
-// hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
+// HKDFDerive derives "outLen" bytes from "masterkey" and "info" using
 // HKDF-SHA256 (RFC 5869).
 // It returns the derived bytes or panics.
-func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
+func HKDFDerive(masterkey []byte, info string, outLen int) (out []byte) {
 	h := hkdf.New(sha256.New, masterkey, nil, []byte(info))
 	out = make([]byte, outLen)
 	n, err := h.Read(out)
 	if n != outLen || err != nil {
-		log.Panicf("hkdfDerive: hkdf read failed, got %d bytes, error: %v", n, err)
+		log.Panicf("HKDFDerive: hkdf read failed, got %d bytes, error: %v", n, err)
 	}
 	return out
 }
+
+// InoNamespace derives a value that identifies the filesystem from
+// "masterkey", for "-ino_namespace". It stays the same as long as the master
+// key does, and reveals nothing about it.
+func InoNamespace(masterkey []byte) uint64 {
+	return binary.LittleEndian.Uint64(HKDFDerive(masterkey, hkdfInfoInoNamespace, 8))
+}
+
+// ManifestKey derives the HMAC key of the "-write_manifest" file of fsck
+// from "masterkey"
+func ManifestKey(masterkey []byte) []byte {
+	return HKDFDerive(masterkey, hkdfInfoManifest, KeyLen)
+}
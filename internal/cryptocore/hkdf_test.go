@@ -12,7 +12,7 @@ type hkdfTestCase struct {
 	out       []byte
 }
 
-// TestHkdfDerive verifies that we get the expected values from hkdfDerive. They
+// TestHkdfDerive verifies that we get the expected values from HKDFDerive. They
 // must not change because this would change the on-disk format.
 func TestHkdfDerive(t *testing.T) {
 	master0 := bytes.Repeat([]byte{0x00}, 32)
@@ -34,7 +34,7 @@ func TestHkdfDerive(t *testing.T) {
 	}
 
 	for i, v := range testCases {
-		out := hkdfDerive(v.masterkey, v.info, 32)
+		out := HKDFDerive(v.masterkey, v.info, 32)
 		if !bytes.Equal(out, v.out) {
 			want := hex.EncodeToString(v.out)
 			have := hex.EncodeToString(out)
@@ -30,3 +30,12 @@ type nonceGenerator struct {
 func (n *nonceGenerator) Get() []byte {
 	return randPrefetcher.read(n.nonceLen)
 }
+
+// Fill writes a random nonce into "b", which must be "nonceLen" bytes long.
+// Unlike Get, it does not allocate.
+func (n *nonceGenerator) Fill(b []byte) {
+	if len(b) != n.nonceLen {
+		log.Panicf("wrong nonce length %d", len(b))
+	}
+	randPrefetcher.readInto(b)
+}
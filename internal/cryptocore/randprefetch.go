@@ -24,12 +24,19 @@ type randPrefetcherT struct {
 
 func (r *randPrefetcherT) read(want int) (out []byte) {
 	out = make([]byte, want)
+	r.readInto(out)
+	return out
+}
+
+// readInto fills "out" with random bytes
+func (r *randPrefetcherT) readInto(out []byte) {
+	want := len(out)
 	r.Lock()
 	// Note: don't use defer, it slows us down!
 	have, err := r.buf.Read(out)
 	if have == want && err == nil {
 		r.Unlock()
-		return out
+		return
 	}
 	// Buffer was empty -> re-fill
 	fresh := <-r.refill
@@ -43,7 +50,6 @@ func (r *randPrefetcherT) read(want int) (out []byte) {
 		log.Panicf("randPrefetcher could not satisfy read: have=%d want=%d err=%v", have, want, err)
 	}
 	r.Unlock()
-	return out
 }
 
 func (r *randPrefetcherT) refillWorker() {
@@ -0,0 +1,84 @@
+package ctlsock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	abi "github.com/rfjakob/gocryptfs/ctlsock"
+)
+
+const (
+	// OpEncrypt is the name of the EncryptPath request type in an ACL
+	OpEncrypt = abi.CmdEncrypt
+	// OpDecrypt is the name of the DecryptPath request type in an ACL
+	OpDecrypt = abi.CmdDecrypt
+	// OpRevokeKey is the name of the revoke_key request type in an ACL
+	OpRevokeKey = abi.CmdRevokeKey
+	// OpChangePassword is the name of the changepasswd request type in an ACL
+	OpChangePassword = abi.CmdChangePassword
+	// OpUnfreeze is the name of the unfreeze request type in an ACL
+	OpUnfreeze = abi.CmdUnfreeze
+	// OpFreeze is the name of the freeze request type in an ACL
+	OpFreeze = abi.CmdFreeze
+	// OpThaw is the name of the thaw request type in an ACL
+	OpThaw = abi.CmdThaw
+	// OpChanges is the name of the changes request type in an ACL
+	OpChanges = abi.CmdChanges
+	// aclAnyUID is the key for the "*" wildcard entry
+	aclAnyUID = -1
+)
+
+// ACL maps the UID of a connecting process to the request types it is
+// allowed to send. A nil ACL allows everything except changepasswd, which
+// needs an explicit entry because it lets the caller guess the password.
+type ACL map[int]map[string]bool
+
+// ParseACL parses an ACL string like "0:encrypt+decrypt,1000:encrypt".
+// Entries are separated by commas and consist of a UID (or "*" for any
+// user), a colon, and the allowed request types separated by "+".
+// An empty string returns a nil ACL.
+func ParseACL(s string) (ACL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	acl := make(ACL)
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid entry %q, expected UID:TYPES", entry)
+		}
+		uid := aclAnyUID
+		if parts[0] != "*" {
+			var err error
+			uid, err = strconv.Atoi(parts[0])
+			if err != nil || uid < 0 {
+				return nil, fmt.Errorf("invalid UID %q", parts[0])
+			}
+		}
+		if acl[uid] == nil {
+			acl[uid] = make(map[string]bool)
+		}
+		for _, op := range strings.Split(parts[1], "+") {
+			if op != OpEncrypt && op != OpDecrypt && op != OpRevokeKey && op != OpChangePassword &&
+				op != OpUnfreeze && op != OpFreeze && op != OpThaw && op != OpChanges {
+				return nil, fmt.Errorf("unknown request type %q", op)
+			}
+			acl[uid][op] = true
+		}
+	}
+	return acl, nil
+}
+
+// Allowed returns true if the user "uid" may send requests of type "op".
+// Pass uid = -1 if the UID of the peer is unknown, then only the "*" entry
+// applies.
+func (acl ACL) Allowed(uid int, op string) bool {
+	if acl == nil {
+		return op != OpChangePassword
+	}
+	if uid >= 0 && acl[uid][op] {
+		return true
+	}
+	return acl[aclAnyUID][op]
+}
@@ -0,0 +1,47 @@
+package ctlsock
+
+import (
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL("")
+	if err != nil || acl != nil {
+		t.Errorf("empty string: acl=%v err=%v", acl, err)
+	}
+	if !acl.Allowed(1000, OpDecrypt) {
+		t.Error("nil ACL must allow decrypt")
+	}
+	if acl.Allowed(0, OpChangePassword) {
+		t.Error("nil ACL must not allow changepasswd")
+	}
+	acl, err = ParseACL("0:encrypt+decrypt,1000:encrypt,*:encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		uid     int
+		op      string
+		allowed bool
+	}{
+		{0, OpEncrypt, true},
+		{0, OpDecrypt, true},
+		{1000, OpEncrypt, true},
+		{1000, OpDecrypt, false},
+		{1001, OpEncrypt, true},
+		{1001, OpDecrypt, false},
+		{-1, OpEncrypt, true},
+		{-1, OpDecrypt, false},
+	}
+	for _, tc := range testCases {
+		if acl.Allowed(tc.uid, tc.op) != tc.allowed {
+			t.Errorf("uid=%d op=%s: want allowed=%v", tc.uid, tc.op, tc.allowed)
+		}
+	}
+	for _, in := range []string{"1000", "x:encrypt", "-5:encrypt", "1000:foo", "1000:encrypt,"} {
+		_, err = ParseACL(in)
+		if err == nil {
+			t.Errorf("%q should have been rejected", in)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package ctlsock
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	abi "github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// The HTTP API ("-ctlsock_http") speaks the JSON protocol of the control
+// socket for clients that cannot use unix sockets:
+//
+// * POST / takes one request in the format of the socket protocol and
+//   returns the response. Version 2 results are not split.
+// * GET /encrypt?path=a/b and GET /decrypt?path=... translate the "path"
+//   arguments like the version 2 encrypt and decrypt commands.
+//
+// Anybody on the machine can connect to a TCP port, and the peer UID is
+// unknown. Therefore only the "*" entry of the ACL applies, and the
+// commands that change the filesystem state (revoke_key, changepasswd,
+// unfreeze, freeze, thaw) are not available. Without an ACL, nothing is
+// allowed, unlike on the socket.
+
+// httpMaxRequest is the maximum size of a POST body, the same as on the
+// socket
+const httpMaxRequest = abi.MaxRequestSize
+
+// httpCommands are the version 2 commands that the HTTP API supports
+var httpCommands = []string{abi.CmdHello, abi.CmdEncrypt, abi.CmdDecrypt}
+
+type httpHandler struct {
+	ch ctlSockHandler
+}
+
+// ServeHTTPAPI serves the HTTP API on "l". This call blocks so you probably
+// want to run it in a new goroutine.
+func ServeHTTPAPI(l net.Listener, fs Interface, acl ACL) {
+	srv := &http.Server{Handler: newHTTPHandler(fs, acl)}
+	err := srv.Serve(l)
+	// Like in acceptLoop, this triggers on program exit
+	tlog.Info.Printf("ctlsock_http: Serve error: %v", err)
+}
+
+func newHTTPHandler(fs Interface, acl ACL) http.Handler {
+	if acl == nil {
+		// A nil ACL allows everything, an empty one nothing
+		acl = ACL{}
+	}
+	return &httpHandler{ch: ctlSockHandler{fs: fs, acl: acl}}
+}
+
+// IsLoopback returns true if "host" is "localhost" or a loopback IP
+// address. The HTTP API must not be reachable from the network.
+func IsLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Web pages can send requests to localhost as well. Browsers do not let
+	// them change the Host header, which protects against DNS rebinding,
+	// and add an Origin header to cross-origin POST and script requests.
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if !IsLoopback(strings.Trim(host, "[]")) || r.Header.Get("Origin") != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == "/" && r.Method == http.MethodPost:
+		h.handlePost(w, r)
+	case (r.URL.Path == "/encrypt" || r.URL.Path == "/decrypt") && r.Method == http.MethodGet:
+		h.handleGet(w, r, r.URL.Path[1:])
+	case r.URL.Path == "/" || r.URL.Path == "/encrypt" || r.URL.Path == "/decrypt":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handlePost handles a request in the socket protocol format
+func (h *httpHandler) handlePost(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, httpMaxRequest+1))
+	if err != nil {
+		return
+	}
+	if len(body) > httpMaxRequest {
+		http.Error(w, "Request too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var in abi.RequestStruct
+	if err = json.Unmarshal(body, &in); err != nil {
+		var reply abi.ResponseStruct
+		reply.ErrNo, reply.ErrText = errnoOf(errors.New("JSON Unmarshal error: " + err.Error()))
+		writeHTTPResponse(w, http.StatusBadRequest, &reply)
+		return
+	}
+	if in.Version < 2 {
+		h.handleV1(w, &in)
+		return
+	}
+	reply := abi.ResponseStruct{
+		Version: abi.ProtocolVersion,
+		ID:      in.ID,
+	}
+	switch in.Command {
+	case abi.CmdHello:
+		reply.Commands = append([]string{}, httpCommands...)
+		writeHTTPResponse(w, http.StatusOK, &reply)
+	case abi.CmdEncrypt, abi.CmdDecrypt:
+		h.translatePaths(w, in.Command, in.Paths, reply)
+	default:
+		reply.ErrNo = int32(syscall.ENOSYS)
+		reply.ErrText = "Unknown command '" + in.Command + "'"
+		writeHTTPResponse(w, http.StatusBadRequest, &reply)
+	}
+}
+
+// handleV1 handles a version 1 request, see handleRequest
+func (h *httpHandler) handleV1(w http.ResponseWriter, in *abi.RequestStruct) {
+	var reply abi.ResponseStruct
+	if in.DecryptPath != "" && in.EncryptPath != "" {
+		reply.ErrNo, reply.ErrText = errnoOf(errors.New("Ambiguous"))
+		writeHTTPResponse(w, http.StatusBadRequest, &reply)
+		return
+	}
+	if in.DecryptPath == "" && in.EncryptPath == "" {
+		reply.ErrNo, reply.ErrText = errnoOf(errors.New("Empty input"))
+		writeHTTPResponse(w, http.StatusBadRequest, &reply)
+		return
+	}
+	op := OpEncrypt
+	inPath := in.EncryptPath
+	if in.DecryptPath != "" {
+		op = OpDecrypt
+		inPath = in.DecryptPath
+	}
+	if !h.ch.acl.Allowed(-1, op) {
+		reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+		writeHTTPResponse(w, http.StatusForbidden, &reply)
+		return
+	}
+	var err error
+	reply.Result, reply.WarnText, err = h.ch.translatePath(op, inPath)
+	reply.ErrNo, reply.ErrText = errnoOf(err)
+	writeHTTPResponse(w, http.StatusOK, &reply)
+}
+
+// handleGet translates the "path" query arguments
+func (h *httpHandler) handleGet(w http.ResponseWriter, r *http.Request, op string) {
+	reply := abi.ResponseStruct{Version: abi.ProtocolVersion}
+	h.translatePaths(w, op, r.URL.Query()["path"], reply)
+}
+
+// translatePaths translates "paths" and sends all results in one response.
+// "reply" is the template for the response.
+func (h *httpHandler) translatePaths(w http.ResponseWriter, op string, paths []string, reply abi.ResponseStruct) {
+	if !h.ch.acl.Allowed(-1, op) {
+		reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+		writeHTTPResponse(w, http.StatusForbidden, &reply)
+		return
+	}
+	if len(paths) == 0 {
+		reply.ErrNo, reply.ErrText = errnoOf(errors.New("Empty input"))
+		writeHTTPResponse(w, http.StatusBadRequest, &reply)
+		return
+	}
+	reply.Results = make([]abi.ResultStruct, len(paths))
+	for i, p := range paths {
+		res := &reply.Results[i]
+		var err error
+		res.Result, res.WarnText, err = h.ch.translatePath(op, p)
+		res.ErrNo, res.ErrText = errnoOf(err)
+	}
+	writeHTTPResponse(w, http.StatusOK, &reply)
+}
+
+// writeHTTPResponse sends "msg" as JSON with the HTTP status "code"
+func writeHTTPResponse(w http.ResponseWriter, code int, msg *abi.ResponseStruct) {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		tlog.Warn.Printf("ctlsock_http: Marshal failed: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(jsonMsg, '\n'))
+}
@@ -0,0 +1,104 @@
+package ctlsock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	abi "github.com/rfjakob/gocryptfs/ctlsock"
+)
+
+func httpRequest(t *testing.T, h http.Handler, r *http.Request) (int, abi.ResponseStruct) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var resp abi.ResponseStruct
+	if w.Header().Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+// httpACL allows the path translation over HTTP
+func httpACL(t *testing.T) ACL {
+	acl, err := ParseACL("*:encrypt+decrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acl
+}
+
+func TestHTTPGet(t *testing.T) {
+	h := newHTTPHandler(fakeFS{}, httpACL(t))
+	r := httptest.NewRequest("GET", "http://127.0.0.1:8471/decrypt?path=A&path=MISSING&path=/B/", nil)
+	code, resp := httpRequest(t, h, r)
+	if code != http.StatusOK || len(resp.Results) != 3 {
+		t.Fatalf("code=%d resp=%+v", code, resp)
+	}
+	if resp.Results[0].Result != "a" {
+		t.Errorf("wrong result %q", resp.Results[0].Result)
+	}
+	if resp.Results[1].ErrNo != int32(syscall.ENOENT) {
+		t.Errorf("wrong errno %d", resp.Results[1].ErrNo)
+	}
+	if resp.Results[2].Result != "b" || resp.Results[2].WarnText == "" {
+		t.Errorf("wrong result %+v", resp.Results[2])
+	}
+}
+
+func TestHTTPPost(t *testing.T) {
+	h := newHTTPHandler(fakeFS{}, httpACL(t))
+	// Version 1
+	r := httptest.NewRequest("POST", "http://localhost/", strings.NewReader(`{"EncryptPath": "foo"}`))
+	code, resp := httpRequest(t, h, r)
+	if code != http.StatusOK || resp.Result != "FOO" {
+		t.Errorf("code=%d resp=%+v", code, resp)
+	}
+	// Version 2
+	r = httptest.NewRequest("POST", "http://localhost/", strings.NewReader(`{"Version": 2, "ID": 7, "Command": "hello"}`))
+	code, resp = httpRequest(t, h, r)
+	if code != http.StatusOK || resp.ID != 7 || strings.Join(resp.Commands, ",") != "hello,encrypt,decrypt" {
+		t.Errorf("code=%d resp=%+v", code, resp)
+	}
+	// State-changing commands are not available
+	r = httptest.NewRequest("POST", "http://localhost/", strings.NewReader(`{"Version": 2, "Command": "changepasswd"}`))
+	code, resp = httpRequest(t, h, r)
+	if code != http.StatusBadRequest || resp.ErrNo != int32(syscall.ENOSYS) {
+		t.Errorf("code=%d resp=%+v", code, resp)
+	}
+}
+
+func TestHTTPForbidden(t *testing.T) {
+	h := newHTTPHandler(fakeFS{}, httpACL(t))
+	// DNS rebinding
+	r := httptest.NewRequest("GET", "http://evil.example.com/encrypt?path=a", nil)
+	if code, _ := httpRequest(t, h, r); code != http.StatusForbidden {
+		t.Errorf("Host: have %d", code)
+	}
+	// Request from a web page
+	r = httptest.NewRequest("POST", "http://127.0.0.1/", strings.NewReader(`{"EncryptPath": "foo"}`))
+	r.Header.Set("Origin", "http://evil.example.com")
+	if code, _ := httpRequest(t, h, r); code != http.StatusForbidden {
+		t.Errorf("Origin: have %d", code)
+	}
+	// Only the "*" ACL entry applies
+	acl, err := ParseACL("0:encrypt+decrypt,*:decrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = newHTTPHandler(fakeFS{}, acl)
+	r = httptest.NewRequest("GET", "http://[::1]:8471/encrypt?path=a", nil)
+	if code, resp := httpRequest(t, h, r); code != http.StatusForbidden || resp.ErrNo != int32(syscall.EACCES) {
+		t.Errorf("ACL: have %d %+v", code, resp)
+	}
+	// No ACL allows nothing
+	h = newHTTPHandler(fakeFS{}, nil)
+	r = httptest.NewRequest("GET", "http://127.0.0.1:8471/decrypt?path=A", nil)
+	if code, resp := httpRequest(t, h, r); code != http.StatusForbidden || resp.ErrNo != int32(syscall.EACCES) {
+		t.Errorf("no ACL: have %d %+v", code, resp)
+	}
+}
@@ -1,8 +1,14 @@
 // Package ctlsock implements the control socket interface that can be
 // activated by passing "-ctlsock" on the command line.
+//
+// Two protocol versions are spoken on the socket. Version 1 requests carry
+// a single EncryptPath or DecryptPath field and get exactly one response.
+// Requests with "Version" set to 2 or higher use the versioned protocol
+// implemented in ctlsock_v2.go.
 package ctlsock
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +17,8 @@ import (
 	"os"
 	"syscall"
 
+	abi "github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -20,38 +28,52 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
-// RequestStruct is sent by a client
-type RequestStruct struct {
-	EncryptPath string
-	DecryptPath string
-}
-
-// ResponseStruct is sent by us as response to a request
-type ResponseStruct struct {
-	// Result is the resulting decrypted or encrypted path. Empty on error.
-	Result string
-	// ErrNo is the error number as defined in errno.h.
-	// 0 means success and -1 means that the error number is not known
-	// (look at ErrText in this case).
-	ErrNo int32
-	// ErrText is a detailed error message.
-	ErrText string
-	// WarnText contains warnings that may have been encountered while
-	// processing the message.
-	WarnText string
-}
-
 type ctlSockHandler struct {
 	fs     Interface
 	socket *net.UnixListener
+	// acl restricts the request types per peer UID. nil allows everything.
+	acl ACL
+	// unfreezer enables abi.CmdUnfreeze. nil if "-guard" is not active.
+	unfreezer Unfreezer
+	// freezer enables abi.CmdFreeze and abi.CmdThaw. nil if not available.
+	freezer Freezer
+	// changes enables abi.CmdChanges. nil if not available.
+	changes ChangeCounter
 }
 
 // Serve serves incoming connections on "sock". This call blocks so you
 // probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
+// If "acl" is not nil, requests are checked against it (see ParseACL).
+func Serve(sock net.Listener, fs Interface, acl ACL) {
+	ServeGuard(sock, fs, acl, nil)
+}
+
+// ServeGuard works like Serve and additionally enables abi.CmdUnfreeze if
+// "u" is not nil.
+func ServeGuard(sock net.Listener, fs Interface, acl ACL, u Unfreezer) {
+	ServeExtras(sock, fs, acl, Extras{Unfreezer: u})
+}
+
+// Extras holds the implementations of optional commands that are not
+// provided by the filesystem itself. nil fields disable the command.
+type Extras struct {
+	// Unfreezer enables abi.CmdUnfreeze
+	Unfreezer Unfreezer
+	// Freezer enables abi.CmdFreeze and abi.CmdThaw
+	Freezer Freezer
+	// Changes enables abi.CmdChanges
+	Changes ChangeCounter
+}
+
+// ServeExtras works like Serve and additionally enables the commands in "e"
+func ServeExtras(sock net.Listener, fs Interface, acl ACL, e Extras) {
 	handler := ctlSockHandler{
-		fs:     fs,
-		socket: sock.(*net.UnixListener),
+		fs:        fs,
+		socket:    sock.(*net.UnixListener),
+		acl:       acl,
+		unfreezer: e.Unfreezer,
+		freezer:   e.Freezer,
+		changes:   e.Changes,
 	}
 	handler.acceptLoop()
 }
@@ -70,19 +92,19 @@ func (ch *ctlSockHandler) acceptLoop() {
 	}
 }
 
-// ReadBufSize is the size of the request read buffer.
-// The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
-// 5000 bytes should be enough to hold the whole JSON request. This
-// assumes that the path does not contain too many characters that had to be
-// be escaped in JSON (for example, a null byte blows up to "\u0000").
-// We abort the connection if the request is bigger than this.
-const ReadBufSize = 5000
-
 // handleConnection reads and parses JSON requests from "conn"
 func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
-	buf := make([]byte, ReadBufSize)
+	uid := -1
+	if ch.acl != nil {
+		var err error
+		uid, err = syscallcompat.PeerUID(conn)
+		if err != nil {
+			tlog.Debug.Printf("ctlsock: could not get peer UID: %v", err)
+		}
+	}
+	buf := make([]byte, abi.ReadBufSize)
 	for {
-		n, err := conn.Read(buf)
+		msg, err := readRequest(conn, buf)
 		if err == io.EOF {
 			conn.Close()
 			return
@@ -91,30 +113,66 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 			conn.Close()
 			return
 		}
-		if n == ReadBufSize {
-			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
+		if msg == nil {
+			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", abi.MaxRequestSize)
 			conn.Close()
 			return
 		}
-		buf = buf[:n]
-		var in RequestStruct
-		err = json.Unmarshal(buf, &in)
+		var in abi.RequestStruct
+		err = json.Unmarshal(msg, &in)
 		if err != nil {
 			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
 			err = errors.New("JSON Unmarshal error: " + err.Error())
 			sendResponse(conn, err, "", "")
 			continue
 		}
-		ch.handleRequest(&in, conn)
-		// Restore original size.
-		buf = buf[:cap(buf)]
+		if in.Version >= 2 {
+			ch.handleRequestV2(&in, conn, uid)
+		} else {
+			ch.handleRequest(&in, conn, uid)
+		}
 	}
 }
 
-// handleRequest handles an already-unmarshaled JSON request
-func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
+// readRequest reads one request from "conn" into "buf", which is grown up
+// to abi.MaxRequestSize. A big request can take several reads, so we read
+// until the data is no longer the start of a JSON object. Returns nil if
+// the request is too big.
+func readRequest(conn io.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if len(buf) > abi.MaxRequestSize {
+			return nil, nil
+		}
+		if err == io.EOF && len(buf) > 0 {
+			// Let the caller report the truncated request
+			return buf, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if !jsonIncomplete(buf) {
+			return buf, nil
+		}
+	}
+}
+
+// jsonIncomplete returns true if "buf" is empty or the beginning of a
+// valid JSON value
+func jsonIncomplete(buf []byte) bool {
+	var v json.RawMessage
+	err := json.NewDecoder(bytes.NewReader(buf)).Decode(&v)
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// handleRequest handles an already-unmarshaled JSON request from user "uid"
+func (ch *ctlSockHandler) handleRequest(in *abi.RequestStruct, conn *net.UnixConn, uid int) {
 	var err error
-	var inPath, outPath, clean, warnText string
+	var inPath string
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
 		err = errors.New("Ambiguous")
@@ -128,53 +186,78 @@ func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 		return
 	}
 	// Canonicalize input path
+	op := OpEncrypt
 	if in.EncryptPath != "" {
 		inPath = in.EncryptPath
 	} else {
 		inPath = in.DecryptPath
+		op = OpDecrypt
 	}
-	clean = SanitizePath(inPath)
+	if !ch.acl.Allowed(uid, op) {
+		tlog.Info.Printf("ctlsock: denied %q request from uid %d", op, uid)
+		sendResponse(conn, syscall.EACCES, "", "")
+		return
+	}
+	outPath, warnText, err := ch.translatePath(op, inPath)
+	sendResponse(conn, err, outPath, warnText)
+}
+
+// translatePath canonicalizes "inPath" and encrypts or decrypts it,
+// depending on "op".
+func (ch *ctlSockHandler) translatePath(op string, inPath string) (outPath string, warnText string, err error) {
+	clean := SanitizePath(inPath)
 	// Warn if a non-canonical path was passed
 	if inPath != clean {
 		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
 	}
 	// Error out if the canonical path is now empty
 	if clean == "" {
-		err = errors.New("Empty input after canonicalization")
-		sendResponse(conn, err, "", warnText)
-		return
+		return "", warnText, errors.New("Empty input after canonicalization")
 	}
 	// Actual encrypt or decrypt operation
-	if in.EncryptPath != "" {
+	if op == OpEncrypt {
 		outPath, err = ch.fs.EncryptPath(clean)
 	} else {
 		outPath, err = ch.fs.DecryptPath(clean)
 	}
-	sendResponse(conn, err, outPath, warnText)
+	return outPath, warnText, err
+}
+
+// errnoOf converts "err" to an error number and message for the response.
+// The error number is -1 if it cannot be determined.
+func errnoOf(err error) (errNo int32, errText string) {
+	if err == nil {
+		return 0, ""
+	}
+	errNo = -1
+	// Try to extract the actual error number
+	if pe, ok := err.(*os.PathError); ok {
+		if se, ok := pe.Err.(syscall.Errno); ok {
+			errNo = int32(se)
+		}
+	} else if se, ok := err.(syscall.Errno); ok {
+		errNo = int32(se)
+	}
+	return errNo, err.Error()
 }
 
 // sendResponse sends a JSON response message
 func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
-	msg := ResponseStruct{
+	msg := abi.ResponseStruct{
 		Result:   result,
 		WarnText: warnText,
 	}
-	if err != nil {
-		msg.ErrText = err.Error()
-		msg.ErrNo = -1
-		// Try to extract the actual error number
-		if pe, ok := err.(*os.PathError); ok {
-			if se, ok := pe.Err.(syscall.Errno); ok {
-				msg.ErrNo = int32(se)
-			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
-		}
-	}
+	msg.ErrNo, msg.ErrText = errnoOf(err)
+	writeResponse(conn, &msg)
+}
+
+// writeResponse marshals "msg" and writes it to "conn", terminated by a
+// newline.
+func writeResponse(conn *net.UnixConn, msg *abi.ResponseStruct) error {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
-		return
+		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	jsonMsg = append(jsonMsg, '\n')
@@ -182,4 +265,5 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Write failed: %v", err)
 	}
+	return err
 }
@@ -0,0 +1,192 @@
+package ctlsock
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	abi "github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// supportedCommands is sent in reply to abi.CmdHello. abi.CmdRevokeKey and
+// abi.CmdChangePassword are added if the filesystem implements KeyRevoker
+// and PasswordChanger, respectively, abi.CmdUnfreeze if an Unfreezer,
+// abi.CmdFreeze and abi.CmdThaw if a Freezer and abi.CmdChanges if a
+// ChangeCounter has been passed to ServeExtras().
+var supportedCommands = []string{abi.CmdHello, abi.CmdEncrypt, abi.CmdDecrypt}
+
+// KeyRevoker is implemented by the Interface passed to Serve() if the
+// master key has been stored in the kernel keyring. It enables
+// abi.CmdRevokeKey.
+type KeyRevoker interface {
+	RevokeKey() error
+}
+
+// PasswordChanger is implemented by the Interface passed to Serve() if the
+// filesystem has a config file whose password can be changed while mounted.
+// It enables abi.CmdChangePassword.
+type PasswordChanger interface {
+	ChangePassword(oldPw []byte, newPw []byte) error
+}
+
+// Unfreezer is implemented by the "-guard" intrusion heuristic. It enables
+// abi.CmdUnfreeze.
+type Unfreezer interface {
+	Unfreeze() error
+}
+
+// Freezer blocks the modifying operations so that CIPHERDIR can be
+// snapshotted. It enables abi.CmdFreeze and abi.CmdThaw.
+type Freezer interface {
+	Freeze() error
+	Thaw() error
+}
+
+// ChangeCounter counts the modifying operations. It enables
+// abi.CmdChanges.
+type ChangeCounter interface {
+	Changes() (epoch string, n uint64)
+}
+
+// ChunkSize is the maximum number of results that are sent in a single
+// response message. Longer result lists are streamed as several messages
+// with "More" set on all but the last one.
+const ChunkSize = 100
+
+// handleRequestV2 handles a version 2+ request from user "uid". Unknown
+// commands are rejected with ENOSYS so that clients can fall back
+// gracefully when talking to an older server.
+func (ch *ctlSockHandler) handleRequestV2(in *abi.RequestStruct, conn *net.UnixConn, uid int) {
+	reply := abi.ResponseStruct{
+		Version: abi.ProtocolVersion,
+		ID:      in.ID,
+	}
+	switch in.Command {
+	case abi.CmdHello:
+		reply.Commands = append([]string{}, supportedCommands...)
+		if _, ok := ch.fs.(KeyRevoker); ok {
+			reply.Commands = append(reply.Commands, abi.CmdRevokeKey)
+		}
+		if _, ok := ch.fs.(PasswordChanger); ok {
+			reply.Commands = append(reply.Commands, abi.CmdChangePassword)
+		}
+		if ch.unfreezer != nil {
+			reply.Commands = append(reply.Commands, abi.CmdUnfreeze)
+		}
+		if ch.freezer != nil {
+			reply.Commands = append(reply.Commands, abi.CmdFreeze, abi.CmdThaw)
+		}
+		if ch.changes != nil {
+			reply.Commands = append(reply.Commands, abi.CmdChanges)
+		}
+		reply.MaxRequestSize = abi.MaxRequestSize
+		writeResponse(conn, &reply)
+	case abi.CmdRevokeKey:
+		kr, ok := ch.fs.(KeyRevoker)
+		if !ok {
+			reply.ErrNo = int32(syscall.ENOSYS)
+			reply.ErrText = "The master key is not stored in the kernel keyring"
+		} else if !ch.acl.Allowed(uid, in.Command) {
+			tlog.Info.Printf("ctlsock: denied %q request from uid %d", in.Command, uid)
+			reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+		} else {
+			tlog.Info.Printf("ctlsock: revoking the master key in the kernel keyring")
+			reply.ErrNo, reply.ErrText = errnoOf(kr.RevokeKey())
+		}
+		writeResponse(conn, &reply)
+	case abi.CmdChangePassword:
+		pc, ok := ch.fs.(PasswordChanger)
+		if !ok {
+			reply.ErrNo = int32(syscall.ENOSYS)
+			reply.ErrText = "The filesystem has no config file"
+		} else if !ch.acl.Allowed(uid, in.Command) {
+			tlog.Info.Printf("ctlsock: denied %q request from uid %d", in.Command, uid)
+			reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+		} else if in.NewPassword == "" {
+			reply.ErrNo, reply.ErrText = errnoOf(errors.New("Empty new password"))
+		} else {
+			tlog.Info.Printf("ctlsock: changing the password")
+			reply.ErrNo, reply.ErrText = errnoOf(pc.ChangePassword([]byte(in.OldPassword), []byte(in.NewPassword)))
+		}
+		writeResponse(conn, &reply)
+	case abi.CmdUnfreeze:
+		if ch.unfreezer == nil {
+			reply.ErrNo = int32(syscall.ENOSYS)
+			reply.ErrText = "The -guard option is not active"
+		} else if !ch.acl.Allowed(uid, in.Command) {
+			tlog.Info.Printf("ctlsock: denied %q request from uid %d", in.Command, uid)
+			reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+		} else {
+			tlog.Info.Printf("ctlsock: unfreezing the filesystem")
+			reply.ErrNo, reply.ErrText = errnoOf(ch.unfreezer.Unfreeze())
+		}
+		writeResponse(conn, &reply)
+	case abi.CmdFreeze, abi.CmdThaw:
+		if ch.freezer == nil {
+			reply.ErrNo = int32(syscall.ENOSYS)
+			reply.ErrText = "Freezing is not available on this mount"
+		} else if !ch.acl.Allowed(uid, in.Command) {
+			tlog.Info.Printf("ctlsock: denied %q request from uid %d", in.Command, uid)
+			reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+		} else if in.Command == abi.CmdFreeze {
+			tlog.Info.Printf("ctlsock: freezing the filesystem")
+			reply.ErrNo, reply.ErrText = errnoOf(ch.freezer.Freeze())
+		} else {
+			tlog.Info.Printf("ctlsock: thawing the filesystem")
+			reply.ErrNo, reply.ErrText = errnoOf(ch.freezer.Thaw())
+		}
+		writeResponse(conn, &reply)
+	case abi.CmdChanges:
+		if ch.changes == nil {
+			reply.ErrNo = int32(syscall.ENOSYS)
+			reply.ErrText = "Change counting is not available on this mount"
+		} else if !ch.acl.Allowed(uid, in.Command) {
+			tlog.Info.Printf("ctlsock: denied %q request from uid %d", in.Command, uid)
+			reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+		} else {
+			reply.Epoch, reply.Changes = ch.changes.Changes()
+		}
+		writeResponse(conn, &reply)
+	case abi.CmdEncrypt, abi.CmdDecrypt:
+		if !ch.acl.Allowed(uid, in.Command) {
+			tlog.Info.Printf("ctlsock: denied %q request from uid %d", in.Command, uid)
+			reply.ErrNo, reply.ErrText = errnoOf(syscall.EACCES)
+			writeResponse(conn, &reply)
+			return
+		}
+		if len(in.Paths) == 0 {
+			reply.ErrNo, reply.ErrText = errnoOf(errors.New("Empty input"))
+			writeResponse(conn, &reply)
+			return
+		}
+		ch.streamPaths(in.Command, in.Paths, conn, reply)
+	default:
+		reply.ErrNo = int32(syscall.ENOSYS)
+		reply.ErrText = "Unknown command '" + in.Command + "'"
+		writeResponse(conn, &reply)
+	}
+}
+
+// streamPaths translates "paths" and sends the results in chunks of at most
+// ChunkSize entries. "reply" is the template for each message.
+func (ch *ctlSockHandler) streamPaths(op string, paths []string, conn *net.UnixConn, reply abi.ResponseStruct) {
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		reply.Results = make([]abi.ResultStruct, n)
+		for i, p := range paths[:n] {
+			r := &reply.Results[i]
+			var err error
+			r.Result, r.WarnText, err = ch.translatePath(op, p)
+			r.ErrNo, r.ErrText = errnoOf(err)
+		}
+		paths = paths[n:]
+		reply.More = len(paths) > 0
+		if writeResponse(conn, &reply) != nil {
+			return
+		}
+	}
+}
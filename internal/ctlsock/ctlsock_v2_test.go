@@ -0,0 +1,179 @@
+package ctlsock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	abi "github.com/rfjakob/gocryptfs/ctlsock"
+)
+
+// fakeFS "encrypts" by upper-casing and "decrypts" by lower-casing
+type fakeFS struct{}
+
+func (fakeFS) EncryptPath(p string) (string, error) {
+	return strings.ToUpper(p), nil
+}
+
+func (fakeFS) DecryptPath(p string) (string, error) {
+	if p == "MISSING" {
+		return "", syscall.ENOENT
+	}
+	return strings.ToLower(p), nil
+}
+
+func startServer(t *testing.T) (conn net.Conn, cleanup func()) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockPath := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(sock, fakeFS{}, nil)
+	conn, err = net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		sock.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProtocolV2(t *testing.T) {
+	conn, cleanup := startServer(t)
+	defer cleanup()
+	dec := json.NewDecoder(conn)
+	send := func(req abi.RequestStruct) {
+		msg, _ := json.Marshal(req)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var resp abi.ResponseStruct
+	// Handshake
+	send(abi.RequestStruct{Version: 2, ID: 1, Command: abi.CmdHello})
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version != abi.ProtocolVersion || resp.ID != 1 || len(resp.Commands) != len(supportedCommands) {
+		t.Errorf("bad hello response: %+v", resp)
+	}
+	// Version 1 requests still work on the same connection
+	resp = abi.ResponseStruct{}
+	send(abi.RequestStruct{EncryptPath: "foo"})
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result != "FOO" || resp.Version != 0 {
+		t.Errorf("bad v1 response: %+v", resp)
+	}
+	// Batch that has to be split into several responses
+	var paths []string
+	for i := 0; i < ChunkSize*2+1; i++ {
+		paths = append(paths, fmt.Sprintf("D%d", i))
+	}
+	paths[5] = "MISSING"
+	send(abi.RequestStruct{Version: 2, ID: 2, Command: abi.CmdDecrypt, Paths: paths})
+	var results []abi.ResultStruct
+	for i := 0; ; i++ {
+		resp = abi.ResponseStruct{}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != 2 {
+			t.Fatalf("wrong ID %d", resp.ID)
+		}
+		results = append(results, resp.Results...)
+		if !resp.More {
+			if i != 2 {
+				t.Errorf("expected 3 responses, got %d", i+1)
+			}
+			break
+		}
+	}
+	if len(results) != len(paths) {
+		t.Fatalf("got %d results, want %d", len(results), len(paths))
+	}
+	if results[0].Result != "d0" || results[len(results)-1].Result != "d200" {
+		t.Errorf("wrong results: %+v %+v", results[0], results[len(results)-1])
+	}
+	if results[5].ErrNo != int32(syscall.ENOENT) || results[5].Result != "" {
+		t.Errorf("wrong error result: %+v", results[5])
+	}
+	// Unknown command
+	resp = abi.ResponseStruct{}
+	send(abi.RequestStruct{Version: 3, ID: 3, Command: "stats"})
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ErrNo != int32(syscall.ENOSYS) || resp.Version != abi.ProtocolVersion {
+		t.Errorf("bad response to unknown command: %+v", resp)
+	}
+}
+
+// TestBigRequest checks that requests bigger than abi.ReadBufSize work, also
+// when they arrive in several pieces, and that requests above
+// abi.MaxRequestSize close the connection
+func TestBigRequest(t *testing.T) {
+	conn, cleanup := startServer(t)
+	defer cleanup()
+	dec := json.NewDecoder(conn)
+	var resp abi.ResponseStruct
+	msg, _ := json.Marshal(abi.RequestStruct{Version: 2, ID: 1, Command: abi.CmdHello})
+	conn.Write(msg)
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.MaxRequestSize != abi.MaxRequestSize {
+		t.Errorf("hello reports MaxRequestSize=%d", resp.MaxRequestSize)
+	}
+	var paths []string
+	for i := 0; i < 10000; i++ {
+		paths = append(paths, fmt.Sprintf("dir/file%d", i))
+	}
+	msg, _ = json.Marshal(abi.RequestStruct{Version: 2, ID: 2, Command: abi.CmdEncrypt, Paths: paths})
+	if len(msg) < abi.ReadBufSize*10 {
+		t.Fatalf("request is only %d bytes", len(msg))
+	}
+	conn.Write(msg[:100])
+	time.Sleep(10 * time.Millisecond)
+	conn.Write(msg[100:])
+	var results []abi.ResultStruct
+	for {
+		resp = abi.ResponseStruct{}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ErrNo != 0 {
+			t.Fatalf("error response: %+v", resp)
+		}
+		results = append(results, resp.Results...)
+		if !resp.More {
+			break
+		}
+	}
+	if len(results) != len(paths) || results[9999].Result != "DIR/FILE9999" {
+		t.Fatalf("got %d results, last: %+v", len(results), results[len(results)-1])
+	}
+	// Too big
+	big := strings.Repeat("x", abi.MaxRequestSize)
+	msg, _ = json.Marshal(abi.RequestStruct{Version: 2, ID: 3, Command: abi.CmdEncrypt, Paths: []string{big}})
+	conn.Write(msg)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := dec.Decode(&resp); err != io.EOF {
+		t.Errorf("the connection should have been closed, err=%v", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Package desktopnotify implements "-desktop_notify", which shows desktop
+// notifications through notify-send(1) when corruption is found or the
+// filesystem is unmounted because it was idle. Laptop users see problems
+// right away instead of finding EIO errors hours later.
+package desktopnotify
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// command is the libnotify command line tool that talks to the
+	// notification daemon over D-Bus
+	command = "notify-send"
+	// repeatInterval suppresses repeated notifications of the same kind, so
+	// a corrupt directory with many entries does not flood the desktop
+	repeatInterval = time.Minute
+)
+
+// Notifier shows desktop notifications. A nil *Notifier shows nothing, so
+// callers do not have to check whether "-desktop_notify" is enabled.
+type Notifier struct {
+	// cmd is the full path of notify-send, replaced in the tests
+	cmd        string
+	mountpoint string
+
+	// lock protects "last" and "suppressed"
+	lock sync.Mutex
+	// last is when a notification with this summary was shown
+	last map[string]time.Time
+	// suppressed counts the notifications that were not shown because of
+	// repeatInterval
+	suppressed map[string]int
+}
+
+// New returns a Notifier for the filesystem mounted at "mountpoint". It
+// fails if notify-send is not installed.
+func New(mountpoint string) (*Notifier, error) {
+	cmd, err := exec.LookPath(command)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{
+		cmd:        cmd,
+		mountpoint: mountpoint,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}, nil
+}
+
+// Corruption reports the corrupt file, name or xattr "item"
+func (n *Notifier) Corruption(item string) {
+	if n == nil {
+		return
+	}
+	n.send("critical", "gocryptfs: corrupt data found",
+		fmt.Sprintf("%s: %s", n.mountpoint, item))
+}
+
+// IdleUnmount reports that the filesystem has been unmounted because it was
+// idle for "timeout"
+func (n *Notifier) IdleUnmount(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+	n.send("normal", "gocryptfs: unmounted",
+		fmt.Sprintf("%s has been unmounted after being idle for %v", n.mountpoint, timeout))
+}
+
+// Intrusion reports that "-guard" has detected mass file access by foreign
+// users
+func (n *Notifier) Intrusion(detail string) {
+	if n == nil {
+		return
+	}
+	n.send("critical", "gocryptfs: suspicious file access",
+		fmt.Sprintf("%s: %s", n.mountpoint, detail))
+}
+
+// send runs notify-send in the background. We do not wait for it to exit,
+// so a hanging notification daemon cannot block the filesystem.
+func (n *Notifier) send(urgency string, summary string, body string) {
+	n.lock.Lock()
+	if time.Since(n.last[summary]) < repeatInterval {
+		n.suppressed[summary]++
+		n.lock.Unlock()
+		return
+	}
+	if s := n.suppressed[summary]; s > 0 {
+		body += fmt.Sprintf(" (and %d more)", s)
+	}
+	n.last[summary] = time.Now()
+	n.suppressed[summary] = 0
+	n.lock.Unlock()
+
+	cmd := exec.Command(n.cmd, "--app-name=gocryptfs", "--urgency="+urgency, summary, body)
+	if err := cmd.Start(); err != nil {
+		tlog.Warn.Printf("desktop_notify: %v", err)
+		return
+	}
+	go cmd.Wait()
+}
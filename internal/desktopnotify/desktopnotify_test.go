@@ -0,0 +1,79 @@
+package desktopnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNilNotifier(t *testing.T) {
+	var n *Notifier
+	n.Corruption("foo")
+	n.IdleUnmount(time.Minute)
+}
+
+// fakeNotifier returns a Notifier that runs a shell script instead of
+// notify-send. The script appends its arguments to the returned file.
+func fakeNotifier(t *testing.T, dir string) (*Notifier, string) {
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "notify-send")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Notifier{
+		cmd:        script,
+		mountpoint: "/mnt",
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}, out
+}
+
+// waitLines waits until "path" has "n" lines and returns them
+func waitLines(t *testing.T, path string, n int) []string {
+	for i := 0; i < 100; i++ {
+		data, _ := ioutil.ReadFile(path)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(data) > 0 && len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s does not have %d lines", path, n)
+	return nil
+}
+
+func TestSend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n, out := fakeNotifier(t, dir)
+	n.Corruption("ino123")
+	// Suppressed, but counted
+	n.Corruption("ino456")
+	n.IdleUnmount(time.Minute)
+	lines := waitLines(t, out, 2)
+	if len(lines) != 2 {
+		t.Fatalf("want 2 notifications, have %q", lines)
+	}
+	// The scripts run concurrently, so the order is random
+	all := strings.Join(lines, "\n")
+	if !strings.Contains(all, "--app-name=gocryptfs --urgency=critical gocryptfs: corrupt data found /mnt: ino123") ||
+		!strings.Contains(all, "--urgency=normal gocryptfs: unmounted /mnt has been unmounted after being idle for 1m0s") ||
+		strings.Contains(all, "ino456") {
+		t.Errorf("wrong notifications: %q", lines)
+	}
+	// Once the repeat interval has passed, the suppressed notifications are
+	// mentioned
+	n.last["gocryptfs: corrupt data found"] = time.Now().Add(-repeatInterval)
+	n.Corruption("ino789")
+	lines = waitLines(t, out, 3)
+	if !strings.HasSuffix(lines[2], "/mnt: ino789 (and 1 more)") {
+		t.Errorf("wrong notification: %q", lines[2])
+	}
+}
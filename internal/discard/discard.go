@@ -0,0 +1,92 @@
+// Package discard implements "-discard": telling the SSD that holds
+// CIPHERDIR which blocks are no longer used after files have been deleted
+// or truncated, so it can reclaim them promptly instead of waiting for the
+// next fstrim(8) run.
+//
+// Deleting or truncating a backing file already returns its blocks to the
+// backing filesystem. What is missing is the discard request to the device,
+// which filesystems only send on their own when they are mounted with the
+// "discard" option. We send it by running FITRIM on the backing filesystem,
+// like fstrim(8) does. FITRIM walks all free space, so the calls are
+// batched: at most one every Interval.
+package discard
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// DefaultInterval is the minimum time between two FITRIM calls
+const DefaultInterval = time.Minute
+
+// Trimmer runs FITRIM on the filesystem of a directory. A nil Trimmer does
+// nothing.
+type Trimmer struct {
+	// Interval is the minimum time between two FITRIM calls
+	Interval time.Duration
+	dir      string
+	// trim does the actual work. Replaced in tests.
+	trim func(dir string) error
+
+	lock sync.Mutex
+	// scheduled is set while a FITRIM call is pending
+	scheduled bool
+	// last is the time of the last FITRIM call
+	last time.Time
+	// disabled is set once FITRIM turned out not to work
+	disabled bool
+}
+
+// New returns a Trimmer for the filesystem "dir" is on
+func New(dir string) *Trimmer {
+	return &Trimmer{
+		Interval: DefaultInterval,
+		dir:      dir,
+		trim:     fitrim,
+	}
+}
+
+// Schedule requests a FITRIM call because blocks have been freed. It returns
+// immediately, the call happens in the background once Interval has passed
+// since the last one.
+func (t *Trimmer) Schedule() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.disabled || t.scheduled {
+		return
+	}
+	t.scheduled = true
+	delay := t.Interval - time.Since(t.last)
+	if delay < 0 {
+		delay = 0
+	}
+	time.AfterFunc(delay, t.run)
+}
+
+func (t *Trimmer) run() {
+	t.lock.Lock()
+	t.scheduled = false
+	t.last = time.Now()
+	t.lock.Unlock()
+	err := t.trim(t.dir)
+	if err == nil {
+		tlog.Debug.Printf("discard: FITRIM on %q done", t.dir)
+		return
+	}
+	switch err {
+	case syscall.EPERM, syscall.EACCES, syscall.ENOTTY, syscall.EOPNOTSUPP, syscall.EINVAL:
+		// Will never work. Don't try again.
+		t.lock.Lock()
+		t.disabled = true
+		t.lock.Unlock()
+		tlog.Warn.Printf("discard: FITRIM on %q failed: %v. Disabling -discard.", t.dir, err)
+	default:
+		tlog.Warn.Printf("discard: FITRIM on %q failed: %v", t.dir, err)
+	}
+}
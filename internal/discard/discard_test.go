@@ -0,0 +1,57 @@
+package discard
+
+import (
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	var calls int32
+	tr := New("/")
+	tr.Interval = 200 * time.Millisecond
+	tr.trim = func(string) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+	// The first call runs right away, the others are batched into one
+	for i := 0; i < 10; i++ {
+		tr.Schedule()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("want 1 call, have %d", n)
+	}
+	for i := 0; i < 10; i++ {
+		tr.Schedule()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("Interval not respected: want 1 call, have %d", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("want 2 calls, have %d", n)
+	}
+}
+
+func TestDisable(t *testing.T) {
+	var calls int32
+	tr := New("/")
+	tr.Interval = 0
+	tr.trim = func(string) error {
+		atomic.AddInt32(&calls, 1)
+		return syscall.EPERM
+	}
+	tr.Schedule()
+	time.Sleep(50 * time.Millisecond)
+	tr.Schedule()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("EPERM should disable the Trimmer, have %d calls", n)
+	}
+	// A nil Trimmer does nothing
+	var nilTrimmer *Trimmer
+	nilTrimmer.Schedule()
+}
@@ -0,0 +1,10 @@
+package discard
+
+import (
+	"syscall"
+)
+
+// fitrim is not available on MacOS. APFS sends discards on its own.
+func fitrim(dir string) error {
+	return syscall.EOPNOTSUPP
+}
@@ -0,0 +1,33 @@
+package discard
+
+import (
+	"math"
+	"syscall"
+	"unsafe"
+)
+
+// _FITRIM is _IOWR('X', 121, struct fstrim_range) from linux/fs.h
+const _FITRIM = 0xC0185879
+
+// fstrimRange is struct fstrim_range from linux/fs.h
+type fstrimRange struct {
+	start  uint64
+	len    uint64
+	minlen uint64
+}
+
+// fitrim discards all free space on the filesystem "dir" is on. Needs
+// CAP_SYS_ADMIN.
+func fitrim(dir string) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	r := fstrimRange{len: math.MaxUint64}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), _FITRIM, uintptr(unsafe.Pointer(&r)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
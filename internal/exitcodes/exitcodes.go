@@ -30,7 +30,8 @@ const (
 	// PasswordIncorrect - the password was incorrect when mounting or when
 	// changing the password.
 	PasswordIncorrect = 12
-	// ScryptParams means that scrypt was called with invalid parameters
+	// ScryptParams means that scrypt or argon2id was called with invalid
+	// parameters
 	ScryptParams = 13
 	// MasterKey means that something went wrong when parsing the "-masterkey"
 	// command line option
@@ -65,6 +66,13 @@ const (
 	FsckErrors = 26
 	// DeprecatedFS - this filesystem is deprecated
 	DeprecatedFS = 27
+	// Expired - the filesystem has passed its expiry time and
+	// "-allow_expired" was not given
+	Expired = 28
+	// FIDO2 - talking to the FIDO2 authenticator failed
+	FIDO2 = 29
+	// TPM2 - sealing or unsealing the master key using the TPM failed
+	TPM2 = 30
 )
 
 // Err wraps an error with an associated numeric exit code
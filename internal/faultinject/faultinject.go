@@ -0,0 +1,143 @@
+// Package faultinject implements "-fault_inject", a developer mode that makes
+// reads and writes to the backing files fail or slow down at random. It is
+// used to test the error handling of gocryptfs and of applications running
+// on top of it.
+package faultinject
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Injector decides which backing-store calls fail. A nil *Injector never
+// injects anything, so callers do not have to check whether fault injection
+// is enabled.
+type Injector struct {
+	// EIO is the probability that a read or write fails with EIO
+	EIO float64
+	// ENOSPC is the probability that a write fails with ENOSPC
+	ENOSPC float64
+	// Short is the probability that a read returns less data than requested
+	Short float64
+	// LatencyP is the probability that a call is delayed by Latency
+	LatencyP float64
+	Latency  time.Duration
+	// Seed for the random number generator. The same seed and the same
+	// sequence of calls give the same faults.
+	Seed int64
+
+	lock sync.Mutex
+	rnd  *rand.Rand
+}
+
+// Parse parses a SPEC like "eio=0.01,enospc=0.01,short=0.05,latency=0.1:50ms,seed=42".
+// Probabilities are between 0 and 1. "latency" takes a probability and a
+// duration. Without "seed", a time-based seed is used.
+func Parse(spec string) (*Injector, error) {
+	i := &Injector{Seed: time.Now().UnixNano()}
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: want KEY=VALUE", kv)
+		}
+		key, val := parts[0], parts[1]
+		var err error
+		switch key {
+		case "eio":
+			i.EIO, err = parseProb(val)
+		case "enospc":
+			i.ENOSPC, err = parseProb(val)
+		case "short":
+			i.Short, err = parseProb(val)
+		case "latency":
+			pd := strings.SplitN(val, ":", 2)
+			if len(pd) != 2 {
+				return nil, fmt.Errorf("latency: want PROBABILITY:DURATION, got %q", val)
+			}
+			if i.LatencyP, err = parseProb(pd[0]); err != nil {
+				break
+			}
+			i.Latency, err = time.ParseDuration(pd[1])
+			if err == nil && i.Latency < 0 {
+				err = fmt.Errorf("negative duration %v", i.Latency)
+			}
+		case "seed":
+			i.Seed, err = strconv.ParseInt(val, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	i.rnd = rand.New(rand.NewSource(i.Seed))
+	return i, nil
+}
+
+func parseProb(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability %v is not between 0 and 1", p)
+	}
+	return p, nil
+}
+
+// hit returns true with probability "p"
+func (i *Injector) hit(p float64) bool {
+	if p == 0 {
+		return false
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.rnd.Float64() < p
+}
+
+// delay sleeps for Latency with probability LatencyP
+func (i *Injector) delay() {
+	if i.hit(i.LatencyP) {
+		time.Sleep(i.Latency)
+	}
+}
+
+// Read is called before a read of "n" bytes from the backing store. It
+// returns how many bytes should actually be read, or the error the read
+// should fail with.
+func (i *Injector) Read(n int) (int, error) {
+	if i == nil {
+		return n, nil
+	}
+	i.delay()
+	if i.hit(i.EIO) {
+		return 0, syscall.EIO
+	}
+	if n > 0 && i.hit(i.Short) {
+		i.lock.Lock()
+		n = i.rnd.Intn(n)
+		i.lock.Unlock()
+	}
+	return n, nil
+}
+
+// Write is called before a write to the backing store. It returns the
+// error the write should fail with.
+func (i *Injector) Write() error {
+	if i == nil {
+		return nil
+	}
+	i.delay()
+	if i.hit(i.EIO) {
+		return syscall.EIO
+	}
+	if i.hit(i.ENOSPC) {
+		return syscall.ENOSPC
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package faultinject
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	i, err := Parse("eio=0.01,enospc=0.5,short=1,latency=0.1:50ms,seed=42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.EIO != 0.01 || i.ENOSPC != 0.5 || i.Short != 1 || i.LatencyP != 0.1 ||
+		i.Latency != 50*time.Millisecond || i.Seed != 42 {
+		t.Errorf("wrong result: %+v", i)
+	}
+	bad := []string{
+		"",
+		"eio",
+		"eio=2",
+		"eio=-0.1",
+		"eio=x",
+		"latency=50ms",
+		"latency=0.1:-1s",
+		"seed=abc",
+		"foo=1",
+	}
+	for _, s := range bad {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+	var i *Injector
+	if n, err := i.Read(100); n != 100 || err != nil {
+		t.Errorf("Read: n=%d err=%v", n, err)
+	}
+	if err := i.Write(); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+}
+
+func TestAlways(t *testing.T) {
+	i, _ := Parse("eio=1")
+	if _, err := i.Read(100); err != syscall.EIO {
+		t.Errorf("Read: %v", err)
+	}
+	if err := i.Write(); err != syscall.EIO {
+		t.Errorf("Write: %v", err)
+	}
+	i, _ = Parse("enospc=1")
+	if n, err := i.Read(100); n != 100 || err != nil {
+		t.Errorf("Read: n=%d err=%v", n, err)
+	}
+	if err := i.Write(); err != syscall.ENOSPC {
+		t.Errorf("Write: %v", err)
+	}
+	i, _ = Parse("short=1")
+	if n, err := i.Read(100); n >= 100 || err != nil {
+		t.Errorf("Read: n=%d err=%v", n, err)
+	}
+}
+
+// The same seed must give the same sequence of faults
+func TestSeed(t *testing.T) {
+	run := func() (out []bool) {
+		i, _ := Parse("eio=0.5,seed=7")
+		for j := 0; j < 100; j++ {
+			out = append(out, i.Write() != nil)
+		}
+		return out
+	}
+	a, b := run(), run()
+	hits := 0
+	for j := range a {
+		if a[j] != b[j] {
+			t.Fatalf("sequences differ at %d", j)
+		}
+		if a[j] {
+			hits++
+		}
+	}
+	if hits == 0 || hits == 100 {
+		t.Errorf("implausible number of hits: %d", hits)
+	}
+}
@@ -0,0 +1,102 @@
+// Package fido2 derives secrets from FIDO2 authenticators using the
+// hmac-secret extension. It calls the "fido2-cred" and "fido2-assert" tools
+// from libfido2 instead of linking against the C library.
+package fido2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// relyingPartyID is the FIDO2 relying party all credentials are bound to
+const relyingPartyID = "gocryptfs"
+
+// run executes "name" with "args", feeds "stdin" to it line by line, and
+// returns the lines it printed to stdout.
+func run(stdin []string, name string, args ...string) ([]string, error) {
+	cmd := exec.Command(name, args...)
+	tlog.Debug.Printf("fido2: running %q", cmd.Args)
+	cmd.Stdin = strings.NewReader(strings.Join(stdin, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v", name, err)
+	}
+	return strings.Split(string(bytes.TrimSpace(out)), "\n"), nil
+}
+
+// field returns the base64-decoded line "i" of "out", as printed by
+// fido2-cred and fido2-assert.
+func field(out []string, i int) ([]byte, error) {
+	if i >= len(out) {
+		return nil, fmt.Errorf("short output: got %d lines, want at least %d", len(out), i+1)
+	}
+	return base64.StdEncoding.DecodeString(out[i])
+}
+
+// Register creates a new credential with hmac-secret support on the
+// authenticator "device" and returns the credential ID.
+// Calls os.Exit on failure.
+func Register(device string, userName string) (credentialID []byte) {
+	tlog.Info.Printf("FIDO2 Register: interact with your device ...")
+	stdin := []string{
+		base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32)), // client data hash
+		relyingPartyID,
+		userName,
+		base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32)), // user ID
+	}
+	out, err := run(stdin, "fido2-cred", "-M", "-h", "-v", device)
+	if err == nil {
+		// Output: client data hash, relying party, format, authenticator
+		// data, credential ID, ...
+		credentialID, err = field(out, 4)
+	}
+	if err == nil && len(credentialID) == 0 {
+		err = fmt.Errorf("empty credential ID")
+	}
+	if err != nil {
+		tlog.Fatal.Printf("FIDO2 Register: %v", err)
+		os.Exit(exitcodes.FIDO2)
+	}
+	return credentialID
+}
+
+// Secret returns the hmac-secret of the credential "credentialID" for "salt"
+// from the authenticator "device". If the authenticator requires a PIN, the
+// user is prompted for it by fido2-assert.
+// Calls os.Exit on failure.
+func Secret(device string, credentialID []byte, salt []byte) (secret []byte) {
+	tlog.Info.Printf("FIDO2 Secret: interact with your device ...")
+	stdin := []string{
+		base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32)), // client data hash
+		relyingPartyID,
+		base64.StdEncoding.EncodeToString(credentialID),
+		base64.StdEncoding.EncodeToString(salt),
+	}
+	out, err := run(stdin, "fido2-assert", "-G", "-h", device)
+	if err != nil {
+		// Retry with PIN verification
+		out, err = run(stdin, "fido2-assert", "-G", "-h", "-v", device)
+	}
+	if err == nil {
+		// Output: client data hash, relying party, authenticator data,
+		// signature, hmac-secret
+		secret, err = field(out, 4)
+	}
+	if err == nil && len(secret) == 0 {
+		err = fmt.Errorf("empty hmac-secret")
+	}
+	if err != nil {
+		tlog.Fatal.Printf("FIDO2 Secret: %v", err)
+		os.Exit(exitcodes.FIDO2)
+	}
+	return secret
+}
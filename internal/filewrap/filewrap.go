@@ -0,0 +1,23 @@
+// Package filewrap wraps the nodefs.File objects returned by Open and Create
+// in the pathfs.FileSystem layers that are stacked on top of fusefrontend,
+// like guard, freeze and optrace.
+package filewrap
+
+import (
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Wrap returns "wrap(f)". If "f" is a *nodefs.WithFlags, the File inside it
+// is wrapped instead, because go-fuse only looks at the outermost File for
+// the FOPEN_* flags. A nil "f" is returned as nil without calling "wrap".
+func Wrap(f nodefs.File, wrap func(nodefs.File) nodefs.File) nodefs.File {
+	if f == nil {
+		return nil
+	}
+	if wf, ok := f.(*nodefs.WithFlags); ok {
+		wf2 := *wf
+		wf2.File = Wrap(wf.File, wrap)
+		return &wf2
+	}
+	return wrap(f)
+}
@@ -0,0 +1,40 @@
+package filewrap
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+type testFile struct {
+	nodefs.File
+}
+
+func wrapTest(f nodefs.File) nodefs.File {
+	return &testFile{File: f}
+}
+
+func TestWrap(t *testing.T) {
+	if Wrap(nil, wrapTest) != nil {
+		t.Error("nil was wrapped")
+	}
+	inner := nodefs.NewDefaultFile()
+	if w, ok := Wrap(inner, wrapTest).(*testFile); !ok || w.File != inner {
+		t.Errorf("plain file was not wrapped: %#v", w)
+	}
+	wf := &nodefs.WithFlags{File: inner, FuseFlags: fuse.FOPEN_KEEP_CACHE}
+	out, ok := Wrap(wf, wrapTest).(*nodefs.WithFlags)
+	if !ok {
+		t.Fatal("WithFlags is not the outermost File")
+	}
+	if out == wf {
+		t.Error("the WithFlags of the caller was modified")
+	}
+	if out.FuseFlags != fuse.FOPEN_KEEP_CACHE {
+		t.Errorf("FuseFlags got lost: %d", out.FuseFlags)
+	}
+	if w, ok := out.File.(*testFile); !ok || w.File != inner {
+		t.Errorf("File inside WithFlags was not wrapped: %#v", out.File)
+	}
+}
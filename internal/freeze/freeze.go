@@ -0,0 +1,111 @@
+// Package freeze implements the "freeze" and "thaw" commands of the control
+// socket. While frozen, operations that would modify CIPHERDIR block until
+// the filesystem is thawed, and everything written before has been synced
+// to disk. This lets snapshot tools (LVM, btrfs, ZFS) capture a consistent
+// copy of CIPHERDIR.
+//
+// The Freezer also counts the modifying operations for the "changes"
+// command, which "-mirror" mounts use to know when to drop their caches.
+package freeze
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+var (
+	// ErrFrozen is returned by Freeze if the filesystem is already frozen
+	ErrFrozen = errors.New("the filesystem is already frozen")
+	// ErrNotFrozen is returned by Thaw if the filesystem is not frozen
+	ErrNotFrozen = errors.New("the filesystem is not frozen")
+)
+
+// Freezer blocks the modifying operations on the filesystems it wraps
+type Freezer struct {
+	// changes counts the finished modifying operations. Accessed
+	// atomically, and first in the struct for 64-bit alignment on 32-bit
+	// platforms.
+	changes uint64
+	// ops is held for reading by every modifying operation while it runs,
+	// and for writing while frozen
+	ops sync.RWMutex
+	// lock protects "frozen" and serializes Freeze and Thaw
+	lock   sync.Mutex
+	frozen bool
+	// cipherdir is synced to disk by Freeze
+	cipherdir string
+	// epoch is random and changes when the filesystem is mounted again,
+	// which resets "changes"
+	epoch string
+}
+
+// New returns a Freezer for the filesystem stored in "cipherdir"
+func New(cipherdir string) *Freezer {
+	return &Freezer{
+		cipherdir: cipherdir,
+		epoch:     hex.EncodeToString(cryptocore.RandBytes(8)),
+	}
+}
+
+// Changes returns the number of modifying operations that have finished
+// since the filesystem was mounted. The number only grows as long as
+// "epoch" stays the same.
+func (f *Freezer) Changes() (epoch string, n uint64) {
+	return f.epoch, atomic.LoadUint64(&f.changes)
+}
+
+// Freeze waits for the running modifying operations to finish, blocks new
+// ones and syncs CIPHERDIR to disk
+func (f *Freezer) Freeze() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.frozen {
+		return ErrFrozen
+	}
+	f.ops.Lock()
+	if err := f.sync(); err != nil {
+		f.ops.Unlock()
+		return err
+	}
+	f.frozen = true
+	return nil
+}
+
+// Thaw lets the blocked operations continue
+func (f *Freezer) Thaw() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.frozen {
+		return ErrNotFrozen
+	}
+	f.frozen = false
+	f.ops.Unlock()
+	return nil
+}
+
+// sync flushes the filesystem that contains CIPHERDIR to disk
+func (f *Freezer) sync() error {
+	fd, err := syscall.Open(f.cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscallcompat.Syncfs(fd)
+}
+
+// enter is called before a modifying operation. It blocks while frozen.
+func (f *Freezer) enter() {
+	f.ops.RLock()
+}
+
+// leave is called after a modifying operation
+func (f *Freezer) leave() {
+	atomic.AddUint64(&f.changes, 1)
+	f.ops.RUnlock()
+}
@@ -0,0 +1,169 @@
+package freeze
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/filewrap"
+)
+
+// Wrap returns a pathfs.FileSystem whose modifying operations block while
+// "f" is frozen. Operations that only read pass through.
+func (f *Freezer) Wrap(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &freezeFS{FileSystem: fs, f: f}
+}
+
+type freezeFS struct {
+	pathfs.FileSystem
+	f *Freezer
+}
+
+func (fs *freezeFS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *freezeFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *freezeFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *freezeFS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *freezeFS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *freezeFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *freezeFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *freezeFS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *freezeFS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *freezeFS) Unlink(name string, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *freezeFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *freezeFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *freezeFS) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	fs.f.enter()
+	defer fs.f.leave()
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+// Open only blocks if it truncates the file
+func (fs *freezeFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&syscall.O_TRUNC != 0 {
+		fs.f.enter()
+		defer fs.f.leave()
+	}
+	file, status := fs.FileSystem.Open(name, flags, context)
+	return fs.wrapFile(file), status
+}
+
+func (fs *freezeFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	fs.f.enter()
+	defer fs.f.leave()
+	file, status := fs.FileSystem.Create(name, flags, mode, context)
+	return fs.wrapFile(file), status
+}
+
+// wrapFile wraps "file" in a freezeFile, so that writes through file
+// handles that were opened before the freeze block as well
+func (fs *freezeFS) wrapFile(file nodefs.File) nodefs.File {
+	return filewrap.Wrap(file, func(file nodefs.File) nodefs.File {
+		return &freezeFile{File: file, f: fs.f}
+	})
+}
+
+// freezeFile blocks the modifying operations on an open file while frozen.
+// Read, Flush, Fsync and Release are passed through.
+type freezeFile struct {
+	nodefs.File
+	f *Freezer
+}
+
+func (file *freezeFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	file.f.enter()
+	defer file.f.leave()
+	return file.File.Write(data, off)
+}
+
+func (file *freezeFile) Truncate(size uint64) fuse.Status {
+	file.f.enter()
+	defer file.f.leave()
+	return file.File.Truncate(size)
+}
+
+func (file *freezeFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	file.f.enter()
+	defer file.f.leave()
+	return file.File.Allocate(off, size, mode)
+}
+
+func (file *freezeFile) Chmod(perms uint32) fuse.Status {
+	file.f.enter()
+	defer file.f.leave()
+	return file.File.Chmod(perms)
+}
+
+func (file *freezeFile) Chown(uid uint32, gid uint32) fuse.Status {
+	file.f.enter()
+	defer file.f.leave()
+	return file.File.Chown(uid, gid)
+}
+
+func (file *freezeFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	file.f.enter()
+	defer file.f.leave()
+	return file.File.Utimens(atime, mtime)
+}
@@ -0,0 +1,104 @@
+package freeze
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func TestFreeze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFreeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(dir+"/foo", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := New(dir)
+	fs := f.Wrap(pathfs.NewLoopbackFileSystem(dir))
+	ctx := &fuse.Context{}
+	file, status := fs.Open("foo", uint32(os.O_RDWR), ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer file.Release()
+	if err = f.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Freeze(); err != ErrFrozen {
+		t.Errorf("want ErrFrozen, have %v", err)
+	}
+	// Reading continues to work
+	if _, status = fs.GetAttr("foo", ctx); !status.Ok() {
+		t.Errorf("GetAttr: %v", status)
+	}
+	if _, status = file.Read(make([]byte, 10), 0); !status.Ok() {
+		t.Errorf("Read: %v", status)
+	}
+	// Writing blocks until Thaw
+	done := make(chan fuse.Status, 2)
+	go func() { done <- fs.Mkdir("dir", 0700, ctx) }()
+	go func() {
+		_, status := file.Write([]byte("bar"), 0)
+		done <- status
+	}()
+	select {
+	case <-done:
+		t.Fatal("write operation did not block")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err = f.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case status = <-done:
+			if !status.Ok() {
+				t.Error(status)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("write operation still blocked after Thaw")
+		}
+	}
+	if err = f.Thaw(); err != ErrNotFrozen {
+		t.Errorf("want ErrNotFrozen, have %v", err)
+	}
+}
+
+// TestChanges checks that modifying operations are counted, and reading
+// ones are not
+func TestChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestChanges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := New(dir)
+	fs := f.Wrap(pathfs.NewLoopbackFileSystem(dir))
+	ctx := &fuse.Context{}
+	epoch, n := f.Changes()
+	if epoch == "" || n != 0 {
+		t.Fatalf("epoch=%q n=%d", epoch, n)
+	}
+	if status := fs.Mkdir("dir", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	fs.GetAttr("dir", ctx)
+	fs.OpenDir("", ctx)
+	if _, n = f.Changes(); n != 1 {
+		t.Errorf("want 1 change, have %d", n)
+	}
+	// A failed operation may have changed something as well
+	fs.Rmdir("nonexisting", ctx)
+	if _, n = f.Changes(); n != 2 {
+		t.Errorf("want 2 changes, have %d", n)
+	}
+	if epoch2, _ := New(dir).Changes(); epoch2 == epoch {
+		t.Errorf("two Freezers have the same epoch %q", epoch)
+	}
+}
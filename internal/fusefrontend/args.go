@@ -2,6 +2,13 @@ package fusefrontend
 
 import (
 	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/asof"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/desktopnotify"
+	"github.com/rfjakob/gocryptfs/internal/faultinject"
+	"github.com/rfjakob/gocryptfs/internal/pathexclude"
+	"github.com/rfjakob/gocryptfs/internal/webhook"
 )
 
 // Args is a container for arguments that are passed from main() to fusefrontend
@@ -24,10 +31,95 @@ type Args struct {
 	// location. If it is false, reverse mode maps ".gocryptfs.reverse.conf"
 	// to "gocryptfs.conf" in the plaintext dir.
 	ConfigCustom bool
+	// ReadOnly makes all operations that would modify CIPHERDIR fail with
+	// EROFS, independent of the "ro" mount option, "-ro"
+	ReadOnly bool
+	// RawAccess shows the ciphertext in the hidden RawDirName directory
+	// in the root of the mount, read-only, "-raw_access"
+	RawAccess bool
+	// InoNamespace moves the reported inode numbers into a range that
+	// depends on the filesystem, "-ino_namespace". 0 disables it.
+	InoNamespace uint64
 	// NoPrealloc disables automatic preallocation before writing
 	NoPrealloc bool
+	// StrictPosix disables the attribute cache and the deviations from POSIX
+	// that exist for convenience, "-strict_posix"
+	StrictPosix bool
+	// WriteBarriers flushes a new file header to disk before the first
+	// block that uses its file ID is written, "-write_barriers"
+	WriteBarriers bool
+	// NoCreateWrite disables the fast path that writes the header together
+	// with the first data blocks of a new file, "-nocreatewrite"
+	NoCreateWrite bool
 	// Try to serialize read operations, "-serialize_reads"
 	SerializeReads bool
 	// Force decode even if integrity check fails (openSSL only)
 	ForceDecode bool
+	// CipherDf makes StatFs report the predicted ciphertext size of the
+	// plaintext tree as used space (reverse mode only), "-cipherdf"
+	CipherDf bool
+	// ReadAhead is the maximum readahead window for sequential reads in
+	// bytes. Zero disables readahead. "-readahead"
+	ReadAhead uint64
+	// PlaintextCacheSize is the memory budget in bytes for caching
+	// decrypted file blocks. Zero disables the cache. "-plaintext_cache_size"
+	PlaintextCacheSize uint64
+	// SharedStorage disables caching because other users may modify
+	// CIPHERDIR at any time, "-sharedstorage"
+	SharedStorage bool
+	// NoCacheGlob lists file name patterns. Matching files are opened with
+	// FOPEN_DIRECT_IO and bypass the kernel page cache, "-nocache_glob"
+	NoCacheGlob []string
+	// Writeback opens files with FOPEN_KEEP_CACHE so the kernel page cache
+	// survives close and reopen, "-writeback"
+	Writeback bool
+	// Policy holds per-file options from the config file
+	Policy []configfile.PolicyRule
+	// Limits restricts file sizes, names and depth. nil means no limits.
+	Limits *configfile.Limits
+	// DirtyRanges tracks which ranges of the backing files are modified,
+	// "-dirty_ranges"
+	DirtyRanges bool
+	// Passthrough lists file names that are stored unencrypted, see
+	// passthrough.go
+	Passthrough []string
+	// DetectConflicts makes file handles check if the backing file has been
+	// modified behind our back, "-detect_conflicts"
+	DetectConflicts bool
+	// ConflictEIO makes file handles return EIO after such a modification,
+	// "-conflict_eio"
+	ConflictEIO bool
+	// FollowSymlinks makes reverse mode present symlinks as the files or
+	// directories they point to, "-follow_symlinks"
+	FollowSymlinks bool
+	// OneFileSystem hides everything that is on a different filesystem
+	// than CIPHERDIR in reverse mode, "-one_file_system"
+	OneFileSystem bool
+	// Writable makes reverse mode decrypt the ciphertext that is written
+	// to it into the plaintext directory, "-writable"
+	Writable bool
+	// Shred is the number of times a deleted file is overwritten with random
+	// data, "-shred". 0 disables it.
+	Shred int
+	// Discard sends discard requests for the space freed by unlink and
+	// truncate to the backing device, "-discard"
+	Discard bool
+	// ExposeControlFiles allows access to gocryptfs.conf through the mount
+	// when names are not encrypted, "-expose-control-files"
+	ExposeControlFiles bool
+	// Exclude hides matching plaintext paths in reverse mode,
+	// "-exclude-from". nil excludes nothing.
+	Exclude *pathexclude.Matcher
+	// AsOf shows the versions of the files that were current at a point in
+	// time, "-as_of". nil shows the current files.
+	AsOf *asof.View
+	// FaultInject makes reads and writes of the backing files fail at
+	// random, "-fault_inject". nil disables it.
+	FaultInject *faultinject.Injector
+	// Webhook receives events like detected corruption, "-webhook". nil
+	// disables it.
+	Webhook *webhook.Notifier
+	// DesktopNotify shows a notification when corruption is found,
+	// "-desktop_notify". nil disables it.
+	DesktopNotify *desktopnotify.Notifier
 }
@@ -0,0 +1,146 @@
+package fusefrontend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+const (
+	// attrCacheTTL is how long a cached GetAttr result stays valid. This is
+	// the same as the attribute timeout we give to the kernel, so changes
+	// to CIPHERDIR that happen behind our back show up equally fast.
+	attrCacheTTL = time.Second
+	// attrCacheMaxPaths limits the number of paths we remember. When the
+	// limit is reached, the cache is emptied.
+	attrCacheMaxPaths = 10000
+)
+
+type attrCacheEntry struct {
+	attr    fuse.Attr
+	expires time.Time
+}
+
+// attrCache caches the results of FS.GetAttr. The attributes are stored per
+// backing inode, so all hard links to a file share one entry, and a
+// modification through any of the paths invalidates all of them.
+// All methods can be called on a nil *attrCache, which disables caching.
+type attrCache struct {
+	sync.Mutex
+	// Plaintext path -> backing inode
+	paths map[string]openfiletable.QIno
+	// Backing inode -> attributes
+	attrs map[openfiletable.QIno]attrCacheEntry
+	// gen is incremented on every invalidation. See generation().
+	gen uint64
+}
+
+func newAttrCache() *attrCache {
+	c := &attrCache{}
+	c.clear()
+	return c
+}
+
+// get returns a copy of the cached attributes for "path", or nil if there
+// are none.
+func (c *attrCache) get(path string) *fuse.Attr {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	qi, ok := c.paths[path]
+	if !ok {
+		return nil
+	}
+	e, ok := c.attrs[qi]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.paths, path)
+		delete(c.attrs, qi)
+		return nil
+	}
+	a := e.attr
+	return &a
+}
+
+// generation must be called before the attributes are read from the
+// backing filesystem, and its result passed to put. This way, attributes
+// that were read before a concurrent invalidation, like the old mtime of a
+// directory where a file was just created, are not cached.
+func (c *attrCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.gen
+}
+
+// put stores a copy of "a", the attributes of "path", which is backed by
+// inode "qi". Does nothing if the cache has been invalidated since "gen"
+// was returned by generation().
+func (c *attrCache) put(path string, qi openfiletable.QIno, a *fuse.Attr, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if len(c.paths) >= attrCacheMaxPaths {
+		c.paths = make(map[string]openfiletable.QIno)
+		c.attrs = make(map[openfiletable.QIno]attrCacheEntry)
+	}
+	c.paths[path] = qi
+	c.attrs[qi] = attrCacheEntry{
+		attr:    *a,
+		expires: time.Now().Add(attrCacheTTL),
+	}
+}
+
+// invalidate drops the cached attributes of backing inode "qi".
+// Call it after modifying a file through a file handle.
+func (c *attrCache) invalidate(qi openfiletable.QIno) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	delete(c.attrs, qi)
+	c.gen++
+	c.Unlock()
+}
+
+// invalidatePath drops the cached attributes of the inode behind "path",
+// which also affects all other paths pointing to the same inode.
+func (c *attrCache) invalidatePath(path string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	if qi, ok := c.paths[path]; ok {
+		delete(c.attrs, qi)
+		delete(c.paths, path)
+	}
+	c.gen++
+	c.Unlock()
+}
+
+// clear drops everything. Operations that add or remove directory entries
+// change the link count and the timestamps of more than one inode, so they
+// clear the whole cache instead of tracking what has changed.
+func (c *attrCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	if c.paths == nil || len(c.paths) > 0 || len(c.attrs) > 0 {
+		c.paths = make(map[string]openfiletable.QIno)
+		c.attrs = make(map[openfiletable.QIno]attrCacheEntry)
+	}
+	c.gen++
+	c.Unlock()
+}
@@ -0,0 +1,62 @@
+package fusefrontend
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+func TestAttrCache(t *testing.T) {
+	c := newAttrCache()
+	qi := openfiletable.QIno{Dev: 1, Ino: 100}
+	c.put("a", qi, &fuse.Attr{Size: 1}, c.generation())
+	c.put("b", qi, &fuse.Attr{Size: 2}, c.generation())
+	// "a" and "b" are hard links, the last put wins for both
+	if a := c.get("a"); a == nil || a.Size != 2 {
+		t.Errorf("a: %v", a)
+	}
+	// Modifying the returned copy must not change the cache
+	c.get("a").Size = 99
+	if a := c.get("b"); a == nil || a.Size != 2 {
+		t.Errorf("b: %v", a)
+	}
+	// Invalidating one path must invalidate the alias as well
+	c.invalidatePath("a")
+	if a := c.get("b"); a != nil {
+		t.Errorf("b should have been invalidated: %v", a)
+	}
+	c.put("b", qi, &fuse.Attr{Size: 3}, c.generation())
+	c.invalidate(qi)
+	if a := c.get("b"); a != nil {
+		t.Errorf("b should have been invalidated by inode: %v", a)
+	}
+	// A nil cache is a no-op
+	var n *attrCache
+	n.put("a", qi, &fuse.Attr{}, n.generation())
+	if n.get("a") != nil {
+		t.Error("nil cache returned something")
+	}
+	n.invalidate(qi)
+	n.invalidatePath("a")
+	n.clear()
+}
+
+// TestAttrCacheGeneration checks that attributes read before an
+// invalidation are not cached
+func TestAttrCacheGeneration(t *testing.T) {
+	c := newAttrCache()
+	qi := openfiletable.QIno{Dev: 1, Ino: 100}
+	gen := c.generation()
+	// A file is created in the directory while GetAttr runs
+	c.clear()
+	c.put("dir", qi, &fuse.Attr{Mtime: 1}, gen)
+	if a := c.get("dir"); a != nil {
+		t.Errorf("stale attributes have been cached: %v", a)
+	}
+	c.put("dir", qi, &fuse.Attr{Mtime: 2}, c.generation())
+	if a := c.get("dir"); a == nil || a.Mtime != 2 {
+		t.Errorf("dir: %v", a)
+	}
+}
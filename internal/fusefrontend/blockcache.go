@@ -0,0 +1,200 @@
+package fusefrontend
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+type blockCacheKey struct {
+	// fileID is the file ID from the file header, converted to a string so
+	// it can be used as a map key
+	fileID  string
+	blockNo uint64
+}
+
+type blockCacheEntry struct {
+	key blockCacheKey
+	// plaintext is the decrypted block. It is shorter than the block size
+	// for the last block of a file.
+	plaintext []byte
+}
+
+// blockCache keeps recently decrypted plaintext blocks so that repeated reads
+// of the same region ("git status" reading the same index over and over) do
+// not decrypt the same blocks again. Blocks are identified by file ID and
+// block number, so the cache survives closing and reopening the file. When
+// the memory budget is exhausted, the least recently used blocks are dropped.
+// All methods can be called on a nil *blockCache, which disables caching.
+type blockCache struct {
+	sync.Mutex
+	// maxBytes is the memory budget ("-plaintext_cache_size")
+	maxBytes uint64
+	// plainBS is the plaintext block size
+	plainBS uint64
+	// bytes is the plaintext size of all cached blocks
+	bytes uint64
+	// lru holds *blockCacheEntry values, most recently used at the front
+	lru *list.List
+	// blocks maps a file ID and a block number to the element in "lru"
+	blocks map[blockCacheKey]*list.Element
+	// files maps a file ID to the block numbers that are cached for it, so
+	// that dropFile does not have to scan the whole cache
+	files map[string]map[uint64]struct{}
+}
+
+func newBlockCache(maxBytes uint64, plainBS uint64) *blockCache {
+	if maxBytes == 0 {
+		return nil
+	}
+	return &blockCache{
+		maxBytes: maxBytes,
+		plainBS:  plainBS,
+		lru:      list.New(),
+		blocks:   make(map[blockCacheKey]*list.Element),
+		files:    make(map[string]map[uint64]struct{}),
+	}
+}
+
+// get appends the plaintext of "blocks" of file "fileID" to "dst". It
+// returns ok=false unless all blocks up to the end of the file are cached.
+// Like doRead, it returns less than requested at the end of the file.
+func (c *blockCache) get(dst []byte, fileID []byte, blocks []contentenc.IntraBlock) (out []byte, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	id := string(fileID)
+	var hits []*list.Element
+	for _, b := range blocks {
+		el, ok := c.blocks[blockCacheKey{id, b.BlockNo}]
+		if !ok {
+			return nil, false
+		}
+		hits = append(hits, el)
+		if uint64(len(el.Value.(*blockCacheEntry).plaintext)) < c.plainBS {
+			// Short block, this is the end of the file
+			break
+		}
+	}
+	out = dst
+	for i, el := range hits {
+		c.lru.MoveToFront(el)
+		plaintext := el.Value.(*blockCacheEntry).plaintext
+		if blocks[i].Skip < uint64(len(plaintext)) {
+			out = append(out, blocks[i].CropBlock(plaintext)...)
+		}
+	}
+	return out, true
+}
+
+// put stores copies of the decrypted blocks in "plaintext", which start at
+// block number "firstBlockNo". "eof" says that "plaintext" reaches up to the
+// end of the file. "count" is the ContentLock counter of "e" from before the
+// ciphertext was read. If the file has been written to since, the blocks may
+// be stale and are not stored.
+func (c *blockCache) put(fileID []byte, firstBlockNo uint64, plaintext []byte, eof bool, e *openfiletable.Entry, count uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	// Checking under our lock means that a writer that increments the
+	// counter after this point calls dropFile after we are done.
+	if e.ContentLock.Count() != count {
+		return
+	}
+	id := string(fileID)
+	blockNo := firstBlockNo
+	n := uint64(0)
+	for ; len(plaintext) > 0; blockNo++ {
+		n = c.plainBS
+		if n > uint64(len(plaintext)) {
+			n = uint64(len(plaintext))
+		}
+		c.add(blockCacheKey{id, blockNo}, append([]byte{}, plaintext[:n]...))
+		plaintext = plaintext[n:]
+	}
+	if eof && n == c.plainBS {
+		// The file ends at a block boundary. Remember that with an empty
+		// block so that reads across the end of the file can be served.
+		c.add(blockCacheKey{id, blockNo}, []byte{})
+	}
+}
+
+// add stores one block and evicts the least recently used blocks until the
+// cache fits into its budget. The caller must hold the lock.
+func (c *blockCache) add(key blockCacheKey, plaintext []byte) {
+	if el, ok := c.blocks[key]; ok {
+		c.remove(el)
+	}
+	el := c.lru.PushFront(&blockCacheEntry{key: key, plaintext: plaintext})
+	c.blocks[key] = el
+	if c.files[key.fileID] == nil {
+		c.files[key.fileID] = make(map[uint64]struct{})
+	}
+	c.files[key.fileID][key.blockNo] = struct{}{}
+	c.bytes += uint64(len(plaintext))
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops one block. The caller must hold the lock.
+func (c *blockCache) remove(el *list.Element) {
+	e := el.Value.(*blockCacheEntry)
+	c.lru.Remove(el)
+	delete(c.blocks, e.key)
+	delete(c.files[e.key.fileID], e.key.blockNo)
+	if len(c.files[e.key.fileID]) == 0 {
+		delete(c.files, e.key.fileID)
+	}
+	c.bytes -= uint64(len(e.plaintext))
+}
+
+// dropFile drops all cached blocks of file "fileID". Call it after
+// modifying the file.
+func (c *blockCache) dropFile(fileID []byte) {
+	if c == nil || fileID == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	id := string(fileID)
+	for blockNo := range c.files[id] {
+		c.remove(c.blocks[blockCacheKey{id, blockNo}])
+	}
+}
+
+// clear drops all cached blocks
+func (c *blockCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.lru.Init()
+	c.blocks = make(map[blockCacheKey]*list.Element)
+	c.files = make(map[string]map[uint64]struct{})
+	c.bytes = 0
+}
+
+// dropCachedBlocks drops the cached plaintext of this file from the block
+// cache. The caller must hold ContentLock.Lock().
+func (f *file) dropCachedBlocks() {
+	if f.fs.blockCache == nil {
+		return
+	}
+	f.fileTableEntry.HeaderLock.RLock()
+	fileID := f.fileTableEntry.ID
+	f.fileTableEntry.HeaderLock.RUnlock()
+	if fileID == nil {
+		// Truncate does not always load the header. Blocks that were cached
+		// through another file handle may still be there.
+		fileID, _ = f.readFileID()
+	}
+	f.fs.blockCache.dropFile(fileID)
+}
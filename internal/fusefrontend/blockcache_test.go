@@ -0,0 +1,104 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+func TestBlockCacheLRU(t *testing.T) {
+	var nilC *blockCache
+	nilC.put([]byte("id"), 0, []byte("x"), true, &openfiletable.Entry{}, 0)
+	nilC.dropFile([]byte("id"))
+	if newBlockCache(0, 4) != nil {
+		t.Error("cache should be disabled")
+	}
+	fs := newTestFS()
+	blocks := fs.contentEnc.ExplodePlainRange(0, 8)
+	if len(blocks) != 1 {
+		t.Fatal(len(blocks))
+	}
+	e := &openfiletable.Entry{}
+	// Room for two blocks of 4 bytes
+	c := newBlockCache(8, 4)
+	c.put([]byte("a"), 0, []byte("aaaa"), false, e, 0)
+	c.put([]byte("b"), 0, []byte("bbbb"), false, e, 0)
+	// Touch "a", so "b" is the least recently used block
+	if out, ok := c.get(nil, []byte("a"), blocks[:1]); !ok || string(out) != "aaaa" {
+		t.Errorf("a: out=%q ok=%v", out, ok)
+	}
+	c.put([]byte("c"), 0, []byte("cccc"), false, e, 0)
+	if _, ok := c.get(nil, []byte("b"), blocks[:1]); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, ok := c.get(nil, []byte("a"), blocks[:1]); !ok {
+		t.Error("a should still be cached")
+	}
+	c.dropFile([]byte("a"))
+	if _, ok := c.get(nil, []byte("a"), blocks[:1]); ok {
+		t.Error("a should have been dropped")
+	}
+	if c.bytes != 4 || len(c.blocks) != 1 || len(c.files) != 1 {
+		t.Errorf("bytes=%d blocks=%d files=%d", c.bytes, len(c.blocks), len(c.files))
+	}
+	// Blocks read before a write must not be stored
+	e.ContentLock.Lock()
+	e.ContentLock.Unlock()
+	c.put([]byte("d"), 0, []byte("dddd"), false, e, 0)
+	if _, ok := c.get(nil, []byte("d"), blocks[:1]); ok {
+		t.Error("stale block was stored")
+	}
+}
+
+// TestBlockCacheRead checks that reads are served from the cache, and that
+// writes and truncates drop the cached blocks.
+func TestBlockCacheRead(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, nil)
+	defer os.RemoveAll(dir)
+	fs.blockCache = newBlockCache(1024*1024, fs.contentEnc.PlainBS())
+	path := filepath.Join(dir, "f")
+	f := openTestFile(t, fs, path).(*file)
+	defer f.Release()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	writeAll(t, f, data)
+	if !bytes.Equal(readAll(t, f), data) {
+		t.Fatal("content mismatch")
+	}
+	if len(fs.blockCache.blocks) == 0 {
+		t.Fatal("nothing was cached")
+	}
+	// Corrupt the first block on disk. Reading it must not notice.
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fd.WriteAt(make([]byte, 100), contentenc.HeaderLen)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, f), data) {
+		t.Error("read was not served from the cache")
+	}
+	// Rewriting the file fixes the corruption and drops the cache
+	data = bytes.Repeat([]byte("abcdefghij"), 1000)
+	writeAll(t, f, data)
+	if !bytes.Equal(readAll(t, f), data) {
+		t.Error("stale data after write")
+	}
+	// Shrink and grow again. The end of the file must read as zeros.
+	if status := f.Truncate(4096); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := f.Truncate(uint64(len(data))); !status.Ok() {
+		t.Fatal(status)
+	}
+	copy(data[4096:], make([]byte, len(data)-4096))
+	if !bytes.Equal(readAll(t, f), data) {
+		t.Error("stale data after truncate")
+	}
+}
@@ -0,0 +1,152 @@
+package fusefrontend
+
+// Virtual xattr that describes the ciphertext layout of a file
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// blockMapXattr is a read-only xattr that is available on every regular
+// file. It is generated on the fly and not stored anywhere. It is not
+// returned by ListXAttr, so "cp -a" and friends do not try to copy it.
+const blockMapXattr = "user.gocryptfs.blockmap"
+
+// blockMapMaxBlocks limits the number of blocks listed in the block map.
+// The kernel does not accept xattr values larger than 64 kiB.
+const blockMapMaxBlocks = 256
+
+// blockMap is what blockMapXattr returns, encoded as JSON.
+type blockMap struct {
+	PlainSize  uint64 `json:"plain_size"`
+	CipherSize uint64 `json:"cipher_size"`
+	PlainBS    uint64 `json:"plain_bs"`
+	CipherBS   uint64 `json:"cipher_bs"`
+	// Header is "file" if the file header is stored at the start of the
+	// backing file, "xattr" for "-external_headers", and "none" if the file
+	// does not have a header yet.
+	Header    string `json:"header"`
+	HeaderLen uint64 `json:"header_len"`
+	FileID    string `json:"file_id,omitempty"`
+	// BlockCount is the number of blocks in the file. Only the first
+	// blockMapMaxBlocks blocks and the last block are listed in Blocks.
+	BlockCount uint64          `json:"block_count"`
+	Blocks     []blockMapEntry `json:"blocks"`
+	// Error describes what is wrong with the ciphertext size or the header
+	Error string `json:"error,omitempty"`
+}
+
+// blockMapEntry maps one plaintext block to its ciphertext block.
+type blockMapEntry struct {
+	BlockNo   uint64 `json:"block"`
+	PlainOff  uint64 `json:"plain_off"`
+	PlainLen  uint64 `json:"plain_len"`
+	CipherOff uint64 `json:"cipher_off"`
+	CipherLen uint64 `json:"cipher_len"`
+}
+
+// getBlockMap returns the block map of the backing file "cPath" as JSON.
+func (fs *FS) getBlockMap(cPath string) ([]byte, fuse.Status) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(cPath, &st)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, fuse.ENODATA
+	}
+	ce := fs.contentEnc
+	m := blockMap{
+		CipherSize: uint64(st.Size),
+		PlainBS:    ce.PlainBS(),
+		CipherBS:   ce.CipherBS(),
+		Header:     "none",
+	}
+	headerLen := uint64(contentenc.HeaderLen)
+	if ce.ExternalHeaders() {
+		headerLen = 0
+	}
+	h, err := readHeader(cPath, ce.ExternalHeaders())
+	if err != nil {
+		m.Error = err.Error()
+	} else if h != nil {
+		m.Header = "file"
+		if ce.ExternalHeaders() {
+			m.Header = "xattr"
+		}
+		m.HeaderLen = contentenc.HeaderLen
+		m.FileID = hex.EncodeToString(h.ID)
+	}
+	if m.CipherSize > headerLen {
+		m.PlainSize = ce.CipherSizeToPlainSize(m.CipherSize)
+		m.BlockCount = ce.CipherOffToBlockNo(m.CipherSize-1) + 1
+		if ce.PlainSizeToCipherSize(m.PlainSize) != m.CipherSize && m.Error == "" {
+			m.Error = "last block is shorter than the block overhead"
+		}
+	}
+	if h == nil && m.PlainSize > 0 && m.Error == "" {
+		m.Error = "file has content but no header"
+	}
+	m.Blocks = []blockMapEntry{}
+	for b := uint64(0); b < m.BlockCount; b++ {
+		if b == blockMapMaxBlocks {
+			b = m.BlockCount - 1
+		}
+		e := blockMapEntry{
+			BlockNo:   b,
+			PlainOff:  ce.BlockNoToPlainOff(b),
+			CipherOff: ce.BlockNoToCipherOff(b),
+		}
+		e.CipherLen = contentenc.MinUint64(m.CipherSize-e.CipherOff, m.CipherBS)
+		if e.CipherLen > ce.BlockOverhead() {
+			e.PlainLen = e.CipherLen - ce.BlockOverhead()
+		}
+		m.Blocks = append(m.Blocks, e)
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		tlog.Warn.Printf("getBlockMap: %v", err)
+		return nil, fuse.EIO
+	}
+	return out, fuse.OK
+}
+
+// readHeader reads the file header of the backing file "cPath". Returns
+// nil, nil if the file has no header yet.
+func readHeader(cPath string, external bool) (*contentenc.FileHeader, error) {
+	if external {
+		buf, err := xattr.LGet(cPath, headerXattr)
+		if err != nil {
+			if e, ok := err.(*xattr.Error); ok && e.Err == errNoAttr {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return contentenc.ParseHeader(buf)
+	}
+	f, err := os.OpenFile(cPath, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := f.ReadAt(buf, 0)
+	if err == io.EOF && n == 0 {
+		return nil, nil
+	} else if err == io.EOF {
+		return nil, fmt.Errorf("incomplete file header: %d bytes", n)
+	} else if err != nil {
+		return nil, err
+	}
+	return contentenc.ParseHeader(buf)
+}
@@ -0,0 +1,70 @@
+package fusefrontend
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func getTestBlockMap(t *testing.T, fs *FS, cPath string) blockMap {
+	out, status := fs.getBlockMap(cPath)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	var m blockMap
+	if err := json.Unmarshal(out, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestBlockMap(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, nil)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "f")
+	f := openTestFile(t, fs, fn).(*file)
+	defer f.Release()
+
+	// Empty file
+	m := getTestBlockMap(t, fs, fn)
+	if m.Header != "none" || m.BlockCount != 0 || len(m.Blocks) != 0 || m.Error != "" {
+		t.Errorf("empty file: %+v", m)
+	}
+
+	// Two full blocks and one partial block
+	writeAll(t, f, make([]byte, 2*4096+100))
+	m = getTestBlockMap(t, fs, fn)
+	if m.PlainSize != 2*4096+100 || m.CipherSize != 18+2*4128+132 {
+		t.Errorf("wrong sizes: %+v", m)
+	}
+	if m.Header != "file" || m.HeaderLen != 18 || len(m.FileID) != 32 || m.Error != "" {
+		t.Errorf("wrong header info: %+v", m)
+	}
+	if m.BlockCount != 3 || len(m.Blocks) != 3 {
+		t.Fatalf("wrong block count: %+v", m)
+	}
+	want := blockMapEntry{BlockNo: 2, PlainOff: 8192, PlainLen: 100, CipherOff: 18 + 2*4128, CipherLen: 132}
+	if m.Blocks[2] != want {
+		t.Errorf("wrong last block: have %+v, want %+v", m.Blocks[2], want)
+	}
+
+	// A last block that cannot hold a nonce and a tag is reported
+	os.Truncate(fn, int64(18+2*4128+10))
+	m = getTestBlockMap(t, fs, fn)
+	if m.Error == "" {
+		t.Errorf("corrupt size was not reported: %+v", m)
+	}
+	if m.BlockCount != 3 || m.Blocks[2].CipherLen != 10 || m.Blocks[2].PlainLen != 0 {
+		t.Errorf("wrong last block: %+v", m.Blocks[2])
+	}
+
+	// Long files only list the first blocks and the last block
+	f.fileTableEntry.ID = nil
+	os.Truncate(fn, 0)
+	writeAll(t, f, make([]byte, 1000*4096))
+	m = getTestBlockMap(t, fs, fn)
+	if m.BlockCount != 1000 || len(m.Blocks) != blockMapMaxBlocks+1 || m.Blocks[blockMapMaxBlocks].BlockNo != 999 {
+		t.Errorf("wrong block list: count=%d len=%d", m.BlockCount, len(m.Blocks))
+	}
+}
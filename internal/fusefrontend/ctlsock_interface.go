@@ -1,12 +1,12 @@
 package fusefrontend
 
 import (
-	"fmt"
 	"path"
 	"strings"
 
 	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 var _ ctlsock.Interface = &FS{} // Verify that interface is implemented.
@@ -17,6 +17,11 @@ func (fs *FS) EncryptPath(plainPath string) (string, error) {
 }
 
 // DecryptPath implements ctlsock.Backend
+//
+// Scripts that watch CIPHERDIR also see the files that gocryptfs keeps next
+// to the encrypted names. A gocryptfs.diriv file is decrypted to the
+// directory it belongs to, and a gocryptfs.longname.*.name file to the file
+// whose long name it stores.
 func (fs *FS) DecryptPath(cipherPath string) (string, error) {
 	if fs.args.PlaintextNames || cipherPath == "" {
 		return cipherPath, nil
@@ -24,23 +29,36 @@ func (fs *FS) DecryptPath(cipherPath string) (string, error) {
 	plainPath := ""
 	parts := strings.Split(cipherPath, "/")
 	wd := fs.args.Cipherdir
-	for _, part := range parts {
+	for i, part := range parts {
+		if fs.passthrough[part] {
+			plainPath = path.Join(plainPath, part)
+			wd = path.Join(wd, part)
+			continue
+		}
+		if i == len(parts)-1 {
+			if part == nametransform.DirIVFilename {
+				return plainPath, nil
+			}
+			if nametransform.NameType(part) == nametransform.LongNameFilename {
+				part = strings.TrimSuffix(part, nametransform.LongNameSuffix)
+			}
+		}
 		dirIV, err := nametransform.ReadDirIV(wd)
 		if err != nil {
-			fmt.Printf("ReadDirIV: %v\n", err)
+			tlog.Debug.Printf("DecryptPath: ReadDirIV: %v", err)
 			return "", err
 		}
 		longPart := part
 		if nametransform.IsLongContent(part) {
 			longPart, err = nametransform.ReadLongName(wd + "/" + part)
 			if err != nil {
-				fmt.Printf("ReadLongName: %v\n", err)
+				tlog.Debug.Printf("DecryptPath: ReadLongName: %v", err)
 				return "", err
 			}
 		}
 		name, err := fs.nameTransform.DecryptName(longPart, dirIV)
 		if err != nil {
-			fmt.Printf("DecryptName: %v\n", err)
+			tlog.Debug.Printf("DecryptPath: DecryptName: %v", err)
 			return "", err
 		}
 		plainPath = path.Join(plainPath, name)
@@ -0,0 +1,55 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestDecryptPath checks that ciphertext paths, including the
+// gocryptfs.diriv and .name files, are decrypted to the plaintext path they
+// belong to
+func TestDecryptPath(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	long := "dir/" + strings.Repeat("x", 200)
+	if status := fs.Mkdir("dir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	f, status := fs.Create(long, uint32(os.O_WRONLY), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	cDirPath, err := fs.EncryptPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cLong, err := fs.EncryptPath(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		cPath string
+		want  string
+	}{
+		{cDirPath, "dir"},
+		{cLong, long},
+		{cLong + nametransform.LongNameSuffix, long},
+		{cDirPath + "/" + nametransform.DirIVFilename, "dir"},
+		{nametransform.DirIVFilename, ""},
+	}
+	for _, tc := range testcases {
+		have, err := fs.DecryptPath(tc.cPath)
+		if err != nil {
+			t.Errorf("%q: %v", tc.cPath, err)
+		} else if have != tc.want {
+			t.Errorf("%q: have %q, want %q", tc.cPath, have, tc.want)
+		}
+	}
+	if _, err := fs.DecryptPath(cDirPath + "/nonexistent"); err == nil {
+		t.Error("decrypting garbage should fail")
+	}
+}
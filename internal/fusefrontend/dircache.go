@@ -0,0 +1,146 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dirCacheTTL is how long an open directory stays in the cache. Like the
+	// DirIV cache, this limits the time we may operate on a stale
+	// directory if CIPHERDIR is modified behind our back.
+	dirCacheTTL = time.Second
+	// dirCacheMax is the maximum number of cached directories.
+	dirCacheMax = 16
+)
+
+type dirCacheEntry struct {
+	// Absolute ciphertext path of the directory
+	path string
+	fd   *os.File
+	// Number of users of "fd" that have not called release() yet
+	refs int
+	// dropped is set when the entry has been removed from the cache while
+	// it was still in use. The last user closes the fd.
+	dropped bool
+	expiry  time.Time
+}
+
+// dirCache keeps recently used directories open. Deleting a tree ("rm -rf")
+// unlinks the files of a directory one by one, and every Unlink had to open
+// the parent directory again, walking the whole ciphertext path.
+// All methods can be called on a nil *dirCache, which disables caching.
+type dirCache struct {
+	sync.Mutex
+	entries map[string]*dirCacheEntry
+}
+
+func newDirCache() *dirCache {
+	return &dirCache{entries: make(map[string]*dirCacheEntry)}
+}
+
+// open returns an open file for directory "dir" (absolute ciphertext path).
+// The caller must call the returned release function when done and must not
+// close the file.
+func (c *dirCache) open(dir string) (*os.File, func(), error) {
+	if c == nil {
+		fd, err := os.Open(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fd, func() { fd.Close() }, nil
+	}
+	c.Lock()
+	e := c.entries[dir]
+	if e != nil && time.Now().After(e.expiry) {
+		c.dropLocked(e)
+		e = nil
+	}
+	if e != nil {
+		e.refs++
+		c.Unlock()
+		return e.fd, func() { c.release(e) }, nil
+	}
+	c.Unlock()
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	e = &dirCacheEntry{
+		path:   dir,
+		fd:     fd,
+		refs:   1,
+		expiry: time.Now().Add(dirCacheTTL),
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.entries[dir] != nil || len(c.entries) >= dirCacheMax {
+		c.pruneLocked()
+	}
+	if c.entries[dir] == nil && len(c.entries) < dirCacheMax {
+		c.entries[dir] = e
+	} else {
+		// Not cached, close it on release
+		e.dropped = true
+	}
+	return fd, func() { c.release(e) }, nil
+}
+
+func (c *dirCache) release(e *dirCacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	e.refs--
+	if e.dropped && e.refs == 0 {
+		e.fd.Close()
+	}
+}
+
+// dropLocked removes "e" from the cache. The caller must hold the lock.
+func (c *dirCache) dropLocked(e *dirCacheEntry) {
+	delete(c.entries, e.path)
+	e.dropped = true
+	if e.refs == 0 {
+		e.fd.Close()
+	}
+}
+
+// pruneLocked removes expired and unused entries. The caller must hold the
+// lock.
+func (c *dirCache) pruneLocked() {
+	now := time.Now()
+	for _, e := range c.entries {
+		if e.refs == 0 || now.After(e.expiry) {
+			c.dropLocked(e)
+		}
+	}
+}
+
+// drop removes directory "dir" (absolute ciphertext path) and everything
+// below it from the cache. Called from Rmdir.
+func (c *dirCache) drop(dir string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for p, e := range c.entries {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			c.dropLocked(e)
+		}
+	}
+}
+
+// clear empties the cache. Called from Rename, which can move directories
+// around.
+func (c *dirCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, e := range c.entries {
+		c.dropLocked(e)
+	}
+}
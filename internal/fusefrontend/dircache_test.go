@@ -0,0 +1,46 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDirCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDirCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newDirCache()
+	fd1, release1, err := c.open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd2, release2, err := c.open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd1 != fd2 {
+		t.Error("directory was opened twice")
+	}
+	release2()
+	// Dropping the entry while it is in use must not close the fd
+	c.drop(dir)
+	if _, err = fd1.Stat(); err != nil {
+		t.Errorf("fd was closed while in use: %v", err)
+	}
+	release1()
+	if _, err = fd1.Stat(); err == nil {
+		t.Error("fd was not closed after the last release")
+	}
+	// The next open must get a new fd
+	fd3, release3, err := c.open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release3()
+	if fd3 == fd1 {
+		t.Error("got a dropped fd")
+	}
+}
@@ -0,0 +1,46 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// dirTimes are the atime and mtime of a backing directory
+type dirTimes []syscall.Timespec
+
+// saveDirTimes returns the timestamps of the backing directory "dirfd", or
+// nil if they cannot be read.
+//
+// Creating an entry with a long name first creates its .name file. If
+// creating the entry itself fails, the .name file is deleted again. The
+// backing directory has been modified twice, but POSIX says that a failed
+// operation must not change the timestamps of the directory. Call
+// saveDirTimes before, and restoreDirTimes after the rollback.
+func saveDirTimes(dirfd *os.File) dirTimes {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(dirfd.Fd()), &st); err != nil {
+		return nil
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	return dirTimes{
+		syscall.NsecToTimespec(int64(a.Atime)*1e9 + int64(a.Atimensec)),
+		syscall.NsecToTimespec(int64(a.Mtime)*1e9 + int64(a.Mtimensec)),
+	}
+}
+
+// restoreDirTimes sets the timestamps of the backing directory "dirfd"
+// back to "t". dirfd.Name() must be the path of the directory.
+// The ctime cannot be set and keeps its new value.
+func restoreDirTimes(dirfd *os.File, t dirTimes) {
+	if t == nil {
+		return
+	}
+	if err := syscall.UtimesNano(dirfd.Name(), t); err != nil {
+		tlog.Warn.Printf("restoreDirTimes %q: %v", dirfd.Name(), err)
+	}
+}
@@ -0,0 +1,294 @@
+package fusefrontend
+
+// Modified ciphertext ranges for sync clients ("-dirty_ranges")
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// dirtyRangesXattr is a virtual xattr that lists the byte ranges of the
+// backing file that have been modified. Like blockMapXattr, it is not stored
+// anywhere and not returned by ListXAttr.
+//
+// Writing the "generation" that has been read back to the xattr tells us
+// that the synced ranges have been uploaded, and they are forgotten.
+const dirtyRangesXattr = "user.gocryptfs.dirty_ranges"
+
+// dirtyRangesMax limits the number of ranges that are kept per file and
+// list. Beyond that, the two ranges with the smallest gap between them are
+// merged. This reports bytes as modified that are not, but never the other
+// way round. It also keeps the xattr value below the 64 kiB kernel limit.
+const dirtyRangesMax = 256
+
+// cipherRange is the byte range [off, end) of a backing file
+type cipherRange struct {
+	off, end uint64
+}
+
+// rangeSet is a sorted list of ranges that neither overlap nor touch
+type rangeSet []cipherRange
+
+// add returns the set with [off, end) added
+func (s rangeSet) add(off, end uint64) rangeSet {
+	if off >= end {
+		return s
+	}
+	out := make(rangeSet, 0, len(s)+1)
+	i := 0
+	for ; i < len(s) && s[i].end < off; i++ {
+		out = append(out, s[i])
+	}
+	r := cipherRange{off, end}
+	for ; i < len(s) && s[i].off <= end; i++ {
+		if s[i].off < r.off {
+			r.off = s[i].off
+		}
+		if s[i].end > r.end {
+			r.end = s[i].end
+		}
+	}
+	out = append(out, r)
+	out = append(out, s[i:]...)
+	for len(out) > dirtyRangesMax {
+		min := 0
+		for j := 1; j < len(out)-1; j++ {
+			if out[j+1].off-out[j].end < out[min+1].off-out[min].end {
+				min = j
+			}
+		}
+		out[min].end = out[min+1].end
+		out = append(out[:min+1], out[min+2:]...)
+	}
+	return out
+}
+
+// dirtyFile are the modified ranges of one backing file
+type dirtyFile struct {
+	// pending ranges have been written, but not fsync'ed yet
+	pending rangeSet
+	// synced ranges have been written and fsync'ed
+	synced rangeSet
+	// generation is incremented when ranges are added to "synced"
+	generation uint64
+}
+
+// dirtyTracker keeps the modified ranges of all files in memory, keyed by
+// inode, so the ranges survive closing and opening the file again.
+// All methods can be called on a nil *dirtyTracker, which disables
+// tracking.
+type dirtyTracker struct {
+	lock  sync.Mutex
+	files map[openfiletable.QIno]*dirtyFile
+}
+
+func newDirtyTracker() *dirtyTracker {
+	return &dirtyTracker{files: make(map[openfiletable.QIno]*dirtyFile)}
+}
+
+// mark records that [off, end) of the backing file "qi" has been modified
+func (d *dirtyTracker) mark(qi openfiletable.QIno, off uint64, end uint64) {
+	if d == nil || off >= end {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	df := d.files[qi]
+	if df == nil {
+		df = &dirtyFile{}
+		d.files[qi] = df
+	}
+	df.pending = df.pending.add(off, end)
+}
+
+// takePending removes the pending ranges of "qi" and returns them. Call it
+// before fsync, and pass the result to synced() if fsync has worked, or to
+// restore() if it has not. Writes that race the fsync stay pending.
+func (d *dirtyTracker) takePending(qi openfiletable.QIno) rangeSet {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	df := d.files[qi]
+	if df == nil {
+		return nil
+	}
+	p := df.pending
+	df.pending = nil
+	return p
+}
+
+// synced moves the ranges "p" from takePending() into the synced ranges
+func (d *dirtyTracker) synced(qi openfiletable.QIno, p rangeSet) {
+	if d == nil || len(p) == 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	df := d.files[qi]
+	if df == nil {
+		// Forgotten in the meantime, see forget()
+		return
+	}
+	for _, r := range p {
+		df.synced = df.synced.add(r.off, r.end)
+	}
+	df.generation++
+}
+
+// restore puts the ranges "p" from takePending() back into the pending
+// ranges
+func (d *dirtyTracker) restore(qi openfiletable.QIno, p rangeSet) {
+	for _, r := range p {
+		d.mark(qi, r.off, r.end)
+	}
+}
+
+// get returns a copy of the state of "qi"
+func (d *dirtyTracker) get(qi openfiletable.QIno) dirtyFile {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	df := d.files[qi]
+	if df == nil {
+		return dirtyFile{}
+	}
+	return dirtyFile{
+		pending:    append(rangeSet(nil), df.pending...),
+		synced:     append(rangeSet(nil), df.synced...),
+		generation: df.generation,
+	}
+}
+
+// ack forgets the synced ranges of "qi" if they are still those of
+// "generation". Otherwise, more ranges have been synced since the client
+// read the xattr, and we return EAGAIN.
+func (d *dirtyTracker) ack(qi openfiletable.QIno, generation uint64) fuse.Status {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	df := d.files[qi]
+	if df == nil {
+		if generation == 0 {
+			return fuse.OK
+		}
+		return fuse.Status(syscall.EAGAIN)
+	}
+	if df.generation != generation {
+		return fuse.Status(syscall.EAGAIN)
+	}
+	df.synced = nil
+	if len(df.pending) == 0 {
+		// The generation starts at zero again
+		delete(d.files, qi)
+	}
+	return fuse.OK
+}
+
+// forget drops everything about "qi". Called when the backing file has been
+// deleted, so a new file that gets the same inode number starts clean.
+func (d *dirtyTracker) forget(qi openfiletable.QIno) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	delete(d.files, qi)
+	d.lock.Unlock()
+}
+
+// ftruncate works like syscall.Ftruncate on the backing file and records
+// the bytes between the old and the new size as modified. After shrinking,
+// the ranges can end beyond the file size.
+func (f *file) ftruncate(size int64) error {
+	var st syscall.Stat_t
+	old := int64(-1)
+	if f.fs.dirty != nil && syscall.Fstat(f.intFd(), &st) == nil {
+		old = st.Size
+	}
+	err := syscall.Ftruncate(f.intFd(), size)
+	if err != nil || old < 0 {
+		return err
+	}
+	if old < size {
+		f.fs.dirty.mark(f.qIno, uint64(old), uint64(size))
+	} else {
+		f.fs.dirty.mark(f.qIno, uint64(size), uint64(old))
+	}
+	return nil
+}
+
+// dirtyRanges is what dirtyRangesXattr returns, encoded as JSON.
+type dirtyRanges struct {
+	CipherSize uint64 `json:"cipher_size"`
+	// Generation is what has to be written to the xattr after uploading
+	// the synced ranges
+	Generation uint64 `json:"generation"`
+	// Synced ranges are on disk, because fsync has been called after they
+	// were written
+	Synced []dirtyRangeEntry `json:"synced"`
+	// Pending ranges have not been fsync'ed yet
+	Pending []dirtyRangeEntry `json:"pending"`
+}
+
+// dirtyRangeEntry is one range of the backing file
+type dirtyRangeEntry struct {
+	Off uint64 `json:"off"`
+	Len uint64 `json:"len"`
+}
+
+func dirtyRangeEntries(s rangeSet) []dirtyRangeEntry {
+	out := []dirtyRangeEntry{}
+	for _, r := range s {
+		out = append(out, dirtyRangeEntry{Off: r.off, Len: r.end - r.off})
+	}
+	return out
+}
+
+// getDirtyRanges returns the modified ranges of the backing file "cPath" as
+// JSON
+func (fs *FS) getDirtyRanges(cPath string) ([]byte, fuse.Status) {
+	if fs.dirty == nil {
+		return nil, fuse.ENODATA
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(cPath, &st); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, fuse.ENODATA
+	}
+	df := fs.dirty.get(openfiletable.QInoFromStat(&st))
+	out, err := json.Marshal(dirtyRanges{
+		CipherSize: uint64(st.Size),
+		Generation: df.generation,
+		Synced:     dirtyRangeEntries(df.synced),
+		Pending:    dirtyRangeEntries(df.pending),
+	})
+	if err != nil {
+		tlog.Warn.Printf("getDirtyRanges: %v", err)
+		return nil, fuse.EIO
+	}
+	return out, fuse.OK
+}
+
+// ackDirtyRanges handles writing the generation "data" to dirtyRangesXattr
+func (fs *FS) ackDirtyRanges(cPath string, data []byte) fuse.Status {
+	if fs.dirty == nil {
+		return fuse.EPERM
+	}
+	generation, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return fuse.EINVAL
+	}
+	var st syscall.Stat_t
+	if err = syscall.Lstat(cPath, &st); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.dirty.ack(openfiletable.QInoFromStat(&st), generation)
+}
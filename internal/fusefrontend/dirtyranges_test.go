@@ -0,0 +1,110 @@
+package fusefrontend
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestRangeSetAdd(t *testing.T) {
+	var s rangeSet
+	s = s.add(10, 20)
+	s = s.add(30, 40)
+	s = s.add(20, 25) // touches the first
+	s = s.add(5, 5)   // empty
+	want := rangeSet{{10, 25}, {30, 40}}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("have %v, want %v", s, want)
+	}
+	s = s.add(0, 100)
+	if !reflect.DeepEqual(s, rangeSet{{0, 100}}) {
+		t.Errorf("have %v", s)
+	}
+	// Too many ranges: the closest ones are merged
+	s = nil
+	for i := uint64(0); i < dirtyRangesMax; i++ {
+		s = s.add(i*10, i*10+1)
+	}
+	s = s.add((dirtyRangesMax-1)*10+2, (dirtyRangesMax-1)*10+3)
+	if len(s) != dirtyRangesMax {
+		t.Fatalf("have %d ranges", len(s))
+	}
+	if last := s[len(s)-1]; last != (cipherRange{(dirtyRangesMax - 1) * 10, (dirtyRangesMax-1)*10 + 3}) {
+		t.Errorf("wrong merge: %v", last)
+	}
+}
+
+func getTestDirtyRanges(t *testing.T, fs *FS, path string) dirtyRanges {
+	data, status := fs.GetXAttr(path, dirtyRangesXattr, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	var d dirtyRanges
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// TestDirtyRanges checks that writes show up as pending ranges, move to
+// the synced ranges on fsync, and are forgotten when acknowledged
+func TestDirtyRanges(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	if _, status := fs.GetXAttr("", dirtyRangesXattr, nil); status != fuse.ENODATA {
+		t.Errorf("disabled: want ENODATA, have %v", status)
+	}
+	fs.dirty = newDirtyTracker()
+	fuseFile, status := fs.Create("f", uint32(os.O_RDWR), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f := fuseFile.(*file)
+	defer f.Release()
+	cBS := f.contentEnc.CipherBS()
+	writeAll(t, f, make([]byte, 3*f.contentEnc.PlainBS()))
+	if status = f.Fsync(0); !status.Ok() {
+		t.Fatal(status)
+	}
+	// Modify the second block
+	if _, status = f.Write([]byte("x"), int64(f.contentEnc.PlainBS())); !status.Ok() {
+		t.Fatal(status)
+	}
+	d := getTestDirtyRanges(t, fs, "f")
+	if d.CipherSize != 18+3*cBS || d.Generation != 1 {
+		t.Errorf("wrong size or generation: %+v", d)
+	}
+	if len(d.Synced) != 1 || d.Synced[0] != (dirtyRangeEntry{0, d.CipherSize}) {
+		t.Errorf("wrong synced ranges: %v", d.Synced)
+	}
+	if len(d.Pending) != 1 || d.Pending[0] != (dirtyRangeEntry{18 + cBS, cBS}) {
+		t.Errorf("wrong pending ranges: %v", d.Pending)
+	}
+	if status = fs.SetXAttr("f", dirtyRangesXattr, []byte("7"), 0, nil); status != fuse.Status(syscall.EAGAIN) {
+		t.Errorf("wrong generation: want EAGAIN, have %v", status)
+	}
+	if status = fs.SetXAttr("f", dirtyRangesXattr, []byte("1"), 0, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	d = getTestDirtyRanges(t, fs, "f")
+	if len(d.Synced) != 0 || len(d.Pending) != 1 {
+		t.Errorf("after ack: %+v", d)
+	}
+	// Shrinking marks the part that has been cut off
+	f.Fsync(0)
+	fs.SetXAttr("f", dirtyRangesXattr, []byte("2"), 0, nil)
+	if status = f.Truncate(f.contentEnc.PlainBS()); !status.Ok() {
+		t.Fatal(status)
+	}
+	d = getTestDirtyRanges(t, fs, "f")
+	if len(d.Pending) != 1 || d.Pending[0] != (dirtyRangeEntry{18 + cBS, 2 * cBS}) {
+		t.Errorf("after truncate: %+v", d)
+	}
+	if status = fs.RemoveXAttr("f", dirtyRangesXattr, nil); status != fuse.EPERM {
+		t.Errorf("RemoveXAttr: want EPERM, have %v", status)
+	}
+}
@@ -0,0 +1,12 @@
+package fusefrontend
+
+// DropCaches forgets everything that has been cached about CIPHERDIR: file
+// attributes, open directories, directory IVs and decrypted blocks. "-mirror"
+// mounts call it when another mount has modified CIPHERDIR.
+// The kernel caches are not touched, "-mirror" sets their timeouts to zero.
+func (fs *FS) DropCaches() {
+	fs.attrCache.clear()
+	fs.dirCache.clear()
+	fs.nameTransform.DirIVCache.Clear()
+	fs.blockCache.clear()
+}
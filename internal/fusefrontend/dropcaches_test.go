@@ -0,0 +1,51 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestDropCaches checks that a second FS on the same CIPHERDIR, like a
+// "-mirror" mount, sees the changes made by the first one after DropCaches
+func TestDropCaches(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	mirror := NewFS(fs.args, fs.contentEnc, fs.nameTransform)
+	mirror.blockCache = newBlockCache(1024*1024, fs.contentEnc.PlainBS())
+	f, status := fs.Create("foo", uint32(os.O_RDWR), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	writeAll(t, f.(*file), []byte("old content"))
+	m, status := mirror.Open("foo", uint32(os.O_RDONLY), nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer m.Release()
+	if have := readAll(t, m.(*file)); string(have) != "old content" {
+		t.Fatalf("have %q", have)
+	}
+	if a, _ := mirror.GetAttr("foo", nil); a == nil || a.Mode&0777 != 0600 {
+		t.Fatalf("GetAttr: %v", a)
+	}
+	// Same size, so that the read can be answered from the block cache
+	writeAll(t, f.(*file), []byte("NEW CONTENT"))
+	if status = fs.Chmod("foo", 0640, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if have := readAll(t, m.(*file)); string(have) != "old content" {
+		t.Errorf("read should have been answered from the cache: %q", have)
+	}
+	if a, _ := mirror.GetAttr("foo", nil); a == nil || a.Mode&0777 != 0600 {
+		t.Errorf("GetAttr should have been answered from the cache: %v", a)
+	}
+	mirror.DropCaches()
+	if have := readAll(t, m.(*file)); !bytes.Equal(have, []byte("NEW CONTENT")) {
+		t.Errorf("stale content after DropCaches: %q", have)
+	}
+	if a, _ := mirror.GetAttr("foo", nil); a == nil || a.Mode&0777 != 0640 {
+		t.Errorf("stale GetAttr after DropCaches: %v", a)
+	}
+}
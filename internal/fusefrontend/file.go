@@ -21,6 +21,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/webhook"
 )
 
 var _ nodefs.File = &file{} // Verify that interface is implemented.
@@ -53,6 +54,21 @@ type file struct {
 	lastOpCount uint64
 	// Parent filesystem
 	fs *FS
+	// created is set by Create() when the file has just been created and
+	// is known to be empty. It enables the createWrite() fast path for the
+	// first write.
+	created bool
+	// Plaintext decrypted in advance for sequential reads, nil if disabled
+	readahead *readahead
+	// prealloc enables preallocation before writing. It defaults to
+	// !Args.NoPrealloc and can be changed per file by Args.Policy.
+	prealloc bool
+	// conflicts is fileTableEntry.Conflicts at the time the file was opened
+	// ("-conflict_eio")
+	conflicts uint64
+	// inode is set by go-fuse through SetInode() and used to invalidate
+	// the kernel page cache ("-writeback")
+	inode *nodefs.Inode
 	// We embed a nodefs.NewDefaultFile() that returns ENOSYS for every operation we
 	// have not implemented. This prevents build breakage when the go-fuse library
 	// adds new methods to the nodefs.File interface.
@@ -70,15 +86,29 @@ func NewFile(fd *os.File, fs *FS) (nodefs.File, fuse.Status) {
 	qi := openfiletable.QInoFromStat(&st)
 	e := openfiletable.Register(qi)
 
-	return &file{
+	f := &file{
 		fd:             fd,
 		contentEnc:     fs.contentEnc,
 		qIno:           qi,
 		fileTableEntry: e,
 		loopbackFile:   nodefs.NewLoopbackFile(fd),
 		fs:             fs,
+		readahead:      newReadahead(fs.args.ReadAhead),
+		prealloc:       !fs.args.NoPrealloc,
 		File:           nodefs.NewDefaultFile(),
-	}, fuse.OK
+	}
+	if fs.args.DetectConflicts {
+		e.ContentLock.Mutex.Lock()
+		if e.Stamp == (openfiletable.Stamp{}) {
+			// We are the first to open the file
+			f.updateStamp()
+		} else {
+			f.checkConflict()
+		}
+		f.conflicts = e.Conflicts
+		e.ContentLock.Mutex.Unlock()
+	}
+	return f, fuse.OK
 }
 
 // intFd - return the backing file descriptor as an integer. Used for debug
@@ -87,15 +117,28 @@ func (f *file) intFd() int {
 	return int(f.fd.Fd())
 }
 
+// tooBig returns true if growing the file to "size" bytes would exceed
+// Limits.MaxFileSize. This is reported to the webhook.
+func (f *file) tooBig(size uint64) bool {
+	if !f.fs.args.Limits.TooBig(size) {
+		return false
+	}
+	f.fs.args.Webhook.Send(webhook.EventQuotaExceeded, fmt.Sprintf("ino%d: size %d", f.qIno.Ino, size))
+	return true
+}
+
 // readFileID loads the file header from disk and extracts the file ID.
 // Returns io.EOF if the file is empty.
 func (f *file) readFileID() ([]byte, error) {
+	if f.contentEnc.ExternalHeaders() {
+		return f.readExternalFileID()
+	}
 	// We read +1 byte to determine if the file has actual content
 	// and not only the header. A header-only file will be considered empty.
 	// This makes File ID poisoning more difficult.
 	readLen := contentenc.HeaderLen + 1
 	buf := make([]byte, readLen)
-	n, err := f.fd.ReadAt(buf, 0)
+	n, err := f.readAt(buf, 0)
 	if err != nil {
 		if err == io.EOF && n != 0 {
 			tlog.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
@@ -117,9 +160,15 @@ func (f *file) readFileID() ([]byte, error) {
 // The caller must hold fileIDLock.Lock().
 func (f *file) createHeader() (fileID []byte, err error) {
 	h := contentenc.RandomHeader()
+	if f.contentEnc.ExternalHeaders() {
+		if err = f.writeExternalHeader(h); err != nil {
+			return nil, err
+		}
+		return h.ID, f.headerBarrier()
+	}
 	buf := h.Pack()
 	// Prevent partially written (=corrupt) header by preallocating the space beforehand
-	if !f.fs.args.NoPrealloc {
+	if f.prealloc {
 		err = syscallcompat.EnospcPrealloc(int(f.fd.Fd()), 0, contentenc.HeaderLen)
 		if err != nil {
 			tlog.Warn.Printf("ino%d: createHeader: prealloc failed: %s\n", f.qIno.Ino, err.Error())
@@ -127,11 +176,44 @@ func (f *file) createHeader() (fileID []byte, err error) {
 		}
 	}
 	// Actually write header
-	_, err = f.fd.WriteAt(buf, 0)
+	_, err = f.writeAt(buf, 0)
 	if err != nil {
 		return nil, err
 	}
-	return h.ID, err
+	return h.ID, f.headerBarrier()
+}
+
+// headerBarrier flushes a header that has just been written to disk when
+// "-write_barriers" is active. Otherwise, after a crash, the disk may
+// contain blocks that were encrypted with the new file ID next to the old
+// header (or no header at all), and they fail to decrypt.
+func (f *file) headerBarrier() error {
+	if !f.fs.args.WriteBarriers {
+		return nil
+	}
+	var err error
+	if f.contentEnc.ExternalHeaders() {
+		// The xattr is metadata that fdatasync does not cover
+		err = syscall.Fsync(f.intFd())
+	} else {
+		err = syscallcompat.Fdatasync(f.intFd())
+	}
+	if err != nil {
+		tlog.Warn.Printf("ino%d: headerBarrier: %v", f.qIno.Ino, err)
+	}
+	return err
+}
+
+// forgetFileID drops the cached file ID in "-sharedstorage" mode, so that
+// doRead() and doWrite() read the header again. Another gocryptfs instance
+// may have truncated the file and written a new header in the meantime.
+func (f *file) forgetFileID() {
+	if !f.fs.args.SharedStorage {
+		return
+	}
+	f.fileTableEntry.HeaderLock.Lock()
+	f.fileTableEntry.ID = nil
+	f.fileTableEntry.HeaderLock.Unlock()
 }
 
 // doRead - read "length" plaintext bytes from plaintext offset "off" and append
@@ -144,6 +226,9 @@ func (f *file) createHeader() (fileID []byte, err error) {
 // Called by Read() for normal reading,
 // by Write() and Truncate() for Read-Modify-Write
 func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Status) {
+	if out, hit := f.readahead.lookup(dst, off, length, f.fileTableEntry.ContentLock.Count()); hit {
+		return out, fuse.OK
+	}
 	// Make sure we have the file ID.
 	f.fileTableEntry.HeaderLock.RLock()
 	if f.fileTableEntry.ID == nil {
@@ -169,8 +254,15 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 		f.fileTableEntry.HeaderLock.RLock()
 	}
 	fileID := f.fileTableEntry.ID
-	// Read the backing ciphertext in one go
 	blocks := f.contentEnc.ExplodePlainRange(off, length)
+	if out, hit := f.fs.blockCache.get(dst, fileID, blocks); hit {
+		f.fileTableEntry.HeaderLock.RUnlock()
+		return out, fuse.OK
+	}
+	// Blocks decrypted from here on may only be cached if no write happens
+	// while we read them
+	count := f.fileTableEntry.ContentLock.Count()
+	// Read the backing ciphertext in one go
 	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
 	skip := blocks[0].Skip
 	tlog.Debug.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
@@ -178,7 +270,7 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 	ciphertext := f.fs.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
+	n, err := f.readAt(ciphertext, int64(alignedOffset))
 	// We don't care if the file ID changes after we have read the data. Drop the lock.
 	f.fileTableEntry.HeaderLock.RUnlock()
 	if err != nil && err != io.EOF {
@@ -210,6 +302,8 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 			tlog.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
 			return nil, fuse.EIO
 		}
+	} else {
+		f.fs.blockCache.put(fileID, firstBlockNo, plaintext, uint64(n) < alignedLength, f.fileTableEntry, count)
 	}
 
 	// Crop down to the relevant part
@@ -240,6 +334,16 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 	defer f.fdLock.RUnlock()
 
 	tlog.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, len(buf), off)
+	if f.fs.args.DetectConflicts {
+		// Reading does not modify the file, so we bypass the counter.
+		f.fileTableEntry.ContentLock.Mutex.Lock()
+		status := f.checkConflict()
+		f.fileTableEntry.ContentLock.Mutex.Unlock()
+		if !status.Ok() {
+			return nil, status
+		}
+	}
+	f.forgetFileID()
 	if f.fs.args.SerializeReads {
 		serialize_reads.Wait(off, len(buf))
 	}
@@ -250,6 +354,7 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 	if status != fuse.OK {
 		return nil, status
 	}
+	f.maybeReadahead(uint64(off), uint64(len(buf)))
 	tlog.Debug.Printf("ino%d: Read: status %v, returning %d bytes", f.qIno.Ino, status, len(out))
 	return fuse.ReadResultData(out), status
 }
@@ -308,28 +413,104 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
 	}
+	// All-zero blocks past EOF are not written but left as file holes
+	holes := f.zeroBlocksPastEOF(blocks, toEncrypt)
 	// Encrypt all blocks
 	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	cOff := int64(blocks[0].BlockCipherOff())
+	var status fuse.Status
+	if holes == nil {
+		status = f.writeCiphertext(ciphertext, cOff)
+	} else {
+		status = f.writeCiphertextSparse(ciphertext, cOff, holes)
+	}
+	// Return memory to CReqPool
+	f.fs.contentEnc.CReqPool.Put(ciphertext)
+	if !status.Ok() {
+		return 0, status
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+// writeCiphertext writes "ciphertext" to the backing file at offset "cOff"
+func (f *file) writeCiphertext(ciphertext []byte, cOff int64) fuse.Status {
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
-	var err error
-	cOff := int64(blocks[0].BlockCipherOff())
-	if !f.fs.args.NoPrealloc {
-		err = syscallcompat.EnospcPrealloc(int(f.fd.Fd()), cOff, int64(len(ciphertext)))
+	if f.prealloc {
+		err := syscallcompat.EnospcPrealloc(int(f.fd.Fd()), cOff, int64(len(ciphertext)))
 		if err != nil {
 			tlog.Warn.Printf("ino%d fh%d: doWrite: prealloc failed: %s", f.qIno.Ino, f.intFd(), err.Error())
-			return 0, fuse.ToStatus(err)
+			return fuse.ToStatus(err)
 		}
 	}
 	// Write
-	_, err = f.fd.WriteAt(ciphertext, cOff)
-	// Return memory to CReqPool
-	f.fs.contentEnc.CReqPool.Put(ciphertext)
+	_, err := f.writeAt(ciphertext, cOff)
 	if err != nil {
 		tlog.Warn.Printf("doWrite: Write failed: %s", err.Error())
-		return 0, fuse.ToStatus(err)
+		return fuse.ToStatus(err)
 	}
-	return uint32(len(data)), fuse.OK
+	return fuse.OK
+}
+
+// createWrite is the fast path for the first write to a file that has just
+// been created. As the file is known to be empty, there is nothing to read,
+// and the header and the first blocks are written with a single pwrite(2)
+// instead of separate read, header write and data write calls.
+// This roughly halves the number of syscalls when many small files are
+// created, like when unpacking an archive.
+//
+// Returns ok=false if the fast path cannot be used because somebody else has
+// already written the header, because "data" contains all-zero blocks
+// that doWrite should leave as holes, or because "-write_barriers" requires
+// the header to reach the disk before the data. With "-sharedstorage",
+// forgetFileID() has just dropped the cached ID, so we cannot tell if
+// another host or handle has written the header, and the fast path is not
+// used either. The caller must hold ContentLock.Lock().
+func (f *file) createWrite(data []byte) (n uint32, status fuse.Status, ok bool) {
+	if f.fs.args.WriteBarriers || f.fs.args.SharedStorage {
+		return 0, fuse.OK, false
+	}
+	f.fileTableEntry.HeaderLock.Lock()
+	defer f.fileTableEntry.HeaderLock.Unlock()
+	if f.fileTableEntry.ID != nil {
+		return 0, fuse.OK, false
+	}
+	h := contentenc.RandomHeader()
+	dataBuf := bytes.NewBuffer(data)
+	blocks := f.contentEnc.ExplodePlainRange(0, uint64(len(data)))
+	toEncrypt := make([][]byte, len(blocks))
+	for i, b := range blocks {
+		toEncrypt[i] = dataBuf.Next(int(b.Length))
+		if f.contentEnc.IsZeroBlock(toEncrypt[i]) {
+			return 0, fuse.OK, false
+		}
+	}
+	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, 0, h.ID)
+	// Return memory to CReqPool
+	defer f.fs.contentEnc.CReqPool.Put(ciphertext)
+	buf := ciphertext
+	if f.contentEnc.ExternalHeaders() {
+		if err := f.writeExternalHeader(h); err != nil {
+			return 0, fuse.ToStatus(err), true
+		}
+	} else {
+		buf = append(h.Pack(), ciphertext...)
+	}
+	// Preallocate so we cannot run out of space in the middle of the write.
+	if f.prealloc {
+		err := syscallcompat.EnospcPrealloc(int(f.fd.Fd()), 0, int64(len(buf)))
+		if err != nil {
+			tlog.Warn.Printf("ino%d fh%d: createWrite: prealloc failed: %s", f.qIno.Ino, f.intFd(), err.Error())
+			return 0, fuse.ToStatus(err), true
+		}
+	}
+	_, err := f.writeAt(buf, 0)
+	if err != nil {
+		tlog.Warn.Printf("createWrite: Write failed: %s", err.Error())
+		return 0, fuse.ToStatus(err), true
+	}
+	f.fileTableEntry.ID = h.ID
+	return uint32(len(data)), fuse.OK, true
 }
 
 // isConsecutiveWrite returns true if the current write
@@ -346,6 +527,13 @@ func (f *file) isConsecutiveWrite(off int64) bool {
 //
 // If the write creates a hole, pads the file to the next block boundary.
 func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if f.fs.args.ReadOnly {
+		return 0, fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	if f.tooBig(uint64(off) + uint64(len(data))) {
+		return 0, fuse.Status(syscall.EFBIG)
+	}
 	if len(data) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
@@ -362,7 +550,29 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.dropCachedBlocks()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if status := f.checkConflict(); !status.Ok() {
+		return 0, status
+	}
+	defer f.updateStamp()
+	if status := f.acquireLease(); !status.Ok() {
+		return 0, status
+	}
+	f.forgetFileID()
+	if f.created {
+		f.created = false
+		if off == 0 && len(data) > 0 {
+			n, status, ok := f.createWrite(data)
+			if ok {
+				if status.Ok() {
+					f.lastOpCount = openfiletable.WriteOpCount()
+					f.lastWrittenOffset = int64(len(data)) - 1
+				}
+				return n, status
+			}
+		}
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
@@ -386,6 +596,9 @@ func (f *file) Release() {
 	if f.released {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
+	f.fileTableEntry.ContentLock.Mutex.Lock()
+	f.releaseLease()
+	f.fileTableEntry.ContentLock.Mutex.Unlock()
 	f.fd.Close()
 	f.released = true
 	f.fdLock.Unlock()
@@ -414,10 +627,21 @@ func (f *file) Fsync(flags int) (code fuse.Status) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	return fuse.ToStatus(syscall.Fsync(int(f.fd.Fd())))
+	pending := f.fs.dirty.takePending(f.qIno)
+	err := syscall.Fsync(int(f.fd.Fd()))
+	if err != nil {
+		f.fs.dirty.restore(f.qIno, pending)
+		return fuse.ToStatus(err)
+	}
+	f.fs.dirty.synced(f.qIno, pending)
+	return fuse.OK
 }
 
 func (f *file) Chmod(mode uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -428,6 +652,10 @@ func (f *file) Chmod(mode uint32) fuse.Status {
 }
 
 func (f *file) Chown(uid uint32, gid uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -445,6 +673,7 @@ func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
 		return fuse.ToStatus(err)
 	}
 	a.FromStat(&st)
+	a.Ino = f.fs.inoMap.Translate(f.qIno)
 	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
 	if f.fs.args.ForceOwner != nil {
 		a.Owner = *f.fs.args.ForceOwner
@@ -454,7 +683,21 @@ func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
 }
 
 func (f *file) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
+	if f.fs.args.DetectConflicts {
+		// Changing the mtime does not modify the content, so we bypass the
+		// counter.
+		f.fileTableEntry.ContentLock.Mutex.Lock()
+		defer f.fileTableEntry.ContentLock.Mutex.Unlock()
+		if status := f.checkConflict(); !status.Ok() {
+			return status
+		}
+		defer f.updateStamp()
+	}
 	return f.loopbackFile.Utimens(a, m)
 }
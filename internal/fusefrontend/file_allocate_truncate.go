@@ -10,6 +10,7 @@ import (
 
 	"github.com/hanwen/go-fuse/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -20,6 +21,10 @@ const FALLOC_DEFAULT = 0x00
 // FALLOC_FL_KEEP_SIZE allocates disk space while not modifying the file size
 const FALLOC_FL_KEEP_SIZE = 0x01
 
+// FALLOC_FL_PUNCH_HOLE deallocates space. Must be combined with
+// FALLOC_FL_KEEP_SIZE.
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
 // Only warn once
 var allocateWarnOnce sync.Once
 
@@ -35,15 +40,24 @@ var allocateWarnOnce sync.Once
 // This allows us to reuse the file grow mechanics from Truncate as they are
 // complicated and hard to get right.
 //
-// Other modes (hole punching, zeroing) are not supported.
+// mode=FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE is implemented by punchHole.
+//
+// Other modes (zeroing, collapsing, inserting) are not supported.
 func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
-	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE && mode != FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE {
 		f := func() {
-			tlog.Warn.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
+			tlog.Warn.Printf("fallocate: only mode 0 (default), 1 (keep size) and 3 (punch hole) are supported")
 		}
 		allocateWarnOnce.Do(f)
 		return fuse.Status(syscall.EOPNOTSUPP)
 	}
+	if mode == FALLOC_DEFAULT && f.tooBig(off+sz) {
+		return fuse.Status(syscall.EFBIG)
+	}
 
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
@@ -52,6 +66,17 @@ func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.dropCachedBlocks()
+	if status := f.checkConflict(); !status.Ok() {
+		return status
+	}
+	defer f.updateStamp()
+	if status := f.acquireLease(); !status.Ok() {
+		return status
+	}
+	if mode&FALLOC_FL_PUNCH_HOLE != 0 {
+		return f.punchHole(off, sz)
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -91,8 +116,62 @@ func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	return f.truncateGrowFile(oldPlainSz, newPlainSz)
 }
 
+// punchHole zeroes the plaintext range [off, off+sz) without changing the
+// file size. Blocks that are completely inside the range are deallocated in
+// the backing file, which turns them into all-zero ciphertext blocks that
+// read back as zeros. Partially covered blocks are overwritten with
+// encrypted zeros.
+// The caller must hold ContentLock.Lock().
+func (f *file) punchHole(off uint64, sz uint64) fuse.Status {
+	plainSz, err := f.statPlainSize()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	// Nothing past EOF needs zeroing
+	end := off + sz
+	if end > plainSz {
+		end = plainSz
+	}
+	if off >= end {
+		return fuse.OK
+	}
+	// Only the first and the last block can be partial, so the full blocks
+	// are contiguous
+	var full []contentenc.IntraBlock
+	for _, b := range f.contentEnc.ExplodePlainRange(off, end-off) {
+		if !b.IsPartial() {
+			full = append(full, b)
+			continue
+		}
+		zeros := make([]byte, b.Length)
+		if _, status := f.doWrite(zeros, int64(b.BlockPlainOff()+b.Skip)); !status.Ok() {
+			return status
+		}
+	}
+	if len(full) == 0 {
+		return fuse.OK
+	}
+	cipherOff := full[0].BlockCipherOff()
+	cipherSz := full[len(full)-1].BlockCipherOff() + f.contentEnc.CipherBS() - cipherOff
+	tlog.Debug.Printf("ino%d: punchHole off=%d sz=%d cipherOff=%d cipherSz=%d",
+		f.qIno.Ino, off, end-off, cipherOff, cipherSz)
+	err = syscallcompat.Fallocate(f.intFd(), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE,
+		int64(cipherOff), int64(cipherSz))
+	if err == nil {
+		f.fs.dirty.mark(f.qIno, cipherOff, cipherOff+cipherSz)
+	}
+	return fuse.ToStatus(err)
+}
+
 // Truncate - FUSE call
 func (f *file) Truncate(newSize uint64) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	if f.tooBig(newSize) {
+		return fuse.Status(syscall.EFBIG)
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -102,10 +181,18 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.dropCachedBlocks()
+	if status := f.checkConflict(); !status.Ok() {
+		return status
+	}
+	defer f.updateStamp()
+	if status := f.acquireLease(); !status.Ok() {
+		return status
+	}
 	var err error
 	// Common case first: Truncate to zero
 	if newSize == 0 {
-		err = syscall.Ftruncate(int(f.fd.Fd()), 0)
+		err = f.ftruncate(0)
 		if err != nil {
 			tlog.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
 			return fuse.ToStatus(err)
@@ -114,6 +201,7 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 		f.fileTableEntry.HeaderLock.Lock()
 		f.fileTableEntry.ID = nil
 		f.fileTableEntry.HeaderLock.Unlock()
+		f.fs.trimmer.Schedule()
 		return fuse.OK
 	}
 	// We need the old file size to determine if we are growing or shrinking
@@ -127,9 +215,14 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 	newB := float32(newSize) / float32(f.contentEnc.PlainBS())
 	tlog.Debug.Printf("ino%d: FUSE Truncate from %.2f to %.2f blocks (%d to %d bytes)", f.qIno.Ino, oldB, newB, oldSize, newSize)
 
-	// File size stays the same - nothing to do
+	// File size stays the same. Like on Linux, truncate(2) still updates
+	// mtime and ctime, so we truncate the backing file to its own size.
 	if newSize == oldSize {
-		return fuse.OK
+		var st syscall.Stat_t
+		if err = syscall.Fstat(f.intFd(), &st); err != nil {
+			return fuse.ToStatus(err)
+		}
+		return fuse.ToStatus(syscall.Ftruncate(f.intFd(), st.Size))
 	}
 	// File grows
 	if newSize > oldSize {
@@ -151,11 +244,12 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 		}
 	}
 	// Truncate down to the last complete block
-	err = syscall.Ftruncate(int(f.fd.Fd()), int64(cipherOff))
+	err = f.ftruncate(int64(cipherOff))
 	if err != nil {
 		tlog.Warn.Printf("Truncate: shrink Ftruncate returned error: %v", err)
 		return fuse.ToStatus(err)
 	}
+	f.fs.trimmer.Schedule()
 	// Append partial block
 	if lastBlockLen > 0 {
 		_, status := f.doWrite(data, int64(plainOff))
@@ -215,7 +309,7 @@ func (f *file) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Statu
 			f.fileTableEntry.ID = id
 		}
 		cSz := int64(f.contentEnc.PlainSizeToCipherSize(newPlainSz))
-		err := syscall.Ftruncate(f.intFd(), cSz)
+		err := f.ftruncate(cSz)
 		if err != nil {
 			tlog.Warn.Printf("Truncate: grow Ftruncate returned error: %v", err)
 		}
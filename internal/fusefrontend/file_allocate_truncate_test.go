@@ -0,0 +1,59 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestPunchHole(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, nil)
+	defer os.RemoveAll(dir)
+	f := openTestFile(t, fs, filepath.Join(dir, "foo"))
+	defer f.Release()
+	bs := int(fs.contentEnc.PlainBS())
+	data := bytes.Repeat([]byte{0xff}, 3*bs+100)
+	if _, status := f.Write(data, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	// Partial first block, two full blocks, partial last block, and past EOF
+	off := 100
+	sz := 3*bs + 1000
+	status := f.Allocate(uint64(off), uint64(sz), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE)
+	if status == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("backing filesystem does not support hole punching")
+	} else if !status.Ok() {
+		t.Fatal(status)
+	}
+	for i := off; i < len(data); i++ {
+		data[i] = 0
+	}
+	buf := make([]byte, 4*bs)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	have, _ := res.Bytes(buf)
+	if !bytes.Equal(have, data) {
+		t.Errorf("wrong content after punching: len=%d, want len=%d", len(have), len(data))
+	}
+	// The full blocks must be holes in the backing file
+	ciphertext, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cOff := fs.contentEnc.BlockNoToCipherOff(1)
+	cBS := fs.contentEnc.CipherBS()
+	if !bytes.Equal(ciphertext[cOff:cOff+2*cBS], make([]byte, 2*cBS)) {
+		t.Error("full blocks have not been deallocated")
+	}
+	// Hole punching without FALLOC_FL_KEEP_SIZE is invalid
+	if status = f.Allocate(0, 1, FALLOC_FL_PUNCH_HOLE); status != fuse.Status(syscall.EOPNOTSUPP) {
+		t.Errorf("want EOPNOTSUPP, got %v", status)
+	}
+}
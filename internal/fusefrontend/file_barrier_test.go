@@ -0,0 +1,56 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteBarriers checks that "-write_barriers" bypasses the createWrite()
+// fast path, which writes header and data at once, and that the data
+// written through doWrite() can be read back.
+func TestWriteBarriers(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.WriteBarriers = true
+	})
+	defer os.RemoveAll(dir)
+	f := openTestFile(t, fs, filepath.Join(dir, "f")).(*file)
+	defer f.Release()
+	f.created = true
+	data := []byte("hello world")
+	if _, status, ok := f.createWrite(data); ok || !status.Ok() {
+		t.Fatalf("createWrite should decline: ok=%v status=%v", ok, status)
+	}
+	writeAll(t, f, data)
+	if have := readAll(t, f); !bytes.Equal(have, data) {
+		t.Errorf("wrong content %q", have)
+	}
+}
+
+// TestCreateWriteSharedStorage checks that the createWrite() fast path does
+// not overwrite a header that another handle has written after the file was
+// created
+func TestCreateWriteSharedStorage(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.SharedStorage = true
+	})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f")
+	f1 := openTestFile(t, fs, path).(*file)
+	defer f1.Release()
+	f1.created = true
+	// The other handle writes two blocks first
+	f2 := openTestFile(t, fs, path).(*file)
+	defer f2.Release()
+	data := bytes.Repeat([]byte("b"), 2*int(fs.contentEnc.PlainBS()))
+	writeAll(t, f2, data)
+	// Then the creator writes to the start of the file
+	if _, status := f1.Write([]byte("aaaa"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	copy(data, "aaaa")
+	if have := readAll(t, f2); !bytes.Equal(have, data) {
+		t.Errorf("content of the other handle was destroyed, have %d bytes", len(have))
+	}
+}
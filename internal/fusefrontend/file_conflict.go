@@ -0,0 +1,77 @@
+package fusefrontend
+
+// Detection of backing files that are modified behind our back
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// stamp returns mtime and size of the backing file.
+func (f *file) stamp() (openfiletable.Stamp, error) {
+	var st syscall.Stat_t
+	err := syscall.Fstat(f.intFd(), &st)
+	if err != nil {
+		return openfiletable.Stamp{}, err
+	}
+	// Go through fuse.Attr to get the same field names on Linux and macOS
+	var a fuse.Attr
+	a.FromStat(&st)
+	return openfiletable.Stamp{Mtime: a.Mtime, Mtimensec: a.Mtimensec, Size: a.Size}, nil
+}
+
+// updateStamp records the current state of the backing file as our own.
+// Called after every modification. The caller must hold ContentLock.
+func (f *file) updateStamp() {
+	if !f.fs.args.DetectConflicts {
+		return
+	}
+	s, err := f.stamp()
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: updateStamp: %v", f.qIno.Ino, f.intFd(), err)
+		return
+	}
+	f.fileTableEntry.Stamp = s
+}
+
+// checkConflict compares the backing file with the state it had after our
+// last modification. If something else, like a sync tool running on
+// CIPHERDIR, has modified it in the meantime, we drop everything we have
+// cached about the file so we don't mix old and new data.
+// With "-conflict_eio", file handles that were opened before the
+// modification return EIO from now on. Opening the file again gives access
+// to the new content.
+// The caller must hold ContentLock (the bare Mutex is enough).
+func (f *file) checkConflict() fuse.Status {
+	if !f.fs.args.DetectConflicts {
+		return fuse.OK
+	}
+	e := f.fileTableEntry
+	s, err := f.stamp()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if s != e.Stamp {
+		tlog.Warn.Printf("ino%d: backing file has been modified externally: mtime=%d.%09d size=%d, expected mtime=%d.%09d size=%d",
+			f.qIno.Ino, s.Mtime, s.Mtimensec, s.Size, e.Stamp.Mtime, e.Stamp.Mtimensec, e.Stamp.Size)
+		e.Stamp = s
+		e.Conflicts++
+		// The header may have been replaced as well
+		e.HeaderLock.Lock()
+		f.fs.blockCache.dropFile(e.ID)
+		e.ID = nil
+		e.HeaderLock.Unlock()
+		// Readahead data is tied to the ContentLock count
+		e.ContentLock.Invalidate()
+		f.fs.attrCache.invalidate(f.qIno)
+		f.invalidatePageCache()
+	}
+	if f.fs.args.ConflictEIO && f.conflicts != e.Conflicts {
+		return fuse.EIO
+	}
+	return fuse.OK
+}
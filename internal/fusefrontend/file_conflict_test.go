@@ -0,0 +1,71 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func readTestFile(f nodefs.File) (string, fuse.Status) {
+	buf := make([]byte, 100)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		return "", status
+	}
+	data, _ := res.Bytes(buf)
+	return string(data), status
+}
+
+func testConflict(t *testing.T, eio bool) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.DetectConflicts = true
+		a.ConflictEIO = eio
+	})
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	// Produce the content the "sync tool" will put into "a"
+	fb := openTestFile(t, fs, b)
+	fb.Write([]byte("new content"), 0)
+	fb.Release()
+	fa := openTestFile(t, fs, a)
+	defer fa.Release()
+	fa.Write([]byte("old"), 0)
+	if s, status := readTestFile(fa); s != "old" {
+		t.Fatalf("got %q %v", s, status)
+	}
+	// Modify "a" in place, behind our back
+	ciphertext, err := ioutil.ReadFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(a, ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, status := readTestFile(fa)
+	if eio {
+		if status != fuse.EIO {
+			t.Errorf("old handle: want EIO, got %q %v", s, status)
+		}
+	} else if s != "new content" {
+		t.Errorf("old handle: got %q %v", s, status)
+	}
+	// A new handle always sees the new content
+	fa2 := openTestFile(t, fs, a)
+	defer fa2.Release()
+	if s, status := readTestFile(fa2); s != "new content" {
+		t.Errorf("new handle: got %q %v", s, status)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	testConflict(t, false)
+}
+
+func TestConflictEIO(t *testing.T) {
+	testConflict(t, true)
+}
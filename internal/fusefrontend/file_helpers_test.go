@@ -0,0 +1,70 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// newTestFSWithArgs creates a temporary CIPHERDIR and returns an FS on top
+// of it. "setArgs" can change the Args before they are passed to NewFS, or
+// be nil. The caller must remove "dir" when done.
+func newTestFSWithArgs(t *testing.T, setArgs func(*Args)) (fs *FS, dir string) {
+	dir, err := ioutil.TempDir("", "gocryptfs-fusefrontend-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfs := newTestFS()
+	args := tfs.args
+	args.Cipherdir = dir
+	if setArgs != nil {
+		setArgs(&args)
+	}
+	return NewFS(args, tfs.contentEnc, tfs.nameTransform), dir
+}
+
+// openTestFile opens "path" as a gocryptfs file handle
+func openTestFile(t *testing.T, fs *FS, path string) nodefs.File {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, status := NewFile(fd, fs)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	return f
+}
+
+// readAll reads the whole file in MAX_KERNEL_WRITE steps
+func readAll(t *testing.T, f *file) []byte {
+	var out []byte
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for {
+		res, status := f.Read(buf, int64(len(out)))
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		data, _ := res.Bytes(buf)
+		out = append(out, data...)
+		if len(data) < len(buf) {
+			return out
+		}
+	}
+}
+
+// writeAll writes "data" at offset 0 in MAX_KERNEL_WRITE steps
+func writeAll(t *testing.T, f *file, data []byte) {
+	for off := 0; off < len(data); off += fuse.MAX_KERNEL_WRITE {
+		end := off + fuse.MAX_KERNEL_WRITE
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, status := f.Write(data[off:end], int64(off)); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+}
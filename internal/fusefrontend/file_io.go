@@ -0,0 +1,41 @@
+package fusefrontend
+
+// Reads and writes of the backing file, with "-fault_inject" hooked in
+
+import (
+	"io"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readAt works like f.fd.ReadAt. With "-fault_inject", the read may fail or
+// come back short as if the file ended early.
+func (f *file) readAt(buf []byte, off int64) (int, error) {
+	n, err := f.fs.args.FaultInject.Read(len(buf))
+	if err != nil {
+		tlog.Debug.Printf("ino%d: fault_inject: read off=%d len=%d: %v", f.qIno.Ino, off, len(buf), err)
+		return 0, &os.PathError{Op: "read", Path: f.fd.Name(), Err: err}
+	}
+	if n < len(buf) {
+		tlog.Debug.Printf("ino%d: fault_inject: short read off=%d len=%d -> %d", f.qIno.Ino, off, len(buf), n)
+		n, err = f.fd.ReadAt(buf[:n], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return f.fd.ReadAt(buf, off)
+}
+
+// writeAt works like f.fd.WriteAt. With "-fault_inject", the write may fail
+// without writing anything.
+func (f *file) writeAt(buf []byte, off int64) (int, error) {
+	if err := f.fs.args.FaultInject.Write(); err != nil {
+		tlog.Debug.Printf("ino%d: fault_inject: write off=%d len=%d: %v", f.qIno.Ino, off, len(buf), err)
+		return 0, &os.PathError{Op: "write", Path: f.fd.Name(), Err: err}
+	}
+	n, err := f.fd.WriteAt(buf, off)
+	f.fs.dirty.mark(f.qIno, uint64(off), uint64(off)+uint64(n))
+	return n, err
+}
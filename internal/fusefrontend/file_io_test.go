@@ -0,0 +1,35 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/faultinject"
+)
+
+func TestFaultInject(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, nil)
+	defer os.RemoveAll(dir)
+	f := openTestFile(t, fs, filepath.Join(dir, "f"))
+	defer f.Release()
+	if _, status := f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	fs.args.FaultInject, _ = faultinject.Parse("enospc=1")
+	if _, status := f.Write([]byte("world"), 5); status != fuse.Status(syscall.ENOSPC) {
+		t.Errorf("Write: want ENOSPC, got %v", status)
+	}
+	fs.args.FaultInject, _ = faultinject.Parse("eio=1")
+	if _, status := readTestFile(f); status != fuse.EIO {
+		t.Errorf("Read: want EIO, got %v", status)
+	}
+	fs.args.FaultInject = nil
+	if s, status := readTestFile(f); s != "hello" {
+		t.Errorf("got %q %v", s, status)
+	}
+}
@@ -0,0 +1,166 @@
+package fusefrontend
+
+// Write leases for "-sharedstorage"
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// leaseXattr is the xattr on the backing file that records which gocryptfs
+// instance may currently write to the file. It does not start with
+// xattrStorePrefix, so it is not visible through the mount.
+// The value is "OWNER EXPIRY", where OWNER is FS.leaseOwner and EXPIRY is
+// the end of the lease in Unix nanoseconds.
+const leaseXattr = "user.gocryptfs_lease"
+
+// leaseDuration is how long a lease is valid after it has been taken. It is
+// renewed on writes once half of it has passed.
+const leaseDuration = 10 * time.Second
+
+// leaseWait is how long a write waits for somebody else's lease to go
+// away before it fails with EAGAIN. It is a variable so the tests can
+// shorten it.
+var leaseWait = leaseDuration + 2*time.Second
+
+// errLeaseHeld is returned by tryLease if somebody else holds the lease
+var errLeaseHeld = errors.New("lease is held by another gocryptfs instance")
+
+var leaseWarnOnce sync.Once
+
+// parseLease splits a leaseXattr value into owner and expiry. Unparseable
+// values are treated as expired.
+func parseLease(v []byte) (owner string, expiry time.Time) {
+	parts := strings.Split(string(v), " ")
+	if len(parts) != 2 {
+		return "", time.Time{}
+	}
+	ns, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return parts[0], time.Unix(0, ns)
+}
+
+// getLease reads leaseXattr from the backing file. The xattr calls go
+// through the file descriptor because the path in f.fd.Name() is stale
+// after a rename.
+func (f *file) getLease() ([]byte, error) {
+	buf := make([]byte, 128)
+	n, err := syscallcompat.Fgetxattr(f.intFd(), leaseXattr, buf)
+	if err == syscall.ERANGE {
+		// Longer than anything we write. parseLease() treats an empty
+		// value as expired.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// tryLease takes or renews the lease on the backing file.
+func (f *file) tryLease() error {
+	fd := f.intFd()
+	now := time.Now()
+	expiry := now.Add(leaseDuration)
+	val := []byte(fmt.Sprintf("%s %d", f.fs.leaseOwner, expiry.UnixNano()))
+	old, err := f.getLease()
+	if err == errNoAttr {
+		// Nobody holds a lease. XATTR_CREATE makes sure that only one of
+		// several racing instances gets it.
+		err = syscallcompat.Fsetxattr(fd, leaseXattr, val, unix.XATTR_CREATE)
+		if err == syscall.EEXIST {
+			return errLeaseHeld
+		} else if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		owner, oldExpiry := parseLease(old)
+		if owner != f.fs.leaseOwner && oldExpiry.After(now) {
+			return errLeaseHeld
+		}
+		if err = syscallcompat.Fsetxattr(fd, leaseXattr, val, unix.XATTR_REPLACE); err != nil {
+			return err
+		}
+		if owner != f.fs.leaseOwner {
+			// Two instances may be taking over an expired lease at the same
+			// time. Whoever wrote last wins.
+			time.Sleep(10 * time.Millisecond)
+			cur, err := f.getLease()
+			if err != nil {
+				return err
+			}
+			if string(cur) != string(val) {
+				return errLeaseHeld
+			}
+		}
+	}
+	f.fileTableEntry.LeaseExpiry = expiry
+	return nil
+}
+
+// acquireLease makes sure we hold the write lease on the backing file in
+// "-sharedstorage" mode, so that gocryptfs instances on different hosts do
+// not interleave their header and block updates. It waits up to leaseWait
+// for somebody else's lease to expire.
+// If the backing storage does not support xattrs, a warning is printed once
+// and writing continues without a lease.
+// The caller must hold ContentLock.Lock().
+func (f *file) acquireLease() fuse.Status {
+	if !f.fs.args.SharedStorage {
+		return fuse.OK
+	}
+	e := f.fileTableEntry
+	if e.LeaseExpiry.Sub(time.Now()) > leaseDuration/2 {
+		return fuse.OK
+	}
+	deadline := time.Now().Add(leaseWait)
+	for {
+		err := f.tryLease()
+		if err == nil {
+			return fuse.OK
+		}
+		if err != errLeaseHeld {
+			leaseWarnOnce.Do(func() {
+				tlog.Warn.Printf("ino%d: cannot take write lease, continuing without: %v", f.qIno.Ino, err)
+			})
+			return fuse.OK
+		}
+		if time.Now().After(deadline) {
+			tlog.Warn.Printf("ino%d: %v, giving up", f.qIno.Ino, err)
+			return fuse.EAGAIN
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// releaseLease removes our lease from the backing file, so other instances
+// do not have to wait for it to expire. The caller must hold ContentLock
+// (the bare Mutex is enough).
+func (f *file) releaseLease() {
+	e := f.fileTableEntry
+	if !f.fs.args.SharedStorage || e.LeaseExpiry.IsZero() {
+		return
+	}
+	e.LeaseExpiry = time.Time{}
+	old, err := f.getLease()
+	if err != nil {
+		return
+	}
+	if owner, _ := parseLease(old); owner == f.fs.leaseOwner {
+		syscallcompat.Fremovexattr(f.intFd(), leaseXattr)
+	}
+}
@@ -0,0 +1,89 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+)
+
+func TestLease(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.SharedStorage = true
+	})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.LSet(path, "user.test", []byte("x")); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	oldWait := leaseWait
+	leaseWait = 200 * time.Millisecond
+	defer func() { leaseWait = oldWait }()
+	fs.leaseOwner = "me"
+	// Somebody else holds the lease
+	foreign := func(expiry time.Time) {
+		v := fmt.Sprintf("other %d", expiry.UnixNano())
+		if err := xattr.LSet(path, leaseXattr, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	foreign(time.Now().Add(time.Hour))
+	f := openTestFile(t, fs, path)
+	if _, status := f.Write([]byte("foo"), 0); status != fuse.EAGAIN {
+		t.Errorf("want EAGAIN, got %v", status)
+	}
+	// The other lease has expired
+	foreign(time.Now().Add(-time.Second))
+	if _, status := f.Write([]byte("foo"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	v, err := xattr.LGet(path, leaseXattr)
+	if owner, expiry := parseLease(v); err != nil || owner != "me" || expiry.Before(time.Now()) {
+		t.Errorf("lease not taken: %q %v", v, err)
+	}
+	// Closing the file drops the lease
+	f.Release()
+	if _, err = xattr.LGet(path, leaseXattr); err == nil {
+		t.Error("lease was not removed")
+	}
+}
+
+// The lease must follow the file when it is renamed while open
+func TestLeaseRename(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.SharedStorage = true
+	})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.LSet(path, "user.test", []byte("x")); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	fs.leaseOwner = "me"
+	f := openTestFile(t, fs, path)
+	path2 := filepath.Join(dir, "bar")
+	if err := os.Rename(path, path2); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := f.Write([]byte("foo"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	v, err := xattr.LGet(path2, leaseXattr)
+	if owner, _ := parseLease(v); err != nil || owner != "me" {
+		t.Errorf("lease not taken on renamed file: %q %v", v, err)
+	}
+	f.Release()
+	if _, err = xattr.LGet(path2, leaseXattr); err == nil {
+		t.Error("lease was not removed")
+	}
+}
@@ -0,0 +1,203 @@
+package fusefrontend
+
+// Readahead for sequential reads
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readahead holds plaintext that has been read and decrypted in advance,
+// while the previous request was being handed to the kernel.
+// All methods can be called on a nil *readahead, which disables readahead.
+type readahead struct {
+	sync.Mutex
+	// maxWindow is the upper limit for "window" ("-readahead")
+	maxWindow uint64
+	// nextOff is the plaintext offset the next read starts at if the access
+	// pattern is sequential
+	nextOff uint64
+	// window is the number of plaintext bytes we read ahead. It starts at
+	// twice the request size and doubles with every sequential read, up to
+	// maxWindow. A non-sequential read resets it.
+	window uint64
+	// pOff is the plaintext offset of "data", always block-aligned
+	pOff uint64
+	// data is the prefetched and decrypted plaintext
+	data []byte
+	// eof is set if the prefetch has hit the end of the file
+	eof bool
+	// count is the ContentLock counter of the file when "data" was read.
+	// If it has changed, the file has been written to and "data" is stale.
+	count uint64
+	// inflight is set while a prefetch runs in the background
+	inflight bool
+}
+
+func newReadahead(maxWindow uint64) *readahead {
+	if maxWindow == 0 {
+		return nil
+	}
+	return &readahead{maxWindow: maxWindow}
+}
+
+// lookup appends "length" bytes of prefetched plaintext starting at
+// plaintext offset "off" to "dst". It returns ok=false if the range has not
+// been prefetched or the file has been modified since ("count" is the
+// current ContentLock counter). Like doRead, it returns less than "length"
+// bytes at the end of the file.
+func (r *readahead) lookup(dst []byte, off uint64, length uint64, count uint64) (out []byte, ok bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.data == nil || count != r.count || off < r.pOff {
+		return nil, false
+	}
+	end := r.pOff + uint64(len(r.data))
+	if off+length > end {
+		if !r.eof {
+			return nil, false
+		}
+		if off >= end {
+			return dst, true
+		}
+		length = end - off
+	}
+	return append(dst, r.data[off-r.pOff:off-r.pOff+length]...), true
+}
+
+// maybeReadahead is called after a successful read of "length" bytes at
+// plaintext offset "off". If the access pattern is sequential, it starts
+// reading and decrypting the following blocks in the background.
+func (f *file) maybeReadahead(off uint64, length uint64) {
+	r := f.readahead
+	if r == nil || length == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if off != r.nextOff {
+		// Random access, drop everything
+		r.nextOff = off + length
+		r.window = 0
+		r.data = nil
+		return
+	}
+	r.nextOff = off + length
+	if r.window == 0 {
+		r.window = 2 * length
+	} else {
+		r.window *= 2
+	}
+	if r.window > r.maxWindow {
+		r.window = r.maxWindow
+	}
+	if r.inflight {
+		return
+	}
+	blocks := f.contentEnc.ExplodePlainRange(r.nextOff, r.window)
+	pOff := f.contentEnc.BlockNoToPlainOff(blocks[0].BlockNo)
+	// Do we still have at least half a window in the buffer?
+	if r.data != nil && r.count == f.fileTableEntry.ContentLock.Count() &&
+		pOff >= r.pOff && (r.eof || r.nextOff+r.window/2 <= r.pOff+uint64(len(r.data))) {
+		return
+	}
+	r.inflight = true
+	go f.prefetch(blocks)
+}
+
+// prefetch reads the ciphertext of "blocks" and decrypts it into the
+// readahead buffer.
+func (f *file) prefetch(blocks []contentenc.IntraBlock) {
+	r := f.readahead
+	data, eof, count, err := f.prefetchDecrypt(blocks)
+	r.Lock()
+	defer r.Unlock()
+	r.inflight = false
+	if err != nil {
+		tlog.Debug.Printf("ino%d: prefetch: %v", f.qIno.Ino, err)
+		r.data = nil
+		return
+	}
+	r.pOff = f.contentEnc.BlockNoToPlainOff(blocks[0].BlockNo)
+	r.data = data
+	r.eof = eof
+	r.count = count
+}
+
+// prefetchDecrypt reads the ciphertext of "blocks" and decrypts it. The
+// decryption is split into chunks that are decrypted concurrently, so large
+// windows do not take longer than reading them from disk.
+func (f *file) prefetchDecrypt(blocks []contentenc.IntraBlock) (data []byte, eof bool, count uint64, err error) {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return nil, false, 0, syscall.EBADF
+	}
+	cOff, cLen := blocks[0].JointCiphertextRange(blocks)
+	ciphertext := make([]byte, cLen)
+	// Keep writers out while we read so we cannot cache a half-written
+	// state. Reading does not modify the file, so we bypass the counter.
+	f.fileTableEntry.ContentLock.Mutex.Lock()
+	f.fileTableEntry.HeaderLock.RLock()
+	fileID := f.fileTableEntry.ID
+	f.fileTableEntry.HeaderLock.RUnlock()
+	count = f.fileTableEntry.ContentLock.Count()
+	n, err := f.readAt(ciphertext, int64(cOff))
+	f.fileTableEntry.ContentLock.Mutex.Unlock()
+	if err != nil && err != io.EOF {
+		return nil, false, 0, err
+	}
+	if fileID == nil {
+		return nil, false, 0, errors.New("file ID is not known yet")
+	}
+	ciphertext = ciphertext[:n]
+	eof = uint64(n) < cLen
+
+	ce := f.contentEnc
+	chunkBlocks := uint64(fuse.MAX_KERNEL_WRITE) / ce.PlainBS()
+	chunkLen := chunkBlocks * ce.CipherBS()
+	nChunks := (uint64(len(ciphertext)) + chunkLen - 1) / chunkLen
+	chunks := make([][]byte, nChunks)
+	errs := make([]error, nChunks)
+	// Limit the number of concurrent decryptions to the number of CPUs
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := uint64(0); i < nChunks; i++ {
+		start := i * chunkLen
+		end := start + chunkLen
+		if end > uint64(len(ciphertext)) {
+			end = uint64(len(ciphertext))
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i uint64, c []byte) {
+			chunks[i], errs[i] = ce.DecryptBlocks(c, blocks[0].BlockNo+i*chunkBlocks, fileID)
+			<-sem
+			wg.Done()
+		}(i, ciphertext[start:end])
+	}
+	wg.Wait()
+	data = make([]byte, 0, nChunks*chunkBlocks*ce.PlainBS())
+	for i := range chunks {
+		data = append(data, chunks[i]...)
+		ce.PReqPool.Put(chunks[i])
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+	}
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return data, eof, count, nil
+}
@@ -0,0 +1,92 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadaheadLookup(t *testing.T) {
+	var nilR *readahead
+	if _, ok := nilR.lookup(nil, 0, 10, 0); ok {
+		t.Error("nil readahead returned a hit")
+	}
+	if newReadahead(0) != nil {
+		t.Error("readahead should be disabled")
+	}
+	r := newReadahead(1024)
+	r.pOff = 100
+	r.data = []byte("0123456789")
+	r.count = 5
+	if out, ok := r.lookup([]byte("x"), 102, 4, 5); !ok || string(out) != "x2345" {
+		t.Errorf("hit: out=%q ok=%v", out, ok)
+	}
+	if _, ok := r.lookup(nil, 102, 4, 6); ok {
+		t.Error("stale data returned")
+	}
+	if _, ok := r.lookup(nil, 99, 4, 5); ok {
+		t.Error("range before the buffer returned")
+	}
+	if _, ok := r.lookup(nil, 108, 4, 5); ok {
+		t.Error("range beyond the buffer returned")
+	}
+	// At EOF, a short read is fine
+	r.eof = true
+	if out, ok := r.lookup(nil, 108, 4, 5); !ok || string(out) != "89" {
+		t.Errorf("eof: out=%q ok=%v", out, ok)
+	}
+	if out, ok := r.lookup(nil, 200, 4, 5); !ok || len(out) != 0 {
+		t.Errorf("beyond eof: out=%q ok=%v", out, ok)
+	}
+}
+
+// TestReadaheadDecrypt reads a file sequentially and checks that the data
+// comes out of the readahead buffer correctly
+func TestReadaheadDecrypt(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.ReadAhead = 1024 * 1024
+	})
+	defer os.RemoveAll(dir)
+	f := openTestFile(t, fs, filepath.Join(dir, "f")).(*file)
+	defer f.Release()
+	data := make([]byte, 3*1024*1024+1234)
+	rand.Read(data)
+	writeAll(t, f, data)
+
+	hits := 0
+	var have []byte
+	buf := make([]byte, 128*1024)
+	for off := 0; ; off += len(buf) {
+		// Give the prefetch time to finish
+		for i := 0; i < 100; i++ {
+			f.readahead.Lock()
+			inflight := f.readahead.inflight
+			f.readahead.Unlock()
+			if !inflight {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, ok := f.readahead.lookup(nil, uint64(off), uint64(len(buf)), f.fileTableEntry.ContentLock.Count()); ok {
+			hits++
+		}
+		res, status := f.Read(buf, int64(off))
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		out, _ := res.Bytes(buf)
+		if len(out) == 0 {
+			break
+		}
+		have = append(have, out...)
+	}
+	if !bytes.Equal(have, data) {
+		t.Error("content mismatch")
+	}
+	if hits == 0 {
+		t.Error("no read was served from the readahead buffer")
+	}
+}
@@ -0,0 +1,75 @@
+package fusefrontend
+
+// Keeping files sparse: all-zero blocks written past EOF become file holes
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// zeroBlocksPastEOF returns which of the plaintext "blocks" are all-zero
+// and start at or after the end of the backing file, or nil if there are
+// none. These do not need to be written: a hole reads back as zeros, see
+// ContentEnc.DecryptBlock.
+func (f *file) zeroBlocksPastEOF(blocks []contentenc.IntraBlock, plaintext [][]byte) []bool {
+	// Checking for zeros is cheap, the Fstat is not. Only do it if needed.
+	found := false
+	for _, p := range plaintext {
+		if f.contentEnc.IsZeroBlock(p) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return nil
+	}
+	var holes []bool
+	for i, b := range blocks {
+		if b.BlockCipherOff() >= uint64(st.Size) && f.contentEnc.IsZeroBlock(plaintext[i]) {
+			if holes == nil {
+				holes = make([]bool, len(blocks))
+			}
+			holes[i] = true
+		}
+	}
+	return holes
+}
+
+// writeCiphertextSparse works like writeCiphertext, but skips the blocks
+// marked in "holes". If the last block is a hole, the file is extended with
+// ftruncate so it gets the right size.
+func (f *file) writeCiphertextSparse(ciphertext []byte, cOff int64, holes []bool) fuse.Status {
+	cBS := int(f.contentEnc.CipherBS())
+	// Start of the current run of blocks that have to be written
+	start := 0
+	for i, hole := range holes {
+		if !hole {
+			continue
+		}
+		if i*cBS > start {
+			if status := f.writeCiphertext(ciphertext[start:i*cBS], cOff+int64(start)); !status.Ok() {
+				return status
+			}
+		}
+		start = (i + 1) * cBS
+	}
+	if start < len(ciphertext) {
+		return f.writeCiphertext(ciphertext[start:], cOff+int64(start))
+	}
+	// The last block is a hole. The blocks we skipped are past EOF, so this
+	// can only grow the file.
+	err := f.ftruncate(cOff + int64(len(ciphertext)))
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: writeCiphertextSparse: Ftruncate failed: %v", f.qIno.Ino, f.intFd(), err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
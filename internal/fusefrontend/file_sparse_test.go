@@ -0,0 +1,62 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteZeroBlocksSparse(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo")
+	f := openTestFile(t, fs, path)
+	defer f.Release()
+	bs := int(fs.contentEnc.PlainBS())
+	// data, zero, zero, data, zero
+	data := make([]byte, 5*bs)
+	copy(data, bytes.Repeat([]byte{1}, bs))
+	copy(data[3*bs:], bytes.Repeat([]byte{2}, bs))
+	if _, status := f.Write(data, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	ciphertext, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cBS := fs.contentEnc.CipherBS()
+	if uint64(len(ciphertext)) != fs.contentEnc.PlainSizeToCipherSize(uint64(len(data))) {
+		t.Fatalf("wrong backing file size %d", len(ciphertext))
+	}
+	for _, blockNo := range []uint64{1, 2, 4} {
+		off := fs.contentEnc.BlockNoToCipherOff(blockNo)
+		if !bytes.Equal(ciphertext[off:off+cBS], make([]byte, cBS)) {
+			t.Errorf("block %d was written, should be a hole", blockNo)
+		}
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("size=%d, allocated=%d", st.Size, st.Blocks*512)
+	buf := make([]byte, 6*bs)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if have, _ := res.Bytes(buf); !bytes.Equal(have, data) {
+		t.Error("content mismatch")
+	}
+	// Zero blocks inside the file are overwritten normally
+	if _, status = f.Write(make([]byte, bs), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	ciphertext, _ = ioutil.ReadFile(path)
+	off := fs.contentEnc.BlockNoToCipherOff(0)
+	if bytes.Equal(ciphertext[off:off+cBS], make([]byte, cBS)) {
+		t.Error("block 0 should have been written")
+	}
+}
@@ -0,0 +1,52 @@
+package fusefrontend
+
+// File headers stored in an xattr, see configfile.FlagExternalHeaders
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// headerXattr is the xattr on the backing file that stores the file header
+// on filesystems created with "-external_headers". Like leaseXattr, it does
+// not start with xattrStorePrefix, so it is not visible through the mount.
+const headerXattr = "user.gocryptfs_header"
+
+// readExternalFileID is readFileID for external headers. Like a header-only
+// file in the normal format, a file without content counts as empty, even
+// if the xattr is present.
+func (f *file) readExternalFileID() ([]byte, error) {
+	var one [1]byte
+	_, err := f.readAt(one[:], 0)
+	if err != nil {
+		return nil, err
+	}
+	// Read one byte more than needed to detect oversized values
+	buf := make([]byte, contentenc.HeaderLen+1)
+	n, err := syscallcompat.Fgetxattr(f.intFd(), headerXattr, buf)
+	if err == errNoAttr {
+		tlog.Warn.Printf("ino%d: file has content but no %s xattr", f.qIno.Ino, headerXattr)
+		f.fs.reportCorruptItem(fmt.Sprint(f.qIno.Ino))
+		return nil, fmt.Errorf("missing %s xattr", headerXattr)
+	} else if err != nil {
+		return nil, err
+	}
+	h, err := contentenc.ParseHeader(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return h.ID, nil
+}
+
+// writeExternalHeader stores the header "h" in the xattr of the backing
+// file, replacing the header that a truncated file may still have.
+func (f *file) writeExternalHeader(h *contentenc.FileHeader) error {
+	err := syscallcompat.Fsetxattr(f.intFd(), headerXattr, h.Pack(), 0)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: writing %s xattr failed: %v", f.qIno.Ino, headerXattr, err)
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/xattr"
+)
+
+func TestExternalHeaders(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, nil)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "f")
+	if err := xattr.Set(dir, "user.test", []byte("x")); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	fs.contentEnc.SetExternalHeaders()
+	f := openTestFile(t, fs, fn).(*file)
+
+	data := make([]byte, 300000)
+	rand.Read(data)
+	writeAll(t, f, data)
+	if have := readAll(t, f); !bytes.Equal(have, data) {
+		t.Fatal("content mismatch")
+	}
+	// Block 0 starts at offset 0, there is no header in the file
+	var st syscall.Stat_t
+	syscall.Stat(fn, &st)
+	if want := fs.contentEnc.PlainSizeToCipherSize(uint64(len(data))); uint64(st.Size) != want {
+		t.Errorf("wrong ciphertext size %d, want %d", st.Size, want)
+	}
+	if uint64(st.Size) != uint64(len(data))+74*fs.contentEnc.BlockOverhead() {
+		t.Errorf("ciphertext size %d includes a header", st.Size)
+	}
+	h, err := xattr.Get(fn, headerXattr)
+	if err != nil || len(h) != 18 {
+		t.Fatalf("header xattr: %x %v", h, err)
+	}
+
+	// A new file handle must find the header again
+	f2 := openTestFile(t, fs, fn).(*file)
+	if have := readAll(t, f2); !bytes.Equal(have, data) {
+		t.Error("content mismatch on second file handle")
+	}
+	f2.Release()
+
+	// Truncating to zero and writing again creates a new header
+	if status := f.Truncate(0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if have := readAll(t, f); string(have) != "hello" {
+		t.Errorf("wrong content %q", have)
+	}
+	h2, _ := xattr.Get(fn, headerXattr)
+	if bytes.Equal(h, h2) {
+		t.Error("header was not replaced")
+	}
+
+	f.Release()
+
+	// Content without a header is an error
+	xattr.Remove(fn, headerXattr)
+	f3 := openTestFile(t, fs, fn).(*file)
+	defer f3.Release()
+	if _, status := readTestFile(f3); status.Ok() {
+		t.Error("reading a file without header xattr should fail")
+	}
+}
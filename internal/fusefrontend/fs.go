@@ -4,6 +4,7 @@ package fusefrontend
 // FUSE operations on paths
 
 import (
+	"encoding/hex"
 	"os"
 	"path/filepath"
 	"sync"
@@ -17,10 +18,15 @@ import (
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/discard"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/serialize_reads"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/webhook"
 )
 
 // FS implements the go-fuse virtual filesystem interface.
@@ -43,6 +49,32 @@ type FS struct {
 	// to inform the user.
 	// Use the reportCorruptItem() function to push an item.
 	CorruptItems chan string
+	// attrCache caches GetAttr results. It is nil (disabled) in
+	// "-sharedstorage" mode.
+	attrCache *attrCache
+	// dirCache keeps recently used directories open. It is nil (disabled)
+	// in "-sharedstorage" mode.
+	dirCache *dirCache
+	// leaseOwner identifies this instance in the write leases that are
+	// taken in "-sharedstorage" mode, see file_lease.go
+	leaseOwner string
+	// inoMap translates backing inode numbers so they stay unique when
+	// CIPHERDIR contains submounts
+	inoMap *inomap.InoMap
+	// blockCache caches decrypted file blocks. It is nil unless
+	// "-plaintext_cache_size" is set.
+	blockCache *blockCache
+	// conn is used to invalidate the kernel page cache. It is nil unless
+	// "-writeback" is active, see SetConnector().
+	conn *nodefs.FileSystemConnector
+	// trimmer discards freed space on the backing device. It is nil unless
+	// "-discard" is active.
+	trimmer *discard.Trimmer
+	// dirty tracks modified ranges of the backing files. It is nil unless
+	// "-dirty_ranges" is active.
+	dirty *dirtyTracker
+	// passthrough holds the names from Args.Passthrough
+	passthrough map[string]bool
 }
 
 var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
@@ -52,30 +84,79 @@ func NewFS(args Args, c *contentenc.ContentEnc, n *nametransform.NameTransform)
 	if args.SerializeReads {
 		serialize_reads.InitSerializer()
 	}
-	return &FS{
+	fs := &FS{
 		FileSystem:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: n,
 		contentEnc:    c,
+		inoMap:        inomap.NewFromDir(args.Cipherdir),
+		blockCache:    newBlockCache(args.PlaintextCacheSize, c.PlainBS()),
 	}
+	fs.inoMap.SetNamespace(args.InoNamespace)
+	if !args.SharedStorage {
+		if !args.StrictPosix {
+			fs.attrCache = newAttrCache()
+		}
+		fs.dirCache = newDirCache()
+	} else {
+		fs.leaseOwner = hex.EncodeToString(cryptocore.RandBytes(8))
+		n.DirIVCache.RootOnly = true
+	}
+	if args.Discard {
+		fs.trimmer = discard.New(args.Cipherdir)
+	}
+	if args.DirtyRanges {
+		fs.dirty = newDirtyTracker()
+	}
+	if len(args.Passthrough) > 0 {
+		fs.passthrough = make(map[string]bool, len(args.Passthrough))
+		for _, name := range args.Passthrough {
+			fs.passthrough[name] = true
+		}
+	}
+	return fs
 }
 
 // GetAttr implements pathfs.Filesystem.
 func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if cPath, ok := fs.rawPath(name); ok {
+		return fs.rawGetAttr(cPath, context)
+	}
 	tlog.Debug.Printf("FS.GetAttr('%s')", name)
 	if fs.isFiltered(name) {
 		return nil, fuse.EPERM
 	}
+	if a := fs.attrCache.get(name); a != nil {
+		return a, fuse.OK
+	}
+	gen := fs.attrCache.generation()
 	cName, err := fs.encryptPath(name)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	a, status := fs.FileSystem.GetAttr(cName, context)
-	if a == nil {
+	// Like pathfs.loopbackFileSystem.GetAttr, but we also need the device
+	// number for the attribute cache.
+	var st syscall.Stat_t
+	cPath := filepath.Join(fs.args.Cipherdir, cName)
+	if cName == "" {
+		// When GetAttr is called for the toplevel directory, we always want
+		// to look through symlinks.
+		err = syscall.Stat(cPath, &st)
+	} else {
+		err = syscall.Lstat(cPath, &st)
+	}
+	if err != nil {
+		status := fuse.ToStatus(err)
 		tlog.Debug.Printf("FS.GetAttr failed: %s", status.String())
-		return a, status
+		return nil, status
 	}
-	if a.IsRegular() {
+	a := &fuse.Attr{}
+	a.FromStat(&st)
+	a.Ino = fs.inoMap.Translate(openfiletable.QInoFromStat(&st))
+	if cName == "" {
+		a.Nlink = fs.rootNlink(a.Nlink)
+	}
+	if a.IsRegular() && !fs.isPassthrough(name) {
 		a.Size = fs.contentEnc.CipherSizeToPlainSize(a.Size)
 	} else if a.IsSymlink() {
 		target, _ := fs.Readlink(name, context)
@@ -84,7 +165,8 @@ func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Stat
 	if fs.args.ForceOwner != nil {
 		a.Owner = *fs.args.ForceOwner
 	}
-	return a, status
+	fs.attrCache.put(name, openfiletable.QInoFromStat(&st), a, gen)
+	return a, fuse.OK
 }
 
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
@@ -103,14 +185,28 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 
 // Open implements pathfs.Filesystem.
 func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	if cPath, ok := fs.rawPath(path); ok {
+		return fs.rawOpen(cPath, flags)
+	}
+	pol := fs.policy(path)
+	defer func() { fuseFile = applyPolicy(fuseFile, pol) }()
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
+	if fs.isPassthrough(path) {
+		return fs.passthroughOpen(path, flags)
+	}
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	fs.openWriteOnlyLock.RLock()
 	defer fs.openWriteOnlyLock.RUnlock()
 
 	newFlags := fs.mangleOpenFlags(flags)
+	if fs.args.ReadOnly && newFlags&(os.O_RDWR|os.O_TRUNC) != 0 {
+		return nil, fuse.EROFS
+	}
+	if newFlags&os.O_TRUNC != 0 {
+		defer fs.attrCache.invalidatePath(path)
+	}
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		tlog.Debug.Printf("Open: getBackingPath: %v", err)
@@ -181,9 +277,18 @@ func (fs *FS) openWriteOnlyFile(cPath string, newFlags int) (fuseFile nodefs.Fil
 
 // Create implements pathfs.Filesystem.
 func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
-	if fs.isFiltered(path) {
+	if fs.readOnly(path) {
+		return nil, fuse.EROFS
+	}
+	defer fs.attrCache.clear()
+	if fs.isFiltered(path) || fs.args.Limits.Forbidden(path) {
 		return nil, fuse.EPERM
 	}
+	pol := fs.policy(path)
+	defer func() { fuseFile = applyPolicy(fuseFile, pol) }()
+	if fs.isPassthrough(path) {
+		return fs.passthroughCreate(path, flags, mode, context)
+	}
 	newFlags := fs.mangleOpenFlags(flags)
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
@@ -203,6 +308,7 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 		defer dirfd.Close()
 
 		// Create ".name"
+		times := saveDirTimes(dirfd)
 		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
 		if err != nil {
 			return nil, fuse.ToStatus(err)
@@ -213,6 +319,7 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 		fdRaw, err = syscallcompat.Openat(int(dirfd.Fd()), cName, newFlags|os.O_CREATE|os.O_EXCL, mode)
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cName)
+			restoreDirTimes(dirfd, times)
 			return nil, fuse.ToStatus(err)
 		}
 		fd = os.NewFile(uintptr(fdRaw), cName)
@@ -230,11 +337,20 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 			tlog.Warn.Printf("Create: fd.Chown failed: %v", err)
 		}
 	}
-	return NewFile(fd, fs)
+	fuseFile, code = NewFile(fd, fs)
+	if code.Ok() && !fs.args.NoCreateWrite {
+		// The file has been created with O_EXCL, so it is empty
+		fuseFile.(*file).created = true
+	}
+	return fuseFile, code
 }
 
 // Chmod implements pathfs.Filesystem.
 func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidatePath(path)
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -251,6 +367,10 @@ func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.
 
 // Chown implements pathfs.Filesystem.
 func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidatePath(path)
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -268,7 +388,7 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 		// a "gocryptfs.diriv" file. This file should also change the owner.
 		// Instead of checking if "cName" is a directory, we just blindly
 		// execute the chown on "cName/gocryptfs.diriv" and ignore errors.
-		dirIVPath := filepath.Join(cName, nametransform.DirIVFilename)
+		dirIVPath := nametransform.MetaPath(filepath.Join(dirfd.Name(), cName), nametransform.DirIVFilename)
 		syscallcompat.Fchownat(int(dirfd.Fd()), dirIVPath, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW)
 	}
 	return fuse.OK
@@ -276,7 +396,11 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 
 // Mknod implements pathfs.Filesystem.
 func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.clear()
+	if fs.isFiltered(path) || fs.args.Limits.Forbidden(path) {
 		return fuse.EPERM
 	}
 	dirfd, cName, err := fs.openBackingPath(path)
@@ -286,6 +410,7 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 	defer dirfd.Close()
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		times := saveDirTimes(dirfd)
 		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
 		if err != nil {
 			return fuse.ToStatus(err)
@@ -294,6 +419,7 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 		err = syscallcompat.Mknodat(int(dirfd.Fd()), cName, mode, int(dev))
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cName)
+			restoreDirTimes(dirfd, times)
 		}
 	} else {
 		// Create regular device node
@@ -318,6 +444,9 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 // While the glibc "truncate" wrapper seems to always use ftruncate, fsstress from
 // xfstests uses this a lot by calling "truncate64" directly.
 func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
 	file, code := fs.Open(path, uint32(os.O_RDWR), context)
 	if code != fuse.OK {
 		return code
@@ -329,6 +458,10 @@ func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code
 
 // Utimens implements pathfs.Filesystem.
 func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Context) (code fuse.Status) {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidatePath(path)
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -339,8 +472,28 @@ func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Con
 	return fs.FileSystem.Utimens(cPath, a, m, context)
 }
 
+// PlainBS returns the plaintext block size
+func (fs *FS) PlainBS() uint64 {
+	return fs.contentEnc.PlainBS()
+}
+
+// PlaintextNames returns true if file names are not encrypted. There are no
+// gocryptfs.diriv files then.
+func (fs *FS) PlaintextNames() bool {
+	return fs.args.PlaintextNames
+}
+
+// PlainSize returns the plaintext size of a file that takes "cipherSize"
+// bytes in CIPHERDIR
+func (fs *FS) PlainSize(cipherSize uint64) uint64 {
+	return fs.contentEnc.CipherSizeToPlainSize(cipherSize)
+}
+
 // StatFs implements pathfs.Filesystem.
 func (fs *FS) StatFs(path string) *fuse.StatfsOut {
+	if cPath, ok := fs.rawPath(path); ok {
+		return fs.FileSystem.StatFs(cPath)
+	}
 	if fs.isFiltered(path) {
 		return nil
 	}
@@ -371,6 +524,12 @@ func (fs *FS) decryptSymlinkTarget(cData64 string) (string, error) {
 
 // Readlink implements pathfs.Filesystem.
 func (fs *FS) Readlink(relPath string, context *fuse.Context) (out string, status fuse.Status) {
+	if cPath, ok := fs.rawPath(relPath); ok {
+		return fs.FileSystem.Readlink(cPath, context)
+	}
+	if fs.isFiltered(relPath) {
+		return "", fuse.EPERM
+	}
 	cPath, err := fs.encryptPath(relPath)
 	if err != nil {
 		return "", fuse.ToStatus(err)
@@ -394,19 +553,39 @@ func (fs *FS) Readlink(relPath string, context *fuse.Context) (out string, statu
 
 // Unlink implements pathfs.Filesystem.
 func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.clear()
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
-	dirfd, cName, err := fs.openBackingPath(path)
+	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	defer dirfd.Close()
+	// Recursive deletes unlink lots of files in the same directory, use the
+	// directory cache.
+	dirfd, release, err := fs.dirCache.open(filepath.Dir(cPath))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer release()
+	cName := filepath.Base(cPath)
+	shredFd := fs.shredOpen(cPath)
+	defer fs.shredClose(shredFd)
+	var st syscall.Stat_t
+	lastLink := fs.dirty != nil && syscall.Lstat(cPath, &st) == nil && st.Nlink == 1
 	// Delete content
 	err = syscallcompat.Unlinkat(int(dirfd.Fd()), cName, 0)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	if lastLink {
+		// The inode number may be reused by a new file
+		fs.dirty.forget(openfiletable.QInoFromStat(&st))
+	}
+	fs.trimmer.Schedule()
 	// Delete ".name" file
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = nametransform.DeleteLongName(dirfd, cName)
@@ -431,8 +610,12 @@ func (fs *FS) encryptSymlinkTarget(data string) (cData64 string) {
 
 // Symlink implements pathfs.Filesystem.
 func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (code fuse.Status) {
+	if fs.readOnly(linkName) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.clear()
 	tlog.Debug.Printf("Symlink(\"%s\", \"%s\")", target, linkName)
-	if fs.isFiltered(linkName) {
+	if fs.isFiltered(linkName) || fs.args.Limits.Forbidden(linkName) {
 		return fuse.EPERM
 	}
 	dirfd, cName, err := fs.openBackingPath(linkName)
@@ -447,6 +630,7 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		times := saveDirTimes(dirfd)
 		err = fs.nameTransform.WriteLongName(dirfd, cName, linkName)
 		if err != nil {
 			return fuse.ToStatus(err)
@@ -455,6 +639,7 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 		err = syscallcompat.Symlinkat(cTarget, int(dirfd.Fd()), cName)
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cName)
+			restoreDirTimes(dirfd, times)
 		}
 	} else {
 		// Create symlink
@@ -476,9 +661,18 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 
 // Rename implements pathfs.Filesystem.
 func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
+	if fs.readOnly(oldPath, newPath) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.clear()
+	if fs.isFiltered(oldPath) || fs.isFiltered(newPath) || fs.args.Limits.Forbidden(newPath) {
 		return fuse.EPERM
 	}
+	// The content of passthrough files is not encrypted. Let mv(1) copy
+	// the file instead.
+	if fs.isPassthrough(oldPath) != fs.isPassthrough(newPath) {
+		return fuse.EXDEV
+	}
 	cOldPath, err := fs.getBackingPath(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -487,13 +681,36 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	// rename(2) does nothing if both names are hard links to the same file.
+	// We must not delete the .name file of the old name in this case.
+	if sameInode(cOldPath, cNewPath) {
+		return fuse.OK
+	}
 	// The Rename may cause a directory to take the place of another directory.
 	// That directory may still be in the DirIV cache, clear it.
 	fs.nameTransform.DirIVCache.Clear()
+	fs.dirCache.clear()
+	// A file that is replaced by the rename is deleted
+	shredFd := fs.shredOpen(cNewPath)
+	defer fs.shredClose(shredFd)
+	if fs.trimmer != nil {
+		var st syscall.Stat_t
+		if syscall.Lstat(cNewPath, &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+			defer fs.trimmer.Schedule()
+		}
+	}
 	// Easy case.
 	if fs.args.PlaintextNames {
 		return fuse.ToStatus(syscall.Rename(cOldPath, cNewPath))
 	}
+	// A directory rename is a single renameat(2) on the ciphertext directory:
+	// the names inside are encrypted with the directory's own IV and do not
+	// change, no matter how many entries it has. The only extra work is the
+	// .name file for long names. We create the new one before and delete the
+	// old one after the rename, so an interruption at any point leaves at
+	// most an orphaned .name file behind, which OpenDir ignores and fsck
+	// reports.
+	//
 	// Handle long source file name
 	var oldDirFd *os.File
 	var finalOldDirFd int
@@ -511,6 +728,7 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	}
 	// Handle long destination file name
 	var newDirFd *os.File
+	var newDirTimes dirTimes
 	var finalNewDirFd int
 	var finalNewPath = cNewPath
 	cNewName := filepath.Base(cNewPath)
@@ -524,6 +742,7 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 		// Use relative path
 		finalNewPath = cNewName
 		// Create destination .name file
+		newDirTimes = saveDirTimes(newDirFd)
 		err = fs.nameTransform.WriteLongName(newDirFd, cNewName, newPath)
 		// Failure to write the .name file is expected when the target path already
 		// exists. Since hashes are pretty unique, there is no need to modify the
@@ -546,6 +765,9 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 		// again.
 		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
 		if fs.Rmdir(newPath, context) == fuse.OK {
+			// The target directory is gone, the timestamps have changed
+			// for real
+			newDirTimes = nil
 			err = syscallcompat.Renameat(finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
 		}
 	}
@@ -553,20 +775,33 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 		if newDirFd != nil {
 			// Roll back .name creation
 			nametransform.DeleteLongName(newDirFd, cNewName)
+			restoreDirTimes(newDirFd, newDirTimes)
 		}
 		return fuse.ToStatus(err)
 	}
 	if oldDirFd != nil {
 		nametransform.DeleteLongName(oldDirFd, cOldName)
 	}
+	// With "-metadata_dir", gocryptfs.diriv and the .name files of a
+	// directory have to move along with it.
+	nametransform.RenameMetaDir(cOldPath, cNewPath)
 	return fuse.OK
 }
 
 // Link implements pathfs.Filesystem.
 func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
+	if fs.readOnly(oldPath, newPath) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.clear()
+	if fs.isFiltered(oldPath) || fs.isFiltered(newPath) || fs.args.Limits.Forbidden(newPath) {
 		return fuse.EPERM
 	}
+	// The content of passthrough files is not encrypted. Let mv(1) copy
+	// the file instead.
+	if fs.isPassthrough(oldPath) != fs.isPassthrough(newPath) {
+		return fuse.EXDEV
+	}
 	oldDirFd, cOldName, err := fs.openBackingPath(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -579,6 +814,7 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 	defer newDirFd.Close()
 	// Handle long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cNewName) {
+		times := saveDirTimes(newDirFd)
 		err = fs.nameTransform.WriteLongName(newDirFd, cNewName, newPath)
 		if err != nil {
 			return fuse.ToStatus(err)
@@ -587,6 +823,7 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 		err = syscallcompat.Linkat(int(oldDirFd.Fd()), cOldName, int(newDirFd.Fd()), cNewName, 0)
 		if err != nil {
 			nametransform.DeleteLongName(newDirFd, cNewName)
+			restoreDirTimes(newDirFd, times)
 		}
 	} else {
 		// Create regular link
@@ -595,8 +832,36 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 	return fuse.ToStatus(err)
 }
 
+// rootNlink corrects the link count "nlink" of the backing root directory
+// for QuarantineDirName, which OpenDir hides. Tools like find(1) rely on
+// the link count to know how many subdirectories to expect.
+func (fs *FS) rootNlink(nlink uint32) uint32 {
+	if fs.args.PlaintextNames || nlink <= 2 {
+		return nlink
+	}
+	var st syscall.Stat_t
+	err := syscall.Lstat(filepath.Join(fs.args.Cipherdir, QuarantineDirName), &st)
+	if err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		nlink--
+	}
+	return nlink
+}
+
+// sameInode returns true if the backing paths "a" and "b" both exist and
+// are hard links to the same inode
+func sameInode(a string, b string) bool {
+	var stA, stB syscall.Stat_t
+	if syscall.Lstat(a, &stA) != nil || syscall.Lstat(b, &stB) != nil {
+		return false
+	}
+	return stA.Dev == stB.Dev && stA.Ino == stB.Ino
+}
+
 // Access implements pathfs.Filesystem.
 func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if cPath, ok := fs.rawPath(path); ok {
+		return fs.rawAccess(cPath, mode, context)
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -608,6 +873,8 @@ func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse
 }
 
 func (fs *FS) reportCorruptItem(item string) {
+	fs.args.Webhook.Send(webhook.EventCorruption, item)
+	fs.args.DesktopNotify.Corruption(item)
 	if fs.CorruptItems == nil {
 		return
 	}
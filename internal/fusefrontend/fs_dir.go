@@ -51,7 +51,11 @@ func (fs *FS) mkdirWithIv(dirfd *os.File, cName string, mode uint32) error {
 
 // Mkdir implements pathfs.FileSystem
 func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
+	if fs.readOnly(newPath) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.clear()
+	if fs.isFiltered(newPath) || fs.args.Limits.Forbidden(newPath) {
 		return fuse.EPERM
 	}
 	dirfd, cName, err := fs.openBackingPath(newPath)
@@ -61,6 +65,10 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 	defer dirfd.Close()
 	if fs.args.PlaintextNames {
 		err = syscallcompat.Mkdirat(int(dirfd.Fd()), cName, mode)
+		if err != nil {
+			// EMLINK when the parent has too many subdirectories
+			return fuse.ToStatus(err)
+		}
 		// Set owner
 		if fs.args.PreserveOwner {
 			err = syscallcompat.Fchownat(int(dirfd.Fd()), cName, int(context.Owner.Uid),
@@ -79,6 +87,7 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 	// Handle long file name
 	if nametransform.IsLongContent(cName) {
 		// Create ".name"
+		times := saveDirTimes(dirfd)
 		err = fs.nameTransform.WriteLongName(dirfd, cName, newPath)
 		if err != nil {
 			return fuse.ToStatus(err)
@@ -88,6 +97,7 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		err = fs.mkdirWithIv(dirfd, cName, mode)
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cName)
+			restoreDirTimes(dirfd, times)
 			return fuse.ToStatus(err)
 		}
 	} else {
@@ -98,6 +108,12 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 	}
 	// Set permissions back to what the user wanted
 	if origMode != mode {
+		// Keep the S_ISGID bit that the directory has inherited from its
+		// parent
+		var st unix.Stat_t
+		if syscallcompat.Fstatat(int(dirfd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			origMode |= uint32(st.Mode) & syscall.S_ISGID
+		}
 		err = syscallcompat.Fchmodat(int(dirfd.Fd()), cName, origMode, unix.AT_SYMLINK_NOFOLLOW)
 		if err != nil {
 			tlog.Warn.Printf("Mkdir: Fchmodat failed: %v", err)
@@ -110,7 +126,8 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		if err != nil {
 			tlog.Warn.Printf("Mkdir: Fchownat 1 failed: %v", err)
 		}
-		err = syscallcompat.Fchownat(int(dirfd.Fd()), filepath.Join(cName, nametransform.DirIVFilename),
+		dirIVPath := nametransform.MetaPath(filepath.Join(dirfd.Name(), cName), nametransform.DirIVFilename)
+		err = syscallcompat.Fchownat(int(dirfd.Fd()), dirIVPath,
 			int(context.Owner.Uid), int(context.Owner.Gid), unix.AT_SYMLINK_NOFOLLOW)
 		if err != nil {
 			tlog.Warn.Printf("Mkdir: Fchownat 2 failed: %v", err)
@@ -131,24 +148,34 @@ func haveDsstore(names []string) bool {
 
 // Rmdir implements pathfs.FileSystem
 func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.clear()
+	if fs.isFiltered(path) {
+		return fuse.EPERM
+	}
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	if fs.args.PlaintextNames {
+		fs.dirCache.drop(cPath)
 		err = syscall.Rmdir(cPath)
 		return fuse.ToStatus(err)
 	}
 	parentDir := filepath.Dir(cPath)
-	parentDirFd, err := os.Open(parentDir)
+	parentDirFd, release, err := fs.dirCache.open(parentDir)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	defer parentDirFd.Close()
+	defer release()
 
 	cName := filepath.Base(cPath)
+	// O_DIRECTORY makes us fail with ENOTDIR on files and symlinks, like
+	// rmdir(2)
 	dirfdRaw, err := syscallcompat.Openat(int(parentDirFd.Fd()), cName,
-		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err == syscall.EACCES {
 		// We need permission to read and modify the directory
 		tlog.Debug.Printf("Rmdir: handling EACCESS")
@@ -170,7 +197,7 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 		var st syscall.Stat_t
 		syscall.Lstat(cPath, &st)
 		dirfdRaw, err = syscallcompat.Openat(int(parentDirFd.Fd()), cName,
-			syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+			syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 		// Undo the chmod if removing the directory failed
 		defer func() {
 			if code != fuse.OK {
@@ -185,13 +212,17 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 		tlog.Debug.Printf("Rmdir: Open: %v", err)
 		return fuse.ToStatus(err)
 	}
-	dirfd := os.NewFile(uintptr(dirfdRaw), cName)
+	dirfd := os.NewFile(uintptr(dirfdRaw), cPath)
 	defer dirfd.Close()
 retry:
 	// Check directory contents
 	children, err := dirfd.Readdirnames(10)
 	if err == io.EOF {
 		// The directory is empty
+		if nametransform.HaveMetadataDir() {
+			// gocryptfs.diriv lives in the metadata directory
+			return fs.rmdirMeta(path, cPath, parentDirFd)
+		}
 		tlog.Warn.Printf("Rmdir: %q: gocryptfs.diriv is missing", cPath)
 		return fuse.ToStatus(syscall.Rmdir(cPath))
 	}
@@ -200,8 +231,9 @@ retry:
 		return fuse.ToStatus(err)
 	}
 	// MacOS sprinkles .DS_Store files everywhere. This is hard to avoid for
-	// users, so handle it transparently here.
-	if runtime.GOOS == "darwin" && len(children) <= 2 && haveDsstore(children) {
+	// users, so handle it transparently here, unless we are asked to stick
+	// to POSIX.
+	if runtime.GOOS == "darwin" && !fs.args.StrictPosix && len(children) <= 2 && haveDsstore(children) {
 		ds := filepath.Join(cPath, dsStoreName)
 		err = syscall.Unlink(ds)
 		if err != nil {
@@ -213,7 +245,7 @@ retry:
 	}
 	// If the directory is not empty besides gocryptfs.diriv, do not even
 	// attempt the dance around gocryptfs.diriv.
-	if len(children) > 1 {
+	if len(children) > 1 || nametransform.HaveMetadataDir() {
 		return fuse.ToStatus(syscall.ENOTEMPTY)
 	}
 	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
@@ -223,6 +255,10 @@ retry:
 	// Protect against concurrent readers.
 	fs.dirIVLock.Lock()
 	defer fs.dirIVLock.Unlock()
+	// Both directories are modified by the rename. Put the timestamps back
+	// if we have to roll it back.
+	dirTimes := saveDirTimes(dirfd)
+	parentTimes := saveDirTimes(parentDirFd)
 	err = syscallcompat.Renameat(int(dirfd.Fd()), nametransform.DirIVFilename,
 		int(parentDirFd.Fd()), tmpName)
 	if err != nil {
@@ -231,14 +267,18 @@ retry:
 		return fuse.ToStatus(err)
 	}
 	// Actual Rmdir
+	fs.dirCache.drop(cPath)
 	err = syscallcompat.Unlinkat(int(parentDirFd.Fd()), cName, unix.AT_REMOVEDIR)
 	if err != nil {
 		// This can happen if another file in the directory was created in the
 		// meantime, undo the rename
 		err2 := syscallcompat.Renameat(int(parentDirFd.Fd()), tmpName,
 			int(dirfd.Fd()), nametransform.DirIVFilename)
-		if err != nil {
+		if err2 != nil {
 			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
+		} else {
+			restoreDirTimes(dirfd, dirTimes)
+			restoreDirTimes(parentDirFd, parentTimes)
 		}
 		return fuse.ToStatus(err)
 	}
@@ -251,14 +291,41 @@ retry:
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongName(parentDirFd, cName)
 	}
-	// The now-deleted directory may have been in the DirIV cache. Clear it.
-	fs.nameTransform.DirIVCache.Clear()
+	// The now-deleted directory may have been in the DirIV cache. Remove it,
+	// but keep the entries of the parents, which are still valid.
+	fs.nameTransform.DirIVCache.ClearDir(path)
+	return fuse.OK
+}
+
+// rmdirMeta deletes the empty ciphertext directory "cPath" and its
+// metadata when "-metadata_dir" is used. As gocryptfs.diriv is not stored in
+// "cPath", there is no need for the rename dance in Rmdir.
+func (fs *FS) rmdirMeta(path string, cPath string, parentDirFd *os.File) fuse.Status {
+	fs.dirIVLock.Lock()
+	defer fs.dirIVLock.Unlock()
+	fs.dirCache.drop(cPath)
+	err := syscall.Rmdir(cPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	nametransform.RemoveMetaDir(cPath)
+	cName := filepath.Base(cPath)
+	if nametransform.IsLongContent(cName) {
+		nametransform.DeleteLongName(parentDirFd, cName)
+	}
+	fs.nameTransform.DirIVCache.ClearDir(path)
 	return fuse.OK
 }
 
 // OpenDir implements pathfs.FileSystem
 func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if cPath, ok := fs.rawPath(dirName); ok {
+		return fs.FileSystem.OpenDir(cPath, context)
+	}
 	tlog.Debug.Printf("OpenDir(%s)", dirName)
+	if fs.isFiltered(dirName) {
+		return nil, fuse.EPERM
+	}
 	cDirName, err := fs.encryptPath(dirName)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -273,6 +340,10 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 	}
 	defer syscall.Close(fd)
 	cipherEntries, err = syscallcompat.Getdents(fd)
+	if err == nil {
+		// Show the files as they were at the "-as_of" time
+		cipherEntries, err = fs.args.AsOf.Filter(cDirAbsPath, cipherEntries)
+	}
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -301,10 +372,12 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 	// Decrypted directory entries
 	var plain []fuse.DirEntry
 	var errorCount int
+	// With encrypted names, gocryptfs.conf would fail to decrypt
+	exposeConf := fs.args.PlaintextNames && fs.args.ExposeControlFiles
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "" && cName == configfile.ConfDefaultName {
+		if dirName == "" && cName == configfile.ConfDefaultName && !exposeConf {
 			// silently ignore "gocryptfs.conf" in the top level dir
 			continue
 		}
@@ -316,13 +389,22 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
+		if dirName == "" && cName == QuarantineDirName {
+			// silently ignore "gocryptfs.quarantine" in the top level dir
+			continue
+		}
+		if fs.passthrough[cName] {
+			// Passthrough files are stored under their plaintext name
+			plain = append(plain, cipherEntries[i])
+			continue
+		}
 		// Handle long file name
 		isLong := nametransform.LongNameNone
 		if fs.args.LongNames {
 			isLong = nametransform.NameType(cName)
 		}
 		if isLong == nametransform.LongNameContent {
-			cNameLong, err := nametransform.ReadLongName(filepath.Join(cDirAbsPath, cName))
+			cNameLong, salt, err := nametransform.ReadLongNameSalt(filepath.Join(cDirAbsPath, cName))
 			if err != nil {
 				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
 					cDirName, cName, err)
@@ -330,6 +412,15 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 				errorCount++
 				continue
 			}
+			// The hash must match the stored name, otherwise the .name file
+			// is corrupt or belongs to a different file.
+			if fs.nameTransform.HashLongNameSalt(cNameLong, salt) != cName {
+				tlog.Warn.Printf("OpenDir %q: invalid entry %q: hash does not match .name content (salt %d)",
+					cDirName, cName, salt)
+				fs.reportCorruptItem(cName)
+				errorCount++
+				continue
+			}
 			cName = cNameLong
 		} else if isLong == nametransform.LongNameFilename {
 			// ignore "gocryptfs.longname.*.name"
@@ -0,0 +1,70 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func dirMtime(t *testing.T, fs *FS, path string) time.Time {
+	a, status := fs.GetAttr(path, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	return time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+}
+
+// TestDirTimes checks that the mtime of a directory changes when an entry
+// is created, renamed or deleted, but not when the creation fails
+func TestDirTimes(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	long := strings.Repeat("x", 200)
+	if status := fs.Mkdir("dir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	ops := []struct {
+		name string
+		op   func() fuse.Status
+		ok   bool
+		// Directory that is checked, "" is the root directory
+		dir string
+	}{
+		{"create", func() fuse.Status {
+			f, status := fs.Create(long, uint32(os.O_WRONLY), 0600, nil)
+			if f != nil {
+				f.Release()
+			}
+			return status
+		}, true, ""},
+		{"create existing", func() fuse.Status {
+			_, status := fs.Create(long, uint32(os.O_WRONLY), 0600, nil)
+			return status
+		}, false, ""},
+		{"rename", func() fuse.Status { return fs.Rename(long, "short", nil) }, true, ""},
+		{"link", func() fuse.Status { return fs.Link("short", long, nil) }, true, ""},
+		{"unlink", func() fuse.Status { return fs.Unlink(long, nil) }, true, ""},
+		// The following fail after the .name file has been written
+		{"link directory", func() fuse.Status { return fs.Link("dir", long, nil) }, false, ""},
+		{"rename into itself", func() fuse.Status { return fs.Rename("dir", "dir/"+long, nil) }, false, "dir"},
+	}
+	for _, o := range ops {
+		// The attributes are cached now
+		before := dirMtime(t, fs, o.dir)
+		time.Sleep(10 * time.Millisecond)
+		status := o.op()
+		if status.Ok() != o.ok {
+			t.Fatalf("%s: unexpected status %v", o.name, status)
+		}
+		after := dirMtime(t, fs, o.dir)
+		if o.ok && !after.After(before) {
+			t.Errorf("%s: mtime did not change: %v", o.name, before)
+		}
+		if !o.ok && !after.Equal(before) {
+			t.Errorf("%s: failed, but mtime changed from %v to %v", o.name, before, after)
+		}
+	}
+}
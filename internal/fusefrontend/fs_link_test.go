@@ -0,0 +1,74 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+func newLinkTestFS(t *testing.T) (*FS, string) {
+	fs, cDir := newTestFSWithArgs(t, func(a *Args) {
+		a.LongNames = true
+	})
+	if err := nametransform.WriteDirIV(nil, cDir); err != nil {
+		t.Fatal(err)
+	}
+	return fs, cDir
+}
+
+// TestRenameSameInode checks that renaming a file onto another hard link
+// of itself keeps both names, as rename(2) does. Deleting the .name file of
+// the old long name would make it unreadable.
+func TestRenameSameInode(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	long := strings.Repeat("x", 200)
+	f, status := fs.Create(long, uint32(os.O_WRONLY), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status = fs.Link(long, "short", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.Rename(long, "short", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	entries, status := fs.OpenDir("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(entries) != 2 {
+		t.Errorf("want 2 entries, have %v", entries)
+	}
+	a, status := fs.GetAttr(long, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if a.Nlink != 2 {
+		t.Errorf("wrong link count %d", a.Nlink)
+	}
+}
+
+// TestRootNlinkQuarantine checks that the hidden quarantine directory is not
+// counted in the link count of the root directory
+func TestRootNlinkQuarantine(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	if status := fs.Mkdir("dir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if err := os.Mkdir(filepath.Join(cDir, QuarantineDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	a, status := fs.GetAttr("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if a.Nlink != 3 {
+		t.Errorf("wrong link count %d, want 3", a.Nlink)
+	}
+}
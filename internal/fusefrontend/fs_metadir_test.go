@@ -0,0 +1,111 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// listMeta returns all gocryptfs.diriv and .name files below "dir"
+func listMeta(t *testing.T, dir string) []string {
+	var out []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		n := fi.Name()
+		if n == nametransform.DirIVFilename || nametransform.NameType(n) == nametransform.LongNameFilename {
+			rel, _ := filepath.Rel(dir, p)
+			out = append(out, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestMetadataDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "TestMetadataDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cDir := filepath.Join(tmp, "cipher")
+	mDir := filepath.Join(tmp, "meta")
+	os.Mkdir(cDir, 0700)
+	os.Mkdir(mDir, 0700)
+	nametransform.SetMetadataDir(cDir, mDir)
+	defer nametransform.SetMetadataDir("", "")
+	if err = nametransform.WriteDirIV(nil, cDir); err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	fs := NewFS(Args{Cipherdir: cDir, LongNames: true}, cEnc, nametransform.New(cCore.EMECipher, true, true))
+
+	long := strings.Repeat("x", 200)
+	for _, d := range []string{"d", "d/" + long, "x", "y"} {
+		if status := fs.Mkdir(d, 0700, nil); !status.Ok() {
+			t.Fatalf("Mkdir %q: %v", d, status)
+		}
+	}
+	for _, n := range []string{long, "d/" + long + "/f"} {
+		f, status := fs.Create(n, uint32(os.O_RDWR), 0600, nil)
+		if !status.Ok() {
+			t.Fatalf("Create %q: %v", n, status)
+		}
+		f.Release()
+	}
+	if m := listMeta(t, cDir); len(m) != 0 {
+		t.Errorf("metadata files in CIPHERDIR: %v", m)
+	}
+	// Root, d, d/long, x, y + 2 long names
+	if m := listMeta(t, mDir); len(m) != 7 {
+		t.Errorf("wrong metadata files: %v", m)
+	}
+	// Directory rename, also over an empty directory
+	if status := fs.Rename("d", "e", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Rename("x", "y", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	entries, status := fs.OpenDir("e/"+long, nil)
+	if !status.Ok() || len(entries) != 1 || entries[0].Name != "f" {
+		t.Errorf("OpenDir after rename: %v %v", entries, status)
+	}
+	if status = fs.Rmdir("e", nil); status != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of non-empty dir: want ENOTEMPTY, got %v", status)
+	}
+	if status = fs.Unlink("e/"+long+"/f", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, d := range []string{"e/" + long, "e", "y"} {
+		if status = fs.Rmdir(d, nil); !status.Ok() {
+			t.Fatalf("Rmdir %q: %v", d, status)
+		}
+	}
+	// Only the root dir and the long name file are left
+	if m := listMeta(t, mDir); len(m) != 2 {
+		t.Errorf("leftover metadata files: %v", m)
+	}
+	entries, status = fs.OpenDir("", nil)
+	if !status.Ok() || len(entries) != 1 || entries[0].Name != long {
+		t.Errorf("OpenDir root: %v %v", entries, status)
+	}
+}
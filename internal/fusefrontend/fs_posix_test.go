@@ -0,0 +1,116 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestRmdirNotDir checks that Rmdir fails with ENOTDIR on files and
+// symlinks, like rmdir(2)
+func TestRmdirNotDir(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	f, status := fs.Create("file", uint32(os.O_WRONLY), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status = fs.Symlink("target", "symlink", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, name := range []string{"file", "symlink"} {
+		if status = fs.Rmdir(name, nil); status != fuse.Status(syscall.ENOTDIR) {
+			t.Errorf("%s: want ENOTDIR, have %v", name, status)
+		}
+	}
+}
+
+// TestMkdirSetgid checks that a new directory inherits S_ISGID from its
+// parent, even if its mode has to be fixed up after creating
+// gocryptfs.diriv
+func TestMkdirSetgid(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	if status := fs.Mkdir("parent", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Chmod("parent", 0700|syscall.S_ISGID, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Mkdir("parent/dir", 0500, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	a, status := fs.GetAttr("parent/dir", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if a.Mode&07777 != 0500|syscall.S_ISGID {
+		t.Errorf("wrong mode %#o", a.Mode&07777)
+	}
+}
+
+// TestTruncateSameSize checks that truncating a file to its current size
+// updates the mtime, like on Linux
+func TestTruncateSameSize(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	f, status := fs.Create("file", uint32(os.O_WRONLY), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	if _, status = f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	var before, after fuse.Attr
+	if status = f.GetAttr(&before); !status.Ok() {
+		t.Fatal(status)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if status = f.Truncate(5); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = f.GetAttr(&after); !status.Ok() {
+		t.Fatal(status)
+	}
+	if after.Size != 5 {
+		t.Errorf("wrong size %d", after.Size)
+	}
+	if after.Mtime == before.Mtime && after.Mtimensec == before.Mtimensec {
+		t.Error("mtime has not changed")
+	}
+}
+
+// TestStrictPosixNoAttrCache checks that "-strict_posix" shows changes to
+// the backing files immediately
+func TestStrictPosixNoAttrCache(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	fs = NewFS(Args{Cipherdir: cDir, LongNames: true, StrictPosix: true}, fs.contentEnc, fs.nameTransform)
+	if status := fs.Mkdir("dir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := fs.GetAttr("dir", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	cPath, err := fs.EncryptPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1000, 0)
+	if err = os.Chtimes(filepath.Join(cDir, cPath), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	a, status := fs.GetAttr("dir", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if a.Mtime != 1000 {
+		t.Errorf("stale mtime %d", a.Mtime)
+	}
+}
@@ -0,0 +1,36 @@
+package fusefrontend
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// CheckHeader reads and parses the file header of the regular file "path"
+// without decrypting any content, for "-fsck_fast". Empty files and
+// passthrough files have no header and always pass. Like in doRead(),
+// incomplete files are also reported through reportCorruptItem().
+func (fs *FS) CheckHeader(path string) error {
+	if fs.isPassthrough(path) {
+		return nil
+	}
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(cPath, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	f, status := NewFile(fd, fs)
+	if !status.Ok() {
+		fd.Close()
+		return syscall.Errno(status)
+	}
+	defer f.Release()
+	_, err = f.(*file).readFileID()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+)
+
+// TestCheckHeader checks that CheckHeader finds a broken header, but not
+// broken content
+func TestCheckHeader(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	for _, name := range []string{"empty", "file"} {
+		f, status := fs.Create(name, uint32(os.O_WRONLY), 0600, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if name == "file" {
+			writeAll(t, f.(*file), make([]byte, 100))
+		}
+		f.Release()
+		if err := fs.CheckHeader(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	cPath, err := fs.getBackingPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(off int64) {
+		fd, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		if _, err = fd.WriteAt([]byte{0xff, 0xff}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Content is not checked
+	corrupt(50)
+	if err = fs.CheckHeader("file"); err != nil {
+		t.Errorf("corrupt content: %v", err)
+	}
+	// The version number at the start of the header
+	corrupt(0)
+	if err = fs.CheckHeader("file"); err == nil {
+		t.Error("corrupt header was not found")
+	}
+	if err = fs.CheckHeader("nonexistent"); err == nil {
+		t.Error("nonexistent file passed")
+	}
+}
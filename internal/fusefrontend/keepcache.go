@@ -0,0 +1,54 @@
+package fusefrontend
+
+// Keeping the kernel page cache across opens for "-writeback"
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// keepCache wraps "f" so that the kernel keeps the cached plaintext pages of
+// the file when it is opened again, instead of reading everything through
+// us again.
+func keepCache(f nodefs.File) nodefs.File {
+	if f == nil {
+		return nil
+	}
+	return &nodefs.WithFlags{
+		File:        f,
+		FuseFlags:   fuse.FOPEN_KEEP_CACHE,
+		Description: "keepcache",
+	}
+}
+
+// SetConnector gives us access to the kernel cache invalidation calls of
+// "conn". Only used with "-writeback".
+func (fs *FS) SetConnector(conn *nodefs.FileSystemConnector) {
+	fs.conn = conn
+}
+
+// SetInode implements nodefs.File. go-fuse calls it when the file is
+// registered, we need the inode to invalidate the page cache.
+func (f *file) SetInode(n *nodefs.Inode) {
+	f.inode = n
+}
+
+// invalidatePageCache drops the cached plaintext pages of the file from the
+// kernel page cache. This is needed after the ciphertext has changed behind
+// the kernel's back, as pages cached with FOPEN_KEEP_CACHE would otherwise
+// stay around until the file is evicted.
+func (f *file) invalidatePageCache() {
+	if !f.fs.args.Writeback || f.fs.conn == nil || f.inode == nil {
+		return
+	}
+	// The kernel may wait for pages that are locked by a FUSE request that
+	// is in progress, so we must not block the caller.
+	go func() {
+		status := f.fs.conn.FileNotify(f.inode, 0, 0)
+		if !status.Ok() && status != fuse.ENOENT {
+			tlog.Warn.Printf("ino%d: invalidating page cache failed: %v", f.qIno.Ino, status)
+		}
+	}()
+}
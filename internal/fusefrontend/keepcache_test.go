@@ -0,0 +1,29 @@
+package fusefrontend
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func TestKeepCache(t *testing.T) {
+	fs := newTestFS()
+	fs.args.NoCacheGlob = []string{"*.db"}
+	if p := fs.policy("a.txt"); p.keepCache {
+		t.Errorf("keepCache set without -writeback: %+v", p)
+	}
+	fs.args.Writeback = true
+	if p := fs.policy("a.txt"); !p.keepCache {
+		t.Errorf("keepCache not set with -writeback: %+v", p)
+	}
+	if p := fs.policy("a.db"); p.keepCache {
+		t.Errorf("keepCache set on an uncached file: %+v", p)
+	}
+	f, ok := applyPolicy(&file{File: nodefs.NewDefaultFile()}, fs.policy("a.txt")).(*nodefs.WithFlags)
+	if !ok || f.FuseFlags != fuse.FOPEN_KEEP_CACHE {
+		t.Errorf("FOPEN_KEEP_CACHE not set: %#v", f)
+	}
+	// Without a connector, invalidation is a no-op
+	(&file{fs: fs, inode: &nodefs.Inode{}}).invalidatePageCache()
+}
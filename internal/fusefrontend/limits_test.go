@@ -0,0 +1,51 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+func TestLimits(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.Limits = &configfile.Limits{MaxFileSize: 10000, ForbiddenNames: []string{"*.exe"}, MaxDepth: 2}
+	})
+	defer os.RemoveAll(dir)
+	f := openTestFile(t, fs, filepath.Join(dir, "f")).(*file)
+	defer f.Release()
+
+	efbig := fuse.Status(syscall.EFBIG)
+	if _, status := f.Write(make([]byte, 10000), 0); !status.Ok() {
+		t.Errorf("write up to the limit failed: %v", status)
+	}
+	if _, status := f.Write(make([]byte, 100), 9950); status != efbig {
+		t.Errorf("write beyond the limit: want EFBIG, have %v", status)
+	}
+	if status := f.Truncate(10001); status != efbig {
+		t.Errorf("truncate beyond the limit: want EFBIG, have %v", status)
+	}
+	if status := f.Allocate(0, 20000, FALLOC_DEFAULT); status != efbig {
+		t.Errorf("allocate beyond the limit: want EFBIG, have %v", status)
+	}
+	if status := f.Truncate(5000); !status.Ok() {
+		t.Errorf("shrinking failed: %v", status)
+	}
+
+	if status := fs.Mkdir("x.exe", 0700, nil); status != fuse.EPERM {
+		t.Errorf("Mkdir of a forbidden name: want EPERM, have %v", status)
+	}
+	if status := fs.Mkdir("a/b/c", 0700, nil); status != fuse.EPERM {
+		t.Errorf("Mkdir beyond MaxDepth: want EPERM, have %v", status)
+	}
+	if _, status := fs.Create("a/x.exe", 0, 0600, nil); status != fuse.EPERM {
+		t.Errorf("Create of a forbidden name: want EPERM, have %v", status)
+	}
+	if status := fs.Rename("a", "b.exe", nil); status != fuse.EPERM {
+		t.Errorf("Rename to a forbidden name: want EPERM, have %v", status)
+	}
+}
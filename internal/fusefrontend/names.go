@@ -5,22 +5,34 @@ package fusefrontend
 import (
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// QuarantineDirName is the top-level directory in CIPHERDIR where
+// "-fsck -repair" moves corrupt files. With encrypted names, it is hidden
+// from the mount.
+const QuarantineDirName = "gocryptfs.quarantine"
+
 // isFiltered - check if plaintext "path" should be forbidden
 //
-// Prevents name clashes with internal files when file names are not encrypted
+// Prevents name clashes with internal files when file names are not encrypted.
+// Every operation that takes a path must check all of its paths, including
+// the source of Rename and Link, or an application inside the mount could
+// move or hard-link the config file to a name it can write to.
+// With encrypted names, no plaintext path maps to a control file.
 func (fs *FS) isFiltered(path string) bool {
-	if !fs.args.PlaintextNames {
+	if !fs.args.PlaintextNames || fs.args.ExposeControlFiles {
 		return false
 	}
-	// gocryptfs.conf in the root directory is forbidden
-	if path == configfile.ConfDefaultName {
-		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
-			configfile.ConfDefaultName)
+	// gocryptfs.conf in the root directory is forbidden. MacOS file systems
+	// are case-insensitive by default, so "GOCRYPTFS.CONF" is the same file.
+	if path == configfile.ConfDefaultName ||
+		(runtime.GOOS == "darwin" && strings.EqualFold(path, configfile.ConfDefaultName)) {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n", path)
 		return true
 	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
@@ -56,12 +68,18 @@ func (fs *FS) openBackingPath(relPath string) (*os.File, string, error) {
 
 // encryptPath - encrypt relative plaintext path
 func (fs *FS) encryptPath(plainPath string) (string, error) {
+	if fs.isPassthrough(plainPath) {
+		return fs.encryptPassthroughPath(plainPath)
+	}
 	if fs.args.PlaintextNames {
-		return plainPath, nil
+		return fs.args.AsOf.Translate(fs.args.Cipherdir, plainPath)
 	}
 	fs.dirIVLock.RLock()
 	cPath, err := fs.nameTransform.EncryptPathDirIV(plainPath, fs.args.Cipherdir)
 	tlog.Debug.Printf("encryptPath '%s' -> '%s' (err: %v)", plainPath, cPath, err)
 	fs.dirIVLock.RUnlock()
-	return cPath, err
+	if err != nil {
+		return "", err
+	}
+	return fs.args.AsOf.Translate(fs.args.Cipherdir, cPath)
 }
@@ -0,0 +1,68 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+// TestFiltered checks that no operation can reach gocryptfs.conf with
+// "-plaintextnames", including renames and hard links, unless
+// "-expose-control-files" is passed
+func TestFiltered(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.PlaintextNames = true
+	})
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	if err := ioutil.WriteFile(conf, []byte("{}"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := configfile.ConfDefaultName
+	ops := map[string]fuse.Status{}
+	_, ops["GetAttr"] = fs.GetAttr(c, nil)
+	_, ops["Open"] = fs.Open(c, uint32(os.O_RDONLY), nil)
+	_, ops["Readlink"] = fs.Readlink(c, nil)
+	_, ops["OpenDir"] = fs.OpenDir(c, nil)
+	ops["Rmdir"] = fs.Rmdir(c, nil)
+	ops["Unlink"] = fs.Unlink(c, nil)
+	ops["Rename from"] = fs.Rename(c, "stolen", nil)
+	ops["Rename to"] = fs.Rename("foo", c, nil)
+	ops["Link from"] = fs.Link(c, "stolen", nil)
+	ops["Link to"] = fs.Link("foo", c, nil)
+	ops["Chmod"] = fs.Chmod(c, 0666, nil)
+	ops["Truncate"] = fs.Truncate(c, 0, nil)
+	for op, status := range ops {
+		if status != fuse.EPERM {
+			t.Errorf("%s: want EPERM, got %v", op, status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stolen")); !os.IsNotExist(err) {
+		t.Errorf("config file was renamed or linked: %v", err)
+	}
+	entries, _ := fs.OpenDir("", nil)
+	for _, e := range entries {
+		if e.Name == c {
+			t.Errorf("%s shows up in the directory listing", c)
+		}
+	}
+	// Escape hatch
+	args := fs.args
+	args.ExposeControlFiles = true
+	fs = NewFS(args, fs.contentEnc, fs.nameTransform)
+	if _, status := fs.GetAttr(c, nil); !status.Ok() {
+		t.Errorf("GetAttr with ExposeControlFiles: %v", status)
+	}
+	entries, _ = fs.OpenDir("", nil)
+	if len(entries) != 2 {
+		t.Errorf("OpenDir with ExposeControlFiles: %v", entries)
+	}
+}
@@ -0,0 +1,36 @@
+package fusefrontend
+
+// Page cache exclusion for "-nocache_glob"
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+// noCache returns true if plaintext "path" matches one of the NoCacheGlob
+// patterns. Patterns without a slash are matched against the file name,
+// patterns with a slash against the whole path relative to the root of the
+// mount.
+func (fs *FS) noCache(path string) bool {
+	for _, g := range fs.args.NoCacheGlob {
+		if configfile.MatchGlob(g, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// directIO wraps "f" so that the kernel opens it with FOPEN_DIRECT_IO and
+// sends every read and write to us instead of going through the page cache.
+func directIO(f nodefs.File) nodefs.File {
+	if f == nil {
+		return nil
+	}
+	return &nodefs.WithFlags{
+		File:        f,
+		FuseFlags:   fuse.FOPEN_DIRECT_IO,
+		Description: "nocache",
+	}
+}
@@ -0,0 +1,36 @@
+package fusefrontend
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func TestNoCache(t *testing.T) {
+	fs := newTestFS()
+	fs.args.NoCacheGlob = []string{"*.sqlite*", "db/*.log"}
+	testcases := map[string]bool{
+		"a.sqlite":         true,
+		"dir/a.sqlite-wal": true,
+		"db/x.log":         true,
+		"db/sub/x.log":     false,
+		"x.log":            false,
+		"sqlite":           false,
+	}
+	for path, want := range testcases {
+		if have := fs.noCache(path); have != want {
+			t.Errorf("%q: want %v, have %v", path, want, have)
+		}
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	if directIO(nil) != nil {
+		t.Error("nil file should stay nil")
+	}
+	f, ok := directIO(nodefs.NewDefaultFile()).(*nodefs.WithFlags)
+	if !ok || f.FuseFlags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Errorf("FOPEN_DIRECT_IO not set: %#v", f)
+	}
+}
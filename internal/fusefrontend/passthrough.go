@@ -0,0 +1,166 @@
+package fusefrontend
+
+// Passthrough files: names from the "Passthrough" list in the config file are
+// stored unencrypted and under their plaintext name
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// isPassthrough returns true if the base name of plaintext "path" is on the
+// passthrough list
+func (fs *FS) isPassthrough(path string) bool {
+	if len(fs.passthrough) == 0 || path == "" {
+		return false
+	}
+	return fs.passthrough[filepath.Base(path)]
+}
+
+// encryptPassthroughPath encrypts the parent directory of the passthrough
+// file "plainPath" and appends the unencrypted name
+func (fs *FS) encryptPassthroughPath(plainPath string) (string, error) {
+	dir := filepath.Dir(plainPath)
+	if dir == "." {
+		dir = ""
+	}
+	cDir := dir
+	if !fs.args.PlaintextNames {
+		fs.dirIVLock.RLock()
+		var err error
+		cDir, err = fs.nameTransform.EncryptPathDirIV(dir, fs.args.Cipherdir)
+		fs.dirIVLock.RUnlock()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fs.args.AsOf.Translate(fs.args.Cipherdir, filepath.Join(cDir, filepath.Base(plainPath)))
+}
+
+// passthroughOpen opens the passthrough file "path" without the read access
+// and the O_APPEND mangling that encrypted files need
+func (fs *FS) passthroughOpen(path string, flags uint32) (nodefs.File, fuse.Status) {
+	if fs.args.ReadOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, fuse.EROFS
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		defer fs.attrCache.invalidatePath(path)
+	}
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	f, err := os.OpenFile(cPath, int(flags), 0)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return newPassthroughFile(f, fs)
+}
+
+func (fs *FS) passthroughCreate(path string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	f, err := os.OpenFile(cPath, int(flags)|os.O_CREATE|os.O_EXCL, os.FileMode(mode))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if fs.args.PreserveOwner {
+		err = f.Chown(int(context.Owner.Uid), int(context.Owner.Gid))
+		if err != nil {
+			tlog.Warn.Printf("Create: fd.Chown failed: %v", err)
+		}
+	}
+	return newPassthroughFile(f, fs)
+}
+
+// passthroughFile is an open passthrough file. The data is passed through
+// as it is, we only keep the attribute cache up to date and enforce "-ro".
+type passthroughFile struct {
+	nodefs.File
+	fs   *FS
+	qIno openfiletable.QIno
+}
+
+func newPassthroughFile(f *os.File, fs *FS) (nodefs.File, fuse.Status) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		f.Close()
+		return nil, fuse.ToStatus(err)
+	}
+	return &passthroughFile{
+		File: nodefs.NewLoopbackFile(f),
+		fs:   fs,
+		qIno: openfiletable.QInoFromStat(&st),
+	}, fuse.OK
+}
+
+func (f *passthroughFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if f.fs.args.ReadOnly {
+		return 0, fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	return f.File.Write(data, off)
+}
+
+func (f *passthroughFile) Truncate(size uint64) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	return f.File.Truncate(size)
+}
+
+func (f *passthroughFile) Chmod(mode uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	return f.File.Chmod(mode)
+}
+
+func (f *passthroughFile) Chown(uid uint32, gid uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	return f.File.Chown(uid, gid)
+}
+
+func (f *passthroughFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	return f.File.Allocate(off, sz, mode)
+}
+
+func (f *passthroughFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate(f.qIno)
+	return f.File.Utimens(a, m)
+}
+
+// GetAttr translates the inode number like FS.GetAttr does
+func (f *passthroughFile) GetAttr(a *fuse.Attr) fuse.Status {
+	status := f.File.GetAttr(a)
+	if !status.Ok() {
+		return status
+	}
+	a.Ino = f.fs.inoMap.Translate(f.qIno)
+	if f.fs.args.ForceOwner != nil {
+		a.Owner = *f.fs.args.ForceOwner
+	}
+	return fuse.OK
+}
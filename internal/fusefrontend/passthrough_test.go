@@ -0,0 +1,70 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestPassthrough checks that passthrough files are stored unencrypted under
+// their plaintext name, also in subdirectories
+func TestPassthrough(t *testing.T) {
+	fs, cDir := newLinkTestFS(t)
+	defer os.RemoveAll(cDir)
+	fs.passthrough = map[string]bool{".nomedia": true}
+	if status := fs.Mkdir("dir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	content := []byte("hello")
+	for _, path := range []string{".nomedia", "dir/.nomedia"} {
+		f, status := fs.Create(path, uint32(os.O_WRONLY), 0600, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if _, status = f.Write(content, 0); !status.Ok() {
+			t.Fatal(status)
+		}
+		f.Release()
+		cPath, err := fs.encryptPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(cPath) != ".nomedia" {
+			t.Errorf("%q: backing file is %q", path, cPath)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(cDir, cPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(content) {
+			t.Errorf("%q: backing file has content %q", path, data)
+		}
+		a, status := fs.GetAttr(path, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if a.Size != uint64(len(content)) {
+			t.Errorf("%q: size %d, want %d", path, a.Size, len(content))
+		}
+	}
+	entries, status := fs.OpenDir("dir", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(entries) != 1 || entries[0].Name != ".nomedia" {
+		t.Errorf("wrong entries %v", entries)
+	}
+	// Moving a file across the boundary would need re-encryption
+	if status = fs.Rename(".nomedia", "x", nil); status != fuse.EXDEV {
+		t.Errorf("Rename: want EXDEV, have %v", status)
+	}
+	if status = fs.Link(".nomedia", "y", nil); status != fuse.EXDEV {
+		t.Errorf("Link: want EXDEV, have %v", status)
+	}
+	if status = fs.Rename(".nomedia", "dir/.nomedia", nil); !status.Ok() {
+		t.Errorf("Rename: %v", status)
+	}
+}
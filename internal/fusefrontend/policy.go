@@ -0,0 +1,64 @@
+package fusefrontend
+
+// Per-file policy from the config file
+
+import (
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// filePolicy holds the per-file options that are decided when a file is
+// opened or created
+type filePolicy struct {
+	cache    bool
+	prealloc bool
+	// keepCache is set when "-writeback" is active and the file is cached
+	keepCache bool
+}
+
+// policy evaluates Args.Policy for plaintext "path". The command line
+// options provide the defaults, and "-nocache_glob" always wins because it
+// was given explicitly for this mount.
+func (fs *FS) policy(path string) filePolicy {
+	var cache, prealloc *bool
+	for i := range fs.args.Policy {
+		r := &fs.args.Policy[i]
+		if !r.Match(path) {
+			continue
+		}
+		if cache == nil {
+			cache = r.Cache
+		}
+		if prealloc == nil {
+			prealloc = r.Prealloc
+		}
+	}
+	p := filePolicy{
+		cache:    cache == nil || *cache,
+		prealloc: !fs.args.NoPrealloc,
+	}
+	if prealloc != nil {
+		p.prealloc = *prealloc
+	}
+	if fs.noCache(path) {
+		p.cache = false
+	}
+	p.keepCache = p.cache && fs.args.Writeback
+	return p
+}
+
+// applyPolicy configures the freshly opened file "f" according to "p"
+func applyPolicy(f nodefs.File, p filePolicy) nodefs.File {
+	if f == nil {
+		return nil
+	}
+	if f2, ok := f.(*file); ok {
+		f2.prealloc = p.prealloc
+	}
+	if !p.cache {
+		return directIO(f)
+	}
+	if p.keepCache {
+		return keepCache(f)
+	}
+	return f
+}
@@ -0,0 +1,38 @@
+package fusefrontend
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+func TestPolicy(t *testing.T) {
+	yes, no := true, false
+	fs := newTestFS()
+	fs.args.NoPrealloc = true
+	fs.args.NoCacheGlob = []string{"*.db"}
+	fs.args.Policy = []configfile.PolicyRule{
+		{Glob: "*.sqlite", Cache: &no},
+		{Glob: "*.sqlite", Cache: &yes, Prealloc: &yes},
+		{Glob: "*.db", Cache: &yes},
+	}
+	testcases := map[string]filePolicy{
+		"a.txt":      {cache: true, prealloc: false},
+		"d/a.sqlite": {cache: false, prealloc: true},
+		"a.db":       {cache: false, prealloc: false},
+	}
+	for path, want := range testcases {
+		if have := fs.policy(path); have != want {
+			t.Errorf("%q: want %+v, have %+v", path, want, have)
+		}
+	}
+	f := &file{File: nodefs.NewDefaultFile()}
+	if applyPolicy(f, filePolicy{cache: true, prealloc: true}) != f || !f.prealloc {
+		t.Error("cached file should not be wrapped")
+	}
+	if _, ok := applyPolicy(f, filePolicy{}).(*nodefs.WithFlags); !ok || f.prealloc {
+		t.Error("uncached file should be wrapped")
+	}
+}
@@ -0,0 +1,120 @@
+package fusefrontend
+
+// Read-only view of the ciphertext inside the mount ("-raw_access")
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// RawDirName is the hidden top-level directory that shows the contents of
+// CIPHERDIR when "-raw_access" is active.
+const RawDirName = ".gocryptfs.raw"
+
+// rawInoFlag is set in the inode numbers of the raw view. Otherwise a raw
+// file would have the same inode number as its plaintext view, and go-fuse
+// would treat the two as hard links.
+const rawInoFlag = 1 << 63
+
+// rawPath returns the path relative to CIPHERDIR if plaintext "path" is
+// inside the raw view.
+func (fs *FS) rawPath(path string) (cPath string, ok bool) {
+	if !fs.args.RawAccess {
+		return "", false
+	}
+	if path == RawDirName {
+		return "", true
+	}
+	if strings.HasPrefix(path, RawDirName+"/") {
+		return path[len(RawDirName)+1:], true
+	}
+	return "", false
+}
+
+// readOnly returns true if any of "paths" may not be modified, either
+// because of "-ro" or because it is inside the raw view.
+func (fs *FS) readOnly(paths ...string) bool {
+	if fs.args.ReadOnly {
+		return true
+	}
+	for _, p := range paths {
+		if _, ok := fs.rawPath(p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FS) rawGetAttr(cPath string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	a, status := fs.FileSystem.GetAttr(cPath, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	a.Ino |= rawInoFlag
+	if fs.args.ForceOwner != nil {
+		a.Owner = *fs.args.ForceOwner
+	}
+	return a, fuse.OK
+}
+
+func (fs *FS) rawOpen(cPath string, flags uint32) (nodefs.File, fuse.Status) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, fuse.EROFS
+	}
+	f, err := os.OpenFile(filepath.Join(fs.args.Cipherdir, cPath), int(flags)|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return &rawFile{File: nodefs.NewLoopbackFile(f)}, fuse.OK
+}
+
+func (fs *FS) rawAccess(cPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if mode&unix.W_OK != 0 {
+		return fuse.EROFS
+	}
+	return fs.FileSystem.Access(cPath, mode, context)
+}
+
+// rawFile is a file in the raw view. All modifications are rejected.
+type rawFile struct {
+	nodefs.File
+}
+
+func (f *rawFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	return 0, fuse.EROFS
+}
+
+func (f *rawFile) Truncate(size uint64) fuse.Status {
+	return fuse.EROFS
+}
+
+func (f *rawFile) Chmod(mode uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (f *rawFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (f *rawFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (f *rawFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	return fuse.EROFS
+}
+
+// GetAttr sets the raw view inode number flag, see rawInoFlag
+func (f *rawFile) GetAttr(a *fuse.Attr) fuse.Status {
+	status := f.File.GetAttr(a)
+	a.Ino |= rawInoFlag
+	return status
+}
@@ -0,0 +1,64 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestRawAccess(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.RawAccess = true
+	})
+	defer os.RemoveAll(dir)
+	f := openTestFile(t, fs, filepath.Join(dir, "foo"))
+	f.Write([]byte("hello"), 0)
+	f.Release()
+	ciphertext, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFoo := RawDirName + "/foo"
+	a, status := fs.GetAttr(rawFoo, nil)
+	if !status.Ok() || a.Size != uint64(len(ciphertext)) {
+		t.Fatalf("GetAttr: %v %v", a, status)
+	}
+	if a.Ino&rawInoFlag == 0 {
+		t.Error("raw inode flag not set")
+	}
+	entries, status := fs.OpenDir(RawDirName, nil)
+	if !status.Ok() || len(entries) != 1 || entries[0].Name != "foo" {
+		t.Errorf("OpenDir: %v %v", entries, status)
+	}
+	rf, status := fs.Open(rawFoo, uint32(os.O_RDONLY), nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer rf.Release()
+	buf := make([]byte, 1000)
+	res, status := rf.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	if !status.Ok() || string(data) != string(ciphertext) {
+		t.Errorf("Read: %v", status)
+	}
+	// Everything in the raw view is read-only
+	if _, status = fs.Open(rawFoo, uint32(os.O_RDWR), nil); status != fuse.EROFS {
+		t.Errorf("Open O_RDWR: want EROFS, got %v", status)
+	}
+	if _, status = rf.Write([]byte("x"), 0); status != fuse.EROFS {
+		t.Errorf("Write: want EROFS, got %v", status)
+	}
+	if status = fs.Unlink(rawFoo, nil); status != fuse.EROFS {
+		t.Errorf("Unlink: want EROFS, got %v", status)
+	}
+	if status = fs.Rename("foo", RawDirName+"/bar", nil); status != fuse.EROFS {
+		t.Errorf("Rename: want EROFS, got %v", status)
+	}
+	// Without "-raw_access", the directory does not exist
+	if _, status = newTestFS().GetAttr(rawFoo, nil); status.Ok() {
+		t.Error("raw view visible without -raw_access")
+	}
+}
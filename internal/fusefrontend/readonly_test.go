@@ -0,0 +1,58 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestReadOnly checks that "-ro" is enforced by the frontend itself
+func TestReadOnly(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.ReadOnly = true
+	})
+	defer os.RemoveAll(dir)
+	// A file handle that was opened read-only, like the kernel would
+	f := openTestFile(t, fs, filepath.Join(dir, "foo"))
+	defer f.Release()
+	ops := map[string]fuse.Status{}
+	_, ops["Create"] = fs.Create("bar", uint32(os.O_RDWR), 0600, nil)
+	_, ops["Open"] = fs.Open("foo", uint32(os.O_WRONLY), nil)
+	ops["Mkdir"] = fs.Mkdir("dir", 0700, nil)
+	ops["Rmdir"] = fs.Rmdir("dir", nil)
+	ops["Unlink"] = fs.Unlink("foo", nil)
+	ops["Rename"] = fs.Rename("foo", "bar", nil)
+	ops["Symlink"] = fs.Symlink("foo", "bar", nil)
+	ops["Link"] = fs.Link("foo", "bar", nil)
+	ops["Chmod"] = fs.Chmod("foo", 0777, nil)
+	ops["Truncate"] = fs.Truncate("foo", 0, nil)
+	ops["SetXAttr"] = fs.SetXAttr("foo", "user.foo", []byte("x"), 0, nil)
+	ops["RemoveXAttr"] = fs.RemoveXAttr("foo", "user.foo", nil)
+	_, ops["file.Write"] = f.Write([]byte("foo"), 0)
+	ops["file.Truncate"] = f.Truncate(0)
+	ops["file.Chmod"] = f.Chmod(0777)
+	ops["file.Utimens"] = f.Utimens(nil, nil)
+	// A passthrough file handle, also opened read-only
+	pfd, err := os.Open(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf, status := newPassthroughFile(pfd, fs)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer pf.Release()
+	_, ops["passthrough.Write"] = pf.Write([]byte("foo"), 0)
+	ops["passthrough.Truncate"] = pf.Truncate(0)
+	ops["passthrough.Chmod"] = pf.Chmod(0777)
+	ops["passthrough.Chown"] = pf.Chown(0, 0)
+	ops["passthrough.Allocate"] = pf.Allocate(0, 10, 0)
+	ops["passthrough.Utimens"] = pf.Utimens(nil, nil)
+	for op, status := range ops {
+		if status != fuse.EROFS {
+			t.Errorf("%s: want EROFS, got %v", op, status)
+		}
+	}
+}
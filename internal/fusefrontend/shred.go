@@ -0,0 +1,52 @@
+package fusefrontend
+
+// Overwrite deleted files with random data ("-shred")
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/shred"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// shredOpen opens the backing file "cPath" that is about to be deleted or
+// replaced. Returns -1 if "-shred" is off or "cPath" is not a regular file.
+// Pass the result to shredClose after the unlink or rename.
+func (fs *FS) shredOpen(cPath string) int {
+	if fs.args.Shred <= 0 {
+		return -1
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(cPath, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return -1
+	}
+	fd, err := syscall.Open(cPath, syscall.O_WRONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		tlog.Warn.Printf("shred: cannot open ino%d for writing, it will not be shredded: %v", st.Ino, err)
+		return -1
+	}
+	return fd
+}
+
+// shredClose overwrites "fd" if its last link is gone, and closes it. The
+// file is not touched if the operation failed, if it has other hard links,
+// or if it is still open through the mount, because then its content is
+// still in use.
+func (fs *FS) shredClose(fd int) {
+	if fd < 0 {
+		return
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil || st.Nlink > 0 {
+		return
+	}
+	if openfiletable.IsOpen(openfiletable.QInoFromStat(&st)) {
+		tlog.Info.Printf("shred: ino%d is still open, not shredding", st.Ino)
+		return
+	}
+	if err := shred.Fd(fd, fs.args.Shred); err != nil {
+		tlog.Warn.Printf("shred: ino%d: %v", st.Ino, err)
+	}
+}
@@ -0,0 +1,58 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestShred checks that "-shred" overwrites the ciphertext of deleted and
+// replaced files, but leaves files with other hard links alone
+func TestShred(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.PlaintextNames = true
+		a.Shred = 1
+	})
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"unlinked", "replaced", "linked", "source"} {
+		f := openTestFile(t, fs, filepath.Join(dir, name))
+		f.Write([]byte("hello world"), 0)
+		f.Release()
+	}
+	err := os.Link(filepath.Join(dir, "linked"), filepath.Join(dir, "otherlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the backing files open so we can look at their content afterwards
+	ciphertext := map[string][]byte{}
+	fds := map[string]*os.File{}
+	for _, name := range []string{"unlinked", "replaced", "linked"} {
+		fds[name], err = os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fds[name].Close()
+		ciphertext[name], _ = ioutil.ReadAll(fds[name])
+	}
+	if status := fs.Unlink("unlinked", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Rename("source", "replaced", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("linked", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	for name, fd := range fds {
+		have := make([]byte, len(ciphertext[name]))
+		if _, err = fd.ReadAt(have, 0); err != nil {
+			t.Fatal(err)
+		}
+		shredded := !bytes.Equal(have, ciphertext[name])
+		if shredded != (name != "linked") {
+			t.Errorf("%s: shredded=%v", name, shredded)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/pkg/xattr"
 
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -20,22 +21,46 @@ var xattrNameIV = []byte("xattr_name_iv_xx")
 // encrypted original name.
 var xattrStorePrefix = "user.gocryptfs."
 
+// POSIX ACLs are stored in these xattrs. They describe permissions, not
+// content, and the backing filesystem has to interpret them, so they are
+// passed through unencrypted (Linux only, see IsACLXattr).
+const (
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
 // GetXAttr: read the value of extended attribute "attr".
 // Implements pathfs.Filesystem.
 func (fs *FS) GetXAttr(path string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if _, ok := fs.rawPath(path); ok {
+		return nil, fuse.ENODATA
+	}
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
-	if disallowedXAttrName(attr) {
+	if DisallowedXAttrName(attr) && !IsACLXattr(attr) {
 		// "ls -l" queries security.selinux, system.posix_acl_access, system.posix_acl_default
 		// and throws error messages if it gets something else than ENODATA.
 		return nil, fuse.ENODATA
 	}
-	cAttr := fs.encryptXattrName(attr)
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if attr == blockMapXattr {
+		return fs.getBlockMap(cPath)
+	}
+	if attr == dirtyRangesXattr {
+		return fs.getDirtyRanges(cPath)
+	}
+	if IsACLXattr(attr) {
+		data, err := xattr.LGet(cPath, attr)
+		if err != nil {
+			return nil, unpackXattrErr(err)
+		}
+		return data, fuse.OK
+	}
+	cAttr := fs.encryptXattrName(attr)
 	encryptedData, err := xattr.LGet(cPath, cAttr)
 	if err != nil {
 		return nil, unpackXattrErr(err)
@@ -52,12 +77,18 @@ const _EOPNOTSUPP = fuse.Status(syscall.EOPNOTSUPP)
 
 // SetXAttr implements pathfs.Filesystem.
 func (fs *FS) SetXAttr(path string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
-	if disallowedXAttrName(attr) {
+	if DisallowedXAttrName(attr) && !IsACLXattr(attr) {
 		return _EOPNOTSUPP
 	}
+	if attr == blockMapXattr {
+		return fuse.EPERM
+	}
 
 	flags = filterXattrSetFlags(flags)
 
@@ -65,6 +96,14 @@ func (fs *FS) SetXAttr(path string, attr string, data []byte, flags int, context
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	if attr == dirtyRangesXattr {
+		return fs.ackDirtyRanges(cPath, data)
+	}
+	if IsACLXattr(attr) {
+		// Setting an access ACL may change the permission bits
+		defer fs.attrCache.invalidatePath(path)
+		return unpackXattrErr(xattr.LSetWithFlags(cPath, attr, data, flags))
+	}
 	cAttr := fs.encryptXattrName(attr)
 	cData := fs.encryptXattrValue(data)
 	return unpackXattrErr(xattr.LSetWithFlags(cPath, cAttr, cData, flags))
@@ -72,22 +111,35 @@ func (fs *FS) SetXAttr(path string, attr string, data []byte, flags int, context
 
 // RemoveXAttr implements pathfs.Filesystem.
 func (fs *FS) RemoveXAttr(path string, attr string, context *fuse.Context) fuse.Status {
+	if fs.readOnly(path) {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
-	if disallowedXAttrName(attr) {
+	if DisallowedXAttrName(attr) && !IsACLXattr(attr) {
 		return _EOPNOTSUPP
 	}
+	if attr == blockMapXattr || attr == dirtyRangesXattr {
+		return fuse.EPERM
+	}
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	if IsACLXattr(attr) {
+		defer fs.attrCache.invalidatePath(path)
+		return unpackXattrErr(xattr.LRemove(cPath, attr))
+	}
 	cAttr := fs.encryptXattrName(attr)
 	return unpackXattrErr(xattr.LRemove(cPath, cAttr))
 }
 
 // ListXAttr implements pathfs.Filesystem.
 func (fs *FS) ListXAttr(path string, context *fuse.Context) ([]string, fuse.Status) {
+	if _, ok := fs.rawPath(path); ok {
+		return nil, fuse.OK
+	}
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
@@ -101,6 +153,10 @@ func (fs *FS) ListXAttr(path string, context *fuse.Context) ([]string, fuse.Stat
 	}
 	names := make([]string, 0, len(cNames))
 	for _, curName := range cNames {
+		if IsACLXattr(curName) {
+			names = append(names, curName)
+			continue
+		}
 		if !strings.HasPrefix(curName, xattrStorePrefix) {
 			continue
 		}
@@ -117,9 +173,15 @@ func (fs *FS) ListXAttr(path string, context *fuse.Context) ([]string, fuse.Stat
 
 // encryptXattrName transforms "user.foo" to "user.gocryptfs.a5sAd4XAa47f5as6dAf"
 func (fs *FS) encryptXattrName(attr string) (cAttr string) {
+	return EncryptXattrName(fs.nameTransform, attr)
+}
+
+// EncryptXattrName returns the name under which the xattr "attr" is stored
+// in the backing file. Reverse mode uses it to present xattrs the way
+// forward mode stores them.
+func EncryptXattrName(n *nametransform.NameTransform, attr string) string {
 	// xattr names are encrypted like file names, but with a fixed IV.
-	cAttr = xattrStorePrefix + fs.nameTransform.EncryptName(attr, xattrNameIV)
-	return cAttr
+	return xattrStorePrefix + n.EncryptName(attr, xattrNameIV)
 }
 
 func (fs *FS) decryptXattrName(cAttr string) (attr string, err error) {
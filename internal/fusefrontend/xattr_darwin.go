@@ -3,9 +3,18 @@
 // Package fusefrontend interfaces directly with the go-fuse library.
 package fusefrontend
 
-import "github.com/pkg/xattr"
+import (
+	"syscall"
 
-func disallowedXAttrName(attr string) bool {
+	"github.com/pkg/xattr"
+)
+
+// errNoAttr is returned when an xattr does not exist
+const errNoAttr = syscall.ENOATTR
+
+// DisallowedXAttrName returns true if "attr" cannot be stored through the
+// mount. All names are allowed on MacOS.
+func DisallowedXAttrName(attr string) bool {
 	return false
 }
 
@@ -13,3 +22,8 @@ func disallowedXAttrName(attr string) bool {
 func filterXattrSetFlags(flags int) int {
 	return flags &^ xattr.XATTR_NOSECURITY
 }
+
+// IsACLXattr returns false because MacOS does not store ACLs in xattrs
+func IsACLXattr(attr string) bool {
+	return false
+}
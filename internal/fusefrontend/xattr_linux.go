@@ -3,17 +3,31 @@
 // Package fusefrontend interfaces directly with the go-fuse library.
 package fusefrontend
 
-import "strings"
+import (
+	"strings"
+	"syscall"
+)
 
 // Only allow the "user" namespace, block "trusted" and "security", as
 // these may be interpreted by the system, and we don't want to cause
 // trouble with our encrypted garbage.
 const xattrUserPrefix = "user."
 
-func disallowedXAttrName(attr string) bool {
+// errNoAttr is returned when an xattr does not exist
+const errNoAttr = syscall.ENODATA
+
+// DisallowedXAttrName returns true if "attr" cannot be stored through the
+// mount
+func DisallowedXAttrName(attr string) bool {
 	return !strings.HasPrefix(attr, xattrUserPrefix)
 }
 
 func filterXattrSetFlags(flags int) int {
 	return flags
 }
+
+// IsACLXattr returns true for the POSIX ACL xattrs, which are passed through
+// to the backing file as-is.
+func IsACLXattr(attr string) bool {
+	return attr == xattrACLAccess || attr == xattrACLDefault
+}
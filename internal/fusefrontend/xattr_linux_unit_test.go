@@ -3,11 +3,61 @@
 package fusefrontend
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
 )
 
 func TestDisallowedLinuxAttributes(t *testing.T) {
-	if !disallowedXAttrName("xxxx") {
+	if !DisallowedXAttrName("xxxx") {
 		t.Fatalf("Names that don't start with 'user.' should fail")
 	}
 }
+
+func TestACLPassthrough(t *testing.T) {
+	fs, dir := newTestFSWithArgs(t, func(a *Args) {
+		a.PlaintextNames = true
+	})
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Access ACL in the kernel's xattr format: version 2, then
+	// user::rw- user:1000:r-- group::r-- mask::r-- other::---
+	// A minimal ACL without the named user would only change the mode bits.
+	acl := []byte{
+		2, 0, 0, 0,
+		0x01, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0, 4, 0, 0xe8, 0x03, 0, 0,
+		0x04, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+		0x10, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+		0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	}
+	status := fs.SetXAttr("foo", xattrACLAccess, acl, 0, nil)
+	if status == _EOPNOTSUPP {
+		t.Skip("backing filesystem does not support ACLs")
+	} else if !status.Ok() {
+		t.Fatal(status)
+	}
+	// Stored unencrypted under the original name
+	if _, err := xattr.LGet(filepath.Join(dir, "foo"), xattrACLAccess); err != nil {
+		t.Error(err)
+	}
+	if _, status = fs.GetXAttr("foo", xattrACLAccess, nil); !status.Ok() {
+		t.Errorf("GetXAttr: %v", status)
+	}
+	names, status := fs.ListXAttr("foo", nil)
+	if !status.Ok() || len(names) != 1 || names[0] != xattrACLAccess {
+		t.Errorf("ListXAttr: %v %v", names, status)
+	}
+	if status = fs.RemoveXAttr("foo", xattrACLAccess, nil); !status.Ok() {
+		t.Errorf("RemoveXAttr: %v", status)
+	}
+	if _, status = fs.GetXAttr("foo", xattrACLDefault, nil); status != fuse.ENODATA {
+		t.Errorf("GetXAttr default ACL: want ENODATA, got %v", status)
+	}
+}
@@ -0,0 +1,101 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	// dirCacheMax limits the number of cached directory listings. When it
+	// is reached, the cache is emptied.
+	dirCacheMax = 1000
+	// dirCacheRacy is how old the last change of a directory must be before
+	// its listing is cached. Filesystems with coarse timestamps could
+	// otherwise miss a second change within the same tick.
+	dirCacheRacy = 2 * time.Second
+)
+
+// dirCacheKey identifies the state of a plaintext directory. Every change of
+// the directory entries updates the mtime and the ctime.
+type dirCacheKey struct {
+	dev       uint64
+	ino       uint64
+	mtime     uint64
+	mtimensec uint32
+	ctime     uint64
+	ctimensec uint32
+}
+
+type dirCacheEntry struct {
+	key     dirCacheKey
+	entries []fuse.DirEntry
+}
+
+// dirCache holds the encrypted listings of directories, indexed by the
+// relative ciphertext path. Encrypting the names is expensive, and "ls -R"
+// or a backup tool reads the same directories again and again.
+type dirCache struct {
+	sync.Mutex
+	dirs map[string]dirCacheEntry
+}
+
+// dirCacheable returns true if OpenDir may use the cache. The listing must
+// only depend on the directory itself, which is not the case when symlink
+// targets or mount points inside the directory matter. Plaintext names
+// need no encryption.
+func (rfs *ReverseFS) dirCacheable() bool {
+	return !rfs.args.PlaintextNames && !rfs.args.FollowSymlinks && !rfs.args.OneFileSystem
+}
+
+// dirKey returns the cache key for the plaintext directory "pRelPath".
+// ok is false if the directory has changed too recently.
+func (rfs *ReverseFS) dirKey(pRelPath string) (key dirCacheKey, ok bool) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(rfs.args.Cipherdir, pRelPath), &st); err != nil {
+		return key, false
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	key = dirCacheKey{
+		dev:       uint64(st.Dev),
+		ino:       a.Ino,
+		mtime:     a.Mtime,
+		mtimensec: a.Mtimensec,
+		ctime:     a.Ctime,
+		ctimensec: a.Ctimensec,
+	}
+	latest := a.ChangeTime()
+	if m := a.ModTime(); m.After(latest) {
+		latest = m
+	}
+	return key, time.Since(latest) >= dirCacheRacy
+}
+
+// lookup returns a copy of the cached listing of "cPath", or nil if there is
+// none for the directory state "key"
+func (c *dirCache) lookup(cPath string, key dirCacheKey) []fuse.DirEntry {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.dirs[cPath]
+	if !ok || e.key != key {
+		return nil
+	}
+	return append([]fuse.DirEntry(nil), e.entries...)
+}
+
+// store caches a copy of "entries" as the listing of "cPath"
+func (c *dirCache) store(cPath string, key dirCacheKey, entries []fuse.DirEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if c.dirs == nil || len(c.dirs) >= dirCacheMax {
+		c.dirs = make(map[string]dirCacheEntry)
+	}
+	c.dirs[cPath] = dirCacheEntry{
+		key:     key,
+		entries: append([]fuse.DirEntry(nil), entries...),
+	}
+}
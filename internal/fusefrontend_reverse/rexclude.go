@@ -0,0 +1,73 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// isExcluded returns true if the plaintext path "pRelPath" is excluded by
+// "-exclude-from" or, with "-one_file_system", is on a different filesystem
+// than the root directory. The config file is never excluded because it is
+// needed to decrypt the ciphertext view.
+func (rfs *ReverseFS) isExcluded(pRelPath string) bool {
+	if rfs.args.Exclude == nil && !rfs.args.OneFileSystem {
+		return false
+	}
+	if pRelPath == configfile.ConfReverseName {
+		return false
+	}
+	var st syscall.Stat_t
+	var err error
+	absPath := filepath.Join(rfs.args.Cipherdir, pRelPath)
+	if rfs.args.FollowSymlinks {
+		err = syscall.Stat(absPath, &st)
+	} else {
+		err = syscall.Lstat(absPath, &st)
+	}
+	if err == nil && rfs.otherFilesystem(uint64(st.Dev)) {
+		return true
+	}
+	isDir := err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	return rfs.args.Exclude.Excluded(pRelPath, isDir)
+}
+
+// otherFilesystem returns true if "-one_file_system" hides the device "dev"
+func (rfs *ReverseFS) otherFilesystem(dev uint64) bool {
+	return rfs.args.OneFileSystem && dev != rfs.rootDev
+}
+
+// excludeEntries drops the excluded entries of the plaintext directory
+// "pDir" from "entries". "dirfd" is the opened directory.
+func (rfs *ReverseFS) excludeEntries(dirfd int, pDir string, entries []fuse.DirEntry) []fuse.DirEntry {
+	if rfs.args.Exclude == nil && !rfs.args.OneFileSystem {
+		return entries
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		p := filepath.Join(pDir, e.Name)
+		if p == configfile.ConfReverseName {
+			out = append(out, e)
+			continue
+		}
+		if rfs.args.OneFileSystem {
+			var st unix.Stat_t
+			err := syscallcompat.Fstatat(dirfd, e.Name, &st, fstatatFlags(rfs.args.FollowSymlinks))
+			if err != nil || rfs.otherFilesystem(uint64(st.Dev)) {
+				continue
+			}
+		}
+		isDir := e.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if rfs.args.Exclude.Excluded(p, isDir) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
@@ -13,8 +13,8 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
-	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -40,7 +40,10 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	fd, err := syscallcompat.OpenNofollow(rfs.args.Cipherdir, pRelPath, syscall.O_RDONLY, 0)
+	if rfs.isExcluded(pRelPath) {
+		return nil, fuse.ENOENT
+	}
+	fd, err := openBacking(rfs.args.Cipherdir, pRelPath, syscall.O_RDONLY, rfs.args.FollowSymlinks)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -61,26 +64,24 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 	}
 	// See if we have that inode number already in the table
 	// (even if Nlink has dropped to 1)
+	// The inode number is only unique per device (there may be submounts)
+	key := openfiletable.QInoFromStat(&st)
 	var derivedIVs pathiv.FileIVs
-	v, found := inodeTable.Load(st.Ino)
+	v, found := inodeTable.Load(key)
 	if found {
 		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
 		derivedIVs = v.(pathiv.FileIVs)
-	} else {
+	} else if st.Nlink <= 1 {
 		derivedIVs = pathiv.DeriveFile(relPath)
+	} else {
 		// Nlink > 1 means there is more than one path to this file.
-		// Store the derived values so we always return the same data,
-		// regardless of the path that is used to access the file.
-		// This means that the first path wins.
-		if st.Nlink > 1 {
-			v, found = inodeTable.LoadOrStore(st.Ino, derivedIVs)
-			if found {
-				// Another thread has stored a different value before we could.
-				derivedIVs = v.(pathiv.FileIVs)
-			} else {
-				tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
-			}
-		}
+		// Derive the values from the inode number so we always return the
+		// same data, regardless of the path that is used to access the file
+		// first, and across remounts. Store them so that this stays true
+		// when Nlink drops to 1.
+		derivedIVs = pathiv.DeriveFileInode(rfs.inodeDev(uint64(st.Dev)), uint64(st.Ino))
+		inodeTable.Store(key, derivedIVs)
+		tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
 	}
 	header := contentenc.FileHeader{
 		Version: contentenc.CurrentVersion,
@@ -95,6 +96,16 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 	}, fuse.OK
 }
 
+// inodeDev returns the device number that is passed to
+// pathiv.DeriveFileInode. Device numbers may change across reboots, so it is
+// zero for the filesystem of the root directory.
+func (rfs *ReverseFS) inodeDev(dev uint64) uint64 {
+	if dev == rfs.rootDev {
+		return 0
+	}
+	return dev
+}
+
 // GetAttr - FUSE call
 // Triggered by fstat() from userspace
 func (rf *reverseFile) GetAttr(*fuse.Attr) fuse.Status {
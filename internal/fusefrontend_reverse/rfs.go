@@ -3,6 +3,7 @@ package fusefrontend_reverse
 import (
 	"fmt"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -15,7 +16,9 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -34,6 +37,19 @@ type ReverseFS struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Predicted ciphertext usage, only used with "-cipherdf"
+	usage usageCache
+	// Translates backing inode numbers
+	inoMap *inomap.InoMap
+	// rootDev is the device number of the plaintext root directory, used
+	// by "-one_file_system" and for the file IDs of hard-linked files
+	rootDev uint64
+	// writers holds the files that are open for writing, indexed by the
+	// relative ciphertext path. Only used with "-writable".
+	writersLock sync.Mutex
+	writers     map[string]*writeFile
+	// Encrypted directory listings, see dirCache
+	dirCache dirCache
 }
 
 var _ pathfs.FileSystem = &ReverseFS{}
@@ -43,14 +59,23 @@ var _ pathfs.FileSystem = &ReverseFS{}
 // ReverseFS provides an encrypted view.
 func NewFS(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransform.NameTransform) *ReverseFS {
 	initLongnameCache()
-	return &ReverseFS{
+	rfs := &ReverseFS{
 		// pathfs.defaultFileSystem returns ENOSYS for all operations
 		FileSystem:    pathfs.NewDefaultFileSystem(),
 		loopbackfs:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: n,
 		contentEnc:    c,
+		inoMap:        inomap.NewFromDir(args.Cipherdir),
+		writers:       make(map[string]*writeFile),
 	}
+	rfs.inoMap.SetNamespace(args.InoNamespace)
+	var st syscall.Stat_t
+	if err := syscall.Stat(args.Cipherdir, &st); err != nil && args.OneFileSystem {
+		tlog.Warn.Printf("-one_file_system: cannot stat %q: %v", args.Cipherdir, err)
+	}
+	rfs.rootDev = uint64(st.Dev)
+	return rfs
 }
 
 // relDir is identical to filepath.Dir excepts that it returns "" when
@@ -99,6 +124,19 @@ func (rfs *ReverseFS) isTranslatedConfig(relPath string) bool {
 // GetAttr - FUSE call
 // "relPath" is the relative ciphertext path
 func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	// A file that is being written may not have a plaintext representation
+	// yet, see writeFile
+	if w := rfs.writer(relPath); w != nil {
+		var a fuse.Attr
+		status := w.GetAttr(&a)
+		return &a, status
+	}
+	return rfs.getAttr(relPath)
+}
+
+// getAttr returns the attributes of the ciphertext path "relPath" as they
+// follow from the plaintext directory
+func (rfs *ReverseFS) getAttr(relPath string) (*fuse.Attr, fuse.Status) {
 	// Handle "gocryptfs.conf"
 	if rfs.isTranslatedConfig(relPath) {
 		absConfPath, _ := rfs.abs(configfile.ConfReverseName, nil)
@@ -144,11 +182,12 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 	}
 	// Stat the backing file/dir using Fstatat
 	var st unix.Stat_t
-	err = syscallcompat.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	err = syscallcompat.Fstatat(dirfd, name, &st, fstatatFlags(rfs.args.FollowSymlinks))
 	syscall.Close(dirfd)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	st.Ino = rfs.inoMap.Translate(openfiletable.QIno{Dev: uint64(st.Dev), Ino: st.Ino})
 	// Instead of risking an inode number collision, we return an error.
 	if st.Ino > inoBaseMin {
 		tlog.Warn.Printf("GetAttr %q: backing file inode number %d crosses reserved space, max=%d. Returning EOVERFLOW.",
@@ -165,12 +204,18 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 		var linkTarget string
 		var readlinkStatus fuse.Status
 
-		linkTarget, readlinkStatus = rfs.Readlink(relPath, context)
+		linkTarget, readlinkStatus = rfs.Readlink(relPath, nil)
 		if !readlinkStatus.Ok() {
 			return nil, readlinkStatus
 		}
 
 		a.Size = uint64(len(linkTarget))
+	} else if a.IsDir() {
+		// Keep the plaintext count if we cannot read the directory (for
+		// example, because it is not readable), stat() should still work
+		if n, err := rfs.dirNlink(relPath); err == nil {
+			a.Nlink = n
+		}
 	}
 	if rfs.args.ForceOwner != nil {
 		a.Owner = *rfs.args.ForceOwner
@@ -183,8 +228,8 @@ func (rfs *ReverseFS) Access(relPath string, mode uint32, context *fuse.Context)
 	if rfs.isTranslatedConfig(relPath) || rfs.isDirIV(relPath) || rfs.isNameFile(relPath) {
 		// access(2) R_OK flag for checking if the file is readable, always 4 as defined in POSIX.
 		ROK := uint32(0x4)
-		// Virtual files can always be read and never written
-		if mode == ROK || mode == 0 {
+		// Virtual files can always be read and, with "-writable", written
+		if mode == ROK || mode == 0 || rfs.writable() {
 			return fuse.OK
 		}
 		return fuse.EPERM
@@ -203,6 +248,9 @@ func (rfs *ReverseFS) Access(relPath string, mode uint32, context *fuse.Context)
 
 // Open - FUSE call
 func (rfs *ReverseFS) Open(relPath string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	if rfs.args.Writable && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return rfs.openWriter(relPath, flags)
+	}
 	if rfs.isTranslatedConfig(relPath) {
 		return rfs.loopbackfs.Open(configfile.ConfReverseName, flags, context)
 	}
@@ -246,13 +294,20 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	// Read plaintext dir
-	fd, err := syscallcompat.OpenNofollow(rfs.args.Cipherdir, relPath, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
-	if err != nil {
-		return nil, fuse.ToStatus(err)
+	if rfs.isExcluded(relPath) {
+		return nil, fuse.ENOENT
+	}
+	// Stat the directory before reading it, so that a change in between
+	// invalidates the cache entry
+	var key dirCacheKey
+	cacheable := rfs.dirCacheable()
+	if cacheable {
+		key, cacheable = rfs.dirKey(relPath)
+		if cached := rfs.dirCache.lookup(cipherPath, key); cached != nil {
+			return cached, fuse.OK
+		}
 	}
-	entries, err := syscallcompat.Getdents(fd)
-	syscall.Close(fd)
+	entries, err := rfs.readPlainDir(relPath)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -293,14 +348,65 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 		entries[i].Name = cName
 	}
 	entries = append(entries, virtualFiles[:nVirtual]...)
+	if cacheable {
+		rfs.dirCache.store(cipherPath, key, entries)
+	}
 	return entries, fuse.OK
 }
 
+// readPlainDir returns the entries of the plaintext directory "relPath" as
+// they are visible in the ciphertext view: symlinks are resolved with
+// "-follow_symlinks", excluded entries are dropped, see excludeEntries, and
+// so are the pending files of "-writable".
+func (rfs *ReverseFS) readPlainDir(relPath string) ([]fuse.DirEntry, error) {
+	fd, err := openBacking(rfs.args.Cipherdir, relPath, syscall.O_RDONLY|syscall.O_DIRECTORY, rfs.args.FollowSymlinks)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err == nil && rfs.args.FollowSymlinks {
+		entries, err = rfs.resolveSymlinks(fd, relPath, entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rfs.args.Writable {
+		entries = hidePending(entries)
+	}
+	return rfs.excludeEntries(fd, relPath, entries), nil
+}
+
+// dirNlink returns the link count of the directory "cRelPath" in the
+// ciphertext view: two plus the number of visible subdirectories. The
+// plaintext count is wrong when subdirectories are excluded or when
+// symlinks to directories are followed. Virtual files are not directories
+// and do not change the count.
+func (rfs *ReverseFS) dirNlink(cRelPath string) (uint32, error) {
+	pRelPath, err := rfs.decryptPath(cRelPath)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := rfs.readPlainDir(pRelPath)
+	if err != nil {
+		return 0, err
+	}
+	n := uint32(2)
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			n++
+		}
+	}
+	return n, nil
+}
+
 // StatFs - FUSE call. Returns information about the filesystem (free space
 // etc).
 // Securing statfs against symlink races seems to be more trouble than
 // it's worth, so we just ignore the path and always return info about the
 // backing storage root dir.
+// The used space is scaled by the overhead of the content encryption. With
+// "-cipherdf", it is replaced by the predicted size of the ciphertext view.
 func (rfs *ReverseFS) StatFs(path string) *fuse.StatfsOut {
 	var s syscall.Statfs_t
 	err := syscall.Statfs(rfs.args.Cipherdir, &s)
@@ -309,6 +415,11 @@ func (rfs *ReverseFS) StatFs(path string) *fuse.StatfsOut {
 	}
 	out := &fuse.StatfsOut{}
 	out.FromStatfsT(&s)
+	if rfs.args.CipherDf {
+		rfs.applyUsage(out)
+	} else {
+		rfs.scaleUsage(out)
+	}
 	return out
 }
 
@@ -8,7 +8,6 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
-	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -48,6 +47,10 @@ func (rfs *ReverseFS) rDecryptName(cName string, dirIV []byte, pDir string) (pNa
 		}
 	} else if nameType == nametransform.LongNameContent {
 		pName, err = rfs.findLongnameParent(pDir, dirIV, cName)
+		if err == syscall.ENOENT && rfs.args.Writable {
+			// The ".name" file may not have been written yet
+			return pendingName(cName), nil
+		}
 		if err != nil {
 			return "", err
 		}
@@ -106,9 +109,12 @@ func (rfs *ReverseFS) openBackingDir(cRelPath string) (dirfd int, pName string,
 	if err != nil {
 		return -1, "", err
 	}
+	if rfs.isExcluded(pRelPath) {
+		return -1, "", syscall.ENOENT
+	}
 	// Open directory, safe against symlink races
 	pDir := filepath.Dir(pRelPath)
-	dirfd, err = syscallcompat.OpenNofollow(rfs.args.Cipherdir, pDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	dirfd, err = openBacking(rfs.args.Cipherdir, pDir, syscall.O_RDONLY|syscall.O_DIRECTORY, rfs.args.FollowSymlinks)
 	if err != nil {
 		return -1, "", err
 	}
@@ -6,7 +6,8 @@ import (
 
 // rPathCacheContainer is a simple one entry path cache. Because the dirIV
 // is generated deterministically from the directory path, there is no need
-// to ever invalidate entries.
+// to invalidate entries, except when "-writable" renames a pending
+// directory.
 type rPathCacheContainer struct {
 	sync.Mutex
 	// Relative ciphertext path to the directory
@@ -41,5 +42,14 @@ func (c *rPathCacheContainer) store(cPath string, dirIV []byte, pPath string) {
 	c.pPath = pPath
 }
 
+// clear drops the cached entry
+func (c *rPathCacheContainer) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.cPath = ""
+	c.dirIV = nil
+	c.pPath = ""
+}
+
 // rPathCache: see rPathCacheContainer above for a detailed description
 var rPathCache rPathCacheContainer
@@ -0,0 +1,173 @@
+package fusefrontend_reverse
+
+// Ciphertext usage for StatFs, scaled or predicted ("-cipherdf")
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// usageMaxAge is how long a finished scan is considered fresh. After that,
+// the next StatFs call starts a new scan in the background.
+const usageMaxAge = time.Minute
+
+// usageScanShare limits the time spent scanning: a result stays fresh for
+// at least usageScanShare times as long as its scan took, so a tree that
+// takes a minute to walk is rescanned every 10 minutes at most.
+const usageScanShare = 10
+
+// usageCache stores the predicted size of the ciphertext view of the
+// plaintext tree. Scanning a big tree takes a while, so the scan runs in the
+// background and StatFs returns the result of the last finished scan.
+type usageCache struct {
+	sync.Mutex
+	// Number of blocks (of size "bsize") the ciphertext view would occupy
+	blocks uint64
+	// Block size that "blocks" is based on
+	bsize uint64
+	// Number of files and directories, including virtual files
+	files uint64
+	// When the last scan has finished. Zero if no scan has finished yet.
+	updated time.Time
+	// How long the last scan took
+	took time.Duration
+	// Is a scan running right now?
+	scanning bool
+}
+
+// applyUsage replaces the "used" part of the backing storage statistics in
+// "out" by the predicted ciphertext usage. The free space stays as it is.
+// If no scan has finished yet, "out" is not modified.
+func (rfs *ReverseFS) applyUsage(out *fuse.StatfsOut) {
+	c := &rfs.usage
+	c.Lock()
+	defer c.Unlock()
+	maxAge := usageMaxAge
+	if c.took*usageScanShare > maxAge {
+		maxAge = c.took * usageScanShare
+	}
+	if !c.scanning && (c.updated.IsZero() || time.Since(c.updated) > maxAge || c.bsize != uint64(out.Bsize)) {
+		c.scanning = true
+		go rfs.scanUsage(uint64(out.Bsize))
+	}
+	if c.updated.IsZero() || c.bsize != uint64(out.Bsize) {
+		return
+	}
+	out.Blocks = c.blocks + out.Bavail
+	out.Bfree = out.Bavail
+	out.Files = c.files + out.Ffree
+}
+
+// scaleUsage multiplies the "used" part of the backing storage statistics in
+// "out" by the expansion factor of the content encryption (file header and
+// per-block overhead). This is a cheap estimate that ignores the virtual
+// files and everything on the backing filesystem that is not in CIPHERDIR.
+func (rfs *ReverseFS) scaleUsage(out *fuse.StatfsOut) {
+	if out.Blocks < out.Bfree {
+		return
+	}
+	used := out.Blocks - out.Bfree
+	plainBS := rfs.contentEnc.PlainBS()
+	overhead := rfs.contentEnc.CipherBS() - plainBS
+	// Split the multiplication to not overflow for huge filesystems
+	used += used/plainBS*overhead + used%plainBS*overhead/plainBS
+	out.Blocks = used + out.Bfree
+}
+
+// scanUsage walks the plaintext tree and stores the predicted ciphertext
+// usage in rfs.usage.
+func (rfs *ReverseFS) scanUsage(bsize uint64) {
+	var blocks, files uint64
+	// roundUp converts a size in bytes to the number of blocks it occupies
+	roundUp := func(size uint64) uint64 {
+		return (size + bsize - 1) / bsize
+	}
+	t0 := time.Now()
+	err := filepath.Walk(rfs.args.Cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Unreadable files and directories do not show up in the
+			// ciphertext view either
+			return nil
+		}
+		// Walk only descends into real directories, not into symlinks
+		walkDir := fi.IsDir()
+		if rfs.args.FollowSymlinks && fi.Mode()&os.ModeSymlink != 0 {
+			// Count the target instead. Symlinked directories are not
+			// descended into, so the result is a lower bound.
+			fi, err = os.Stat(path)
+			if err != nil {
+				// Dangling symlinks are hidden
+				return nil
+			}
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && rfs.otherFilesystem(uint64(st.Dev)) {
+			if walkDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != rfs.args.Cipherdir && rfs.args.Exclude != nil {
+			rel, _ := filepath.Rel(rfs.args.Cipherdir, path)
+			if rel != configfile.ConfReverseName && rfs.args.Exclude.Excluded(rel, fi.IsDir()) {
+				if walkDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		files++
+		if fi.Mode().IsRegular() {
+			blocks += roundUp(rfs.contentEnc.PlainSizeToCipherSize(uint64(fi.Size())))
+		}
+		if rfs.args.PlaintextNames || path == rfs.args.Cipherdir {
+			return nil
+		}
+		if fi.IsDir() {
+			// Virtual gocryptfs.diriv
+			files++
+			blocks += roundUp(nametransform.DirIVLen)
+		}
+		name := fi.Name()
+		if filepath.Dir(path) == rfs.args.Cipherdir && name == configfile.ConfReverseName {
+			return nil
+		}
+		// Virtual gocryptfs.longname.XYZ.name file
+		if l := rfs.encryptedNameLen(name); l > unix.NAME_MAX {
+			files++
+			blocks += roundUp(uint64(l))
+		}
+		return nil
+	})
+	if err != nil {
+		tlog.Warn.Printf("scanUsage: %v", err)
+	}
+	tlog.Debug.Printf("scanUsage: %d blocks, %d files, took %v", blocks, files, time.Since(t0))
+	c := &rfs.usage
+	c.Lock()
+	c.blocks = blocks
+	c.bsize = bsize
+	c.files = files
+	c.updated = time.Now()
+	c.took = time.Since(t0)
+	c.scanning = false
+	c.Unlock()
+}
+
+// encryptedNameLen returns the length the plaintext name "name" will have
+// once it is encrypted and base64-encoded. The name is padded to the
+// next 16-byte boundary before encryption (PKCS#7, at least one byte).
+func (rfs *ReverseFS) encryptedNameLen(name string) int {
+	padded := (len(name)/16 + 1) * 16
+	return rfs.nameTransform.B64.EncodedLen(padded)
+}
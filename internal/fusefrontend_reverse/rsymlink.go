@@ -0,0 +1,93 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// openBacking opens the plaintext path "relPath" (relative to "cipherdir").
+// Symlinks are only followed if "follow" is set ("-follow_symlinks").
+// Otherwise, this is identical to syscallcompat.OpenNofollow.
+func openBacking(cipherdir string, relPath string, flags int, follow bool) (int, error) {
+	if !follow {
+		return syscallcompat.OpenNofollow(cipherdir, relPath, flags, 0)
+	}
+	return syscall.Open(filepath.Join(cipherdir, relPath), flags, 0)
+}
+
+// fstatatFlags returns the flags that should be passed to Fstatat when
+// looking at a backing file.
+func fstatatFlags(follow bool) int {
+	if follow {
+		return 0
+	}
+	return unix.AT_SYMLINK_NOFOLLOW
+}
+
+// ancestors returns the device and inode numbers of all directories on
+// the way from the root directory to "pRelPath", inclusive.
+// If a directory shows up twice, we have followed a symlink that points to
+// one of its own ancestors, and ELOOP is returned.
+func (rfs *ReverseFS) ancestors(pRelPath string) (map[openfiletable.QIno]bool, error) {
+	seen := make(map[openfiletable.QIno]bool)
+	p := rfs.args.Cipherdir
+	parts := []string{""}
+	if pRelPath != "" {
+		parts = append(parts, strings.Split(pRelPath, "/")...)
+	}
+	for _, part := range parts {
+		p = filepath.Join(p, part)
+		var st syscall.Stat_t
+		err := syscall.Stat(p, &st)
+		if err != nil {
+			return nil, err
+		}
+		key := openfiletable.QIno{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}
+		if seen[key] {
+			tlog.Debug.Printf("ancestors: directory loop at %q", p)
+			return nil, syscall.ELOOP
+		}
+		seen[key] = true
+	}
+	return seen, nil
+}
+
+// resolveSymlinks replaces the symlinks in "entries" with the type of their
+// target. Dangling symlinks and symlinks that point to an ancestor directory
+// (which would give an infinitely deep tree) are dropped.
+// "dirfd" is the opened plaintext directory "pRelPath".
+func (rfs *ReverseFS) resolveSymlinks(dirfd int, pRelPath string, entries []fuse.DirEntry) ([]fuse.DirEntry, error) {
+	seen, err := rfs.ancestors(pRelPath)
+	if err != nil {
+		return nil, err
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			out = append(out, e)
+			continue
+		}
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(dirfd, e.Name, &st, 0)
+		if err != nil {
+			tlog.Debug.Printf("resolveSymlinks: skipping %q: %v", e.Name, err)
+			continue
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR && seen[openfiletable.QIno{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}] {
+			tlog.Debug.Printf("resolveSymlinks: skipping %q: points to an ancestor directory", e.Name)
+			continue
+		}
+		e.Mode = st.Mode
+		out = append(out, e)
+	}
+	return out, nil
+}
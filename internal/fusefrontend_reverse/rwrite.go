@@ -0,0 +1,491 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// "-writable" lets tools restore ciphertext through the reverse mount. What
+// is written is decrypted into the plaintext directory:
+//
+// * File contents are collected in a writeFile and decrypted on Flush.
+// * gocryptfs.diriv and gocryptfs.conf cannot change. Writes are accepted if
+//   the content matches what we would have returned.
+// * A file with a long name can only be decrypted once its ".name" file
+//   has been written. Until then, it is stored under a pending name, see
+//   pendingName.
+// * Files cannot be renamed (EXDEV) because the ciphertext of a file
+//   depends on its path. "mv" falls back to copy and delete.
+
+// pendingPrefix starts the plaintext names of files that are in the process
+// of being written. They are hidden from the ciphertext view.
+const pendingPrefix = ".gocryptfs.pending."
+
+// pendingName returns the plaintext name that stands in for the long name
+// "gocryptfs.longname.XYZ" until the matching ".name" file is written
+func pendingName(longname string) string {
+	return pendingPrefix + longname
+}
+
+// hidePending drops the pending plaintext files from "entries"
+func hidePending(entries []fuse.DirEntry) []fuse.DirEntry {
+	out := entries[:0]
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name, pendingPrefix) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// writable returns true if "-writable" is set and the mount is not
+// read-only. The "ro" mount option alone is not enough, "-ko rw" can
+// override it.
+func (rfs *ReverseFS) writable() bool {
+	return rfs.args.Writable && !rfs.args.ReadOnly
+}
+
+// isVirtual returns true if "cPath" is gocryptfs.conf, gocryptfs.diriv or a
+// ".name" file
+func (rfs *ReverseFS) isVirtual(cPath string) bool {
+	return rfs.isTranslatedConfig(cPath) || rfs.isDirIV(cPath) || rfs.isNameFile(cPath)
+}
+
+// writer returns the writeFile that is open for "cPath", or nil
+func (rfs *ReverseFS) writer(cPath string) *writeFile {
+	rfs.writersLock.Lock()
+	defer rfs.writersLock.Unlock()
+	return rfs.writers[cPath]
+}
+
+func (rfs *ReverseFS) registerWriter(f *writeFile) {
+	rfs.writersLock.Lock()
+	defer rfs.writersLock.Unlock()
+	rfs.writers[f.cPath] = f
+}
+
+func (rfs *ReverseFS) unregisterWriter(f *writeFile) {
+	rfs.writersLock.Lock()
+	defer rfs.writersLock.Unlock()
+	if rfs.writers[f.cPath] == f {
+		delete(rfs.writers, f.cPath)
+	}
+}
+
+// decryptNewPath decrypts the ciphertext path "cPath" of a file that is
+// about to be created
+func (rfs *ReverseFS) decryptNewPath(cPath string) (string, fuse.Status) {
+	if rfs.isVirtual(cPath) {
+		return "", fuse.EPERM
+	}
+	pRelPath, err := rfs.decryptPath(cPath)
+	if err == syscall.ENOENT {
+		// Not a valid encrypted name, like the temporary files of rsync
+		return "", fuse.EPERM
+	}
+	if err != nil {
+		return "", fuse.ToStatus(err)
+	}
+	if rfs.isExcluded(pRelPath) {
+		return "", fuse.EPERM
+	}
+	return pRelPath, fuse.OK
+}
+
+// openWriter returns a writeFile for "cPath" that starts out with the
+// current ciphertext, unless O_TRUNC is set
+func (rfs *ReverseFS) openWriter(cPath string, flags uint32) (nodefs.File, fuse.Status) {
+	if !rfs.writable() {
+		return nil, fuse.EROFS
+	}
+	a, status := rfs.GetAttr(cPath, nil)
+	if !status.Ok() {
+		return nil, status
+	}
+	if !a.IsRegular() {
+		return nil, fuse.Status(syscall.EISDIR)
+	}
+	f, status := rfs.newWriteFile(cPath, a.Mode)
+	if !status.Ok() {
+		return nil, status
+	}
+	if flags&syscall.O_TRUNC == 0 {
+		src, status := rfs.Open(cPath, syscall.O_RDONLY, nil)
+		if status.Ok() {
+			status = f.fill(src)
+			src.Release()
+		}
+		if !status.Ok() {
+			f.spool.Close()
+			return nil, status
+		}
+	} else {
+		f.dirty = true
+	}
+	rfs.registerWriter(f)
+	return f, fuse.OK
+}
+
+// Create - FUSE call. The plaintext file is created right away so it shows
+// up in the directory, and filled on Flush.
+func (rfs *ReverseFS) Create(cPath string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !rfs.writable() {
+		return nil, fuse.EROFS
+	}
+	if !rfs.isVirtual(cPath) {
+		pRelPath, status := rfs.decryptNewPath(cPath)
+		if !status.Ok() {
+			return nil, status
+		}
+		fd, err := syscallcompat.OpenNofollow(rfs.args.Cipherdir, pRelPath,
+			syscall.O_WRONLY|syscall.O_CREAT|int(flags&syscall.O_EXCL), mode&07777)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		syscall.Close(fd)
+	}
+	f, status := rfs.newWriteFile(cPath, mode)
+	if !status.Ok() {
+		return nil, status
+	}
+	f.dirty = true
+	rfs.registerWriter(f)
+	return f, fuse.OK
+}
+
+// commit decrypts the ciphertext in "spool" into the plaintext file of
+// "cPath". "mode" is used for the new plaintext file.
+func (rfs *ReverseFS) commit(cPath string, spool *os.File, mode uint32) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	if rfs.isNameFile(cPath) {
+		return rfs.commitNameFile(cPath, spool)
+	}
+	if rfs.isDirIV(cPath) || rfs.isTranslatedConfig(cPath) {
+		return rfs.verifyVirtual(cPath, spool)
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	dirfd, err := openBacking(rfs.args.Cipherdir, filepath.Dir(pRelPath), syscall.O_RDONLY|syscall.O_DIRECTORY, false)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer syscall.Close(dirfd)
+	// Decrypt into a temporary file and rename it over the old file, so
+	// that a write error does not destroy the old content
+	tmp := pendingPrefix + "tmp." + hex.EncodeToString(cryptocore.RandBytes(8))
+	fd, err := syscallcompat.Openat(dirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	out := os.NewFile(uintptr(fd), tmp)
+	err = rfs.decryptContent(out, spool)
+	if err == nil {
+		err = out.Chmod(os.FileMode(mode))
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, tmp, dirfd, filepath.Base(pRelPath))
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd, tmp, 0)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
+
+// decryptContent decrypts the file contents in "spool" and writes the
+// plaintext to "out". Returns EIO if the ciphertext is corrupt.
+func (rfs *ReverseFS) decryptContent(out io.Writer, spool *os.File) error {
+	fi, err := spool.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil
+	}
+	hdr := make([]byte, contentenc.HeaderLen)
+	if _, err = spool.ReadAt(hdr, 0); err != nil {
+		tlog.Warn.Printf("decryptContent: cannot read the file header: %v", err)
+		return syscall.EIO
+	}
+	h, err := contentenc.ParseHeader(hdr)
+	if err != nil {
+		tlog.Warn.Printf("decryptContent: %v", err)
+		return syscall.EIO
+	}
+	buf := make([]byte, rfs.contentEnc.CipherBS())
+	blockNo := uint64(0)
+	for off := int64(contentenc.HeaderLen); off < size; blockNo++ {
+		n, err := spool.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		plaintext, err := rfs.contentEnc.DecryptBlock(buf[:n], blockNo, h.ID)
+		if err != nil {
+			tlog.Warn.Printf("decryptContent: block %d: %v", blockNo, err)
+			return syscall.EIO
+		}
+		if _, err = out.Write(plaintext); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// verifyVirtual accepts the content of gocryptfs.diriv and gocryptfs.conf
+// if it matches what we would return. Anything else would mean that the
+// ciphertext comes from a different place or filesystem.
+func (rfs *ReverseFS) verifyVirtual(cPath string, spool *os.File) fuse.Status {
+	var want []byte
+	if rfs.isDirIV(cPath) {
+		want = pathiv.Derive(nametransform.Dir(cPath), pathiv.PurposeDirIV)
+	} else {
+		var err error
+		want, err = ioutil.ReadFile(filepath.Join(rfs.args.Cipherdir, configfile.ConfReverseName))
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+	}
+	have, err := ioutil.ReadAll(io.NewSectionReader(spool, 0, 1<<20))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if !bytes.Equal(have, want) {
+		tlog.Warn.Printf("verifyVirtual: %q does not match, the ciphertext belongs to a different directory or filesystem", cPath)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// commitNameFile decrypts the long name in "spool" and moves the pending
+// file of the ".name" file "cPath", if any, to the plaintext name
+func (rfs *ReverseFS) commitNameFile(cPath string, spool *os.File) fuse.Status {
+	content, err := ioutil.ReadAll(io.NewSectionReader(spool, 0, 1<<20))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	cName := string(content)
+	dotName := filepath.Base(cPath)
+	longname := dotName[:len(dotName)-len(nametransform.LongNameSuffix)]
+	if rfs.nameTransform.HashLongName(cName) != longname {
+		tlog.Warn.Printf("commitNameFile: %q does not match its content", cPath)
+		return fuse.EIO
+	}
+	cDir := nametransform.Dir(cPath)
+	pName, err := rfs.nameTransform.DecryptName(cName, pathiv.Derive(cDir, pathiv.PurposeDirIV))
+	if err != nil {
+		tlog.Warn.Printf("commitNameFile: %q: %v", cPath, err)
+		return fuse.EIO
+	}
+	pDir, err := rfs.decryptPath(cDir)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if rfs.isExcluded(filepath.Join(pDir, pName)) {
+		return fuse.EPERM
+	}
+	dirfd, err := openBacking(rfs.args.Cipherdir, pDir, syscall.O_RDONLY|syscall.O_DIRECTORY, false)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer syscall.Close(dirfd)
+	err = syscallcompat.Renameat(dirfd, pendingName(longname), dirfd, pName)
+	if err != nil && err != syscall.ENOENT {
+		return fuse.ToStatus(err)
+	}
+	// The ".name" file may also come first. Then the cache entry makes the
+	// file go to the right place directly.
+	longnameCacheLock.Lock()
+	longnameParentCache[pDir+"/"+longname] = pName
+	longnameCacheLock.Unlock()
+	// The cached path may point to the pending name
+	rPathCache.clear()
+	return fuse.OK
+}
+
+// Truncate - FUSE call. Only files that are open for writing can be
+// truncated to arbitrary sizes because the ciphertext size of a plaintext
+// file is fixed.
+func (rfs *ReverseFS) Truncate(cPath string, size uint64, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	if w := rfs.writer(cPath); w != nil {
+		return w.Truncate(size)
+	}
+	if rfs.isVirtual(cPath) && size == 0 {
+		// Will be verified when the content is written
+		return fuse.OK
+	}
+	if size != 0 {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	return rfs.loopbackfs.Truncate(pRelPath, 0, context)
+}
+
+// Unlink - FUSE call. Virtual files disappear with their plaintext file or
+// directory, so deleting them is a no-op.
+func (rfs *ReverseFS) Unlink(cPath string, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	if rfs.isTranslatedConfig(cPath) {
+		return fuse.EPERM
+	}
+	if rfs.isVirtual(cPath) {
+		return fuse.OK
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	return rfs.loopbackfs.Unlink(pRelPath, context)
+}
+
+// Mkdir - FUSE call
+func (rfs *ReverseFS) Mkdir(cPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	return rfs.loopbackfs.Mkdir(pRelPath, mode, context)
+}
+
+// Rmdir - FUSE call
+func (rfs *ReverseFS) Rmdir(cPath string, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	return rfs.loopbackfs.Rmdir(pRelPath, context)
+}
+
+// Symlink - FUSE call. The target is decrypted like in forward mode.
+func (rfs *ReverseFS) Symlink(cTarget string, cPath string, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	target := cTarget
+	if !rfs.args.PlaintextNames && cTarget != "" {
+		cBinTarget, err := rfs.nameTransform.B64.DecodeString(cTarget)
+		if err != nil {
+			return fuse.EINVAL
+		}
+		pBinTarget, err := rfs.contentEnc.DecryptBlock(cBinTarget, 0, nil)
+		if err != nil {
+			tlog.Warn.Printf("Symlink %q: cannot decrypt the target: %v", cPath, err)
+			return fuse.EIO
+		}
+		target = string(pBinTarget)
+	}
+	return rfs.loopbackfs.Symlink(target, pRelPath, context)
+}
+
+// Rename - FUSE call. See the comment at the top of the file.
+func (rfs *ReverseFS) Rename(oldPath string, newPath string, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	return fuse.Status(syscall.EXDEV)
+}
+
+// chmodPlain sets the permissions of the plaintext file of "cPath".
+// Virtual files have fixed permissions.
+func (rfs *ReverseFS) chmodPlain(cPath string, mode uint32) fuse.Status {
+	if rfs.isVirtual(cPath) {
+		return fuse.OK
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	return rfs.loopbackfs.Chmod(pRelPath, mode, nil)
+}
+
+// Chmod - FUSE call
+func (rfs *ReverseFS) Chmod(cPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	if w := rfs.writer(cPath); w != nil {
+		return w.Chmod(mode)
+	}
+	return rfs.chmodPlain(cPath, mode)
+}
+
+// Chown - FUSE call
+func (rfs *ReverseFS) Chown(cPath string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	if w := rfs.writer(cPath); w != nil {
+		return w.Chown(uid, gid)
+	}
+	if rfs.isVirtual(cPath) {
+		return fuse.OK
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	return rfs.loopbackfs.Chown(pRelPath, uid, gid, context)
+}
+
+// Utimens - FUSE call
+func (rfs *ReverseFS) Utimens(cPath string, a *time.Time, m *time.Time, context *fuse.Context) fuse.Status {
+	if !rfs.writable() {
+		return fuse.EROFS
+	}
+	if w := rfs.writer(cPath); w != nil {
+		return w.Utimens(a, m)
+	}
+	if rfs.isVirtual(cPath) {
+		return fuse.OK
+	}
+	pRelPath, status := rfs.decryptNewPath(cPath)
+	if !status.Ok() {
+		return status
+	}
+	return rfs.loopbackfs.Utimens(pRelPath, a, m, context)
+}
@@ -0,0 +1,238 @@
+package fusefrontend_reverse
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// writeFile is a file that has been opened for writing with "-writable".
+// The ciphertext is collected in a spool file and decrypted into the
+// plaintext directory on Flush, because it can only be decrypted once the
+// file header and the complete blocks are there.
+type writeFile struct {
+	// Embed nodefs.defaultFile for a ENOSYS implementation of all methods
+	nodefs.File
+	// the filesystem the file belongs to
+	rfs *ReverseFS
+	// relative ciphertext path
+	cPath string
+
+	// lock protects the fields below
+	lock sync.Mutex
+	// spool holds the ciphertext. It is an unlinked temporary file.
+	spool *os.File
+	// dirty is set when the spool has not been committed yet
+	dirty bool
+	// mode is the permission bits of the plaintext file
+	mode uint32
+	// Timestamps and owner that have been set through the file handle.
+	// They are applied again after the commit has replaced the plaintext
+	// file.
+	atime, mtime *time.Time
+	owner        *fuse.Owner
+}
+
+// newWriteFile returns a writeFile for "cPath" with an empty spool
+func (rfs *ReverseFS) newWriteFile(cPath string, mode uint32) (*writeFile, fuse.Status) {
+	spool, err := ioutil.TempFile("", "gocryptfs-reverse-")
+	if err != nil {
+		tlog.Warn.Printf("newWriteFile: cannot create spool file: %v", err)
+		return nil, fuse.ToStatus(err)
+	}
+	// Nobody else needs to see the file
+	os.Remove(spool.Name())
+	return &writeFile{
+		File:  nodefs.NewDefaultFile(),
+		rfs:   rfs,
+		cPath: cPath,
+		spool: spool,
+		mode:  mode & 07777,
+	}, fuse.OK
+}
+
+// fill copies the current content of "src" into the spool
+func (f *writeFile) fill(src nodefs.File) fuse.Status {
+	buf := make([]byte, 128*1024)
+	var off int64
+	for {
+		res, status := src.Read(buf, off)
+		if !status.Ok() {
+			return status
+		}
+		data, status := res.Bytes(buf)
+		if !status.Ok() {
+			return status
+		}
+		if len(data) == 0 {
+			return fuse.OK
+		}
+		if _, err := f.spool.WriteAt(data, off); err != nil {
+			return fuse.ToStatus(err)
+		}
+		off += int64(len(data))
+	}
+}
+
+// Read - FUSE call. Returns what has been written so far.
+func (f *writeFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.spool.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return nil, fuse.ToStatus(err)
+	}
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+// Write - FUSE call
+func (f *writeFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if !f.rfs.writable() {
+		return 0, fuse.EROFS
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.spool.WriteAt(data, off)
+	f.dirty = true
+	return uint32(n), fuse.ToStatus(err)
+}
+
+// Truncate - FUSE call
+func (f *writeFile) Truncate(size uint64) fuse.Status {
+	if !f.rfs.writable() {
+		return fuse.EROFS
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.spool.Truncate(int64(size))
+	f.dirty = true
+	return fuse.ToStatus(err)
+}
+
+// Flush - FUSE call. Decrypts the spool into the plaintext directory.
+func (f *writeFile) Flush() fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.commit()
+}
+
+// Fsync - FUSE call
+func (f *writeFile) Fsync(flags int) fuse.Status {
+	return f.Flush()
+}
+
+// commit writes the spool to the plaintext directory if it has changed.
+// Caller must hold f.lock.
+func (f *writeFile) commit() fuse.Status {
+	if !f.dirty {
+		return fuse.OK
+	}
+	status := f.rfs.commit(f.cPath, f.spool, f.mode)
+	if !status.Ok() {
+		return status
+	}
+	f.dirty = false
+	return f.applyMeta()
+}
+
+// applyMeta sets the timestamps and the owner that have been set through
+// the file handle on the plaintext file. Caller must hold f.lock.
+func (f *writeFile) applyMeta() fuse.Status {
+	if f.rfs.isVirtual(f.cPath) {
+		return fuse.OK
+	}
+	pRelPath, err := f.rfs.decryptPath(f.cPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	status := fuse.OK
+	if f.atime != nil || f.mtime != nil {
+		status = f.rfs.loopbackfs.Utimens(pRelPath, f.atime, f.mtime, nil)
+	}
+	if status.Ok() && f.owner != nil {
+		status = f.rfs.loopbackfs.Chown(pRelPath, f.owner.Uid, f.owner.Gid, nil)
+	}
+	return status
+}
+
+// Release - FUSE call
+func (f *writeFile) Release() {
+	f.rfs.unregisterWriter(f)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.dirty {
+		tlog.Warn.Printf("writeFile.Release: %q has not been flushed, discarding the data", f.cPath)
+	}
+	f.spool.Close()
+}
+
+// GetAttr - FUSE call. Reports the size of the spool.
+func (f *writeFile) GetAttr(a *fuse.Attr) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fi, err := f.spool.Stat()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	attr, status := f.rfs.getAttr(f.cPath)
+	if !status.Ok() {
+		// A ".name" file that has not been committed yet
+		attr = &fuse.Attr{
+			Mode:  virtualFileMode,
+			Nlink: 1,
+		}
+		if f.rfs.args.ForceOwner != nil {
+			attr.Owner = *f.rfs.args.ForceOwner
+		}
+	}
+	*a = *attr
+	a.Size = uint64(fi.Size())
+	a.Blocks = (a.Size + 511) / 512
+	return fuse.OK
+}
+
+// Chmod - FUSE call
+func (f *writeFile) Chmod(mode uint32) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.mode = mode & 07777
+	if f.dirty {
+		return fuse.OK
+	}
+	return f.rfs.chmodPlain(f.cPath, mode)
+}
+
+// Chown - FUSE call
+func (f *writeFile) Chown(uid uint32, gid uint32) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.owner = &fuse.Owner{Uid: uid, Gid: gid}
+	if f.dirty {
+		return fuse.OK
+	}
+	return f.applyMeta()
+}
+
+// Utimens - FUSE call
+func (f *writeFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.atime, f.mtime = a, m
+	if f.dirty {
+		return fuse.OK
+	}
+	return f.applyMeta()
+}
+
+// Allocate - FUSE call. The spool has no use for preallocation.
+func (f *writeFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
+	return fuse.Status(syscall.EOPNOTSUPP)
+}
@@ -0,0 +1,118 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// xattr names above this length are rejected by the kernel
+const xattrNameMax = 255
+
+// GetXAttr - FUSE call. Returns the value of the encrypted xattr "cAttr"
+// in the format that forward mode stores it in.
+func (rfs *ReverseFS) GetXAttr(relPath string, cAttr string, context *fuse.Context) ([]byte, fuse.Status) {
+	names, pPath, status := rfs.listPlainXattrs(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	for _, attr := range names {
+		if rfs.encryptXattrName(attr) != cAttr {
+			continue
+		}
+		data, err := rfs.getXattr(pPath, attr)
+		if err != nil {
+			return nil, unpackXattrErr(err)
+		}
+		if fusefrontend.IsACLXattr(attr) || len(data) == 0 {
+			return data, fuse.OK
+		}
+		// The value must be deterministic, like the file contents, so the
+		// nonce is derived from the path and the xattr name.
+		nonce := pathiv.Derive(relPath+"\000"+attr, pathiv.PurposeXattrIV)
+		return rfs.contentEnc.EncryptBlockNonce(data, 0, nil, nonce), fuse.OK
+	}
+	return nil, fuse.ENODATA
+}
+
+// ListXAttr - FUSE call. Lists the encrypted names of the xattrs that forward
+// mode can decrypt.
+func (rfs *ReverseFS) ListXAttr(relPath string, context *fuse.Context) ([]string, fuse.Status) {
+	names, _, status := rfs.listPlainXattrs(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	cNames := make([]string, 0, len(names))
+	for _, attr := range names {
+		cAttr := rfs.encryptXattrName(attr)
+		if len(cAttr) > xattrNameMax {
+			tlog.Debug.Printf("ListXAttr %q: encrypted name of %q is too long, skipping", relPath, attr)
+			continue
+		}
+		cNames = append(cNames, cAttr)
+	}
+	return cNames, fuse.OK
+}
+
+// listPlainXattrs returns the names of the xattrs of the backing file of
+// "relPath" that forward mode would store, and the absolute plaintext path.
+// Virtual files have no xattrs.
+func (rfs *ReverseFS) listPlainXattrs(relPath string) ([]string, string, fuse.Status) {
+	if rfs.isTranslatedConfig(relPath) || rfs.isDirIV(relPath) || rfs.isNameFile(relPath) {
+		return nil, "", fuse.OK
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return nil, "", fuse.ToStatus(err)
+	}
+	if rfs.isExcluded(pRelPath) {
+		return nil, "", fuse.ENOENT
+	}
+	pPath := filepath.Join(rfs.args.Cipherdir, pRelPath)
+	var names []string
+	if rfs.args.FollowSymlinks {
+		names, err = xattr.List(pPath)
+	} else {
+		names, err = xattr.LList(pPath)
+	}
+	if err != nil {
+		return nil, "", unpackXattrErr(err)
+	}
+	out := names[:0]
+	for _, attr := range names {
+		if fusefrontend.DisallowedXAttrName(attr) && !fusefrontend.IsACLXattr(attr) {
+			continue
+		}
+		out = append(out, attr)
+	}
+	return out, pPath, fuse.OK
+}
+
+func (rfs *ReverseFS) getXattr(pPath string, attr string) ([]byte, error) {
+	if rfs.args.FollowSymlinks {
+		return xattr.Get(pPath, attr)
+	}
+	return xattr.LGet(pPath, attr)
+}
+
+// encryptXattrName returns the name forward mode stores "attr" under. POSIX
+// ACLs are stored as-is.
+func (rfs *ReverseFS) encryptXattrName(attr string) string {
+	if fusefrontend.IsACLXattr(attr) {
+		return attr
+	}
+	return fusefrontend.EncryptXattrName(rfs.nameTransform, attr)
+}
+
+// unpackXattrErr converts an error from the xattr package to a fuse status
+func unpackXattrErr(err error) fuse.Status {
+	if err2, ok := err.(*xattr.Error); ok {
+		return fuse.ToStatus(err2.Err)
+	}
+	return fuse.ToStatus(err)
+}
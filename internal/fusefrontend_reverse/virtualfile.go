@@ -11,6 +11,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -41,6 +42,9 @@ func (rfs *ReverseFS) newDirIVFile(cRelPath string) (nodefs.File, fuse.Status) {
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if rfs.isExcluded(dir) {
+		return nil, fuse.ENOENT
+	}
 	iv := pathiv.Derive(cDir, pathiv.PurposeDirIV)
 	return rfs.newVirtualFile(iv, rfs.args.Cipherdir, dir, inoBaseDirIV)
 }
@@ -56,11 +60,14 @@ type virtualFile struct {
 	parentFile string
 	// inode number of a virtual file is inode of parent file plus inoBase
 	inoBase uint64
+	// the filesystem the file belongs to
+	rfs *ReverseFS
 }
 
 // newVirtualFile creates a new in-memory file that does not have a representation
-// on disk. "content" is the file content. Timestamps and file owner are copied
-// from "parentFile" (plaintext path relative to "cipherdir").
+// on disk. "content" is the file content. The file owner is copied from
+// "parentFile" (plaintext path relative to "cipherdir"), and the inode number
+// is derived from it. Timestamps are fixed, see virtualFile.GetAttr.
 // For a "gocryptfs.diriv" file, you would use the parent directory as
 // "parentFile".
 func (rfs *ReverseFS) newVirtualFile(content []byte, cipherdir string, parentFile string, inoBase uint64) (nodefs.File, fuse.Status) {
@@ -73,6 +80,7 @@ func (rfs *ReverseFS) newVirtualFile(content []byte, cipherdir string, parentFil
 		cipherdir:  cipherdir,
 		parentFile: parentFile,
 		inoBase:    inoBase,
+		rfs:        rfs,
 	}, fuse.OK
 }
 
@@ -91,18 +99,19 @@ func (f *virtualFile) Read(buf []byte, off int64) (resultData fuse.ReadResult, s
 // GetAttr - FUSE call
 func (f *virtualFile) GetAttr(a *fuse.Attr) fuse.Status {
 	dir := filepath.Dir(f.parentFile)
-	dirfd, err := syscallcompat.OpenNofollow(f.cipherdir, dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	dirfd, err := openBacking(f.cipherdir, dir, syscall.O_RDONLY|syscall.O_DIRECTORY, f.rfs.args.FollowSymlinks)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(dirfd)
 	name := filepath.Base(f.parentFile)
 	var st unix.Stat_t
-	err = syscallcompat.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	err = syscallcompat.Fstatat(dirfd, name, &st, fstatatFlags(f.rfs.args.FollowSymlinks))
 	if err != nil {
 		tlog.Debug.Printf("GetAttr: Fstatat %q: %v\n", f.parentFile, err)
 		return fuse.ToStatus(err)
 	}
+	st.Ino = f.rfs.inoMap.Translate(openfiletable.QIno{Dev: uint64(st.Dev), Ino: st.Ino})
 	if st.Ino > inoBaseMin {
 		tlog.Warn.Printf("virtualFile.GetAttr: parent file inode number %d crosses reserved space, max=%d. Returning EOVERFLOW.",
 			st.Ino, inoBaseMin)
@@ -112,7 +121,15 @@ func (f *virtualFile) GetAttr(a *fuse.Attr) fuse.Status {
 	st.Size = int64(len(f.content))
 	st.Mode = virtualFileMode
 	st.Nlink = 1
+	st.Blocks = (st.Size + 511) / 512
 	st2 := syscallcompat.Unix2syscall(st)
 	a.FromStat(&st2)
+	// The content of a virtual file only depends on its path and never
+	// changes. Copying the timestamps of the parent would make rsync & co
+	// re-send the file whenever something in the parent directory changes,
+	// so we report the Unix epoch instead.
+	a.Atime, a.Atimensec = 0, 0
+	a.Mtime, a.Mtimensec = 0, 0
+	a.Ctime, a.Ctimensec = 0, 0
 	return fuse.OK
 }
@@ -0,0 +1,163 @@
+// Package guard implements "-guard", a heuristic against ransomware-style
+// enumeration. If processes of users that are not on the allowlist open many
+// files in a short time, the event is reported and, depending on the action,
+// the mount is frozen and the cached keys are locked.
+package guard
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions
+const (
+	// ActionReport only reports the event
+	ActionReport = "report"
+	// ActionFreeze reports the event and makes all further operations fail
+	// with EACCES until the mount is unfrozen through the control socket
+	ActionFreeze = "freeze"
+	// ActionLock works like ActionFreeze and additionally removes the master
+	// key from the kernel keyring and from gocryptfs-agent, so that a new
+	// mount needs the password
+	ActionLock = "lock"
+)
+
+// ErrNotFrozen is returned by Unfreeze if the mount is not frozen
+var ErrNotFrozen = errors.New("the filesystem is not frozen")
+
+// Guard counts the files opened by foreign users
+type Guard struct {
+	// frozen is 1 while the mount is frozen. Accessed atomically.
+	frozen int32
+	// Opens is the number of opens by foreign users within Window that
+	// triggers the action
+	Opens int
+	// Window is the length of the counting window
+	Window time.Duration
+	// Allow lists the UIDs whose opens are not counted
+	Allow map[uint32]bool
+	// Action is one of the Action* constants
+	Action string
+	// OnTrigger is called when the threshold is reached, with a
+	// description of what happened. It runs in its own goroutine.
+	OnTrigger func(detail string)
+
+	lock sync.Mutex
+	// windowStart is the start of the current counting window
+	windowStart time.Time
+	// count is the number of opens by foreign users since windowStart
+	count int
+	// triggered is set once the threshold has been reached, so that the
+	// event is only reported once per freeze
+	triggered bool
+}
+
+// Parse parses a SPEC like "opens=100,window=10s,allow=1000+1001,action=freeze".
+// "opens" is required. "window" defaults to 10s and "action" to "freeze".
+// The user "ownUID" is always allowed.
+func Parse(spec string, ownUID uint32) (*Guard, error) {
+	g := &Guard{
+		Window: 10 * time.Second,
+		Allow:  map[uint32]bool{ownUID: true},
+		Action: ActionFreeze,
+	}
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: want KEY=VALUE", kv)
+		}
+		key, val := parts[0], parts[1]
+		var err error
+		switch key {
+		case "opens":
+			g.Opens, err = strconv.Atoi(val)
+			if err == nil && g.Opens < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "window":
+			g.Window, err = time.ParseDuration(val)
+			if err == nil && g.Window <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "allow":
+			for _, s := range strings.Split(val, "+") {
+				var uid uint64
+				uid, err = strconv.ParseUint(s, 10, 32)
+				if err != nil {
+					break
+				}
+				g.Allow[uint32(uid)] = true
+			}
+		case "action":
+			switch val {
+			case ActionReport, ActionFreeze, ActionLock:
+				g.Action = val
+			default:
+				err = fmt.Errorf("unknown action %q", val)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	if g.Opens == 0 {
+		return nil, errors.New("opens: missing")
+	}
+	return g, nil
+}
+
+// Frozen returns true while all operations are rejected
+func (g *Guard) Frozen() bool {
+	return atomic.LoadInt32(&g.frozen) == 1
+}
+
+// Unfreeze lifts the freeze and starts counting from zero
+func (g *Guard) Unfreeze() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !atomic.CompareAndSwapInt32(&g.frozen, 1, 0) {
+		return ErrNotFrozen
+	}
+	g.count = 0
+	g.triggered = false
+	return nil
+}
+
+// countOpen is called when user "uid" opens "path"
+func (g *Guard) countOpen(uid uint32, path string) {
+	if g.Allow[uid] {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now()
+	if now.Sub(g.windowStart) > g.Window {
+		g.windowStart = now
+		g.count = 0
+	}
+	g.count++
+	if g.count < g.Opens || g.triggered {
+		return
+	}
+	g.triggered = true
+	if g.Action != ActionReport {
+		atomic.StoreInt32(&g.frozen, 1)
+	}
+	detail := fmt.Sprintf("%d opens by foreign users within %v, last: uid %d opened %q, action: %s",
+		g.count, g.Window, uid, path, g.Action)
+	if g.Action == ActionReport {
+		// Report again when the next window fills up
+		g.triggered = false
+		g.count = 0
+	}
+	if g.OnTrigger != nil {
+		go g.OnTrigger(detail)
+	}
+}
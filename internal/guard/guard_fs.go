@@ -0,0 +1,252 @@
+package guard
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/filewrap"
+)
+
+// Wrap returns a pathfs.FileSystem that counts the opens on "fs" and
+// rejects all operations with EACCES while frozen
+func (g *Guard) Wrap(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &guardFS{FileSystem: fs, g: g}
+}
+
+type guardFS struct {
+	pathfs.FileSystem
+	g *Guard
+}
+
+func (fs *guardFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if fs.g.Frozen() {
+		return nil, fuse.EACCES
+	}
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *guardFS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *guardFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *guardFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *guardFS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *guardFS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+func (fs *guardFS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+func (fs *guardFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *guardFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *guardFS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+func (fs *guardFS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *guardFS) Unlink(name string, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *guardFS) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if fs.g.Frozen() {
+		return nil, fuse.EACCES
+	}
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *guardFS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if fs.g.Frozen() {
+		return nil, fuse.EACCES
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *guardFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *guardFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *guardFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	fs.g.countOpen(context.Owner.Uid, name)
+	if fs.g.Frozen() {
+		return nil, fuse.EACCES
+	}
+	f, status := fs.FileSystem.Open(name, flags, context)
+	return fs.track(f), status
+}
+
+func (fs *guardFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	fs.g.countOpen(context.Owner.Uid, name)
+	if fs.g.Frozen() {
+		return nil, fuse.EACCES
+	}
+	f, status := fs.FileSystem.Create(name, flags, mode, context)
+	return fs.track(f), status
+}
+
+func (fs *guardFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	fs.g.countOpen(context.Owner.Uid, name)
+	if fs.g.Frozen() {
+		return nil, fuse.EACCES
+	}
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (fs *guardFS) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if fs.g.Frozen() {
+		return fuse.EACCES
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *guardFS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if fs.g.Frozen() {
+		return "", fuse.EACCES
+	}
+	return fs.FileSystem.Readlink(name, context)
+}
+
+// track wraps "f" in a guardFile, so that file handles that were opened
+// before the freeze cannot be used either
+func (fs *guardFS) track(f nodefs.File) nodefs.File {
+	return filewrap.Wrap(f, func(f nodefs.File) nodefs.File {
+		return &guardFile{File: f, g: fs.g}
+	})
+}
+
+// guardFile rejects the operations on an open file while frozen. Flush and
+// Release are passed through so that the file can be closed.
+type guardFile struct {
+	nodefs.File
+	g *Guard
+}
+
+func (f *guardFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if f.g.Frozen() {
+		return nil, fuse.EACCES
+	}
+	return f.File.Read(buf, off)
+}
+
+func (f *guardFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if f.g.Frozen() {
+		return 0, fuse.EACCES
+	}
+	return f.File.Write(data, off)
+}
+
+func (f *guardFile) Truncate(size uint64) fuse.Status {
+	if f.g.Frozen() {
+		return fuse.EACCES
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *guardFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	if f.g.Frozen() {
+		return fuse.EACCES
+	}
+	return f.File.Allocate(off, size, mode)
+}
+
+func (f *guardFile) Fsync(flags int) fuse.Status {
+	if f.g.Frozen() {
+		return fuse.EACCES
+	}
+	return f.File.Fsync(flags)
+}
+
+func (f *guardFile) GetAttr(a *fuse.Attr) fuse.Status {
+	if f.g.Frozen() {
+		return fuse.EACCES
+	}
+	return f.File.GetAttr(a)
+}
+
+func (f *guardFile) Chmod(perms uint32) fuse.Status {
+	if f.g.Frozen() {
+		return fuse.EACCES
+	}
+	return f.File.Chmod(perms)
+}
+
+func (f *guardFile) Chown(uid uint32, gid uint32) fuse.Status {
+	if f.g.Frozen() {
+		return fuse.EACCES
+	}
+	return f.File.Chown(uid, gid)
+}
+
+func (f *guardFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	if f.g.Frozen() {
+		return fuse.EACCES
+	}
+	return f.File.Utimens(atime, mtime)
+}
@@ -0,0 +1,123 @@
+package guard
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func TestParse(t *testing.T) {
+	g, err := Parse("opens=50,window=2s,allow=33+1001,action=lock", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Opens != 50 || g.Window != 2*time.Second || g.Action != ActionLock ||
+		!g.Allow[33] || !g.Allow[1000] || !g.Allow[1001] || g.Allow[0] {
+		t.Errorf("wrong result: %+v", g)
+	}
+	bad := []string{
+		"",
+		"opens",
+		"opens=0",
+		"opens=x",
+		"window=10s",
+		"opens=1,window=-1s",
+		"opens=1,allow=x",
+		"opens=1,action=kill",
+		"opens=1,foo=1",
+	}
+	for _, s := range bad {
+		if _, err := Parse(s, 1000); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+}
+
+func ctx(uid uint32) *fuse.Context {
+	return &fuse.Context{Owner: fuse.Owner{Uid: uid}}
+}
+
+func TestFreeze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFreeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(dir+"/foo", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Parse("opens=3", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	triggered := make(chan string, 10)
+	g.OnTrigger = func(detail string) { triggered <- detail }
+	fs := g.Wrap(pathfs.NewLoopbackFileSystem(dir))
+	// Our own user is not counted
+	for i := 0; i < 10; i++ {
+		if _, status := fs.OpenDir("", ctx(1000)); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	f, status := fs.Open("foo", uint32(os.O_RDONLY), ctx(1000))
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	for i := 0; i < 2; i++ {
+		fs.OpenDir("", ctx(2000))
+	}
+	if g.Frozen() {
+		t.Fatal("frozen too early")
+	}
+	fs.OpenDir("", ctx(2000))
+	select {
+	case <-triggered:
+	case <-time.After(time.Second):
+		t.Fatal("OnTrigger was not called")
+	}
+	if !g.Frozen() {
+		t.Fatal("not frozen")
+	}
+	if _, status := fs.GetAttr("foo", ctx(1000)); status != fuse.EACCES {
+		t.Errorf("GetAttr: want EACCES, have %v", status)
+	}
+	if _, status := f.Read(make([]byte, 10), 0); status != fuse.EACCES {
+		t.Errorf("Read: want EACCES, have %v", status)
+	}
+	if err = g.Unfreeze(); err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Unfreeze(); err != ErrNotFrozen {
+		t.Errorf("want ErrNotFrozen, have %v", err)
+	}
+	if _, status := f.Read(make([]byte, 10), 0); !status.Ok() {
+		t.Errorf("Read after Unfreeze: %v", status)
+	}
+}
+
+func TestReport(t *testing.T) {
+	g, err := Parse("opens=2,action=report", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	triggered := make(chan string, 10)
+	g.OnTrigger = func(detail string) { triggered <- detail }
+	for i := 0; i < 4; i++ {
+		g.countOpen(2000, "x")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-triggered:
+		case <-time.After(time.Second):
+			t.Fatalf("OnTrigger was called %d times, want 2", i)
+		}
+	}
+	if g.Frozen() {
+		t.Error("action=report must not freeze")
+	}
+}
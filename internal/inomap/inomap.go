@@ -0,0 +1,124 @@
+// Package inomap translates the inode numbers of the backing filesystem to
+// the inode numbers gocryptfs reports to the kernel.
+//
+// NFS file handles and tools like "find -inum" or backup programs rely on
+// inode numbers that are unique and do not change across remounts. Passing
+// the backing inode numbers through is not enough, as files on different
+// filesystems (submounts inside CIPHERDIR, or targets of "-follow_symlinks"
+// in reverse mode) may share them. The translation implemented here is a
+// pure function of the (device, inode) pair, so it needs no table in
+// memory or on disk and gives the same result on every mount.
+//
+// With a namespace (see SetNamespace), the inode numbers of different
+// filesystems are shifted into different ranges, so that several mounts
+// exported through one NFS server are unlikely to share inode numbers.
+package inomap
+
+import (
+	"hash/fnv"
+	"sync"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// DevShift is the position of the device tag in the translated inode
+	// number of files that live on a different filesystem than the root
+	// directory.
+	DevShift = 48
+	// DevBits is the size of the device tag. 11 bits above bit 48 keep
+	// translated numbers below 2^59, so the upper bits remain available
+	// to the frontends (virtual files in reverse mode, the raw view).
+	DevBits = 11
+	// Max is the largest inode number Translate returns for inode numbers
+	// that can be tagged.
+	Max = 1<<(DevShift+DevBits) - 1
+)
+
+// InoMap translates inode numbers for a backing directory tree.
+type InoMap struct {
+	// rootDev is the device number of the root directory
+	rootDev uint64
+	// namespace is added to the device tag, modulo 2^DevBits. 0 means no
+	// namespace.
+	namespace uint64
+	// warnOnce makes sure we only complain once about inode numbers we cannot
+	// translate.
+	warnOnce sync.Once
+}
+
+// New returns an InoMap for a tree whose root directory is on device
+// "rootDev".
+func New(rootDev uint64) *InoMap {
+	return &InoMap{rootDev: rootDev}
+}
+
+// NewFromDir is like New, but stats "dir" to get the device number.
+// If the stat fails, a warning is logged and all devices are tagged.
+func NewFromDir(dir string) *InoMap {
+	var st syscall.Stat_t
+	err := syscall.Stat(dir, &st)
+	if err != nil {
+		tlog.Warn.Printf("inomap: Stat %q: %v", dir, err)
+	}
+	return New(uint64(st.Dev))
+}
+
+// SetNamespace moves the translated inode numbers into the namespace "ns",
+// an arbitrary value that identifies the filesystem. There are only
+// 2^DevBits-1 namespaces, so two filesystems share one with a probability of
+// about 1 in 2000. Must be called before the first Translate.
+func (m *InoMap) SetNamespace(ns uint64) {
+	if ns == 0 {
+		m.namespace = 0
+		return
+	}
+	m.namespace = ns%(1<<DevBits-1) + 1
+}
+
+// Translate converts the backing (device, inode) pair "qi" to the inode
+// number we report to the kernel.
+//
+// Files on the same filesystem as the root directory keep their inode
+// number. For files on other filesystems, a tag derived from the device
+// number is put in the upper bits. With a namespace, the namespace is
+// added to the tag, so the files on the root filesystem are tagged as well.
+func (m *InoMap) Translate(qi openfiletable.QIno) uint64 {
+	var tag uint64
+	if qi.Dev != m.rootDev {
+		tag = devTag(qi.Dev)
+	}
+	// The sum is a bijection on the tags, so the translated numbers stay
+	// unique
+	tag = (tag + m.namespace) % (1 << DevBits)
+	if tag == 0 {
+		return qi.Ino
+	}
+	if qi.Ino >= 1<<DevShift {
+		m.warnOnce.Do(func() {
+			tlog.Warn.Printf("inomap: inode number %d on device %d is too big to be tagged, "+
+				"inode numbers may collide", qi.Ino, qi.Dev)
+		})
+		return qi.Ino
+	}
+	return tag<<DevShift | qi.Ino
+}
+
+// TranslateStat replaces the inode number in "st" by its translation.
+func (m *InoMap) TranslateStat(st *syscall.Stat_t) {
+	st.Ino = m.Translate(openfiletable.QInoFromStat(st))
+}
+
+// devTag hashes the device number "dev" to a non-zero DevBits-sized value.
+func devTag(dev uint64) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = byte(dev >> (8 * uint(i)))
+	}
+	h.Write(buf[:])
+	tag := h.Sum64() % (1<<DevBits - 1)
+	return tag + 1
+}
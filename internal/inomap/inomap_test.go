@@ -0,0 +1,67 @@
+package inomap
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+func TestTranslate(t *testing.T) {
+	m := New(2049)
+	if ino := m.Translate(openfiletable.QIno{Dev: 2049, Ino: 1234}); ino != 1234 {
+		t.Errorf("inode number on the root device was changed: %d", ino)
+	}
+	ino1 := m.Translate(openfiletable.QIno{Dev: 2050, Ino: 1234})
+	ino2 := m.Translate(openfiletable.QIno{Dev: 2051, Ino: 1234})
+	if ino1 == 1234 || ino2 == 1234 || ino1 == ino2 {
+		t.Errorf("inode numbers on other devices were not tagged: %d %d", ino1, ino2)
+	}
+	// A fresh InoMap, like after a remount, must give the same result
+	if ino1 != New(2049).Translate(openfiletable.QIno{Dev: 2050, Ino: 1234}) {
+		t.Errorf("translation is not deterministic")
+	}
+	if ino1 > Max || ino2 > Max {
+		t.Errorf("translated inode number is too big: %d %d", ino1, ino2)
+	}
+	// Inode numbers that do not fit are passed through
+	big := uint64(1) << 50
+	if ino := m.Translate(openfiletable.QIno{Dev: 2050, Ino: big}); ino != big {
+		t.Errorf("big inode number was changed: %d", ino)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	a := New(2049)
+	a.SetNamespace(1)
+	b := New(2049)
+	b.SetNamespace(2)
+	qi := openfiletable.QIno{Dev: 2049, Ino: 1234}
+	inoA := a.Translate(qi)
+	inoB := b.Translate(qi)
+	if inoA == 1234 || inoB == 1234 || inoA == inoB {
+		t.Errorf("namespaces were not applied: %d %d", inoA, inoB)
+	}
+	if inoA&(1<<DevShift-1) != 1234 {
+		t.Errorf("the lower bits were changed: %d", inoA)
+	}
+	// Within one namespace, devices with different tags must not collide,
+	// whatever the namespace is
+	tags := map[uint64]bool{0: true}
+	for dev := uint64(2050); dev < 2050+50; dev++ {
+		tags[devTag(dev)] = true
+	}
+	for ns := uint64(1); ns < 1<<DevBits; ns++ {
+		a.SetNamespace(ns)
+		seen := make(map[uint64]bool)
+		for dev := uint64(2049); dev < 2050+50; dev++ {
+			ino := a.Translate(openfiletable.QIno{Dev: dev, Ino: 1234})
+			if ino > Max {
+				t.Fatalf("ns %d dev %d: translated inode number is too big: %d", ns, dev, ino)
+			}
+			seen[ino] = true
+		}
+		if len(seen) != len(tags) {
+			t.Fatalf("ns %d: %d distinct inode numbers for %d distinct tags", ns, len(seen), len(tags))
+		}
+	}
+}
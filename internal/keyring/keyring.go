@@ -0,0 +1,18 @@
+// Package keyring caches unlocked master keys in the Linux kernel keyring,
+// so that mounting the same filesystem again does not ask for the password.
+package keyring
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Description returns the key description for the filesystem whose config
+// file has the key ID "keyID", see configfile.ConfFile.KeyID(). Because
+// EncryptedKey is random, the description is unique per filesystem, and it
+// changes when the password, the "Sealed" flag or the expiry time is
+// changed.
+func Description(keyID []byte) string {
+	h := sha256.Sum256(keyID)
+	return "gocryptfs:" + hex.EncodeToString(h[:16])
+}
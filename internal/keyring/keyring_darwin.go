@@ -0,0 +1,20 @@
+package keyring
+
+import (
+	"syscall"
+)
+
+// Store is not implemented on Darwin, which has no kernel keyring.
+func Store(desc string, key []byte, timeout int) error {
+	return syscall.ENOTSUP
+}
+
+// Load is not implemented on Darwin.
+func Load(desc string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// Revoke is not implemented on Darwin.
+func Revoke(desc string) error {
+	return syscall.ENOTSUP
+}
@@ -0,0 +1,61 @@
+package keyring
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	keyType = "user"
+	// keyPerm lets the possessor do everything and the owning user view,
+	// read and search the key.
+	keyPerm = 0x3f0b0000
+	// maxKeyLen is the size of the read buffer in Load()
+	maxKeyLen = 64
+)
+
+// Store adds "key" to the user keyring under "desc", replacing a key that
+// is already stored there. The key expires after "timeout" seconds, or
+// never if "timeout" is zero.
+func Store(desc string, key []byte, timeout int) error {
+	id, err := unix.AddKey(keyType, desc, key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return err
+	}
+	if err = unix.KeyctlSetperm(id, keyPerm); err == nil && timeout > 0 {
+		_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, timeout, 0, 0)
+	}
+	if err != nil {
+		unix.KeyctlInt(unix.KEYCTL_REVOKE, id, 0, 0, 0)
+	}
+	return err
+}
+
+// Load returns the key stored under "desc" in the user keyring.
+func Load(desc string) ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, keyType, desc, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxKeyLen)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n > len(buf) {
+		return nil, fmt.Errorf("key too long: %d bytes", n)
+	}
+	return buf[:n], nil
+}
+
+// Revoke revokes the key stored under "desc" in the user keyring. Later
+// Load() calls fail.
+func Revoke(desc string) error {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, keyType, desc, 0)
+	if err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_REVOKE, id, 0, 0, 0)
+	return err
+}
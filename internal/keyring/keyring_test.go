@@ -0,0 +1,32 @@
+package keyring
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+)
+
+func TestStoreLoadRevoke(t *testing.T) {
+	desc := Description([]byte("TestStoreLoadRevoke"))
+	key := bytes.Repeat([]byte{0x42}, 32)
+	err := Store(desc, key, 60)
+	if err == syscall.ENOSYS || err == syscall.ENOTSUP || err == syscall.EACCES {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := Load(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Errorf("wrong key: %x", key2)
+	}
+	if err = Revoke(desc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(desc); err == nil {
+		t.Error("revoked key could still be loaded")
+	}
+}
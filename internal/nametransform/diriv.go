@@ -30,7 +30,7 @@ const (
 // If the directory itself cannot be opened, a syscall error will be returned.
 // Otherwise, a fmt.Errorf() error value is returned with the details.
 func ReadDirIV(dir string) (iv []byte, err error) {
-	fd, err := os.Open(filepath.Join(dir, DirIVFilename))
+	fd, err := os.Open(MetaPath(dir, DirIVFilename))
 	if err != nil {
 		// Note: getting errors here is normal because of concurrent deletes.
 		// Strip the useless annotation that os.Open has added and return
@@ -45,7 +45,7 @@ func ReadDirIV(dir string) (iv []byte, err error) {
 // ReadDirIVAt reads "gocryptfs.diriv" from the directory that is opened as "dirfd".
 // Using the dirfd makes it immune to concurrent renames of the directory.
 func ReadDirIVAt(dirfd *os.File) (iv []byte, err error) {
-	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), DirIVFilename,
+	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), metaNameAt(dirfd, DirIVFilename),
 		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fmt.Errorf("openat failed: %v", err)
@@ -80,7 +80,9 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 // WriteDirIV - create diriv file inside of the specified directory. If dirfd
 // is nil "dir" should be the absolute path to the directory. If dirfd != nil
 // "dir" should be a path (without slashes) relative to the directory
-// described by "dirfd". This function is exported because it is used from
+// described by "dirfd". With "-metadata_dir", the file is created in the
+// metadata directory, see MetaPath().
+// This function is exported because it is used from
 // pathfs_frontend, main, and also the automated tests.
 func WriteDirIV(dirfd *os.File, dir string) error {
 	// For relative paths we do not expect that "dir" contains slashes
@@ -89,6 +91,16 @@ func WriteDirIV(dirfd *os.File, dir string) error {
 	}
 	iv := cryptocore.RandBytes(DirIVLen)
 	file := filepath.Join(dir, DirIVFilename)
+	if metaRoot != "" {
+		if dirfd != nil {
+			dir = filepath.Join(dirfd.Name(), dir)
+		}
+		file = MetaPath(dir, DirIVFilename)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			tlog.Warn.Printf("WriteDirIV: MkdirAll: %v", err)
+			return err
+		}
+	}
 	// 0400 permissions: gocryptfs.diriv should never be modified after creation.
 	// Don't use "ioutil.WriteFile", it causes trouble on NFS: https://github.com/rfjakob/gocryptfs/issues/105
 	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
@@ -111,13 +123,17 @@ func WriteDirIV(dirfd *os.File, dir string) error {
 }
 
 // encryptAndHashName encrypts "name" and hashes it to a longname if it is
-// too long.
-func (be *NameTransform) encryptAndHashName(name string, iv []byte) string {
+// too long. "dir" is the absolute path to the ciphertext directory and is
+// used to resolve hash collisions if LongNameRetries is set.
+func (be *NameTransform) encryptAndHashName(name string, iv []byte, dir string) (string, error) {
 	cName := be.EncryptName(name, iv)
 	if be.longNames && len(cName) > unix.NAME_MAX {
-		return be.HashLongName(cName)
+		if be.LongNameRetries > 0 {
+			return be.findLongName(dir, cName)
+		}
+		return be.HashLongName(cName), nil
 	}
-	return cName
+	return cName, nil
 }
 
 // EncryptPathDirIV - encrypt relative plaintext path "plainPath" using EME with
@@ -139,7 +155,11 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 	// in the tar extract benchmark.
 	parentDir := Dir(plainPath)
 	if iv, cParentDir := be.DirIVCache.Lookup(parentDir); iv != nil {
-		cBaseName := be.encryptAndHashName(baseName, iv)
+		var cBaseName string
+		cBaseName, err = be.encryptAndHashName(baseName, iv, filepath.Join(rootDir, cParentDir))
+		if err != nil {
+			return "", err
+		}
 		return filepath.Join(cParentDir, cBaseName), nil
 	}
 	// We have to walk the directory tree, starting at the root directory.
@@ -157,7 +177,11 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 			}
 			be.DirIVCache.Store(plainWD, iv, cipherWD)
 		}
-		cipherName := be.encryptAndHashName(plainName, iv)
+		var cipherName string
+		cipherName, err = be.encryptAndHashName(plainName, iv, filepath.Join(rootDir, cipherWD))
+		if err != nil {
+			return "", err
+		}
 		cipherWD = filepath.Join(cipherWD, cipherName)
 		plainWD = filepath.Join(plainWD, plainName)
 	}
@@ -37,6 +37,11 @@ type DirIVCache struct {
 	// getattr cache.
 	expiry time.Time
 
+	// RootOnly limits the cache to the root directory. Set in
+	// "-sharedstorage" mode, where other gocryptfs instances may delete and
+	// re-create directories at any time.
+	RootOnly bool
+
 	sync.RWMutex
 }
 
@@ -71,6 +76,9 @@ func (c *DirIVCache) Store(dir string, iv []byte, cDir string) {
 	if dir == "" {
 		c.rootDirIV = iv
 	}
+	if c.RootOnly {
+		return
+	}
 	// Sanity check: plaintext and chiphertext paths must have the same number
 	// of segments
 	if strings.Count(dir, "/") != strings.Count(cDir, "/") {
@@ -92,6 +100,20 @@ func (c *DirIVCache) Store(dir string, iv []byte, cDir string) {
 	c.data[dir] = cacheEntry{iv, cDir}
 }
 
+// ClearDir removes the entries for "dir" (relative plaintext path) and all
+// directories below it. Called from fusefrontend when a directory is deleted.
+// This is cheaper than Clear() when many directories are deleted in a row,
+// like in "rm -rf", because the entries for the parents survive.
+func (c *DirIVCache) ClearDir(dir string) {
+	c.Lock()
+	defer c.Unlock()
+	for k := range c.data {
+		if k == dir || strings.HasPrefix(k, dir+"/") {
+			delete(c.data, k)
+		}
+	}
+}
+
 // Clear ... clear the cache.
 // Called from fusefrontend when directories are renamed or deleted.
 func (c *DirIVCache) Clear() {
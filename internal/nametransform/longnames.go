@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -20,11 +21,28 @@ const (
 	// gocryptfs.longname.[sha256].name  <--- File name, suffix = .name
 	LongNameSuffix = ".name"
 	longNamePrefix = "gocryptfs.longname."
+	// longNameSaltSep separates the encrypted name from the collision salt
+	// in a ".name" file. ":" is not part of the base64url alphabet, so it
+	// can never appear in an encrypted name.
+	longNameSaltSep = ":"
+	// LongNameMaxRetries is the maximum number of salts that are tried
+	// when resolving a longname hash collision.
+	LongNameMaxRetries = 99
 )
 
 // HashLongName - take the hash of a long string "name" and return
 // "gocryptfs.longname.[sha256]"
 func (n *NameTransform) HashLongName(name string) string {
+	return n.HashLongNameSalt(name, 0)
+}
+
+// HashLongNameSalt is like HashLongName, but mixes "salt" into the hash.
+// Salt 0 gives the same result as HashLongName. Non-zero salts are only
+// used to resolve hash collisions, see findLongName().
+func (n *NameTransform) HashLongNameSalt(name string, salt int) string {
+	if salt != 0 {
+		name = name + longNameSaltSep + strconv.Itoa(salt)
+	}
 	hashBin := sha256.Sum256([]byte(name))
 	hashBase64 := n.B64.EncodeToString(hashBin[:])
 	return longNamePrefix + hashBase64
@@ -63,34 +81,91 @@ func IsLongContent(cName string) bool {
 	return NameType(cName) == LongNameContent
 }
 
-// ReadLongName - read "$path.name"
+// ReadLongName - read "$path.name" and return the encrypted name stored in
+// it. A collision salt, if present, is stripped.
 func ReadLongName(path string) (string, error) {
-	path += LongNameSuffix
-	fd, err := os.Open(path)
+	cName, _, err := ReadLongNameSalt(path)
+	return cName, err
+}
+
+// ReadLongNameSalt - read "$path.name" and return the encrypted name and the
+// collision salt stored in it. The salt is zero for all files that were
+// created without a hash collision.
+func ReadLongNameSalt(path string) (cName string, salt int, err error) {
+	fd, err := os.Open(MetaPath(filepath.Dir(path), filepath.Base(path)+LongNameSuffix))
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer fd.Close()
 	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA=="
-	lim := 344
+	// plus up to 3 bytes for the collision salt (":99").
+	lim := 344 + 3
 	// Allocate a bigger buffer so we see whether the file is too big
 	buf := make([]byte, lim+1)
 	n, err := fd.ReadAt(buf, 0)
 	if err != nil && err != io.EOF {
-		return "", err
+		return "", 0, err
 	}
 	if n == 0 {
-		return "", fmt.Errorf("ReadLongName: empty file")
+		return "", 0, fmt.Errorf("ReadLongName: empty file")
 	}
 	if n > lim {
-		return "", fmt.Errorf("ReadLongName: size=%d > limit=%d", n, lim)
+		return "", 0, fmt.Errorf("ReadLongName: size=%d > limit=%d", n, lim)
+	}
+	return ParseLongName(string(buf[0:n]))
+}
+
+// ParseLongName splits the content of a ".name" file into the encrypted name
+// and the collision salt.
+func ParseLongName(content string) (cName string, salt int, err error) {
+	i := strings.LastIndex(content, longNameSaltSep)
+	if i < 0 {
+		return content, 0, nil
+	}
+	salt, err = strconv.Atoi(content[i+1:])
+	if err != nil || salt <= 0 || salt > LongNameMaxRetries {
+		return "", 0, fmt.Errorf("ReadLongName: invalid salt %q", content[i+1:])
 	}
-	return string(buf[0:n]), nil
+	return content[:i], salt, nil
+}
+
+// findLongName returns the hashed name for the encrypted name "cName" in the
+// ciphertext directory "dir" (absolute path), taking hash collisions into
+// account.
+// If one of the candidate hashes HashLongNameSalt(cName, 0...LongNameRetries)
+// has a ".name" file that contains "cName", this hash is returned. Otherwise,
+// the first candidate that is not in use yet is returned.
+func (n *NameTransform) findLongName(dir string, cName string) (string, error) {
+	free := ""
+	for salt := 0; salt <= n.LongNameRetries; salt++ {
+		hashName := n.HashLongNameSalt(cName, salt)
+		have, _, err := ReadLongNameSalt(filepath.Join(dir, hashName))
+		if os.IsNotExist(err) {
+			// Deleting a file can leave a gap in the chain, so keep looking
+			// for a matching entry.
+			if free == "" {
+				free = hashName
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if have == cName {
+			return hashName, nil
+		}
+		tlog.Warn.Printf("findLongName: hash collision on %q (salt %d), trying next salt", hashName, salt)
+	}
+	if free == "" {
+		tlog.Warn.Printf("findLongName: all %d salts are in use, giving up", n.LongNameRetries+1)
+		return "", syscall.EEXIST
+	}
+	return free, nil
 }
 
 // DeleteLongName deletes "hashName.name".
 func DeleteLongName(dirfd *os.File, hashName string) error {
-	err := syscallcompat.Unlinkat(int(dirfd.Fd()), hashName+LongNameSuffix, 0)
+	err := syscallcompat.Unlinkat(int(dirfd.Fd()), metaNameAt(dirfd, hashName+LongNameSuffix), 0)
 	if err != nil {
 		tlog.Warn.Printf("DeleteLongName: %v", err)
 	}
@@ -100,6 +175,12 @@ func DeleteLongName(dirfd *os.File, hashName string) error {
 // WriteLongName encrypts plainName and writes it into "hashName.name".
 // For the convenience of the caller, plainName may also be a path and will be
 // converted internally.
+// If "hashName" was generated with a collision salt, the salt is recorded
+// in the ".name" file as well.
+//
+// If "hashName.name" already exists and contains the same name, EEXIST is
+// returned. If it contains a different name, we have hit a hash collision (or
+// a corrupt ".name" file) and EIO is returned.
 func (n *NameTransform) WriteLongName(dirfd *os.File, hashName string, plainName string) (err error) {
 	plainName = filepath.Base(plainName)
 
@@ -109,23 +190,64 @@ func (n *NameTransform) WriteLongName(dirfd *os.File, hashName string, plainName
 		return err
 	}
 	cName := n.EncryptName(plainName, dirIV)
+	content := cName
+	salt := n.longNameSalt(cName, hashName)
+	if salt > 0 {
+		content += longNameSaltSep + strconv.Itoa(salt)
+	}
 
 	// Write the encrypted name into hashName.name
-	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), hashName+LongNameSuffix,
+	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), metaNameAt(dirfd, hashName+LongNameSuffix),
 		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
 	if err != nil {
 		// Don't warn if the file already exists - this is allowed for renames
 		// and should be handled by the caller.
 		if err != syscall.EEXIST {
 			tlog.Warn.Printf("WriteLongName: Openat: %v", err)
+			return err
 		}
-		return err
+		return checkLongNameCollision(dirfd, hashName, cName)
 	}
 	fd := os.NewFile(uintptr(fdRaw), hashName+LongNameSuffix)
 	defer fd.Close()
-	_, err = fd.Write([]byte(cName))
+	_, err = fd.Write([]byte(content))
 	if err != nil {
 		tlog.Warn.Printf("WriteLongName: Write: %v", err)
 	}
 	return err
 }
+
+// longNameSalt returns the collision salt that was used to generate
+// "hashName" from "cName". Returns 0 if no salt (or an unknown salt)
+// was used.
+func (n *NameTransform) longNameSalt(cName string, hashName string) int {
+	for salt := 1; salt <= n.LongNameRetries; salt++ {
+		if n.HashLongNameSalt(cName, salt) == hashName {
+			return salt
+		}
+	}
+	return 0
+}
+
+// checkLongNameCollision is called when "hashName.name" already exists.
+// Returns EEXIST if it stores "cName", EIO otherwise.
+func checkLongNameCollision(dirfd *os.File, hashName string, cName string) error {
+	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), metaNameAt(dirfd, hashName+LongNameSuffix),
+		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	fd := os.NewFile(uintptr(fdRaw), hashName+LongNameSuffix)
+	defer fd.Close()
+	buf := make([]byte, len(cName)+len(longNameSaltSep)+3)
+	n, err := fd.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	have, _, err := ParseLongName(string(buf[:n]))
+	if err != nil || have != cName {
+		tlog.Warn.Printf("WriteLongName: %q: hash collision or corrupt .name file", hashName)
+		return syscall.EIO
+	}
+	return syscall.EEXIST
+}
@@ -1,6 +1,9 @@
 package nametransform
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -20,3 +23,72 @@ func TestIsLongName(t *testing.T) {
 		t.Errorf("False positive")
 	}
 }
+
+func TestParseLongName(t *testing.T) {
+	cName, salt, err := ParseLongName("LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU=")
+	if err != nil || salt != 0 || cName != "LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU=" {
+		t.Errorf("unsalted: cName=%q salt=%d err=%v", cName, salt, err)
+	}
+	cName, salt, err = ParseLongName("LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU=:3")
+	if err != nil || salt != 3 || cName != "LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU=" {
+		t.Errorf("salted: cName=%q salt=%d err=%v", cName, salt, err)
+	}
+	for _, in := range []string{"foo:", "foo:0", "foo:-1", "foo:x", "foo:100"} {
+		_, _, err = ParseLongName(in)
+		if err == nil {
+			t.Errorf("%q should have been rejected", in)
+		}
+	}
+}
+
+func TestHashLongNameSalt(t *testing.T) {
+	n := New(nil, true, true)
+	name := "LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU="
+	if n.HashLongNameSalt(name, 0) != n.HashLongName(name) {
+		t.Error("salt 0 must be identical to HashLongName")
+	}
+	if n.HashLongNameSalt(name, 1) == n.HashLongName(name) {
+		t.Error("salt 1 must give a different hash")
+	}
+	n.LongNameRetries = 2
+	if s := n.longNameSalt(name, n.HashLongNameSalt(name, 2)); s != 2 {
+		t.Errorf("wrong salt: %d", s)
+	}
+}
+
+func TestFindLongName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFindLongName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := New(nil, true, true)
+	n.LongNameRetries = 2
+	cName := "LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU="
+	h0 := n.HashLongNameSalt(cName, 0)
+	h1 := n.HashLongNameSalt(cName, 1)
+	// Nothing exists yet, the unsalted hash should be used
+	h, err := n.findLongName(dir, cName)
+	if err != nil || h != h0 {
+		t.Fatalf("empty dir: h=%q err=%v", h, err)
+	}
+	// Simulate a collision: h0 is taken by another name
+	err = ioutil.WriteFile(filepath.Join(dir, h0+LongNameSuffix), []byte("otherName"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = n.findLongName(dir, cName)
+	if err != nil || h != h1 {
+		t.Fatalf("collision: h=%q err=%v", h, err)
+	}
+	// Once h1 has been created, it must be found again
+	err = ioutil.WriteFile(filepath.Join(dir, h1+LongNameSuffix), []byte(cName+":1"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, h0+LongNameSuffix))
+	h, err = n.findLongName(dir, cName)
+	if err != nil || h != h1 {
+		t.Fatalf("gap: h=%q err=%v", h, err)
+	}
+}
@@ -0,0 +1,110 @@
+package nametransform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// With "-metadata_dir", gocryptfs.diriv and the long name ".name" files are
+// not stored next to the file contents in CIPHERDIR, but in a separate
+// directory tree that mirrors the ciphertext directory structure:
+//
+//	CIPHERDIR/a/b/gocryptfs.longname.XYZ   <--- file content
+//	METADIR/a/b/gocryptfs.diriv
+//	METADIR/a/b/gocryptfs.longname.XYZ.name
+//
+// This allows putting the small, frequently-read files on fast local storage
+// when CIPHERDIR is on a slow network filesystem.
+var (
+	// cipherRoot is the CIPHERDIR the metadata belongs to (absolute path)
+	cipherRoot string
+	// metaRoot is the metadata directory (absolute path), or "" if the
+	// metadata is stored in CIPHERDIR.
+	metaRoot string
+)
+
+// SetMetadataDir makes all functions in this package store the metadata of
+// "cipherdir" below "metadir". Both must be absolute paths. Passing an empty
+// "metadir" restores the default of storing the metadata in CIPHERDIR.
+func SetMetadataDir(cipherdir string, metadir string) {
+	cipherRoot = filepath.Clean(cipherdir)
+	metaRoot = ""
+	if metadir != "" {
+		metaRoot = filepath.Clean(metadir)
+	}
+}
+
+// HaveMetadataDir returns true if a separate metadata directory is in use.
+func HaveMetadataDir() bool {
+	return metaRoot != ""
+}
+
+// MetaPath returns the path of the metadata file "name" (gocryptfs.diriv or
+// a ".name" file) that belongs to the ciphertext directory "dir" (absolute
+// path). Without a metadata directory, this is just "dir/name".
+// Passing an empty "name" returns the metadata directory of "dir".
+func MetaPath(dir string, name string) string {
+	if metaRoot == "" {
+		return filepath.Join(dir, name)
+	}
+	rel, err := filepath.Rel(cipherRoot, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		tlog.Warn.Printf("MetaPath: %q is outside of %q", dir, cipherRoot)
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join(metaRoot, rel, name)
+}
+
+// metaNameAt returns the name that has to be passed to the *at() syscalls,
+// together with "dirfd", to access the metadata file "name" of the directory
+// opened as "dirfd". With a metadata directory, this is an absolute path,
+// which makes the syscalls ignore "dirfd".
+func metaNameAt(dirfd *os.File, name string) string {
+	if metaRoot == "" {
+		return name
+	}
+	return MetaPath(dirfd.Name(), name)
+}
+
+// RenameMetaDir moves the metadata of the ciphertext directory "oldDir" to
+// "newDir" after the directory itself has been renamed. The metadata of an
+// (empty) directory that was overwritten by the rename is deleted.
+// Does nothing if there is no metadata directory or "newDir" is not a
+// directory.
+func RenameMetaDir(oldDir string, newDir string) error {
+	if metaRoot == "" {
+		return nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(newDir, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil
+	}
+	newMeta := MetaPath(newDir, "")
+	if err := os.RemoveAll(newMeta); err != nil {
+		tlog.Warn.Printf("RenameMetaDir: %v", err)
+		return err
+	}
+	err := os.Rename(MetaPath(oldDir, ""), newMeta)
+	if err != nil {
+		tlog.Warn.Printf("RenameMetaDir: %v", err)
+	}
+	return err
+}
+
+// RemoveMetaDir deletes the metadata of the ciphertext directory "dir"
+// after the directory itself has been deleted.
+// Does nothing if there is no metadata directory.
+func RemoveMetaDir(dir string) error {
+	if metaRoot == "" {
+		return nil
+	}
+	err := os.RemoveAll(MetaPath(dir, ""))
+	if err != nil {
+		tlog.Warn.Printf("RemoveMetaDir: %v", err)
+	}
+	return err
+}
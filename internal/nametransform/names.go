@@ -21,6 +21,10 @@ type NameTransform struct {
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depeding
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// LongNameRetries is the number of alternative (salted) hashes that are
+	// tried when a longname hash collides with an existing file. Zero
+	// disables collision handling, "-longnameretries".
+	LongNameRetries int
 }
 
 // New returns a new NameTransform instance.
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 // QIno = Qualified Inode number.
@@ -57,11 +58,13 @@ type table struct {
 
 // Entry is an entry in the open file table
 type Entry struct {
-	// Reference count
-	refCount int
 	// ContentLock guards the file content from concurrent writes. Every writer
 	// must take this lock before modifying the file content.
+	// It must be the first element of the struct to guarantee 64-bit
+	// alignment of its counter.
 	ContentLock countingMutex
+	// Reference count
+	refCount int
 	// HeaderLock guards the file ID (in this struct) and the file header (on
 	// disk). Take HeaderLock.RLock() to make sure the file ID does not change
 	// behind your back. If you modify the file ID, you must take
@@ -69,6 +72,22 @@ type Entry struct {
 	HeaderLock sync.RWMutex
 	// ID is the file ID in the file header.
 	ID []byte
+	// Stamp is the mtime and size of the backing file after our own last
+	// modification. Guarded by ContentLock.
+	Stamp Stamp
+	// Conflicts counts how often the backing file has been found modified
+	// behind our back. Guarded by ContentLock.
+	Conflicts uint64
+	// LeaseExpiry is when our write lease on the backing file ends
+	// ("-sharedstorage"). Zero if we hold no lease. Guarded by ContentLock.
+	LeaseExpiry time.Time
+}
+
+// Stamp identifies the state of a backing file by its mtime and size.
+type Stamp struct {
+	Mtime     uint64
+	Mtimensec uint32
+	Size      uint64
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
@@ -99,14 +118,39 @@ func Unregister(qi QIno) {
 	}
 }
 
-// countingMutex incrementes t.writeLockCount on each Lock() call.
+// IsOpen returns true if "qi" has an entry in the open file table
+func IsOpen(qi QIno) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[qi] != nil
+}
+
+// countingMutex incrementes t.writeLockCount and its own counter on each
+// Lock() call.
 type countingMutex struct {
+	// count is accessed using atomic operations and must be the first
+	// element of the struct to guarantee 64-bit alignment.
+	count uint64
 	sync.Mutex
 }
 
 func (c *countingMutex) Lock() {
 	c.Mutex.Lock()
 	atomic.AddUint64(&t.writeOpCount, 1)
+	atomic.AddUint64(&c.count, 1)
+}
+
+// Invalidate increments the counters like Lock() does, but without taking the
+// lock. State that was cached under the old count becomes stale.
+func (c *countingMutex) Invalidate() {
+	atomic.AddUint64(&t.writeOpCount, 1)
+	atomic.AddUint64(&c.count, 1)
+}
+
+// Count returns how often Lock() has been called on this mutex. Unlike
+// WriteOpCount(), it is not affected by writes to other files.
+func (c *countingMutex) Count() uint64 {
+	return atomic.LoadUint64(&c.count)
 }
 
 // WriteOpCount returns the write lock counter value. This value is encremented
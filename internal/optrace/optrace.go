@@ -0,0 +1,138 @@
+// Package optrace records the FUSE operations of a gocryptfs mount
+// ("-record_trace") and replays them against a directory
+// (gocryptfs-replay), so that performance problems can be reproduced
+// without sharing any file names or file contents.
+package optrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is one FUSE operation. A trace file contains one JSON-encoded
+// Record per line.
+type Record struct {
+	// T is the start time of the operation in nanoseconds since the start
+	// of the trace
+	T int64
+	// Op is the operation name, like "Open" or "Write"
+	Op string
+	// Path is the anonymized path relative to the root of the mount
+	Path string `json:",omitempty"`
+	// Path2 is the second path for Rename, Link and Symlink (anonymized)
+	Path2 string `json:",omitempty"`
+	// Fh identifies the file handle for operations on open files
+	Fh uint64 `json:",omitempty"`
+	// Off is the offset for Read, Write and Allocate
+	Off int64 `json:",omitempty"`
+	// Len is the length for Read, Write, Allocate and the size for
+	// Truncate
+	Len int64 `json:",omitempty"`
+	// Flags are the open flags or the fallocate mode
+	Flags uint32 `json:",omitempty"`
+	// Mode is the file mode for Create, Mkdir, Chmod and Access
+	Mode uint32 `json:",omitempty"`
+	// Dur is how long the operation took in nanoseconds
+	Dur int64
+	// Status is the resulting errno, 0 on success
+	Status int32 `json:",omitempty"`
+}
+
+// flushInterval is how often buffered records are written out at most
+const flushInterval = time.Second
+
+// Recorder writes Records to a trace file. It is safe for concurrent use.
+type Recorder struct {
+	lock      sync.Mutex
+	w         io.WriteCloser
+	buf       *bufio.Writer
+	enc       *json.Encoder
+	start     time.Time
+	lastFlush time.Time
+	// names maps plaintext file names to anonymous ones
+	names map[string]string
+	// lastFh is the last file handle number that was handed out
+	lastFh uint64
+}
+
+// NewRecorder creates a Recorder that writes to "w". Call Close when done.
+func NewRecorder(w io.WriteCloser) *Recorder {
+	buf := bufio.NewWriter(w)
+	now := time.Now()
+	return &Recorder{
+		w:         w,
+		buf:       buf,
+		enc:       json.NewEncoder(buf),
+		start:     now,
+		lastFlush: now,
+		names:     make(map[string]string),
+	}
+}
+
+// anonymize replaces every component of "path" by a name that only
+// depends on the original name. The same name always gets the same
+// replacement, so the directory structure is preserved.
+// The caller must hold r.lock.
+func (r *Recorder) anonymize(path string) string {
+	if path == "" {
+		return ""
+	}
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		// Keep the structure of symlink targets like "/a/b" or "../c"
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		a, ok := r.names[p]
+		if !ok {
+			a = "n" + strconv.Itoa(len(r.names)+1)
+			r.names[p] = a
+		}
+		parts[i] = a
+	}
+	return strings.Join(parts, "/")
+}
+
+// newFh returns a fresh file handle number
+func (r *Recorder) newFh() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastFh++
+	return r.lastFh
+}
+
+// record writes "rec" for an operation that started at "start". Path and
+// Path2 are anonymized here.
+func (r *Recorder) record(start time.Time, rec Record) {
+	now := time.Now()
+	rec.T = int64(start.Sub(r.start))
+	rec.Dur = int64(now.Sub(start))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rec.Path = r.anonymize(rec.Path)
+	rec.Path2 = r.anonymize(rec.Path2)
+	// Errors are ignored, we do not want to break the filesystem because
+	// the trace file cannot be written
+	r.enc.Encode(&rec)
+	if now.Sub(r.lastFlush) > flushInterval {
+		r.buf.Flush()
+		r.lastFlush = now
+	}
+}
+
+// Close flushes the buffered records and closes the trace file
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.buf.Flush()
+	err2 := r.w.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
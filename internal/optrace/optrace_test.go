@@ -0,0 +1,88 @@
+package optrace
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestRecordReplay(t *testing.T) {
+	src, err := ioutil.TempDir("", "TestRecordReplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	var trace bytes.Buffer
+	r := NewRecorder(nopCloser{&trace})
+	fs := r.Wrap(pathfs.NewLoopbackFileSystem(src))
+	if status := fs.Mkdir("secretdir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	f, status := fs.Create("secretdir/secretfile", uint32(os.O_RDWR), 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Write([]byte("secret content"), 0)
+	f.Write([]byte("more"), 1000)
+	f.Release()
+	fs.GetAttr("secretdir/missing", nil)
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(trace.String(), "secret") {
+		t.Fatalf("trace is not anonymized:\n%s", trace.String())
+	}
+	dst, err := ioutil.TempDir("", "TestRecordReplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	stats, err := Replay(&trace, dst, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["Write"] == nil || stats["Write"].N != 2 {
+		t.Errorf("wrong stats: %v", stats)
+	}
+	for op, s := range stats {
+		if s.Errors != 0 {
+			t.Errorf("%s: %d errors", op, s.Errors)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dst, "n1", "n2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 1004 {
+		t.Errorf("wrong size %d", fi.Size())
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	r := NewRecorder(nopCloser{&bytes.Buffer{}})
+	testcases := map[string]string{
+		"":            "",
+		"a":           "n1",
+		"a/b":         "n1/n2",
+		"b/a":         "n2/n1",
+		"/abs/../a":   "/n3/../n1",
+		"./b":         "./n2",
+		"c/b/a/b/c/d": "n4/n2/n1/n2/n4/n5",
+	}
+	for _, in := range []string{"", "a", "a/b", "b/a", "/abs/../a", "./b", "c/b/a/b/c/d"} {
+		if have := r.anonymize(in); have != testcases[in] {
+			t.Errorf("%q: want %q, have %q", in, testcases[in], have)
+		}
+	}
+}
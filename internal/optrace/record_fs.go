@@ -0,0 +1,187 @@
+package optrace
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/filewrap"
+)
+
+// Wrap returns a pathfs.FileSystem that records the operations on "fs"
+func (r *Recorder) Wrap(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &recordFS{FileSystem: fs, r: r}
+}
+
+type recordFS struct {
+	pathfs.FileSystem
+	r *Recorder
+}
+
+func (fs *recordFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	t := time.Now()
+	a, status := fs.FileSystem.GetAttr(name, context)
+	fs.r.record(t, Record{Op: "GetAttr", Path: name, Status: int32(status)})
+	return a, status
+}
+
+func (fs *recordFS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Chmod(name, mode, context)
+	fs.r.record(t, Record{Op: "Chmod", Path: name, Mode: mode, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Utimens(name, atime, mtime, context)
+	fs.r.record(t, Record{Op: "Utimens", Path: name, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Truncate(name, size, context)
+	fs.r.record(t, Record{Op: "Truncate", Path: name, Len: int64(size), Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Access(name, mode, context)
+	fs.r.record(t, Record{Op: "Access", Path: name, Mode: mode, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Link(oldName, newName, context)
+	fs.r.record(t, Record{Op: "Link", Path: oldName, Path2: newName, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Mkdir(name, mode, context)
+	fs.r.record(t, Record{Op: "Mkdir", Path: name, Mode: mode, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Rename(oldName, newName, context)
+	fs.r.record(t, Record{Op: "Rename", Path: oldName, Path2: newName, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Rmdir(name, context)
+	fs.r.record(t, Record{Op: "Rmdir", Path: name, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Unlink(name string, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Unlink(name, context)
+	fs.r.record(t, Record{Op: "Unlink", Path: name, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	t := time.Now()
+	f, status := fs.FileSystem.Open(name, flags, context)
+	f, fh := fs.track(f)
+	fs.r.record(t, Record{Op: "Open", Path: name, Fh: fh, Flags: flags, Status: int32(status)})
+	return f, status
+}
+
+func (fs *recordFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	t := time.Now()
+	f, status := fs.FileSystem.Create(name, flags, mode, context)
+	f, fh := fs.track(f)
+	fs.r.record(t, Record{Op: "Create", Path: name, Fh: fh, Flags: flags, Mode: mode, Status: int32(status)})
+	return f, status
+}
+
+func (fs *recordFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	t := time.Now()
+	entries, status := fs.FileSystem.OpenDir(name, context)
+	fs.r.record(t, Record{Op: "OpenDir", Path: name, Len: int64(len(entries)), Status: int32(status)})
+	return entries, status
+}
+
+func (fs *recordFS) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	t := time.Now()
+	status := fs.FileSystem.Symlink(value, linkName, context)
+	// The target is stored in Path2, anonymized like a path
+	fs.r.record(t, Record{Op: "Symlink", Path: linkName, Path2: value, Status: int32(status)})
+	return status
+}
+
+func (fs *recordFS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	t := time.Now()
+	target, status := fs.FileSystem.Readlink(name, context)
+	fs.r.record(t, Record{Op: "Readlink", Path: name, Status: int32(status)})
+	return target, status
+}
+
+// track wraps "f" in a recordFile with a new file handle number
+func (fs *recordFS) track(f nodefs.File) (nodefs.File, uint64) {
+	var fh uint64
+	f = filewrap.Wrap(f, func(f nodefs.File) nodefs.File {
+		fh = fs.r.newFh()
+		return &recordFile{File: f, r: fs.r, fh: fh}
+	})
+	return f, fh
+}
+
+// recordFile records the operations on an open file
+type recordFile struct {
+	nodefs.File
+	r  *Recorder
+	fh uint64
+}
+
+func (f *recordFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	t := time.Now()
+	res, status := f.File.Read(buf, off)
+	f.r.record(t, Record{Op: "Read", Fh: f.fh, Off: off, Len: int64(len(buf)), Status: int32(status)})
+	return res, status
+}
+
+func (f *recordFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	t := time.Now()
+	n, status := f.File.Write(data, off)
+	f.r.record(t, Record{Op: "Write", Fh: f.fh, Off: off, Len: int64(len(data)), Status: int32(status)})
+	return n, status
+}
+
+func (f *recordFile) Truncate(size uint64) fuse.Status {
+	t := time.Now()
+	status := f.File.Truncate(size)
+	f.r.record(t, Record{Op: "FTruncate", Fh: f.fh, Len: int64(size), Status: int32(status)})
+	return status
+}
+
+func (f *recordFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	t := time.Now()
+	status := f.File.Allocate(off, size, mode)
+	f.r.record(t, Record{Op: "Allocate", Fh: f.fh, Off: int64(off), Len: int64(size), Flags: mode, Status: int32(status)})
+	return status
+}
+
+func (f *recordFile) Fsync(flags int) fuse.Status {
+	t := time.Now()
+	status := f.File.Fsync(flags)
+	f.r.record(t, Record{Op: "Fsync", Fh: f.fh, Status: int32(status)})
+	return status
+}
+
+func (f *recordFile) Release() {
+	t := time.Now()
+	f.File.Release()
+	f.r.record(t, Record{Op: "Release", Fh: f.fh})
+}
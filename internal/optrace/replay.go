@@ -0,0 +1,179 @@
+package optrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// OpStats summarizes the replayed operations of one type
+type OpStats struct {
+	// N is the number of operations
+	N int
+	// Errors is the number of operations that failed during replay but
+	// succeeded when they were recorded
+	Errors int
+	// Dur is the total time the replayed operations took
+	Dur time.Duration
+	// RecordedDur is the total time the operations took when they were
+	// recorded
+	RecordedDur time.Duration
+}
+
+// replayer holds the state of a running replay
+type replayer struct {
+	dir   string
+	files map[uint64]*os.File
+	// data is written by "Write" operations. It is random so that the
+	// replay does not hit the all-zero block shortcuts.
+	data  []byte
+	stats map[string]*OpStats
+}
+
+// Replay executes the trace read from "r" against the directory "dir",
+// which is usually a gocryptfs mount. Operations are executed one after the
+// other, as fast as possible, unless "realtime" is set, in which case the
+// original timing is kept. Failing operations are counted but do not stop
+// the replay.
+func Replay(r io.Reader, dir string, realtime bool) (map[string]*OpStats, error) {
+	p := replayer{
+		dir:   dir,
+		files: make(map[uint64]*os.File),
+		data:  make([]byte, 128*1024),
+		stats: make(map[string]*OpStats),
+	}
+	rand.Read(p.data)
+	defer func() {
+		for _, f := range p.files {
+			f.Close()
+		}
+	}()
+	s := bufio.NewScanner(r)
+	start := time.Now()
+	for line := 1; s.Scan(); line++ {
+		var rec Record
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return p.stats, fmt.Errorf("line %d: %v", line, err)
+		}
+		if realtime {
+			if d := time.Duration(rec.T) - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		t := time.Now()
+		err := p.do(&rec)
+		dur := time.Since(t)
+		st := p.stats[rec.Op]
+		if st == nil {
+			st = &OpStats{}
+			p.stats[rec.Op] = st
+		}
+		st.N++
+		st.Dur += dur
+		st.RecordedDur += time.Duration(rec.Dur)
+		if err != nil && rec.Status == 0 {
+			st.Errors++
+		}
+	}
+	return p.stats, s.Err()
+}
+
+// do executes a single operation
+func (p *replayer) do(rec *Record) error {
+	path := filepath.Join(p.dir, rec.Path)
+	path2 := filepath.Join(p.dir, rec.Path2)
+	f := p.files[rec.Fh]
+	if rec.Fh != 0 && f == nil && rec.Op != "Open" && rec.Op != "Create" {
+		return syscall.EBADF
+	}
+	switch rec.Op {
+	case "GetAttr":
+		_, err := os.Lstat(path)
+		return err
+	case "Chmod":
+		return os.Chmod(path, os.FileMode(rec.Mode&07777))
+	case "Utimens":
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	case "Truncate":
+		return os.Truncate(path, rec.Len)
+	case "Access":
+		return syscall.Access(path, rec.Mode)
+	case "Link":
+		return os.Link(path, path2)
+	case "Mkdir":
+		return os.Mkdir(path, os.FileMode(rec.Mode&07777))
+	case "Rename":
+		return os.Rename(path, path2)
+	case "Rmdir":
+		return syscall.Rmdir(path)
+	case "Unlink":
+		return syscall.Unlink(path)
+	case "Open", "Create":
+		flags := int(rec.Flags)
+		if rec.Op == "Create" {
+			flags |= os.O_CREATE
+		}
+		nf, err := os.OpenFile(path, flags, os.FileMode(rec.Mode&07777))
+		if err != nil {
+			return err
+		}
+		if rec.Fh == 0 {
+			// Failed when it was recorded, nobody will use it
+			return nf.Close()
+		}
+		p.files[rec.Fh] = nf
+		return nil
+	case "OpenDir":
+		d, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		_, err = d.Readdirnames(-1)
+		return err
+	case "Symlink":
+		// Path2 holds the target
+		return os.Symlink(rec.Path2, path)
+	case "Readlink":
+		_, err := os.Readlink(path)
+		return err
+	case "Read":
+		buf := make([]byte, rec.Len)
+		_, err := f.ReadAt(buf, rec.Off)
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	case "Write":
+		for n := int64(0); n < rec.Len; {
+			chunk := rec.Len - n
+			if chunk > int64(len(p.data)) {
+				chunk = int64(len(p.data))
+			}
+			if _, err := f.WriteAt(p.data[:chunk], rec.Off+n); err != nil {
+				return err
+			}
+			n += chunk
+		}
+		return nil
+	case "FTruncate":
+		return f.Truncate(rec.Len)
+	case "Allocate":
+		return syscallcompat.Fallocate(int(f.Fd()), rec.Flags, rec.Off, rec.Len)
+	case "Fsync":
+		return f.Sync()
+	case "Release":
+		delete(p.files, rec.Fh)
+		return f.Close()
+	}
+	return fmt.Errorf("unknown operation %q", rec.Op)
+}
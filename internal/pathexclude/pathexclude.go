@@ -0,0 +1,169 @@
+// Package pathexclude matches relative paths against a list of exclusion
+// rules in gitignore(5) syntax, as used by "-exclude-from".
+package pathexclude
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// rule is one parsed line
+type rule struct {
+	// segments is the pattern split at "/". A "**" segment matches any
+	// number of path components.
+	segments []string
+	// negate is set for "!pattern" rules, which re-include paths
+	negate bool
+	// dirOnly is set for "pattern/" rules, which only match directories
+	dirOnly bool
+}
+
+// Matcher holds the rules. A nil Matcher excludes nothing.
+type Matcher struct {
+	rules []rule
+}
+
+// LoadFile reads the rules from "filename"
+func LoadFile(filename string) (*Matcher, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	m, err := New(lines)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", filename, err)
+	}
+	return m, nil
+}
+
+// New parses "lines" in gitignore syntax. Blank lines and lines starting
+// with "#" are ignored. "!" negates the pattern: matching paths are included
+// again. A trailing "/" makes the pattern match only directories. A pattern
+// that contains a "/" anywhere but at the end is anchored at the root,
+// otherwise it matches the name at any depth. "*", "?" and "[...]" work like
+// in path.Match, and "**" matches any number of directories. A backslash
+// escapes a leading "#" or "!", and trailing spaces.
+func New(lines []string) (*Matcher, error) {
+	m := &Matcher{}
+	for i, l := range lines {
+		r, ok, err := parseLine(l)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %q: %v", i+1, l, err)
+		}
+		if !ok {
+			continue
+		}
+		m.rules = append(m.rules, r)
+	}
+	return m, nil
+}
+
+// parseLine parses one line. Returns ok=false for blank lines and comments.
+func parseLine(l string) (r rule, ok bool, err error) {
+	// Trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(l, " ") && !strings.HasSuffix(l, "\\ ") {
+		l = l[:len(l)-1]
+	}
+	if l == "" || l[0] == '#' {
+		return r, false, nil
+	}
+	if l[0] == '!' {
+		r.negate = true
+		l = l[1:]
+	} else if strings.HasPrefix(l, "\\#") || strings.HasPrefix(l, "\\!") {
+		l = l[1:]
+	}
+	if strings.HasSuffix(l, "/") {
+		r.dirOnly = true
+		l = strings.TrimRight(l, "/")
+	}
+	if l == "" {
+		return r, false, fmt.Errorf("empty pattern")
+	}
+	anchored := strings.Contains(l, "/")
+	l = strings.TrimLeft(l, "/")
+	r.segments = strings.Split(l, "/")
+	if !anchored {
+		r.segments = append([]string{"**"}, r.segments...)
+	}
+	for _, s := range r.segments {
+		if s == "**" {
+			continue
+		}
+		if _, err = path.Match(s, ""); err != nil {
+			return r, false, err
+		}
+	}
+	return r, true, nil
+}
+
+// Excluded returns true if "relPath" is excluded. "isDir" tells if
+// "relPath" is a directory. Like in git, a path inside an excluded directory
+// is excluded even if a later rule would include it again.
+func (m *Matcher) Excluded(relPath string, isDir bool) bool {
+	if m == nil || len(m.rules) == 0 || relPath == "" {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	// All ancestors are directories
+	for i := 1; i < len(parts); i++ {
+		if m.match(parts[:i], true) {
+			return true
+		}
+	}
+	return m.match(parts, isDir)
+}
+
+// match returns the result of the last rule that matches "parts"
+func (m *Matcher) match(parts []string, isDir bool) bool {
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		r := &m.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(r.segments, parts) {
+			return !r.negate
+		}
+	}
+	return false
+}
+
+// matchSegments matches the path components "parts" against the pattern
+// segments "pattern"
+func matchSegments(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		// A trailing "**" matches everything inside, but not the directory
+		// itself
+		if len(pattern) == 1 {
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], parts[1:])
+}
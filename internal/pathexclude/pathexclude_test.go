@@ -0,0 +1,100 @@
+package pathexclude
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	m, err := New([]string{
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"/build",
+		"cache/",
+		"doc/*.tmp",
+		"a/**/z",
+		"secret/**",
+		"!secret/public",
+		"\\#hash",
+		"trailing\\ ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"x.log", false, true},
+		{"sub/x.log", false, true},
+		{"keep.log", false, false},
+		{"sub/keep.log", false, false},
+		{"build", true, true},
+		{"build/out", false, true},
+		{"sub/build", true, false},
+		{"cache", true, true},
+		{"sub/cache", true, true},
+		{"sub/cache/file", false, true},
+		{"cache", false, false},
+		{"doc/x.tmp", false, true},
+		{"doc/sub/x.tmp", false, false},
+		{"sub/doc/x.tmp", false, false},
+		{"a/z", false, true},
+		{"a/b/c/z", false, true},
+		{"b/a/z", false, false},
+		{"secret", true, false},
+		{"secret/key", false, true},
+		// Cannot re-include a file if its parent directory is excluded
+		{"cache/keep.log", false, true},
+		{"secret/public", false, false},
+		{"#hash", false, true},
+		{"trailing ", false, true},
+		{"trailing", false, false},
+		{"", true, false},
+		{"comment", false, false},
+	}
+	for _, tc := range testCases {
+		if have := m.Excluded(tc.path, tc.isDir); have != tc.excluded {
+			t.Errorf("%q isDir=%v: have %v, want %v", tc.path, tc.isDir, have, tc.excluded)
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+	var m *Matcher
+	if m.Excluded("foo", false) {
+		t.Error("nil Matcher excluded something")
+	}
+}
+
+func TestBadPattern(t *testing.T) {
+	for _, l := range []string{"[", "foo/[a", "/"} {
+		if _, err := New([]string{l}); err == nil {
+			t.Errorf("%q should have been rejected", l)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestLoadFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("*.bak\n!important.bak\n")
+	f.Close()
+	m, err := LoadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Excluded("x.bak", false) || m.Excluded("important.bak", false) {
+		t.Error("wrong result")
+	}
+	if _, err = LoadFile("/nonexisting/exclude"); err == nil {
+		t.Error("missing file was accepted")
+	}
+}
@@ -3,6 +3,7 @@ package pathiv
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 )
@@ -20,6 +21,9 @@ const (
 	PurposeSymlinkIV Purpose = "SYMLINKIV"
 	// PurposeBlock0IV means the value will be used as the IV of ciphertext block #0.
 	PurposeBlock0IV Purpose = "BLOCK0IV"
+	// PurposeXattrIV means the value will be used as the IV for xattr value
+	// encryption. The xattr name is appended to the path.
+	PurposeXattrIV Purpose = "XATTRIV"
 )
 
 // Derive derives an IV from an encrypted path by hashing it with sha256
@@ -44,6 +48,20 @@ func DeriveFile(path string) (fileIVs FileIVs) {
 	return fileIVs
 }
 
+// DeriveFileInode derives the IVs of a file with more than one hard link from
+// its inode number "ino", so that they do not depend on the path that is
+// used to access the file. "dev" is mixed in if it is not zero, for files
+// that are not on the same filesystem as the root directory.
+// A path cannot contain null bytes, so the values never collide with the
+// ones returned by DeriveFile.
+func DeriveFileInode(dev uint64, ino uint64) FileIVs {
+	key := fmt.Sprintf("\000ino\000%d", ino)
+	if dev != 0 {
+		key = fmt.Sprintf("\000dev\000%d%s", dev, key)
+	}
+	return DeriveFile(key)
+}
+
 // BlockIV returns the block IV for block number "blockNo". "block0iv" is the block
 // IV of block #0.
 func BlockIV(block0iv []byte, blockNo uint64) []byte {
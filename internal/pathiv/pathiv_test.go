@@ -26,3 +26,21 @@ func TestBlockIV(t *testing.T) {
 		t.Errorf("\nhave=%s\nwant=%s", hex.EncodeToString(b28), hex.EncodeToString(expected))
 	}
 }
+
+// TestDeriveFileInode checks that the IVs of hard-linked files only depend
+// on the inode and device numbers
+func TestDeriveFileInode(t *testing.T) {
+	a := DeriveFileInode(0, 1234)
+	if b := DeriveFileInode(0, 1234); !bytes.Equal(a.ID, b.ID) || !bytes.Equal(a.Block0IV, b.Block0IV) {
+		t.Error("not deterministic")
+	}
+	if b := DeriveFileInode(0, 1235); bytes.Equal(a.ID, b.ID) {
+		t.Error("same file ID for different inodes")
+	}
+	if b := DeriveFileInode(7, 1234); bytes.Equal(a.ID, b.ID) {
+		t.Error("same file ID on different devices")
+	}
+	if b := DeriveFile("1234"); bytes.Equal(a.ID, b.ID) {
+		t.Error("collides with a path")
+	}
+}
@@ -0,0 +1,280 @@
+// Package progress reports how far long-running command line operations,
+// like "-fsck", have come. It prints to stderr, either as text for humans or,
+// with "-progress_json", as one JSON object per line for scripts. On a
+// terminal, the text is a progress bar that is redrawn in place.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Mode selects the output format
+type Mode int
+
+const (
+	// Off disables the output ("-quiet")
+	Off Mode = iota
+	// Text prints lines for humans, or a progress bar on a terminal
+	Text
+	// JSON prints one Status object per line ("-progress_json")
+	JSON
+)
+
+// Interval is how often a line is printed in Text mode when stderr is not a
+// terminal
+var Interval = 10 * time.Second
+
+// RedrawInterval is how often the progress bar is redrawn, and how often
+// a JSON line is printed
+var RedrawInterval = time.Second
+
+// barWidth is the number of characters between the brackets of the
+// progress bar
+const barWidth = 20
+
+// Counter counts the work of one phase of an operation. Add can be called
+// from several goroutines. The totals are set before the phase starts and
+// are zero if they are not known.
+// The counters are updated atomically, which needs 64-bit alignment on
+// 32-bit platforms. Allocate a Counter on its own, not inside a struct.
+type Counter struct {
+	items, bytes           uint64
+	ItemsTotal, BytesTotal uint64
+}
+
+// Add records that "items" items with "bytes" bytes have been processed
+func (c *Counter) Add(items uint64, bytes uint64) {
+	atomic.AddUint64(&c.items, items)
+	atomic.AddUint64(&c.bytes, bytes)
+}
+
+// Writer returns a writer that passes everything to "w" and counts the bytes
+func (c *Counter) Writer(w io.Writer) io.Writer {
+	return &countingWriter{w: w, c: c}
+}
+
+type countingWriter struct {
+	w io.Writer
+	c *Counter
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.c.Add(0, uint64(n))
+	return n, err
+}
+
+// Status is a snapshot of a Counter. It is also what JSON mode prints.
+type Status struct {
+	Op    string `json:"op"`
+	Phase string `json:"phase"`
+	// Unit is what the items are, like "files"
+	Unit       string `json:"unit,omitempty"`
+	Items      uint64 `json:"items"`
+	ItemsTotal uint64 `json:"items_total,omitempty"`
+	Bytes      uint64 `json:"bytes"`
+	BytesTotal uint64 `json:"bytes_total,omitempty"`
+	// Elapsed is the time since the phase started in seconds
+	Elapsed float64 `json:"elapsed"`
+	// Rate is the throughput in bytes per second
+	Rate float64 `json:"rate"`
+	// ETA is the estimated time left in seconds, or nil if unknown
+	ETA *float64 `json:"eta,omitempty"`
+	// Done is set in the last line of a phase
+	Done bool `json:"done,omitempty"`
+}
+
+// NewStatus takes a snapshot of "c", which has been started at "start"
+func NewStatus(op string, phase string, unit string, c *Counter, start time.Time) Status {
+	s := Status{
+		Op:         op,
+		Phase:      phase,
+		Unit:       unit,
+		Items:      atomic.LoadUint64(&c.items),
+		ItemsTotal: c.ItemsTotal,
+		Bytes:      atomic.LoadUint64(&c.bytes),
+		BytesTotal: c.BytesTotal,
+	}
+	elapsed := time.Since(start)
+	s.Elapsed = elapsed.Seconds()
+	if s.Elapsed > 0 {
+		s.Rate = float64(s.Bytes) / s.Elapsed
+	}
+	// Estimate by bytes, or by items if all of them are empty
+	if done, total, ok := s.fraction(); ok && done > 0 && done <= total {
+		left := float64(elapsed) * float64(total-done) / float64(done)
+		// Whole seconds are precise enough
+		eta := float64(time.Duration(left) / time.Second)
+		s.ETA = &eta
+	}
+	return s
+}
+
+// fraction returns what is done of what total, by bytes if their total is
+// known, otherwise by items
+func (s *Status) fraction() (done uint64, total uint64, ok bool) {
+	if s.BytesTotal > 0 {
+		return s.Bytes, s.BytesTotal, true
+	}
+	if s.ItemsTotal > 0 {
+		return s.Items, s.ItemsTotal, true
+	}
+	return 0, 0, false
+}
+
+// String formats the status for humans, like
+// "check: 1 of 4 files, 1.0 MiB of 2.0 MiB, 102.4 KiB/s, ETA 10s"
+func (s Status) String() string {
+	var parts []string
+	if s.Unit != "" {
+		if s.ItemsTotal > 0 {
+			parts = append(parts, fmt.Sprintf("%d of %d %s", s.Items, s.ItemsTotal, s.Unit))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d %s", s.Items, s.Unit))
+		}
+	}
+	if s.BytesTotal > 0 {
+		parts = append(parts, fmt.Sprintf("%s of %s", FormatBytes(s.Bytes), FormatBytes(s.BytesTotal)))
+	} else if s.Bytes > 0 {
+		parts = append(parts, FormatBytes(s.Bytes))
+	}
+	if s.Bytes > 0 {
+		parts = append(parts, FormatBytes(uint64(s.Rate))+"/s")
+	}
+	if _, _, ok := s.fraction(); ok {
+		eta := "unknown"
+		if s.ETA != nil {
+			eta = (time.Duration(*s.ETA) * time.Second).String()
+		}
+		parts = append(parts, "ETA "+eta)
+	}
+	return s.Phase + ": " + strings.Join(parts, ", ")
+}
+
+// bar returns a progress bar like "[=====>              ]  25% ", or "" if
+// the total is not known
+func (s Status) bar() string {
+	done, total, ok := s.fraction()
+	if !ok {
+		return ""
+	}
+	if done > total {
+		done = total
+	}
+	n := int(done * barWidth / total)
+	b := strings.Repeat("=", n)
+	if n < barWidth {
+		b += ">" + strings.Repeat(" ", barWidth-n-1)
+	}
+	return fmt.Sprintf("[%s] %3d%% ", b, done*100/total)
+}
+
+// FormatBytes formats "n" bytes for humans, like "1.5 GiB"
+func FormatBytes(n uint64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n) / 1024
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if f < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", f, unit)
+		}
+		f /= 1024
+	}
+	panic("unreachable")
+}
+
+// Reporter prints the progress of the phases of an operation
+type Reporter struct {
+	mode Mode
+	op   string
+	w    io.Writer
+	// terminal is true if "w" is a terminal
+	terminal bool
+}
+
+// New returns a Reporter for the operation "op", like "fsck", that prints
+// to stderr
+func New(mode Mode, op string) *Reporter {
+	return &Reporter{
+		mode:     mode,
+		op:       op,
+		w:        os.Stderr,
+		terminal: terminal.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+// Interactive returns true if the progress is shown as a progress bar on
+// a terminal
+func (r *Reporter) Interactive() bool {
+	return r.mode == Text && r.terminal
+}
+
+// Start reports the progress of the phase "phase" from "c" until the
+// returned function is called. "unit" is what the items are called, or ""
+// if they are not counted.
+func (r *Reporter) Start(phase string, unit string, c *Counter) (stop func()) {
+	if r.mode == Off {
+		return func() {}
+	}
+	start := time.Now()
+	status := func() Status {
+		return NewStatus(r.op, phase, unit, c, start)
+	}
+	interval := Interval
+	if r.mode == JSON || r.terminal {
+		interval = RedrawInterval
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				r.print(status(), false)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		s := status()
+		s.Done = true
+		r.print(s, true)
+	}
+}
+
+// print prints "s". "last" is true for the final status of a phase. Only
+// the progress bar and JSON mode print it, as a line every Interval
+// already says enough.
+func (r *Reporter) print(s Status, last bool) {
+	switch {
+	case r.mode == JSON:
+		js, _ := json.Marshal(s)
+		fmt.Fprintf(r.w, "%s\n", js)
+	case r.terminal:
+		// Return to the start of the line and clear what is left of the
+		// old one
+		fmt.Fprintf(r.w, "\r%s: %s%s\x1b[K", r.op, s.bar(), s)
+		if last {
+			fmt.Fprintf(r.w, "\n")
+		}
+	case !last:
+		fmt.Fprintf(r.w, "%s: %s\n", r.op, s)
+	}
+}
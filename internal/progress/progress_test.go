@@ -0,0 +1,85 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	testcases := []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{3 << 30, "3.0 GiB"},
+		{5 << 50, "5120.0 TiB"},
+	}
+	for _, tc := range testcases {
+		if have := FormatBytes(tc.n); have != tc.want {
+			t.Errorf("FormatBytes(%d): have %q, want %q", tc.n, have, tc.want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	c := &Counter{ItemsTotal: 4, BytesTotal: 2 << 20}
+	c.Add(1, 1<<20)
+	// Half of the bytes in about 10 seconds, so about 10 seconds are left
+	s := NewStatus("fsck", "check", "files", c, time.Now().Add(-10*time.Second))
+	if have := s.String(); have != "check: 1 of 4 files, 1.0 MiB of 2.0 MiB, 102.4 KiB/s, ETA 10s" {
+		t.Errorf("wrong status %q", have)
+	}
+	if have := s.bar(); have != "[==========>         ]  50% " {
+		t.Errorf("wrong bar %q", have)
+	}
+	c = &Counter{ItemsTotal: 4, BytesTotal: 2 << 20}
+	s = NewStatus("fsck", "check", "files", c, time.Now())
+	if have := s.String(); have != "check: 0 of 4 files, 0 B of 2.0 MiB, ETA unknown" {
+		t.Errorf("wrong status %q", have)
+	}
+	// No totals: no ETA and no bar
+	c = &Counter{}
+	c.Add(3, 0)
+	s = NewStatus("fsck", "scan", "files", c, time.Now())
+	if have := s.String(); have != "scan: 3 files" {
+		t.Errorf("wrong status %q", have)
+	}
+	if have := s.bar(); have != "" {
+		t.Errorf("wrong bar %q", have)
+	}
+}
+
+// TestJSON checks that JSON mode prints one object per line, and that the
+// last one is marked as done
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	r := &Reporter{mode: JSON, op: "export", w: &buf}
+	c := &Counter{}
+	stop := r.Start("export", "", c)
+	w := c.Writer(&bytes.Buffer{})
+	w.Write(make([]byte, 100))
+	stop()
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	var s Status
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Op != "export" || s.Phase != "export" || s.Bytes != 100 || !s.Done || s.ETA != nil {
+		t.Errorf("wrong status %+v", s)
+	}
+}
+
+// TestOff checks that nothing is printed in Off mode
+func TestOff(t *testing.T) {
+	var buf bytes.Buffer
+	r := &Reporter{mode: Off, op: "fsck", w: &buf}
+	r.Start("check", "files", &Counter{})()
+	if buf.Len() != 0 {
+		t.Errorf("printed %q", buf.String())
+	}
+}
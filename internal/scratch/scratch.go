@@ -0,0 +1,343 @@
+// Package scratch implements "-scratch_glob": files whose names match one
+// of the patterns (editor swap files, "*.tmp", ...) are kept in memory and
+// never written to CIPHERDIR. This saves the churn of syncing short-lived
+// ciphertext files to the cloud.
+//
+// The file contents are encrypted with a random key that only exists in
+// memory, so they cannot be recovered from swap after the unmount. A
+// scratch file that is renamed to a name that does not match (the usual
+// "write foo.tmp, rename to foo" pattern) is written to CIPHERDIR at that
+// point.
+//
+// "-scratch_size" limits the memory that the scratch files may use. Writes
+// beyond the limit fail with ENOSPC.
+package scratch
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// inoFlag is set in the inode numbers of scratch files. Translated backing
+// inode numbers stay below 2^59 (see inomap), and the raw view uses 1<<63.
+const inoFlag = 1 << 62
+
+// blockSize is the size of the separately encrypted blocks
+const blockSize = 4096
+
+// Store holds the scratch files of a mount
+type Store struct {
+	globs []string
+	aead  cipher.AEAD
+
+	// maxBlocks is the limit for usedBlocks, 0 means no limit
+	maxBlocks uint64
+
+	// lock protects "files", "nextIno", "usedBlocks" and the nodes
+	lock    sync.Mutex
+	files   map[string]*node
+	nextIno uint64
+	// usedBlocks is the number of blocks stored in all nodes
+	usedBlocks uint64
+}
+
+// node is one scratch file
+type node struct {
+	ino   uint64
+	mode  uint32
+	owner fuse.Owner
+	atime time.Time
+	mtime time.Time
+	ctime time.Time
+	size  uint64
+	// gen is incremented on every change, so that persist() can tell if the
+	// file has changed while it was being copied
+	gen uint64
+	// handles is the number of open file handles
+	handles int
+	// unlinked is set once the name is gone. Open file handles keep working,
+	// and the blocks are freed when the last one is closed.
+	unlinked bool
+	// blocks holds the encrypted blocks. Missing blocks are holes.
+	blocks map[uint64][]byte
+}
+
+// New returns a Store for files matching one of "globs". The patterns are
+// matched like "-nocache_glob". The scratch files may use up to "maxBytes"
+// bytes of memory, 0 means no limit.
+func New(globs []string, maxBytes uint64) *Store {
+	block, err := aes.NewCipher(cryptocore.RandBytes(32))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &Store{
+		globs:     globs,
+		aead:      aead,
+		maxBlocks: (maxBytes + blockSize - 1) / blockSize,
+		files:     make(map[string]*node),
+	}
+}
+
+// Match returns true if new files at "path" are scratch files
+func (s *Store) Match(path string) bool {
+	for _, g := range s.globs {
+		if configfile.MatchGlob(g, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the scratch file at "path" or nil. Caller must hold s.lock.
+func (s *Store) get(path string) *node {
+	return s.files[path]
+}
+
+// create adds an empty scratch file at "path". Caller must hold s.lock.
+func (s *Store) create(path string, mode uint32, owner fuse.Owner) *node {
+	s.nextIno++
+	now := time.Now()
+	n := &node{
+		ino:    inoFlag | s.nextIno,
+		mode:   mode & 07777,
+		owner:  owner,
+		atime:  now,
+		mtime:  now,
+		ctime:  now,
+		blocks: make(map[uint64][]byte),
+	}
+	s.files[path] = n
+	return n
+}
+
+// remove drops the scratch file at "path". Caller must hold s.lock.
+func (s *Store) remove(path string) {
+	if n := s.files[path]; n != nil {
+		n.unlinked = true
+		n.ctime = time.Now()
+		delete(s.files, path)
+		if n.handles == 0 {
+			s.free(n)
+		}
+	}
+}
+
+// free drops the blocks of "n". Caller must hold s.lock.
+func (s *Store) free(n *node) {
+	s.usedBlocks -= uint64(len(n.blocks))
+	n.blocks = make(map[uint64][]byte)
+}
+
+// snapshot returns a copy of "n" that can be read without holding s.lock.
+// Caller must hold s.lock.
+func (n *node) snapshot() *node {
+	c := *n
+	c.blocks = make(map[uint64][]byte, len(n.blocks))
+	for k, v := range n.blocks {
+		// Stored blocks are never modified, only replaced
+		c.blocks[k] = v
+	}
+	return &c
+}
+
+// children returns the names of the scratch files directly inside "dir".
+// Caller must hold s.lock.
+func (s *Store) children(dir string) []string {
+	var names []string
+	for p := range s.files {
+		if parentDir(p) == dir {
+			names = append(names, filepath.Base(p))
+		}
+	}
+	return names
+}
+
+// hasDescendants returns true if there are scratch files below "dir".
+// Caller must hold s.lock.
+func (s *Store) hasDescendants(dir string) bool {
+	for p := range s.files {
+		if strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// moveDir updates the paths after the directory "oldDir" has been renamed
+// to "newDir". Caller must hold s.lock.
+func (s *Store) moveDir(oldDir string, newDir string) {
+	for p, n := range s.files {
+		if strings.HasPrefix(p, oldDir+"/") {
+			delete(s.files, p)
+			s.files[newDir+p[len(oldDir):]] = n
+		}
+	}
+}
+
+// parentDir is filepath.Dir, but returns "" for the root directory like
+// the FUSE API does
+func parentDir(path string) string {
+	d := filepath.Dir(path)
+	if d == "." {
+		return ""
+	}
+	return d
+}
+
+// attr fills "a" with the attributes of "n". Caller must hold s.lock.
+func (n *node) attr(a *fuse.Attr) {
+	*a = fuse.Attr{
+		Ino:   n.ino,
+		Size:  n.size,
+		Mode:  syscall.S_IFREG | n.mode,
+		Owner: n.owner,
+		Nlink: 1,
+	}
+	if n.unlinked {
+		a.Nlink = 0
+	}
+	a.Blocks = uint64(len(n.blocks)) * blockSize / 512
+	a.SetTimes(&n.atime, &n.mtime, &n.ctime)
+}
+
+// ad returns the associated data for block "blockNo" of "n", so that blocks
+// cannot be swapped between files or positions
+func (n *node) ad(blockNo uint64) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad, n.ino)
+	binary.BigEndian.PutUint64(ad[8:], blockNo)
+	return ad
+}
+
+// readBlock returns the plaintext of block "blockNo", padded with zeros to
+// blockSize. Caller must hold s.lock.
+func (s *Store) readBlock(n *node, blockNo uint64) []byte {
+	out := make([]byte, blockSize)
+	c, ok := n.blocks[blockNo]
+	if !ok {
+		return out
+	}
+	nonceLen := s.aead.NonceSize()
+	p, err := s.aead.Open(nil, c[:nonceLen], c[nonceLen:], n.ad(blockNo))
+	if err != nil {
+		// We encrypted this block ourselves, in our own memory
+		panic(err)
+	}
+	copy(out, p)
+	return out
+}
+
+// writeBlock encrypts and stores "data" as block "blockNo". Caller must
+// hold s.lock.
+func (s *Store) writeBlock(n *node, blockNo uint64, data []byte) {
+	if _, ok := n.blocks[blockNo]; !ok {
+		s.usedBlocks++
+	}
+	nonce := cryptocore.RandBytes(s.aead.NonceSize())
+	n.blocks[blockNo] = s.aead.Seal(nonce, nonce, data, n.ad(blockNo))
+}
+
+// read reads into "buf" from offset "off". Caller must hold s.lock.
+func (s *Store) read(n *node, buf []byte, off uint64) int {
+	if off >= n.size {
+		return 0
+	}
+	end := off + uint64(len(buf))
+	if end > n.size {
+		end = n.size
+	}
+	done := 0
+	for pos := off; pos < end; {
+		blockNo := pos / blockSize
+		skip := pos % blockSize
+		b := s.readBlock(n, blockNo)
+		c := copy(buf[done:end-off], b[skip:])
+		done += c
+		pos += uint64(c)
+	}
+	n.atime = time.Now()
+	return done
+}
+
+// write writes "data" at offset "off". Returns ENOSPC if the new blocks
+// would exceed the memory limit. Caller must hold s.lock.
+func (s *Store) write(n *node, data []byte, off uint64) fuse.Status {
+	if s.maxBlocks > 0 && len(data) > 0 {
+		var newBlocks uint64
+		for blockNo := off / blockSize; blockNo <= (off+uint64(len(data))-1)/blockSize; blockNo++ {
+			if _, ok := n.blocks[blockNo]; !ok {
+				newBlocks++
+			}
+		}
+		if s.usedBlocks+newBlocks > s.maxBlocks {
+			return fuse.Status(syscall.ENOSPC)
+		}
+	}
+	for done := 0; done < len(data); {
+		pos := off + uint64(done)
+		blockNo := pos / blockSize
+		skip := pos % blockSize
+		b := s.readBlock(n, blockNo)
+		c := copy(b[skip:], data[done:])
+		done += c
+		// Only store up to the end of the file
+		blockEnd := skip + uint64(c)
+		if n.size > blockNo*blockSize {
+			old := n.size - blockNo*blockSize
+			if old > blockSize {
+				old = blockSize
+			}
+			if old > blockEnd {
+				blockEnd = old
+			}
+		}
+		s.writeBlock(n, blockNo, b[:blockEnd])
+	}
+	if end := off + uint64(len(data)); end > n.size {
+		n.size = end
+	}
+	n.mtime = time.Now()
+	n.ctime = n.mtime
+	n.gen++
+	return fuse.OK
+}
+
+// truncate changes the size of "n" to "size". Caller must hold s.lock.
+func (s *Store) truncate(n *node, size uint64) {
+	if size < n.size {
+		for blockNo := range n.blocks {
+			if blockNo*blockSize >= size {
+				delete(n.blocks, blockNo)
+				s.usedBlocks--
+			}
+		}
+		// Zero the tail of the last block, so that growing the file
+		// again exposes zeros
+		if rest := size % blockSize; rest != 0 {
+			blockNo := size / blockSize
+			if _, ok := n.blocks[blockNo]; ok {
+				b := s.readBlock(n, blockNo)
+				s.writeBlock(n, blockNo, b[:rest])
+			}
+		}
+	}
+	n.size = size
+	n.mtime = time.Now()
+	n.ctime = n.mtime
+	n.gen++
+}
@@ -0,0 +1,134 @@
+package scratch
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// memFile is an open scratch file
+type memFile struct {
+	// Embed nodefs.defaultFile for a ENOSYS implementation of all methods
+	nodefs.File
+	s *Store
+	n *node
+}
+
+func (f *memFile) String() string {
+	return fmt.Sprintf("scratch.memFile(ino%d)", f.n.ino)
+}
+
+func (f *memFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	c := f.s.read(f.n, buf, uint64(off))
+	return fuse.ReadResultData(buf[:c]), fuse.OK
+}
+
+func (f *memFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	if status := f.s.write(f.n, data, uint64(off)); !status.Ok() {
+		return 0, status
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *memFile) Truncate(size uint64) fuse.Status {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	f.s.truncate(f.n, size)
+	return fuse.OK
+}
+
+func (f *memFile) GetAttr(a *fuse.Attr) fuse.Status {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	f.n.attr(a)
+	return fuse.OK
+}
+
+func (f *memFile) Chmod(mode uint32) fuse.Status {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	f.n.chmod(mode)
+	return fuse.OK
+}
+
+func (f *memFile) Chown(uid uint32, gid uint32) fuse.Status {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	f.n.chown(uid, gid)
+	return fuse.OK
+}
+
+func (f *memFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	f.n.utimens(atime, mtime)
+	return fuse.OK
+}
+
+// Release frees the blocks of an unlinked file when its last handle is
+// closed
+func (f *memFile) Release() {
+	f.s.lock.Lock()
+	defer f.s.lock.Unlock()
+	f.n.handles--
+	if f.n.unlinked && f.n.handles == 0 {
+		f.s.free(f.n)
+	}
+}
+
+// Flush and Fsync have nothing to do, the data never reaches the disk
+func (f *memFile) Flush() fuse.Status {
+	return fuse.OK
+}
+
+func (f *memFile) Fsync(flags int) fuse.Status {
+	return fuse.OK
+}
+
+// open returns a file handle for "n". Caller must hold s.lock.
+func (s *Store) open(n *node, flags uint32) nodefs.File {
+	if flags&syscall.O_TRUNC != 0 {
+		s.truncate(n, 0)
+	}
+	n.handles++
+	return &memFile{File: nodefs.NewDefaultFile(), s: s, n: n}
+}
+
+// chmod changes the permission bits. Caller must hold s.lock.
+func (n *node) chmod(mode uint32) {
+	n.mode = mode & 07777
+	n.ctime = time.Now()
+	n.gen++
+}
+
+// chown implements chown(2) semantics: ^uint32(0) means "don't change".
+// Caller must hold s.lock.
+func (n *node) chown(uid uint32, gid uint32) {
+	if uid != ^uint32(0) {
+		n.owner.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		n.owner.Gid = gid
+	}
+	n.ctime = time.Now()
+	n.gen++
+}
+
+// utimens sets the times. nil means "don't change". Caller must hold s.lock.
+func (n *node) utimens(atime *time.Time, mtime *time.Time) {
+	if atime != nil {
+		n.atime = *atime
+	}
+	if mtime != nil {
+		n.mtime = *mtime
+	}
+	n.ctime = time.Now()
+	n.gen++
+}
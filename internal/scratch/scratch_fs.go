@@ -0,0 +1,310 @@
+package scratch
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Wrap returns a pathfs.FileSystem that keeps new files matching the
+// patterns in memory and passes everything else through to "fs"
+func (s *Store) Wrap(fs pathfs.FileSystem) pathfs.FileSystem {
+	return &scratchFS{FileSystem: fs, s: s}
+}
+
+type scratchFS struct {
+	pathfs.FileSystem
+	s *Store
+}
+
+// withNode calls "fn" with the store locked if "name" is a scratch file.
+// Returns false otherwise. The lock is not held while operations are passed
+// through, so that other files are not slowed down.
+func (fs *scratchFS) withNode(name string, fn func(n *node)) bool {
+	fs.s.lock.Lock()
+	defer fs.s.lock.Unlock()
+	n := fs.s.get(name)
+	if n == nil {
+		return false
+	}
+	fn(n)
+	return true
+}
+
+// exists returns true if "name" is a scratch file
+func (fs *scratchFS) exists(name string) bool {
+	return fs.withNode(name, func(*node) {})
+}
+
+func (fs *scratchFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	var a fuse.Attr
+	if fs.withNode(name, func(n *node) { n.attr(&a) }) {
+		return &a, fuse.OK
+	}
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+func (fs *scratchFS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.withNode(name, func(n *node) { n.chmod(mode) }) {
+		return fuse.OK
+	}
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+func (fs *scratchFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if fs.withNode(name, func(n *node) { n.chown(uid, gid) }) {
+		return fuse.OK
+	}
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+func (fs *scratchFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if fs.withNode(name, func(n *node) { n.utimens(atime, mtime) }) {
+		return fuse.OK
+	}
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+func (fs *scratchFS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if fs.withNode(name, func(n *node) { fs.s.truncate(n, size) }) {
+		return fuse.OK
+	}
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *scratchFS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.exists(name) {
+		return fuse.OK
+	}
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+// Link - scratch files cannot have hard links
+func (fs *scratchFS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if fs.exists(oldName) || fs.exists(newName) {
+		return fuse.Status(syscall.EXDEV)
+	}
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+// Mkdir, Mknod and Symlink must not shadow or be shadowed by a scratch file
+func (fs *scratchFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.exists(name) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+func (fs *scratchFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if fs.exists(name) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+func (fs *scratchFS) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	if fs.exists(linkName) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+func (fs *scratchFS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	fs.s.lock.Lock()
+	n := fs.s.get(oldName)
+	if n != nil && !fs.s.Match(newName) {
+		fs.s.lock.Unlock()
+		return fs.persist(oldName, newName, context)
+	}
+	defer fs.s.lock.Unlock()
+	if n == nil {
+		status := fs.FileSystem.Rename(oldName, newName, context)
+		if status.Ok() {
+			// A real file may replace a scratch file, and a renamed
+			// directory takes its scratch files with it
+			fs.s.remove(newName)
+			fs.s.moveDir(oldName, newName)
+		}
+		return status
+	}
+	if oldName == newName {
+		return fuse.OK
+	}
+	// Stays in memory. Delete whatever real file had the name before.
+	if a, status := fs.FileSystem.GetAttr(newName, context); status.Ok() {
+		if a.IsDir() {
+			return fuse.Status(syscall.EISDIR)
+		}
+		if status = fs.FileSystem.Unlink(newName, context); !status.Ok() {
+			return status
+		}
+	} else if parent, status := fs.FileSystem.GetAttr(parentDir(newName), context); !status.Ok() || !parent.IsDir() {
+		return fuse.ENOENT
+	}
+	fs.s.remove(newName)
+	delete(fs.s.files, oldName)
+	fs.s.files[newName] = n
+	n.ctime = time.Now()
+	n.gen++
+	return fuse.OK
+}
+
+// persist writes the scratch file at "oldName" to the real file "name",
+// replacing it atomically, and drops the scratch file.
+// The contents are copied without holding s.lock. Fails with EBUSY if the
+// scratch file is open, because writes through the open handles would be
+// lost, or if it is opened or changed while it is being copied.
+func (fs *scratchFS) persist(oldName string, name string, context *fuse.Context) fuse.Status {
+	fs.s.lock.Lock()
+	n := fs.s.get(oldName)
+	if n == nil {
+		fs.s.lock.Unlock()
+		return fuse.ENOENT
+	}
+	if n.handles > 0 {
+		fs.s.lock.Unlock()
+		return fuse.Status(syscall.EBUSY)
+	}
+	snap := n.snapshot()
+	fs.s.lock.Unlock()
+
+	tmp := filepath.Join(parentDir(name), fmt.Sprintf(".%s.scratch-%x", filepath.Base(name), cryptocore.RandBytes(4)))
+	f, status := fs.FileSystem.Create(tmp, uint32(syscall.O_WRONLY|syscall.O_EXCL), snap.mode, context)
+	if !status.Ok() {
+		return status
+	}
+	buf := make([]byte, 128*1024)
+	for off := uint64(0); off < snap.size && status.Ok(); {
+		c := fs.s.read(snap, buf, off)
+		var written uint32
+		written, status = f.Write(buf[:c], int64(off))
+		off += uint64(written)
+	}
+	if status.Ok() {
+		status = f.Utimens(&snap.atime, &snap.mtime)
+	}
+	if status.Ok() {
+		status = f.Flush()
+	}
+	f.Release()
+	if status.Ok() {
+		fs.s.lock.Lock()
+		if fs.s.get(oldName) != n || n.handles > 0 || n.gen != snap.gen {
+			status = fuse.Status(syscall.EBUSY)
+		} else {
+			status = fs.FileSystem.Rename(tmp, name, context)
+			if status.Ok() {
+				fs.s.remove(oldName)
+				fs.s.remove(name)
+			}
+		}
+		fs.s.lock.Unlock()
+	}
+	if !status.Ok() {
+		tlog.Warn.Printf("scratch: writing %q failed: %v", name, status)
+		fs.FileSystem.Unlink(tmp, context)
+	}
+	return status
+}
+
+func (fs *scratchFS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	fs.s.lock.Lock()
+	defer fs.s.lock.Unlock()
+	if fs.s.hasDescendants(name) {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+func (fs *scratchFS) Unlink(name string, context *fuse.Context) fuse.Status {
+	if fs.withNode(name, func(*node) { fs.s.remove(name) }) {
+		return fuse.OK
+	}
+	return fs.FileSystem.Unlink(name, context)
+}
+
+func (fs *scratchFS) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if fs.exists(name) {
+		return nil, fuse.ENODATA
+	}
+	return fs.FileSystem.GetXAttr(name, attribute, context)
+}
+
+func (fs *scratchFS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if fs.exists(name) {
+		return nil, fuse.OK
+	}
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+func (fs *scratchFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if fs.exists(name) {
+		return fuse.ENODATA
+	}
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+func (fs *scratchFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.exists(name) {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+func (fs *scratchFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	var f nodefs.File
+	if fs.withNode(name, func(n *node) { f = fs.s.open(n, flags) }) {
+		return f, fuse.OK
+	}
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+// Create creates a scratch file if "name" matches and no real file of that
+// name exists
+func (fs *scratchFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !fs.s.Match(name) {
+		return fs.FileSystem.Create(name, flags, mode, context)
+	}
+	fs.s.lock.Lock()
+	defer fs.s.lock.Unlock()
+	if n := fs.s.get(name); n != nil {
+		if flags&syscall.O_EXCL != 0 {
+			return nil, fuse.Status(syscall.EEXIST)
+		}
+		return fs.s.open(n, flags), fuse.OK
+	}
+	if _, status := fs.FileSystem.GetAttr(name, context); status.Ok() {
+		return fs.FileSystem.Create(name, flags, mode, context)
+	}
+	parent, status := fs.FileSystem.GetAttr(parentDir(name), context)
+	if !status.Ok() {
+		return nil, status
+	}
+	if !parent.IsDir() {
+		return nil, fuse.Status(syscall.ENOTDIR)
+	}
+	n := fs.s.create(name, mode, context.Owner)
+	return fs.s.open(n, flags), fuse.OK
+}
+
+// OpenDir adds the scratch files to the directory listing
+func (fs *scratchFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, status := fs.FileSystem.OpenDir(name, context)
+	if !status.Ok() {
+		return entries, status
+	}
+	fs.s.lock.Lock()
+	defer fs.s.lock.Unlock()
+	for _, c := range fs.s.children(name) {
+		entries = append(entries, fuse.DirEntry{Name: c, Mode: syscall.S_IFREG})
+	}
+	return entries, fuse.OK
+}
@@ -0,0 +1,184 @@
+package scratch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+var ctx = &fuse.Context{Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}}
+
+func TestReadWrite(t *testing.T) {
+	s := New(nil, 0)
+	n := s.create("x", 0600, ctx.Owner)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	s.write(n, data[:5], 0)
+	s.write(n, data[5:], 5)
+	// Hole in the middle
+	s.write(n, []byte("end"), 20000)
+	buf := make([]byte, 30000)
+	c := s.read(n, buf, 0)
+	if c != 20003 {
+		t.Fatalf("wrong length %d", c)
+	}
+	if !bytes.Equal(buf[:len(data)], data) {
+		t.Error("data mismatch")
+	}
+	if !bytes.Equal(buf[len(data):20000], make([]byte, 20000-len(data))) {
+		t.Error("hole is not zero")
+	}
+	if string(buf[20000:c]) != "end" {
+		t.Errorf("wrong tail %q", buf[20000:c])
+	}
+	// Blocks are encrypted
+	for _, b := range n.blocks {
+		if bytes.Contains(b, []byte("0123456789")) {
+			t.Error("block is not encrypted")
+		}
+	}
+	s.truncate(n, 3)
+	s.truncate(n, 5000)
+	c = s.read(n, buf, 0)
+	if c != 5000 || string(buf[:3]) != "012" || !bytes.Equal(buf[3:c], make([]byte, c-3)) {
+		t.Error("truncate did not zero the tail")
+	}
+}
+
+func TestScratchFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestScratchFS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := New([]string{"*.tmp", "*.swp"}, 0)
+	fs := s.Wrap(pathfs.NewLoopbackFileSystem(dir))
+	f, status := fs.Create("a.tmp", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if _, err = os.Stat(dir + "/a.tmp"); !os.IsNotExist(err) {
+		t.Errorf("scratch file reached the backing dir: %v", err)
+	}
+	a, status := fs.GetAttr("a.tmp", ctx)
+	if !status.Ok() || a.Size != 5 || !a.IsRegular() {
+		t.Errorf("GetAttr: %v %v", a, status)
+	}
+	entries, _ := fs.OpenDir("", ctx)
+	if len(entries) != 1 || entries[0].Name != "a.tmp" {
+		t.Errorf("OpenDir: %v", entries)
+	}
+	// Stays in memory
+	if status = fs.Rename("a.tmp", "b.swp", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = fs.GetAttr("a.tmp", ctx); status != fuse.ENOENT {
+		t.Errorf("a.tmp still exists: %v", status)
+	}
+	// Written to disk
+	if status = fs.Rename("b.swp", "b", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	content, err := ioutil.ReadFile(dir + "/b")
+	if err != nil || string(content) != "hello" {
+		t.Errorf("persisted file: %q %v", content, err)
+	}
+	if _, status = fs.GetAttr("b.swp", ctx); status != fuse.ENOENT {
+		t.Errorf("b.swp still exists: %v", status)
+	}
+	// Existing real files that match stay real
+	if err = ioutil.WriteFile(dir+"/real.tmp", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, status = fs.Create("real.tmp", uint32(os.O_WRONLY|os.O_TRUNC), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if st, err := os.Stat(dir + "/real.tmp"); err != nil || st.Size() != 0 {
+		t.Errorf("real.tmp: %v %v", st, err)
+	}
+	// Directories with scratch files are not empty
+	os.Mkdir(dir+"/d", 0700)
+	f, _ = fs.Create("d/c.tmp", uint32(os.O_WRONLY), 0600, ctx)
+	f.Release()
+	if status = fs.Rmdir("d", ctx); status != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir: want ENOTEMPTY, have %v", status)
+	}
+	if status = fs.Rename("d", "e", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = fs.GetAttr("e/c.tmp", ctx); !status.Ok() {
+		t.Errorf("scratch file did not move with its directory: %v", status)
+	}
+	if status = fs.Unlink("e/c.tmp", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.Rmdir("e", ctx); !status.Ok() {
+		t.Errorf("Rmdir: %v", status)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	s := New(nil, 2*blockSize)
+	a := s.create("a", 0600, ctx.Owner)
+	b := s.create("b", 0600, ctx.Owner)
+	if status := s.write(a, make([]byte, blockSize+1), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := s.write(b, []byte("x"), 0); status != fuse.Status(syscall.ENOSPC) {
+		t.Errorf("want ENOSPC, have %v", status)
+	}
+	// Overwriting existing blocks needs no new memory
+	if status := s.write(a, []byte("x"), 100); !status.Ok() {
+		t.Error(status)
+	}
+	// Deleting a file frees its blocks
+	s.remove("a")
+	if status := s.write(b, make([]byte, 2*blockSize), 0); !status.Ok() {
+		t.Error(status)
+	}
+	s.truncate(b, 0)
+	if s.usedBlocks != 0 {
+		t.Errorf("usedBlocks=%d after truncate", s.usedBlocks)
+	}
+}
+
+// Renaming an open scratch file to a real name would lose the writes
+// through the open handle
+func TestPersistOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPersistOpen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := New([]string{"*.tmp"}, 0)
+	fs := s.Wrap(pathfs.NewLoopbackFileSystem(dir))
+	f, status := fs.Create("a.tmp", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Write([]byte("hello"), 0)
+	if status = fs.Rename("a.tmp", "a", ctx); status != fuse.Status(syscall.EBUSY) {
+		t.Errorf("want EBUSY, have %v", status)
+	}
+	f.Release()
+	if status = fs.Rename("a.tmp", "a", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	content, err := ioutil.ReadFile(dir + "/a")
+	if err != nil || string(content) != "hello" {
+		t.Errorf("persisted file: %q %v", content, err)
+	}
+	if s.usedBlocks != 0 {
+		t.Errorf("usedBlocks=%d after persist", s.usedBlocks)
+	}
+}
@@ -0,0 +1,28 @@
+package shred
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Check returns an error if shredding cannot work on the filesystem "dir"
+// is on, and warnings if it may not work.
+func Check(dir string) (warnings []string, err error) {
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(dir, &fs); err != nil {
+		return nil, err
+	}
+	var name []byte
+	for _, c := range fs.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if string(name) == "apfs" {
+		return nil, fmt.Errorf("%s is on apfs, a copy-on-write filesystem. Overwriting a file "+
+			"writes the new data to a different place on disk", dir)
+	}
+	return []string{fmt.Sprintf("%s is on %s. If this is a solid-state drive, the drive may "+
+		"keep copies of the overwritten data", dir, name)}, nil
+}
@@ -0,0 +1,82 @@
+package shred
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Filesystem magic numbers from statfs(2)
+const (
+	magicBtrfs    = 0x9123683E
+	magicZFS      = 0x2FC12FC1
+	magicBcachefs = 0xCA451A4E
+	magicNilfs    = 0x3434
+	magicF2FS     = 0xF2F52010
+	magicNFS      = 0x6969
+	magicSMB2     = 0xFE534D42
+	magicCIFS     = 0xFF534D42
+	magicFUSE     = 0x65735546
+)
+
+// copyOnWrite lists the filesystems that never overwrite data in place
+var copyOnWrite = map[int64]string{
+	magicBtrfs:    "btrfs",
+	magicZFS:      "zfs",
+	magicBcachefs: "bcachefs",
+	magicNilfs:    "nilfs2",
+	magicF2FS:     "f2fs",
+}
+
+// remote lists the filesystems where we cannot know what happens to the
+// overwritten data
+var remote = map[int64]string{
+	magicNFS:  "nfs",
+	magicSMB2: "smb2",
+	magicCIFS: "cifs",
+	magicFUSE: "fuse",
+}
+
+// Check returns an error if shredding cannot work on the filesystem "dir"
+// is on, and warnings if it may not work.
+func Check(dir string) (warnings []string, err error) {
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(dir, &fs); err != nil {
+		return nil, err
+	}
+	fsType := int64(fs.Type) & 0xFFFFFFFF
+	if name := copyOnWrite[fsType]; name != "" {
+		return nil, fmt.Errorf("%s is on %s, a copy-on-write filesystem. Overwriting a file "+
+			"writes the new data to a different place on disk", dir, name)
+	}
+	if name := remote[fsType]; name != "" {
+		warnings = append(warnings, fmt.Sprintf("%s is on %s. Whether overwritten data is "+
+			"really gone depends on the server", dir, name))
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(dir, &st); err != nil {
+		return nil, err
+	}
+	if rotational(uint64(st.Dev)) == "0" {
+		warnings = append(warnings, fmt.Sprintf("%s is on a solid-state drive. The drive may "+
+			"keep copies of the overwritten data in remapped or trimmed blocks", dir))
+	}
+	return warnings, nil
+}
+
+// rotational returns the content of the "rotational" sysfs attribute of the
+// block device "dev", or "" if it is not known
+func rotational(dev uint64) string {
+	base := fmt.Sprintf("/sys/dev/block/%d:%d/", unix.Major(dev), unix.Minor(dev))
+	// Partitions do not have a queue directory, but their parent disk has
+	for _, p := range []string{"queue/rotational", "../queue/rotational"} {
+		c, err := ioutil.ReadFile(base + p)
+		if err == nil {
+			return strings.TrimSpace(string(c))
+		}
+	}
+	return ""
+}
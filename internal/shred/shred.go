@@ -0,0 +1,49 @@
+// Package shred implements "-shred": overwriting the ciphertext of a file
+// before it is deleted. This is best-effort. It only works if the backing
+// filesystem writes the new data to the same place on disk, which is not the
+// case on copy-on-write filesystems (see Check), and SSDs may keep copies of
+// the old data in blocks that have been remapped.
+package shred
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// bufSize is the size of the random buffer that is written repeatedly
+const bufSize = 1024 * 1024
+
+// Fd overwrites the whole regular file "fd" with random data "passes" times
+// and syncs it to disk after every pass.
+func Fd(fd int, passes int) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return fmt.Errorf("not a regular file")
+	}
+	size := st.Size
+	n := int64(bufSize)
+	if size < n {
+		n = size
+	}
+	buf := cryptocore.RandBytes(int(n))
+	for p := 0; p < passes; p++ {
+		for off := int64(0); off < size; off += int64(len(buf)) {
+			b := buf
+			if rest := size - off; rest < int64(len(b)) {
+				b = b[:rest]
+			}
+			if _, err := syscall.Pwrite(fd, b, off); err != nil {
+				return err
+			}
+		}
+		if err := syscall.Fsync(fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
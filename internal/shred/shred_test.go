@@ -0,0 +1,41 @@
+package shred
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFd(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestFd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// Not a multiple of the buffer size
+	orig := bytes.Repeat([]byte("secret"), 500000)
+	if _, err = f.Write(orig); err != nil {
+		t.Fatal(err)
+	}
+	if err = Fd(int(f.Fd()), 2); err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(orig) {
+		t.Errorf("size changed from %d to %d", len(orig), len(have))
+	}
+	if bytes.Contains(have, []byte("secret")) {
+		t.Error("content was not overwritten")
+	}
+}
+
+func TestCheckMissing(t *testing.T) {
+	if _, err := Check("/nonexisting/dir"); err == nil {
+		t.Error("should have failed")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
 	"github.com/rfjakob/gocryptfs/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/internal/xchacha"
 )
 
 // Run - run the speed the test and print the results.
@@ -27,9 +28,10 @@ func Run() {
 		{name: "AES-GCM-256-OpenSSL", f: bStupidGCM, preferred: prefer_openssl.PreferOpenSSL()},
 		{name: "AES-GCM-256-Go", f: bGoGCM, preferred: !prefer_openssl.PreferOpenSSL()},
 		{name: "AES-SIV-512-Go", f: bAESSIV, preferred: false},
+		{name: "XChaCha20-Poly1305-Go", f: bXChaCha, preferred: false},
 	}
 	for _, b := range bTable {
-		fmt.Printf("%-20s\t", b.name)
+		fmt.Printf("%-21s\t", b.name)
 		mbs := mbPerSec(testing.Benchmark(b.f))
 		if mbs > 0 {
 			fmt.Printf("%7.2f MB/s", mbs)
@@ -119,3 +121,18 @@ func bAESSIV(b *testing.B) {
 		gGCM.Seal(iv, iv, in, authData)
 	}
 }
+
+func bXChaCha(b *testing.B) {
+	key := randBytes(32)
+	authData := randBytes(24)
+	iv := randBytes(24)
+	in := make([]byte, blockSize)
+	b.SetBytes(int64(len(in)))
+	c := xchacha.New(key)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Encrypt and append to nonce
+		c.Seal(iv, iv, in, authData)
+	}
+}
@@ -27,3 +27,7 @@ func BenchmarkGoGCM(b *testing.B) {
 func BenchmarkAESSIV(b *testing.B) {
 	bAESSIV(b)
 }
+
+func BenchmarkXChaCha(b *testing.B) {
+	bXChaCha(b)
+}
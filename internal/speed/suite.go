@@ -0,0 +1,209 @@
+package speed
+
+// The "-bench_suite" benchmark matrix
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+// SuiteReport is the output of RunSuite. It is written as JSON so that
+// results from different machines and releases can be collected and
+// compared.
+type SuiteReport struct {
+	Host    HostInfo
+	Results []SuiteResult
+}
+
+// HostInfo describes the machine and the gocryptfs build the benchmarks
+// were run on.
+type HostInfo struct {
+	// Version is the gocryptfs version string
+	Version   string
+	GoVersion string
+	GOOS      string
+	GOARCH    string
+	NumCPU    int
+	// CPU is the model name from /proc/cpuinfo, empty if unknown
+	CPU string `json:",omitempty"`
+	// Date is the time the suite was started, RFC3339
+	Date string
+}
+
+// SuiteResult is one cell of the benchmark matrix
+type SuiteResult struct {
+	Cipher    string
+	BlockSize uint64
+	Workload  string
+	// NsPerOp is the time per operation. What an operation is depends on
+	// the workload, see suiteWorkloads.
+	NsPerOp int64
+	// MBPerSec is the plaintext throughput in MB/s (1e6 bytes). Zero for
+	// workloads where throughput makes no sense.
+	MBPerSec float64
+}
+
+// suiteCiphers are the content encryption backends we benchmark
+var suiteCiphers = []cryptocore.AEADTypeEnum{
+	cryptocore.BackendOpenSSL,
+	cryptocore.BackendGoGCM,
+	cryptocore.BackendAESSIV,
+	cryptocore.BackendXChaCha20Poly1305,
+}
+
+// suiteBlockSizes are the plaintext block sizes we benchmark
+var suiteBlockSizes = []uint64{contentenc.DefaultBS, 16384, 65536}
+
+// suiteChunk is the size of the writes and reads in the "write" and
+// "read" workloads. It is the largest request the kernel sends us.
+const suiteChunk = 128 * 1024
+
+// suiteWorkload runs "n" operations against "ce" and returns the number of
+// plaintext bytes processed per operation, or zero if only the time per
+// operation is meaningful
+type suiteWorkload func(ce *contentenc.ContentEnc, n int) int64
+
+var suiteWorkloads = []struct {
+	name string
+	f    suiteWorkload
+}{
+	// Encrypt a suiteChunk of full blocks, like a large sequential write
+	{"write", wlWrite},
+	// Decrypt a suiteChunk of full blocks, like a large sequential read
+	{"read", wlRead},
+	// Overwrite one byte in the middle of a block (read-modify-write)
+	{"rmw", wlRMW},
+}
+
+func wlWrite(ce *contentenc.ContentEnc, n int) int64 {
+	bs := int(ce.PlainBS())
+	blocks := make([][]byte, suiteChunk/bs)
+	for i := range blocks {
+		blocks[i] = make([]byte, bs)
+	}
+	fileID := randBytes(contentenc.DefaultIVBits / 8)
+	for i := 0; i < n; i++ {
+		c := ce.EncryptBlocks(blocks, 0, fileID)
+		ce.CReqPool.Put(c)
+	}
+	return suiteChunk
+}
+
+func wlRead(ce *contentenc.ContentEnc, n int) int64 {
+	bs := int(ce.PlainBS())
+	blocks := make([][]byte, suiteChunk/bs)
+	for i := range blocks {
+		blocks[i] = make([]byte, bs)
+	}
+	fileID := randBytes(contentenc.DefaultIVBits / 8)
+	ciphertext := append([]byte{}, ce.EncryptBlocks(blocks, 0, fileID)...)
+	for i := 0; i < n; i++ {
+		p, err := ce.DecryptBlocks(ciphertext, 0, fileID)
+		if err != nil {
+			panic(err)
+		}
+		ce.PReqPool.Put(p)
+	}
+	return suiteChunk
+}
+
+func wlRMW(ce *contentenc.ContentEnc, n int) int64 {
+	bs := int(ce.PlainBS())
+	fileID := randBytes(contentenc.DefaultIVBits / 8)
+	ciphertext := ce.EncryptBlock(make([]byte, bs), 0, fileID)
+	for i := 0; i < n; i++ {
+		old, err := ce.DecryptBlock(ciphertext, 0, fileID)
+		if err != nil {
+			panic(err)
+		}
+		merged := ce.MergeBlocks(old, []byte{byte(i)}, bs/2)
+		ciphertext = ce.EncryptBlock(merged, 0, fileID)
+	}
+	return 0
+}
+
+// RunSuite runs the benchmark matrix (ciphers x block sizes x workloads)
+// and writes the report as JSON to "w". Progress is printed to stderr.
+// "version" is the gocryptfs version string.
+func RunSuite(w io.Writer, version string) error {
+	report := SuiteReport{Host: hostInfo(version)}
+	key := randBytes(cryptocore.KeyLen)
+	for _, t := range suiteCiphers {
+		if t == cryptocore.BackendOpenSSL && stupidgcm.BuiltWithoutOpenssl {
+			continue
+		}
+		spec := t.Spec()
+		cc := cryptocore.New(key, t, spec.IVBits, true, false)
+		for _, bs := range suiteBlockSizes {
+			ce := contentenc.New(cc, bs, false)
+			for _, wl := range suiteWorkloads {
+				fmt.Fprintf(os.Stderr, "%-21s %6d %-5s ", spec.Name, bs, wl.name)
+				res := runWorkload(ce, wl.f)
+				fmt.Fprintf(os.Stderr, "%9.2f MB/s %9d ns/op\n", res.MBPerSec, res.NsPerOp)
+				res.Cipher = spec.Name
+				res.BlockSize = bs
+				res.Workload = wl.name
+				report.Results = append(report.Results, res)
+			}
+		}
+	}
+	js, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(js, '\n'))
+	return err
+}
+
+// runWorkload benchmarks "f" using the standard testing machinery
+func runWorkload(ce *contentenc.ContentEnc, f suiteWorkload) SuiteResult {
+	r := testing.Benchmark(func(b *testing.B) {
+		b.SetBytes(f(ce, 1))
+		b.ResetTimer()
+		f(ce, b.N)
+	})
+	return SuiteResult{
+		NsPerOp:  r.NsPerOp(),
+		MBPerSec: mbPerSec(r),
+	}
+}
+
+func hostInfo(version string) HostInfo {
+	return HostInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+		CPU:       cpuModel(),
+		Date:      time.Now().Format(time.RFC3339),
+	}
+}
+
+// cpuModel returns the first "model name" from /proc/cpuinfo
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "model name" {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
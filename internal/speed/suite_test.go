@@ -0,0 +1,45 @@
+package speed
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// TestSuiteWorkloads runs every workload once with every cipher and block
+// size, without timing anything
+func TestSuiteWorkloads(t *testing.T) {
+	key := randBytes(cryptocore.KeyLen)
+	for _, c := range []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM, cryptocore.BackendAESSIV, cryptocore.BackendXChaCha20Poly1305} {
+		cc := cryptocore.New(key, c, c.Spec().IVBits, true, false)
+		for _, bs := range suiteBlockSizes {
+			ce := contentenc.New(cc, bs, false)
+			for _, wl := range suiteWorkloads {
+				if n := wl.f(ce, 2); n < 0 {
+					t.Errorf("%v %d %s: returned %d bytes per op", c, bs, wl.name, n)
+				}
+			}
+		}
+	}
+}
+
+func TestSuiteReportJSON(t *testing.T) {
+	r := SuiteReport{
+		Host:    hostInfo("v0.0-test"),
+		Results: []SuiteResult{{Cipher: "AES-GCM-256-Go", BlockSize: 4096, Workload: "read", NsPerOp: 1, MBPerSec: 2}},
+	}
+	js, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r2 SuiteReport
+	if err = json.Unmarshal(js, &r2); err != nil {
+		t.Fatal(err)
+	}
+	if r2.Host.Version != "v0.0-test" || r2.Host.GOARCH != runtime.GOARCH || len(r2.Results) != 1 {
+		t.Errorf("round trip failed: %s", js)
+	}
+}
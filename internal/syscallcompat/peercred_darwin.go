@@ -0,0 +1,50 @@
+package syscallcompat
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// From <sys/un.h> and <sys/ucred.h>
+const (
+	solLocal      = 0
+	localPeercred = 1
+	xucredVersion = 0
+)
+
+// xucred is "struct xucred" from <sys/ucred.h>
+type xucred struct {
+	Version uint32
+	UID     uint32
+	Ngroups int16
+	Groups  [16]uint32
+}
+
+// PeerUID returns the UID of the process on the other end of "conn".
+func PeerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred xucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		l := uint32(unsafe.Sizeof(cred))
+		_, _, e1 := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeercred,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&l)), 0)
+		if e1 != 0 {
+			credErr = e1
+		}
+	})
+	if err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+	if cred.Version != xucredVersion {
+		return -1, syscall.EINVAL
+	}
+	return int(cred.UID), nil
+}
@@ -0,0 +1,33 @@
+package syscallcompat
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestPeerUID(t *testing.T) {
+	sock := tmpDir + "/peercred.sock"
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	uid, err := PeerUID(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != os.Getuid() {
+		t.Errorf("PeerUID=%d, want %d", uid, os.Getuid())
+	}
+}
@@ -3,6 +3,7 @@ package syscallcompat
 import (
 	"log"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
@@ -21,6 +22,70 @@ func Fallocate(fd int, mode uint32, off int64, len int64) error {
 	return syscall.EOPNOTSUPP
 }
 
+// Syncfs is not available on Darwin. Flush all filesystems instead.
+func Syncfs(fd int) error {
+	syscall.Sync()
+	return nil
+}
+
+// Fdatasync is not available on Darwin. Use fsync instead.
+func Fdatasync(fd int) error {
+	return syscall.Fsync(fd)
+}
+
+// Fgetxattr reads the extended attribute "attr" of the open file "fd" into
+// "dest" and returns the size of the value.
+func Fgetxattr(fd int, attr string, dest []byte) (sz int, err error) {
+	p, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return 0, err
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	// The last two arguments are "position" and "options"
+	r0, _, e1 := syscall.Syscall6(syscall.SYS_FGETXATTR, uintptr(fd), uintptr(unsafe.Pointer(p)),
+		uintptr(d), uintptr(len(dest)), 0, 0)
+	if e1 != 0 {
+		return 0, e1
+	}
+	return int(r0), nil
+}
+
+// Fsetxattr sets the extended attribute "attr" of the open file "fd".
+func Fsetxattr(fd int, attr string, data []byte, flags int) (err error) {
+	p, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var d unsafe.Pointer
+	if len(data) > 0 {
+		d = unsafe.Pointer(&data[0])
+	}
+	// "position" is zero, "flags" is passed as "options"
+	_, _, e1 := syscall.Syscall6(syscall.SYS_FSETXATTR, uintptr(fd), uintptr(unsafe.Pointer(p)),
+		uintptr(d), uintptr(len(data)), 0, uintptr(flags))
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
+// Fremovexattr removes the extended attribute "attr" of the open file "fd".
+func Fremovexattr(fd int, attr string) (err error) {
+	p, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	// The last argument is "options"
+	_, _, e1 := syscall.Syscall(syscall.SYS_FREMOVEXATTR, uintptr(fd), uintptr(unsafe.Pointer(p)), 0)
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
 // Dup3 is not available on Darwin, so we use Dup2 instead.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	if flags != 0 {
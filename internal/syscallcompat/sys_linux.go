@@ -4,6 +4,7 @@ package syscallcompat
 import (
 	"sync"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
@@ -47,6 +48,67 @@ func Fallocate(fd int, mode uint32, off int64, len int64) (err error) {
 	return syscall.Fallocate(fd, mode, off, len)
 }
 
+// Syncfs flushes all data of the filesystem that contains "fd" to disk.
+func Syncfs(fd int) error {
+	return unix.Syncfs(fd)
+}
+
+// Fdatasync flushes the data of "fd" to disk, and the metadata that is
+// needed to read it back.
+func Fdatasync(fd int) error {
+	return syscall.Fdatasync(fd)
+}
+
+// Fgetxattr reads the extended attribute "attr" of the open file "fd" into
+// "dest" and returns the size of the value.
+func Fgetxattr(fd int, attr string, dest []byte) (sz int, err error) {
+	p, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return 0, err
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	r0, _, e1 := syscall.Syscall6(syscall.SYS_FGETXATTR, uintptr(fd), uintptr(unsafe.Pointer(p)),
+		uintptr(d), uintptr(len(dest)), 0, 0)
+	if e1 != 0 {
+		return 0, e1
+	}
+	return int(r0), nil
+}
+
+// Fsetxattr sets the extended attribute "attr" of the open file "fd".
+func Fsetxattr(fd int, attr string, data []byte, flags int) (err error) {
+	p, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var d unsafe.Pointer
+	if len(data) > 0 {
+		d = unsafe.Pointer(&data[0])
+	}
+	_, _, e1 := syscall.Syscall6(syscall.SYS_FSETXATTR, uintptr(fd), uintptr(unsafe.Pointer(p)),
+		uintptr(d), uintptr(len(data)), uintptr(flags), 0)
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
+// Fremovexattr removes the extended attribute "attr" of the open file "fd".
+func Fremovexattr(fd int, attr string) (err error) {
+	p, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	_, _, e1 := syscall.Syscall(syscall.SYS_FREMOVEXATTR, uintptr(fd), uintptr(unsafe.Pointer(p)), 0)
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
 // Openat wraps the Openat syscall.
 func Openat(dirfd int, path string, flags int, mode uint32) (fd int, err error) {
 	// Why would we ever want to call this without O_NOFOLLOW and O_EXCL?
@@ -0,0 +1,112 @@
+// Package tpm2 seals data to the local TPM 2.0 and unseals it again.
+// Like the fido2 package, it calls the tpm2-tools programs ("tpm2_create",
+// "tpm2_unseal", ...) instead of linking against a TPM library.
+//
+// The sealed object is created below the storage primary key of the owner
+// hierarchy. The primary key is re-created from the default template on
+// every call, so nothing has to be persisted inside the TPM.
+package tpm2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// run executes "name" with "args" and returns what it printed to stdout.
+// "stdin" is passed to the program if it is not nil.
+func run(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	tlog.Debug.Printf("tpm2: running %q", cmd.Args)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v", name, err)
+	}
+	return out, nil
+}
+
+// createPrimary creates the storage primary key and saves its context to
+// "dir".
+func createPrimary(dir string) (ctx string, err error) {
+	ctx = filepath.Join(dir, "primary.ctx")
+	_, err = run(nil, "tpm2_createprimary", "-Q", "-C", "o", "-c", ctx)
+	return ctx, err
+}
+
+// Seal seals "data" to the TPM and returns the public and private parts of
+// the sealed object. If "pcrs" is not empty (example: "sha256:0,7"), the
+// object can only be unsealed while these PCRs have their current values.
+func Seal(data []byte, pcrs string) (public []byte, private []byte, err error) {
+	dir, err := ioutil.TempDir("", "gocryptfs-tpm2")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	primary, err := createPrimary(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := filepath.Join(dir, "seal.pub")
+	priv := filepath.Join(dir, "seal.priv")
+	args := []string{"-Q", "-C", primary, "-i", "-", "-u", pub, "-r", priv}
+	if pcrs != "" {
+		policy := filepath.Join(dir, "pcr.policy")
+		_, err = run(nil, "tpm2_createpolicy", "-Q", "--policy-pcr", "-l", pcrs, "-L", policy)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, "-L", policy)
+	}
+	if _, err = run(data, "tpm2_create", args...); err != nil {
+		return nil, nil, err
+	}
+	if public, err = ioutil.ReadFile(pub); err != nil {
+		return nil, nil, err
+	}
+	if private, err = ioutil.ReadFile(priv); err != nil {
+		return nil, nil, err
+	}
+	return public, private, nil
+}
+
+// Unseal loads the sealed object consisting of "public" and "private" into
+// the TPM and returns the unsealed data. "pcrs" must be what was passed to
+// Seal().
+func Unseal(public []byte, private []byte, pcrs string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "gocryptfs-tpm2")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	primary, err := createPrimary(dir)
+	if err != nil {
+		return nil, err
+	}
+	pub := filepath.Join(dir, "seal.pub")
+	priv := filepath.Join(dir, "seal.priv")
+	if err = ioutil.WriteFile(pub, public, 0600); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(priv, private, 0600); err != nil {
+		return nil, err
+	}
+	obj := filepath.Join(dir, "seal.ctx")
+	_, err = run(nil, "tpm2_load", "-Q", "-C", primary, "-u", pub, "-r", priv, "-c", obj)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-c", obj}
+	if pcrs != "" {
+		args = append(args, "-p", "pcr:"+pcrs)
+	}
+	return run(nil, "tpm2_unseal", args...)
+}
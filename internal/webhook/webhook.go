@@ -0,0 +1,184 @@
+// Package webhook implements "-webhook", which POSTs JSON events about the
+// mounted filesystem to a URL so monitoring systems learn about problems
+// without scraping the logs.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Event names
+const (
+	// EventMounted is sent when the filesystem is mounted and ready
+	EventMounted = "mounted"
+	// EventUnmounted is sent when the filesystem has been unmounted
+	EventUnmounted = "unmounted"
+	// EventCorruption is sent for every corrupt file, name or xattr that is
+	// found. Detail identifies the item.
+	EventCorruption = "corruption_detected"
+	// EventQuotaExceeded is sent when a write is rejected because of the
+	// "Limits" in the config file
+	EventQuotaExceeded = "quota_exceeded"
+	// EventKeyLocked is sent when the master key has been removed from the
+	// kernel keyring
+	EventKeyLocked = "key_locked"
+	// EventIntrusion is sent when "-guard" has detected mass file access by
+	// foreign users. Detail describes what happened and the action taken.
+	EventIntrusion = "intrusion_detected"
+)
+
+const (
+	// queueLen is the number of events that may wait for delivery. More
+	// events are dropped, so a flood of events cannot block the filesystem.
+	queueLen = 100
+	// maxTries is the number of delivery attempts per event
+	maxTries = 5
+	// firstBackoff is the wait time after the first failed attempt. It
+	// doubles after each further failure.
+	firstBackoff = time.Second
+)
+
+// Event is the JSON object that is POSTed to the URL
+type Event struct {
+	Event      string
+	Time       time.Time
+	Host       string
+	Cipherdir  string
+	Mountpoint string
+	// Detail is event-specific, for example the corrupt item
+	Detail string `json:",omitempty"`
+}
+
+// Notifier delivers events to the URL in the background. A nil *Notifier
+// drops all events, so callers do not have to check whether "-webhook" is
+// enabled.
+type Notifier struct {
+	url        string
+	cipherdir  string
+	mountpoint string
+	host       string
+	client     *http.Client
+	// backoff is firstBackoff, shortened in the tests
+	backoff time.Duration
+
+	// lock protects "closed" and sending to "queue"
+	lock     sync.Mutex
+	closed   bool
+	queue    chan Event
+	done     chan struct{}
+	dropOnce sync.Once
+}
+
+// New starts a Notifier that POSTs to "url"
+func New(url string, cipherdir string, mountpoint string) *Notifier {
+	host, _ := os.Hostname()
+	n := &Notifier{
+		url:        url,
+		cipherdir:  cipherdir,
+		mountpoint: mountpoint,
+		host:       host,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		backoff:    firstBackoff,
+		queue:      make(chan Event, queueLen),
+		done:       make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Send queues the event "event" for delivery. It never blocks. Events sent
+// after Close are dropped.
+func (n *Notifier) Send(event string, detail string) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return
+	}
+	e := Event{
+		Event:      event,
+		Time:       time.Now(),
+		Host:       n.host,
+		Cipherdir:  n.cipherdir,
+		Mountpoint: n.mountpoint,
+		Detail:     detail,
+	}
+	select {
+	case n.queue <- e:
+	default:
+		n.dropOnce.Do(func() {
+			tlog.Warn.Printf("webhook: queue is full, dropping events")
+		})
+	}
+}
+
+// Close waits up to "timeout" for the queued events to be delivered
+func (n *Notifier) Close(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.lock.Unlock()
+	select {
+	case <-n.done:
+	case <-time.After(timeout):
+		tlog.Warn.Printf("webhook: timeout, %d events were not delivered", len(n.queue))
+	}
+}
+
+// run delivers the queued events one by one, in order
+func (n *Notifier) run() {
+	for e := range n.queue {
+		n.deliver(e)
+	}
+	close(n.done)
+}
+
+// deliver POSTs "e", retrying with exponential backoff
+func (n *Notifier) deliver(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		tlog.Warn.Printf("webhook: %v", err)
+		return
+	}
+	wait := n.backoff
+	for try := 1; ; try++ {
+		err = n.post(body)
+		if err == nil {
+			return
+		}
+		if try == maxTries {
+			tlog.Warn.Printf("webhook: giving up on %q event after %d tries: %v", e.Event, try, err)
+			return
+		}
+		tlog.Debug.Printf("webhook: try %d failed: %v", try, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (n *Notifier) post(body []byte) error {
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
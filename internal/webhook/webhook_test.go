@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNilNotifier(t *testing.T) {
+	var n *Notifier
+	n.Send(EventMounted, "")
+	n.Close(time.Second)
+}
+
+func TestDeliver(t *testing.T) {
+	var lock sync.Mutex
+	var events []Event
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		// The first attempt fails and must be retried
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events = append(events, e)
+	}))
+	defer srv.Close()
+
+	n := New(srv.URL, "/cipher", "/mnt")
+	n.backoff = time.Millisecond
+	n.Send(EventMounted, "")
+	n.Send(EventCorruption, "ino123")
+	n.Close(5 * time.Second)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if calls != 3 || len(events) != 2 {
+		t.Fatalf("calls=%d events=%+v", calls, events)
+	}
+	if events[0].Event != EventMounted || events[1].Event != EventCorruption || events[1].Detail != "ino123" {
+		t.Errorf("wrong events: %+v", events)
+	}
+	if events[0].Cipherdir != "/cipher" || events[0].Mountpoint != "/mnt" || events[0].Time.IsZero() {
+		t.Errorf("missing fields: %+v", events[0])
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	n := New(srv.URL, "/cipher", "/mnt")
+	n.backoff = time.Millisecond
+	n.Send(EventUnmounted, "")
+	n.Close(5 * time.Second)
+	lock.Lock()
+	defer lock.Unlock()
+	if calls != maxTries {
+		t.Errorf("want %d tries, have %d", maxTries, calls)
+	}
+}
@@ -0,0 +1,147 @@
+// Package xchacha implements XChaCha20-Poly1305 on top of the
+// ChaCha20-Poly1305 implementation in golang.org/x/crypto and provides
+// it as a crypto.AEAD interface.
+//
+// XChaCha20-Poly1305 is specified in
+// https://tools.ietf.org/html/draft-arciszewski-xchacha-02 .
+// The 24-byte nonce is large enough to be generated randomly, and the
+// cipher is fast on CPUs without AES acceleration.
+package xchacha
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"log"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type xchacha struct {
+	key []byte
+}
+
+var _ cipher.AEAD = &xchacha{}
+
+const (
+	// KeyLen is the required key length.
+	KeyLen = chacha20poly1305.KeySize
+	// NonceLen is the nonce length of XChaCha20-Poly1305.
+	NonceLen = 24
+	// TagLen is the length of the Poly1305 authentication tag.
+	TagLen = 16
+)
+
+// New returns a new cipher.AEAD implementation.
+func New(keyIn []byte) cipher.AEAD {
+	if len(keyIn) != KeyLen {
+		log.Panicf("Key must be %d byte long (you passed %d)", KeyLen, len(keyIn))
+	}
+	// Create a private copy so the caller can zero the one he owns
+	key := append([]byte{}, keyIn...)
+	return &xchacha{
+		key: key,
+	}
+}
+
+func (x *xchacha) NonceSize() int {
+	return NonceLen
+}
+
+func (x *xchacha) Overhead() int {
+	return TagLen
+}
+
+// deriveAead derives the per-nonce subkey using HChaCha20 and returns
+// a ChaCha20-Poly1305 instance using it, plus the 12-byte inner nonce.
+func (x *xchacha) deriveAead(nonce []byte) (cipher.AEAD, []byte) {
+	if len(nonce) != NonceLen {
+		log.Panicf("nonce must be %d bytes long", NonceLen)
+	}
+	if len(x.key) == 0 {
+		log.Panic("Key has been wiped?")
+	}
+	subkey := hChaCha20(x.key, nonce[:16])
+	aead, err := chacha20poly1305.New(subkey[:])
+	for i := range subkey {
+		subkey[i] = 0
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	innerNonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(innerNonce[4:], nonce[16:])
+	return aead, innerNonce
+}
+
+// Seal encrypts "in" using "nonce" and "authData" and appends the result to "dst"
+func (x *xchacha) Seal(dst, nonce, plaintext, authData []byte) []byte {
+	aead, innerNonce := x.deriveAead(nonce)
+	return aead.Seal(dst, innerNonce, plaintext, authData)
+}
+
+// Open decrypts "in" using "nonce" and "authData" and appends the result to "dst"
+func (x *xchacha) Open(dst, nonce, ciphertext, authData []byte) ([]byte, error) {
+	aead, innerNonce := x.deriveAead(nonce)
+	return aead.Open(dst, innerNonce, ciphertext, authData)
+}
+
+// Wipe tries to wipe the key from memory by overwriting it with zeros
+// and setting the reference to nil.
+//
+// This is not bulletproof due to possible GC copies, but
+// still raises to bar for extracting the key.
+func (x *xchacha) Wipe() {
+	for i := range x.key {
+		x.key[i] = 0
+	}
+	x.key = nil
+}
+
+// hChaCha20 derives a 32-byte subkey from "key" and the first 16 bytes of
+// the XChaCha20 nonce.
+func hChaCha20(key []byte, nonce []byte) (out [32]byte) {
+	var s [16]uint32
+	// "expand 32-byte k"
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	for i := 0; i < 4; i++ {
+		s[12+i] = binary.LittleEndian.Uint32(nonce[i*4:])
+	}
+	for i := 0; i < 10; i++ {
+		// Column round
+		quarterRound(&s, 0, 4, 8, 12)
+		quarterRound(&s, 1, 5, 9, 13)
+		quarterRound(&s, 2, 6, 10, 14)
+		quarterRound(&s, 3, 7, 11, 15)
+		// Diagonal round
+		quarterRound(&s, 0, 5, 10, 15)
+		quarterRound(&s, 1, 6, 11, 12)
+		quarterRound(&s, 2, 7, 8, 13)
+		quarterRound(&s, 3, 4, 9, 14)
+	}
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint32(out[i*4:], s[i])
+		binary.LittleEndian.PutUint32(out[16+i*4:], s[12+i])
+	}
+	for i := range s {
+		s[i] = 0
+	}
+	return out
+}
+
+func quarterRound(s *[16]uint32, a, b, c, d int) {
+	s[a] += s[b]
+	s[d] ^= s[a]
+	s[d] = s[d]<<16 | s[d]>>16
+	s[c] += s[d]
+	s[b] ^= s[c]
+	s[b] = s[b]<<12 | s[b]>>20
+	s[a] += s[b]
+	s[d] ^= s[a]
+	s[d] = s[d]<<8 | s[d]>>24
+	s[c] += s[d]
+	s[b] ^= s[c]
+	s[b] = s[b]<<7 | s[b]>>25
+}
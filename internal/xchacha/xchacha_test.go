@@ -0,0 +1,53 @@
+package xchacha
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vector from draft-arciszewski-xchacha-02, section 2.2.1
+func TestHChaCha20(t *testing.T) {
+	key := make([]byte, KeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce, _ := hex.DecodeString("000000090000004a0000000031415927")
+	want := "82413b4227b27bfed30e42508a877d73a0f9e4d58a74a853c12ec41326d3ecdc"
+	have := hChaCha20(key, nonce)
+	if hex.EncodeToString(have[:]) != want {
+		t.Errorf("wrong subkey: %x", have)
+	}
+}
+
+// Reference ciphertext generated with golang.org/x/crypto/chacha20poly1305.NewX
+func TestSealOpen(t *testing.T) {
+	key := make([]byte, KeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce := make([]byte, NonceLen)
+	for i := range nonce {
+		nonce[i] = byte(0x40 + i)
+	}
+	plaintext := []byte("gocryptfs test vector")
+	aData := []byte("aad")
+	want, _ := hex.DecodeString("b3566602a9900d70fcd4f3dbdce845e4f7d9d9ab6100cb012a8e738c427d83709dcfc7e19a")
+	a := New(key)
+	ciphertext := a.Seal(nil, nonce, plaintext, aData)
+	if !bytes.Equal(ciphertext, want) {
+		t.Fatalf("wrong ciphertext: %x", ciphertext)
+	}
+	out, err := a.Open(nil, nonce, ciphertext, aData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plaintext) {
+		t.Errorf("wrong plaintext: %q", out)
+	}
+	ciphertext[0] ^= 1
+	_, err = a.Open(nil, nonce, ciphertext, aData)
+	if err == nil {
+		t.Error("corrupted ciphertext was accepted")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/webhook"
+)
+
+// keyringUsable returns false for filesystems where caching the master key
+// would bypass the second person or the FIDO2 token. It applies to
+// gocryptfs-agent as well.
+func keyringUsable(confFile *configfile.ConfFile) bool {
+	if confFile.IsFeatureFlagSet(configfile.FlagDualControl) || confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		tlog.Info.Printf("Dual control and FIDO2 filesystems cannot use the kernel keyring or gocryptfs-agent")
+		return false
+	}
+	return true
+}
+
+// keyringLoad tries to get the master key for "args.config" from the kernel
+// keyring. Returns a nil masterkey if it is not there.
+// Calls os.Exit on failure.
+func keyringLoad(args *argContainer) (masterkey []byte, confFile *configfile.ConfFile) {
+	_, confFile, err := configfile.LoadConfFile(args.config, nil)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if !keyringUsable(confFile) {
+		return nil, nil
+	}
+	// The description covers the settings that the master key is bound to.
+	// If they have been edited, the key is not found and we fall back to
+	// the password.
+	desc := keyring.Description(confFile.KeyID())
+	masterkey, err = keyring.Load(desc)
+	if err != nil {
+		tlog.Debug.Printf("keyringLoad: %v", err)
+		return nil, nil
+	}
+	if len(masterkey) != cryptocore.KeyLen {
+		tlog.Warn.Printf("Ignoring master key of length %d in the kernel keyring", len(masterkey))
+		return nil, nil
+	}
+	tlog.Info.Printf("Using master key from the kernel keyring")
+	if confFile.Expired(time.Now()) {
+		if err = confirmExpired(args, confFile); err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+	}
+	args._keyringDesc = desc
+	return masterkey, confFile
+}
+
+// keyringStore stores "masterkey" in the kernel keyring, expiring after
+// "-keyring_timeout" seconds. Failures are not fatal.
+func keyringStore(args *argContainer, confFile *configfile.ConfFile, masterkey []byte) {
+	if !keyringUsable(confFile) {
+		return
+	}
+	desc := keyring.Description(confFile.KeyID())
+	err := keyring.Store(desc, masterkey, args.keyring_timeout)
+	if err != nil {
+		tlog.Warn.Printf("Could not store the master key in the kernel keyring: %v", err)
+		return
+	}
+	args._keyringDesc = desc
+}
+
+// keyringCtlsock additionally enables the revoke_key control socket command
+type keyringCtlsock struct {
+	*passwdCtlsock
+}
+
+// RevokeKey implements ctlsock.KeyRevoker
+func (k keyringCtlsock) RevokeKey() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	err := keyring.Revoke(k.args._keyringDesc)
+	if err == nil {
+		k.args._webhook.Send(webhook.EventKeyLocked, "")
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
+)
+
+// TestKeyringTamper checks that the kernel keyring does not hand out the
+// master key once the "Sealed" flag or the expiry time has been edited
+func TestKeyringTamper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestKeyringTamper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, expiry := range []bool{false, true} {
+		masterkey, confFile := keyTestConf(t, dir)
+		args := &argContainer{config: filepath.Join(dir, configfile.ConfDefaultName), keyring_timeout: 60}
+		keyringStore(args, confFile, masterkey)
+		if args._keyringDesc == "" {
+			t.Skip("kernel keyring not available")
+		}
+		defer keyring.Revoke(args._keyringDesc)
+		if have, _ := keyringLoad(args); string(have) != string(masterkey) {
+			t.Fatalf("master key not found in the keyring")
+		}
+		keyTestTamper(t, confFile, expiry)
+		if have, _ := keyringLoad(args); have != nil {
+			t.Errorf("expiry=%v: edited config file got the master key from the keyring", expiry)
+		}
+	}
+}
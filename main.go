@@ -7,12 +7,15 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/archivefs"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/speed"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
@@ -46,9 +49,18 @@ func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.Conf
 		masterkey = parseMasterKey(args.masterkey, false)
 		_, confFile, err = configfile.LoadConfFile(args.config, nil)
 	} else {
-		pw := readpassword.Once(args.extpass, "")
+		// Parse the config first to find out if we need a FIDO2 token
+		_, confFile, err = configfile.LoadConfFile(args.config, nil)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return nil, nil, err
+		}
+		pw := readPassword(args, confFile, "")
 		tlog.Info.Println("Decrypting master key")
 		masterkey, confFile, err = configfile.LoadConfFile(args.config, pw)
+		if err == nil && confFile.Expired(time.Now()) {
+			err = confirmExpired(args, confFile)
+		}
 		for i := range pw {
 			pw[i] = 0
 		}
@@ -60,6 +72,27 @@ func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.Conf
 	return masterkey, confFile, nil
 }
 
+// confirmExpired is called when the filesystem has passed its expiry time.
+// Access is only allowed with "-allow_expired", and the user has to enter
+// the password (again, unless the master key came from the TPM).
+func confirmExpired(args *argContainer, confFile *configfile.ConfFile) error {
+	expiry := time.Unix(confFile.Expiry, 0).Format(time.RFC3339)
+	if !args.allow_expired {
+		return exitcodes.NewErr("Filesystem expired on "+expiry+
+			". Pass -allow_expired to access it anyway.", exitcodes.Expired)
+	}
+	tlog.Info.Printf(tlog.ColorYellow+"Filesystem expired on %s."+tlog.ColorReset, expiry)
+	pw := readPassword(args, confFile, "Password again")
+	key, _, err := configfile.LoadConfFile(args.config, pw)
+	for i := range pw {
+		pw[i] = 0
+	}
+	for i := range key {
+		key[i] = 0
+	}
+	return err
+}
+
 // changePassword - change the password of config file "filename"
 // Does not return (calls os.Exit both on success and on error).
 func changePassword(args *argContainer) {
@@ -71,9 +104,33 @@ func changePassword(args *argContainer) {
 		if err != nil {
 			exitcodes.Exit(err)
 		}
-		tlog.Info.Println("Please enter your new password.")
-		newPw := readpassword.Twice(args.extpass)
+		if args.extpass == "" && !confFile.IsFeatureFlagSet(configfile.FlagDualControl) &&
+			!confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			tlog.Info.Println("Please enter your new password.")
+		}
+		newPw := readNewPassword(args, confFile.FIDO2, confFile.IsFeatureFlagSet(configfile.FlagDualControl))
+		if args.duress && (confFile.IsFeatureFlagSet(configfile.FlagDualControl) ||
+			confFile.IsFeatureFlagSet(configfile.FlagFIDO2)) {
+			tlog.Fatal.Printf("Dual control and FIDO2 filesystems do not support -duress")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.duress {
+			duressPw := readDuressPassword(args, newPw)
+			confFile.SetDuressPassword(duressPw, args.scryptn)
+			for i := range duressPw {
+				duressPw[i] = 0
+			}
+		}
 		readpassword.CheckTrailingGarbage()
+		if args.expiry != "" {
+			confFile.SetExpiry(args._expiry)
+		}
+		if args.tpm2 {
+			tpm2SealKey(args, confFile, masterkey)
+		} else if args.expiry != "" {
+			// The TPM-sealed copy is bound to the expiry time
+			tpm2Reseal(args, confFile, masterkey)
+		}
 		confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
 		for i := range newPw {
 			newPw[i] = 0
@@ -139,6 +196,11 @@ func main() {
 	if args.debug {
 		tlog.Debug.Enabled = true
 	}
+	// "-export_tar" needs stdout for the tar stream
+	if args.export_tar {
+		tlog.Debug.Logger.SetOutput(os.Stderr)
+		tlog.Info.Logger.SetOutput(os.Stderr)
+	}
 	// "-v"
 	if args.version {
 		tlog.Debug.Printf("openssl=%v\n", args.openssl)
@@ -156,6 +218,14 @@ func main() {
 		speed.Run()
 		os.Exit(0)
 	}
+	// "-bench_suite"
+	if args.bench_suite {
+		if err := speed.RunSuite(os.Stdout, GitVersion); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.Other)
+		}
+		os.Exit(0)
+	}
 	if args.wpanic {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
@@ -174,11 +244,21 @@ func main() {
 	}
 	// Check that CIPHERDIR exists
 	args.cipherdir, _ = filepath.Abs(flagSet.Arg(0))
-	err = isDir(args.cipherdir)
-	if err != nil {
+	if archivefs.IsArchive(args.cipherdir) {
+		openArchive(&args)
+	} else if err = isDir(args.cipherdir); err != nil {
 		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 		os.Exit(exitcodes.CipherDir)
 	}
+	// "-metadata_dir"
+	if args.metadata_dir != "" {
+		args.metadata_dir, _ = filepath.Abs(args.metadata_dir)
+		if err = isDir(args.metadata_dir); err != nil {
+			tlog.Fatal.Printf("Invalid \"-metadata_dir\" setting: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		nametransform.SetMetadataDir(args.cipherdir, args.metadata_dir)
+	}
 	// "-q"
 	if args.quiet {
 		tlog.Info.Enabled = false
@@ -196,6 +276,10 @@ func main() {
 		}
 		tlog.Info.Printf("Using config file at custom location %s", args.config)
 		args._configCustom = true
+	} else if args._archive != nil {
+		args.config = archiveConfig(&args)
+		// Keep args._archiveConf open until main() returns
+		defer runtime.KeepAlive(&args)
 	} else if args.reverse {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfReverseName)
 	} else {
@@ -261,11 +345,11 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -seal, -unseal, -export_tar is allowed")
 		os.Exit(exitcodes.Usage)
 	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -seal, -unseal, -export_tar take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
@@ -289,4 +373,14 @@ func main() {
 		fsck(&args)
 		os.Exit(0)
 	}
+	// "-seal" and "-unseal"
+	if args.seal || args.unseal {
+		setSealed(&args, args.seal)
+		os.Exit(0)
+	}
+	// "-export_tar"
+	if args.export_tar {
+		exportTar(&args)
+		os.Exit(0)
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 
@@ -92,6 +93,31 @@ func getMasterKey(args *argContainer) (masterkey []byte, confFile *configfile.Co
 			tlog.ColorReset)
 		return make([]byte, cryptocore.KeyLen), nil
 	}
+	// "-tpm2"
+	if args.tpm2 {
+		masterkey, confFile = tpm2UnsealKey(args)
+		if confFile.Expired(time.Now()) {
+			if err := confirmExpired(args, confFile); err != nil {
+				tlog.Fatal.Println(err)
+				exitcodes.Exit(err)
+			}
+		}
+		return masterkey, confFile
+	}
+	// "-use_keyring"
+	if args.use_keyring {
+		masterkey, confFile = keyringLoad(args)
+		if masterkey != nil {
+			return masterkey, confFile
+		}
+	}
+	// "-use_agent"
+	if args.use_agent {
+		masterkey, confFile = agentLoad(args)
+		if masterkey != nil {
+			return masterkey, confFile
+		}
+	}
 	var err error
 	// Load master key from config file (normal operation).
 	// Prompts the user for the password.
@@ -104,6 +130,12 @@ func getMasterKey(args *argContainer) (masterkey []byte, confFile *configfile.Co
 		exitcodes.Exit(err)
 	}
 	readpassword.CheckTrailingGarbage()
+	if args.use_keyring {
+		keyringStore(args, confFile, masterkey)
+	}
+	if args.use_agent {
+		agentStore(confFile, masterkey)
+	}
 	if !args.fsck {
 		// We only want to print the masterkey message on a normal mount.
 		printMasterKey(masterkey)
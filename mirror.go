@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	abi "github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// mirrorPollInterval is how often a "-mirror" mount asks the primary mount
+// whether CIPHERDIR has changed
+var mirrorPollInterval = 500 * time.Millisecond
+
+// mirror keeps the caches of a "-mirror" mount in line with the read-write
+// primary mount. It polls the "changes" command on the control socket of
+// the primary mount, and drops the caches when the count has moved.
+type mirror struct {
+	// sockPath is the control socket of the primary mount
+	sockPath string
+	// c is the connection, or nil after it has broken
+	c *abi.CtlSock
+	// Last answer to the "changes" command
+	epoch   string
+	changes uint64
+	// lost is true while the primary mount cannot be reached
+	lost bool
+}
+
+// newMirror connects to the control socket of the primary mount at
+// "sockPath"
+func newMirror(sockPath string) (*mirror, error) {
+	c, err := abi.New(sockPath)
+	if err != nil {
+		return nil, err
+	}
+	m := &mirror{sockPath: sockPath, c: c}
+	m.epoch, m.changes, err = c.Changes()
+	if err == syscall.ENOSYS {
+		err = fmt.Errorf("%s: the %q command is not available. Is this a read-write mount of a newer gocryptfs?",
+			sockPath, abi.CmdChanges)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// poll asks the primary mount for changes and calls "drop" if there have
+// been any. While the primary mount cannot be reached, we cannot know, so
+// "drop" is called on every poll.
+func (m *mirror) poll(drop func()) {
+	if m.c == nil {
+		c, err := abi.New(m.sockPath)
+		if err != nil {
+			m.setLost(err)
+			drop()
+			return
+		}
+		m.c = c
+	}
+	epoch, n, err := m.c.Changes()
+	if err != nil {
+		m.c.Close()
+		m.c = nil
+		m.setLost(err)
+		drop()
+		return
+	}
+	if m.lost {
+		tlog.Info.Printf("-mirror: reconnected to the primary mount")
+		m.lost = false
+	}
+	if epoch != m.epoch || n != m.changes {
+		m.epoch, m.changes = epoch, n
+		drop()
+	}
+}
+
+// setLost warns once that the primary mount is gone
+func (m *mirror) setLost(err error) {
+	if !m.lost {
+		tlog.Warn.Printf("-mirror: lost the primary mount: %v. Caches are dropped until it is back.", err)
+		m.lost = true
+	}
+}
+
+// run calls poll every mirrorPollInterval. It never returns.
+func (m *mirror) run(drop func()) {
+	for range time.Tick(mirrorPollInterval) {
+		m.poll(drop)
+	}
+}
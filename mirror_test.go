@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+)
+
+type mirrorTestFS struct{}
+
+func (mirrorTestFS) EncryptPath(p string) (string, error) { return p, nil }
+func (mirrorTestFS) DecryptPath(p string) (string, error) { return p, nil }
+
+type mirrorTestCounter struct {
+	epoch string
+	n     uint64
+}
+
+func (c *mirrorTestCounter) Changes() (string, uint64) {
+	return c.epoch, atomic.LoadUint64(&c.n)
+}
+
+func serveMirrorTest(t *testing.T, sockPath string, c *mirrorTestCounter) net.Listener {
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ctlsock.ServeExtras(sock, mirrorTestFS{}, nil, ctlsock.Extras{Changes: c})
+	return sock
+}
+
+// TestMirrorPoll checks that the caches are dropped when the primary mount
+// has changed something, and while it is gone
+func TestMirrorPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMirrorPoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "sock")
+	if _, err = newMirror(sockPath); err == nil {
+		t.Error("connecting to a missing socket should fail")
+	}
+	counter := &mirrorTestCounter{epoch: "1"}
+	sock := serveMirrorTest(t, sockPath, counter)
+	m, err := newMirror(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drops := 0
+	drop := func() { drops++ }
+	m.poll(drop)
+	if drops != 0 {
+		t.Errorf("nothing has changed, but the caches were dropped")
+	}
+	atomic.AddUint64(&counter.n, 1)
+	m.poll(drop)
+	m.poll(drop)
+	if drops != 1 {
+		t.Errorf("want 1 drop, have %d", drops)
+	}
+	// The primary mount goes away. Closing the listener does not end the
+	// connections that are being served, so close ours as well.
+	sock.Close()
+	m.c.Close()
+	m.poll(drop)
+	m.poll(drop)
+	if drops != 3 || !m.lost {
+		t.Errorf("drops=%d lost=%v", drops, m.lost)
+	}
+	// ...and is mounted again, with the counter starting from zero
+	os.Remove(sockPath)
+	sock = serveMirrorTest(t, sockPath, &mirrorTestCounter{epoch: "2"})
+	defer sock.Close()
+	m.poll(drop)
+	if drops != 4 || m.lost || m.epoch != "2" {
+		t.Errorf("drops=%d lost=%v epoch=%q", drops, m.lost, m.epoch)
+	}
+	m.poll(drop)
+	if drops != 4 {
+		t.Errorf("nothing has changed, but the caches were dropped")
+	}
+}
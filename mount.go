@@ -14,6 +14,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,15 +22,23 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 
+	"github.com/rfjakob/gocryptfs/internal/archivefs"
+	"github.com/rfjakob/gocryptfs/internal/asof"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/desktopnotify"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/freeze"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/optrace"
+	"github.com/rfjakob/gocryptfs/internal/scratch"
+	"github.com/rfjakob/gocryptfs/internal/shred"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/webhook"
 )
 
 // doMount mounts an encrypted directory.
@@ -71,6 +80,19 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
+	if args.shred > 0 {
+		warnings, err := shred.Check(args.cipherdir)
+		if err != nil {
+			tlog.Fatal.Printf("-shred: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		for _, w := range warnings {
+			tlog.Warn.Printf("-shred: %s", w)
+		}
+	}
+	if args.discard && os.Getuid() != 0 {
+		tlog.Warn.Printf("-discard: FITRIM needs root privileges, it will most likely fail")
+	}
 	// Open control socket early so we can error out before asking the user
 	// for the password
 	if args.ctlsock != "" {
@@ -78,7 +100,15 @@ func doMount(args *argContainer) {
 		// This messes up the delete-on-close logic in the unix socket object.
 		args.ctlsock, _ = filepath.Abs(args.ctlsock)
 		var sock net.Listener
-		sock, err = net.Listen("unix", args.ctlsock)
+		if args._ctlsockMode >= 0 {
+			// Create the socket with the right permissions. A chmod after
+			// Listen would leave a window where others can connect.
+			oldUmask := syscall.Umask(0777 &^ args._ctlsockMode)
+			sock, err = net.Listen("unix", args.ctlsock)
+			syscall.Umask(oldUmask)
+		} else {
+			sock, err = net.Listen("unix", args.ctlsock)
+		}
 		if err != nil {
 			tlog.Fatal.Printf("ctlsock: %v", err)
 			os.Exit(exitcodes.CtlSock)
@@ -92,16 +122,89 @@ func doMount(args *argContainer) {
 			}
 		}()
 	}
+	// Check that the primary mount is there before asking for the password
+	// as well
+	if args.mirror != "" {
+		// We reconnect after we have cd'ed to / when daemonizing
+		args.mirror, _ = filepath.Abs(args.mirror)
+		args._mirror, err = newMirror(args.mirror)
+		if err != nil {
+			tlog.Fatal.Printf("-mirror: %v", err)
+			os.Exit(exitcodes.CtlSock)
+		}
+	}
+	if args.ctlsock_http != "" {
+		l, err := net.Listen("tcp", args.ctlsock_http)
+		if err != nil {
+			tlog.Fatal.Printf("ctlsock_http: %v", err)
+			os.Exit(exitcodes.CtlSock)
+		}
+		args._ctlsockHTTP = l
+		defer l.Close()
+	}
+	if args.webhook != "" {
+		args._webhook = webhook.New(args.webhook, args.cipherdir, args.mountpoint)
+	}
+	if args.desktop_notify {
+		args._desktopNotify, err = desktopnotify.New(args.mountpoint)
+		if err != nil {
+			tlog.Warn.Printf("-desktop_notify: %v, notifications are disabled", err)
+		}
+	}
 	// We cannot use JSON for pretty-printing as the fields are unexported
 	tlog.Debug.Printf("cli args: %#v", args)
+	// The "freeze" control socket command only makes sense if we write to
+	// CIPHERDIR
+	if args.ctlsock != "" && !args.reverse && args._archive == nil {
+		args._freezer = freeze.New(args.cipherdir)
+	}
 	// Initialize gocryptfs
 	fs, wipeKeys := initFuseFrontend(args)
+	var pathFs pathfs.FileSystem = fs
+	if args._freezer != nil {
+		pathFs = args._freezer.Wrap(pathFs)
+	}
+	if args.scratch_glob != "" {
+		maxBytes := uint64(args.scratch_size) * 1024 * 1024
+		pathFs = scratch.New(strings.Split(args.scratch_glob, ","), maxBytes).Wrap(pathFs)
+	}
+	if args.record_trace != "" {
+		f, err := os.OpenFile(args.record_trace, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			tlog.Fatal.Printf("-record_trace: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		rec := optrace.NewRecorder(f)
+		defer rec.Close()
+		pathFs = rec.Wrap(pathFs)
+	}
+	if args._guard != nil {
+		args._guard.OnTrigger = func(detail string) { guardTriggered(args, detail) }
+		pathFs = args._guard.Wrap(pathFs)
+	}
+	var idle *idleMonitor
+	if args.idle > 0 {
+		idle = newIdleMonitor(pathFs)
+		idle.notify = args._desktopNotify
+		pathFs = idle
+	}
 	// Initialize go-fuse FUSE server
-	srv := initGoFuse(fs, args)
+	srv, conn := initGoFuse(pathFs, args)
+	if ffs, ok := fs.(*fusefrontend.FS); ok && args.writeback {
+		ffs.SetConnector(conn)
+	}
+	if ffs, ok := fs.(*fusefrontend.FS); ok && args._mirror != nil {
+		go args._mirror.run(ffs.DropCaches)
+	}
+	if idle != nil {
+		srv.RecordLatencies(idle)
+		go idle.run(srv, args.idle)
+	}
 	// Try to wipe secrect keys from memory after unmount
 	defer wipeKeys()
 
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
+	args._webhook.Send(webhook.EventMounted, "")
 	// We have been forked into the background, as evidenced by the set
 	// "notifypid".
 	if args.notifypid > 0 {
@@ -133,12 +236,29 @@ func doMount(args *argContainer) {
 	// Wait for SIGINT in the background and unmount ourselves if we get it.
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
-	handleSigint(srv, args.mountpoint)
+	handleSigint(srv, args)
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
 	// Jump into server loop. Returns when it gets an umount request from the kernel.
 	srv.Serve()
+	notifyUnmounted(args._webhook)
+}
+
+// webhookCloseTimeout is how long we wait for the delivery of the last
+// webhook events before we exit
+const webhookCloseTimeout = 10 * time.Second
+
+var notifyUnmountedOnce sync.Once
+
+// notifyUnmounted sends the "unmounted" webhook event and waits for the
+// delivery. Both the main goroutine and the signal handler call it, the
+// event is only sent once.
+func notifyUnmounted(n *webhook.Notifier) {
+	notifyUnmountedOnce.Do(func() {
+		n.Send(webhook.EventUnmounted, "")
+		n.Close(webhookCloseTimeout)
+	})
 }
 
 // setOpenFileLimit tries to increase the open file limit to 4096 (the default hard
@@ -182,34 +302,89 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	if args.aessiv {
 		cryptoBackend = cryptocore.BackendAESSIV
 	}
+	if args.xchacha {
+		cryptoBackend = cryptocore.BackendXChaCha20Poly1305
+	}
 	// forceOwner implies allow_other, as documented.
 	// Set this early, so args.allow_other can be relied on below this point.
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:      args.cipherdir,
-		PlaintextNames: args.plaintextnames,
-		LongNames:      args.longnames,
-		ConfigCustom:   args._configCustom,
-		NoPrealloc:     args.noprealloc,
-		SerializeReads: args.serialize_reads,
-		ForceDecode:    args.forcedecode,
-		ForceOwner:     args._forceOwner,
-	}
+		Cipherdir:       args.cipherdir,
+		PlaintextNames:  args.plaintextnames,
+		LongNames:       args.longnames,
+		ConfigCustom:    args._configCustom,
+		NoPrealloc:      args.noprealloc,
+		WriteBarriers:   args.write_barriers,
+		StrictPosix:     args.strict_posix,
+		NoCreateWrite:   args.nocreatewrite,
+		SerializeReads:  args.serialize_reads,
+		ForceDecode:     args.forcedecode,
+		ForceOwner:      args._forceOwner,
+		CipherDf:        args.cipherdf,
+		FollowSymlinks:  args.follow_symlinks,
+		SharedStorage:   args.sharedstorage,
+		ReadAhead:       uint64(args.readahead) * 1024,
+		DetectConflicts: args.detect_conflicts,
+		ConflictEIO:     args.conflict_eio,
+		RawAccess:       args.raw_access,
+		Webhook:         args._webhook,
+		Writeback:       args.writeback,
+		FaultInject:     args._faultInject,
+	}
+	if args.nocache_glob != "" {
+		frontendArgs.NoCacheGlob = strings.Split(args.nocache_glob, ",")
+	}
+	frontendArgs.DesktopNotify = args._desktopNotify
+	frontendArgs.PlaintextCacheSize = uint64(args.plaintext_cache_size) * 1024 * 1024
+	frontendArgs.Exclude = args._exclude
+	frontendArgs.Shred = args.shred
+	frontendArgs.Discard = args.discard
+	frontendArgs.DirtyRanges = args.dirty_ranges
+	frontendArgs.OneFileSystem = args.one_file_system
+	frontendArgs.Writable = args.writable
+	if args._asOf != 0 {
+		frontendArgs.AsOf = asof.New(time.Unix(args._asOf, 0))
+	}
+	plainBS := uint64(args.blocksize)
+	externalHeaders := args.external_headers
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
+		plainBS = confFile.PlainBS()
+		externalHeaders = confFile.IsFeatureFlagSet(configfile.FlagExternalHeaders)
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		frontendArgs.Policy = confFile.Policy
+		frontendArgs.Limits = confFile.Limits
+		frontendArgs.Passthrough = confFile.Passthrough
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
-		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
-			cryptoBackend = cryptocore.BackendAESSIV
-		} else if args.reverse {
+		// The Sealed flag is authenticated on every path that hands out the
+		// master key, see configfile.ConfFile.KeyAD()
+		if confFile.IsFeatureFlagSet(configfile.FlagSealed) {
+			if args.writable {
+				tlog.Fatal.Printf("Filesystem is sealed, -writable is not allowed")
+				os.Exit(exitcodes.Usage)
+			}
+			if !args.ro {
+				tlog.Info.Printf("Filesystem is sealed, mounting read-only")
+				args.ro = true
+			}
+		}
+		if be, ok := confFile.AEADBackend(); ok {
+			cryptoBackend = be
+		}
+		if args.reverse && !cryptoBackend.Spec().Deterministic {
 			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	frontendArgs.ReadOnly = args.ro
+	frontendArgs.ExposeControlFiles = args.expose_control_files
+	if args.expose_control_files && !frontendArgs.PlaintextNames {
+		tlog.Info.Printf("-expose_control_files has no effect because file names are encrypted")
+	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
 	if args.allow_other && os.Getuid() == 0 {
@@ -219,9 +394,26 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	tlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
 
 	// Init crypto backend
-	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
+	cCore := cryptocore.New(masterkey, cryptoBackend, cryptoBackend.Spec().IVBits, args.hkdf, args.forcedecode)
+	cEnc := contentenc.New(cCore, plainBS, args.forcedecode)
+	if externalHeaders {
+		if args.reverse || args._archive != nil {
+			tlog.Fatal.Printf("Filesystems with external file headers cannot be used in reverse mode or from an archive")
+			os.Exit(exitcodes.Usage)
+		}
+		cEnc.SetExternalHeaders()
+	}
+	if args.serialize_writes {
+		cEnc.SetSerializeWrites()
+	}
 	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.raw64)
+	nameTransform.LongNameRetries = args.longnameretries
+	if args.ino_namespace {
+		frontendArgs.InoNamespace = cryptocore.InoNamespace(masterkey)
+	}
+	if args.write_manifest != "" || args.verify_manifest != "" {
+		args._manifestKey = cryptocore.ManifestKey(masterkey)
+	}
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
 	for i := range masterkey {
@@ -231,42 +423,76 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	// Spawn fusefrontend
 	var fs ctlsockFs
 	if args.reverse {
-		if cryptoBackend != cryptocore.BackendAESSIV {
+		if !cryptoBackend.Spec().Deterministic {
 			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
 		}
 		fs = fusefrontend_reverse.NewFS(frontendArgs, cEnc, nameTransform)
 
+	} else if args._archive != nil {
+		fs = archivefs.NewFS(args._archive, frontendArgs, cEnc, nameTransform)
 	} else {
 		fs = fusefrontend.NewFS(frontendArgs, cEnc, nameTransform)
 	}
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
 	if args._ctlsockFd != nil {
-		go ctlsock.Serve(args._ctlsockFd, fs)
+		var iface ctlsock.Interface = fs
+		// Without a config file ("-masterkey", "-zerokey"), there is no
+		// password to change. The config file in an archive cannot be
+		// changed.
+		if confFile != nil && args._archive == nil {
+			p := &passwdCtlsock{Interface: fs, args: args}
+			iface = p
+			if args._keyringDesc != "" {
+				iface = keyringCtlsock{p}
+			}
+		}
+		var extras ctlsock.Extras
+		if args._guard != nil {
+			extras.Unfreezer = args._guard
+		}
+		if args._freezer != nil {
+			extras.Freezer = args._freezer
+			extras.Changes = args._freezer
+		}
+		go ctlsock.ServeExtras(args._ctlsockFd, iface, args._ctlsockACL, extras)
+	}
+	if args._ctlsockHTTP != nil {
+		go ctlsock.ServeHTTPAPI(args._ctlsockHTTP, fs, args._ctlsockACL)
+	}
+	return fs, func() {
+		cCore.Wipe()
+		for i := range args._manifestKey {
+			args._manifestKey[i] = 0
+		}
 	}
-	return fs, func() { cCore.Wipe() }
 }
 
-func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
+func initGoFuse(fs pathfs.FileSystem, args *argContainer) (*fuse.Server, *nodefs.FileSystemConnector) {
 	// pathFsOpts are passed into go-fuse/pathfs
 	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: true}
-	if args.sharedstorage {
+	if args.sharedstorage || args.mirror != "" {
 		// shared storage mode disables hard link tracking as the backing inode
 		// numbers may change behind our back:
 		// https://github.com/rfjakob/gocryptfs/issues/156
+		// The same goes for the files that the primary mount of "-mirror"
+		// deletes and creates.
 		pathFsOpts.ClientInodes = false
 	}
 	if args.reverse {
-		// Reverse mode is read-only, so we don't need a working link().
+		// Reverse mode has no link(), not even with "-writable".
 		// Disable hard link tracking to avoid strange breakage on duplicate
 		// inode numbers ( https://github.com/rfjakob/gocryptfs/issues/149 ).
 		pathFsOpts.ClientInodes = false
 	}
 	pathFs := pathfs.NewPathNodeFs(fs, pathFsOpts)
 	var fuseOpts *nodefs.Options
-	if args.sharedstorage {
+	if args.sharedstorage || args.strict_posix || args.mirror != "" {
 		// sharedstorage mode sets all cache timeouts to zero so changes to the
-		// backing shared storage show up immediately.
+		// backing shared storage show up immediately. In strict POSIX mode,
+		// stat() must see the timestamps and link counts that the last
+		// operation has left behind. The kernel does not know when the
+		// primary mount of "-mirror" changes something.
 		fuseOpts = &nodefs.Options{}
 	} else {
 		fuseOpts = &nodefs.Options{
@@ -294,6 +520,10 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		mOpts.AllowOther = true
 		// Make the kernel check the file permissions for us
 		mOpts.Options = append(mOpts.Options, "default_permissions")
+	} else if args.strict_posix {
+		// The permission checks are then done exactly like on a local
+		// filesystem, including the sticky bit and supplementary groups
+		mOpts.Options = append(mOpts.Options, "default_permissions")
 	}
 	if args.forcedecode {
 		tlog.Info.Printf(tlog.ColorYellow + "THE OPTION \"-forcedecode\" IS ACTIVE. GOCRYPTFS WILL RETURN CORRUPT DATA!" +
@@ -322,8 +552,8 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 	}
 
 	// The kernel enforces read-only operation, we just have to pass "ro".
-	// Reverse mounts are always read-only.
-	if args.ro || args.reverse {
+	// Reverse mounts are read-only unless "-writable" is passed.
+	if args.ro || (args.reverse && !args.writable) {
 		mOpts.Options = append(mOpts.Options, "ro")
 	}
 	// Add additional mount options (if any) after the stock ones, so the user has
@@ -348,10 +578,10 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 	// directories with the requested permissions.
 	syscall.Umask(0000)
 
-	return srv
+	return srv, conn
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
+func handleSigint(srv *fuse.Server, args *argContainer) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
@@ -363,12 +593,13 @@ func handleSigint(srv *fuse.Server, mountpoint string) {
 			if runtime.GOOS == "linux" {
 				// MacOSX does not support lazy unmount
 				tlog.Info.Printf("Trying lazy unmount")
-				cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
+				cmd := exec.Command("fusermount", "-u", "-z", args.mountpoint)
 				cmd.Stdout = os.Stdout
 				cmd.Stderr = os.Stderr
 				cmd.Run()
 			}
 		}
+		notifyUnmounted(args._webhook)
 		os.Exit(exitcodes.SigInt)
 	}()
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fido2"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readPassword gets the password for "confFile". This is the hmac-secret
+// from the FIDO2 token for filesystems that use one, and what the user enters
+// (or "-extpass" returns) otherwise. Dual control filesystems need both
+// persons' passwords, or one password and the FIDO2 token.
+// "prompt" is passed to readpassword.Once.
+// Calls os.Exit on failure.
+func readPassword(args *argContainer, confFile *configfile.ConfFile, prompt string) []byte {
+	var params *configfile.FIDO2Params
+	if confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		if args.fido2 == "" {
+			tlog.Fatal.Printf("The master key is protected by a FIDO2 token, please pass -fido2 DEVICE")
+			os.Exit(exitcodes.Usage)
+		}
+		params = confFile.FIDO2
+	}
+	if !confFile.IsFeatureFlagSet(configfile.FlagDualControl) {
+		if params != nil {
+			return fido2.Secret(args.fido2, params.CredentialID, params.HMACSalt)
+		}
+		return readpassword.Once(args.extpass, prompt)
+	}
+	if prompt == "" {
+		prompt = "Password"
+	}
+	pw1 := readpassword.Once(args.extpass, prompt+" (first person)")
+	var pw2 []byte
+	if params != nil {
+		pw2 = fido2.Secret(args.fido2, params.CredentialID, params.HMACSalt)
+	} else {
+		pw2 = readpassword.Once(args.extpass, prompt+" (second person)")
+	}
+	return combinePasswords(pw1, pw2)
+}
+
+// readNewPassword asks for a new password (on "-init" and "-passwd").
+// If "params" is set, the FIDO2 hmac-secret is used instead of a (second)
+// password. The caller should call readpassword.CheckTrailingGarbage() when
+// done reading passwords.
+// Calls os.Exit on failure.
+func readNewPassword(args *argContainer, params *configfile.FIDO2Params, dualControl bool) []byte {
+	if !dualControl && params != nil {
+		return fido2.Secret(args.fido2, params.CredentialID, params.HMACSalt)
+	}
+	if dualControl && args.extpass == "" {
+		tlog.Info.Printf("First person: choose your password.")
+	}
+	pw1 := readpassword.Twice(args.extpass)
+	if !dualControl {
+		return pw1
+	}
+	var pw2 []byte
+	if params != nil {
+		pw2 = fido2.Secret(args.fido2, params.CredentialID, params.HMACSalt)
+	} else {
+		if args.extpass == "" {
+			tlog.Info.Printf("Second person: choose your password.")
+		}
+		pw2 = readpassword.Twice(args.extpass)
+	}
+	return combinePasswords(pw1, pw2)
+}
+
+// combinePasswords checks that the two dual control passwords differ and
+// combines them into one. Wipes "pw1" and "pw2".
+// Calls os.Exit if they are identical.
+func combinePasswords(pw1 []byte, pw2 []byte) []byte {
+	defer func() {
+		for i := range pw1 {
+			pw1[i] = 0
+		}
+		for i := range pw2 {
+			pw2[i] = 0
+		}
+	}()
+	if bytes.Equal(pw1, pw2) {
+		tlog.Fatal.Println("Dual control needs two different passwords")
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return configfile.CombinePasswords(pw1, pw2)
+}
+
+// readDuressPassword asks for the duress password (on "-init" and "-passwd"
+// with "-duress"), which must differ from the real password "pw".
+// Calls os.Exit on failure.
+func readDuressPassword(args *argContainer, pw []byte) []byte {
+	if args.extpass == "" {
+		tlog.Info.Printf("Choose the duress password. Entering it instead of the real password destroys the master key.")
+	}
+	duressPw := readpassword.Twice(args.extpass)
+	if bytes.Equal(pw, duressPw) {
+		tlog.Fatal.Println("The duress password must differ from the password")
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return duressPw
+}
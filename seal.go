@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// setSealed - seal or unseal the filesystem described by the config file
+// "args.config". Sealed filesystems are always mounted read-only.
+// Does not return (calls os.Exit both on success and on error).
+func setSealed(args *argContainer, sealed bool) {
+	if args.masterkey != "" {
+		// Re-encrypting the master key with the existing salt needs the
+		// password.
+		tlog.Fatal.Printf("-seal and -unseal cannot be used with -masterkey. Use -passwd to set a new password first.")
+		os.Exit(exitcodes.Usage)
+	}
+	// Check if the file can be opened at all before prompting for a password
+	fd, err := os.Open(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.OpenConf)
+	}
+	fd.Close()
+	_, confFile, err := configfile.LoadConfFile(args.config, nil)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	pw := readPassword(args, confFile, "")
+	tlog.Info.Println("Decrypting master key")
+	masterkey, confFile, err := configfile.LoadConfFile(args.config, pw)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	confFile.SetSealed(masterkey, pw, sealed)
+	// The TPM-sealed copy is bound to the flag as well
+	tpm2Reseal(args, confFile, masterkey)
+	for i := range pw {
+		pw[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	if sealed {
+		tlog.Info.Println(tlog.ColorGreen + "Filesystem sealed. Future mounts will be read-only." + tlog.ColorReset)
+	} else {
+		tlog.Info.Println(tlog.ColorGreen + "Filesystem unsealed." + tlog.ColorReset)
+	}
+}
@@ -3,10 +3,12 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -60,6 +62,187 @@ func TestInitAessiv(t *testing.T) {
 	}
 }
 
+// Test -init with -kdf=argon2id and mount it
+func TestInitArgon2id(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-kdf=argon2id")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagArgon2id) {
+		t.Error("Argon2id flag should be set but is not")
+	}
+	pDir := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, pDir, "-extpass", "echo test")
+	test_helpers.UnmountPanic(pDir)
+}
+
+// Test -init with -xchacha
+func TestInitXChaCha(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-xchacha")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		t.Error("XChaCha20Poly1305 flag should be set but is not")
+	}
+	// Mount without passing -xchacha, the config file must take effect
+	pDir := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	content := []byte("hello xchacha")
+	err = ioutil.WriteFile(pDir+"/foo", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Errorf("wrong size %d", fi.Size())
+	}
+}
+
+// Test -init with -blocksize
+func TestInitBlockSize(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-blocksize=65536")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagBlockSize) || c.BlockSize != 65536 {
+		t.Fatalf("BlockSize not stored in config: %+v", c)
+	}
+	pDir := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	// Two full blocks and one partial block
+	content := make([]byte, 2*65536+1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err = ioutil.WriteFile(pDir+"/foo", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Error("content mismatch")
+	}
+	// 18 bytes header, 32 bytes overhead per block
+	want := int64(len(content) + 18 + 3*32)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == configfile.ConfDefaultName || e.Name() == "gocryptfs.diriv" {
+			continue
+		}
+		if e.Size() != want {
+			t.Errorf("ciphertext size: want %d, have %d", want, e.Size())
+		}
+	}
+}
+
+// Test -seal and -unseal
+func TestSeal(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-seal", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	pDir := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, pDir, "-extpass", "echo test")
+	err := ioutil.WriteFile(pDir+"/foo", nil, 0600)
+	test_helpers.UnmountPanic(pDir)
+	if err == nil {
+		t.Error("writing to a sealed filesystem should have failed")
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-unseal", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	err = ioutil.WriteFile(pDir+"/foo", nil, 0600)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Test -init with -dualcontrol
+func TestInitDualControl(t *testing.T) {
+	dir := test_helpers.TmpDir + "/TestInitDualControl"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-dualcontrol", "-scryptn=10", dir)
+	cmd.Stdin = strings.NewReader("alice\nbob\n")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// One password is not enough
+	_, _, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, []byte("alice"))
+	if err == nil {
+		t.Error("a single password was accepted")
+	}
+	pw := configfile.CombinePasswords([]byte("alice"), []byte("bob"))
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagDualControl) {
+		t.Error("DualControl flag should be set but is not")
+	}
+	// Identical passwords are rejected
+	dir2 := dir + "2"
+	if err = os.Mkdir(dir2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-dualcontrol", "-scryptn=10",
+		"-extpass", "echo test", dir2)
+	if err = cmd.Run(); err == nil {
+		t.Error("identical passwords were accepted")
+	}
+}
+
+// Test -expiry and -allow_expired
+func TestExpiry(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-expiry=2000-01-01")
+	pDir := dir + ".mnt"
+	err := test_helpers.Mount(dir, pDir, false, "-extpass", "echo test", "-wpanic=false")
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Expired {
+		t.Errorf("want=%d, got=%d", exitcodes.Expired, exitCode)
+	}
+	// -allow_expired asks for the password twice (extpass is run twice)
+	test_helpers.MountOrFatal(t, dir, pDir, "-extpass", "echo test", "-allow_expired")
+	test_helpers.UnmountPanic(pDir)
+	// Remove the expiry date
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-allow_expired",
+		"-expiry", "none", dir)
+	cmd.Stdin = strings.NewReader("test\ntest\ntest\n")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, pDir, "-extpass", "echo test")
+	test_helpers.UnmountPanic(pDir)
+}
+
 // Test -init with -reverse
 func TestInitReverse(t *testing.T) {
 	dir := test_helpers.InitFS(t, "-reverse")
@@ -244,6 +427,48 @@ func TestRo(t *testing.T) {
 	}
 }
 
+// Test "-readahead": sequential reads must return the right data, also
+// after the file has been modified
+func TestReadahead(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-readahead=512", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+
+	file := mnt + "/file"
+	content := make([]byte, 2*1024*1024)
+	for i := range content {
+		content[i] = byte(i / 4096)
+	}
+	err := ioutil.WriteFile(file, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	for off := 0; off < len(content); off += len(buf) {
+		if off == len(content)/2 {
+			// Overwrite data that has probably been read ahead already
+			copy(content[off+len(buf):], []byte("modified"))
+			_, err = f.WriteAt([]byte("modified"), int64(off+len(buf)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = f.ReadAt(buf, int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, content[off:off+len(buf)]) {
+			t.Fatalf("wrong data at offset %d", off)
+		}
+	}
+}
+
 // Test "-nonempty"
 func TestNonempty(t *testing.T) {
 	dir := test_helpers.InitFS(t)
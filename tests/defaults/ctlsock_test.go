@@ -1,11 +1,12 @@
 package defaults
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 	"testing"
 
-	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/ctlsock"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
 
@@ -96,3 +97,86 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// Check that "-ctlsock_acl" blocks request types that are not allowed
+func TestCtlSockACL(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	acl := fmt.Sprintf("%d:encrypt", os.Getuid())
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-ctlsock_acl="+acl,
+		"-ctlsock_mode=0600", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("wrong socket permissions: %o", fi.Mode().Perm())
+	}
+	req := ctlsock.RequestStruct{EncryptPath: "foobar"}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.Result == "" || response.ErrNo != 0 {
+		t.Errorf("encrypt should be allowed: %+v", response)
+	}
+	req = ctlsock.RequestStruct{DecryptPath: response.Result}
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != int32(syscall.EACCES) || response.Result != "" {
+		t.Errorf("decrypt should be denied: %+v", response)
+	}
+}
+
+// "-ctlsock_mode=0" is a valid mode, not the default
+func TestCtlSockModeZero(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-ctlsock_mode=0", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0 {
+		t.Errorf("wrong socket permissions: %o", fi.Mode().Perm())
+	}
+}
+
+// Round-trip a batch of paths through the client library
+func TestCtlSockClient(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	paths := []string{"a", "a/b", "a/b/" + test_helpers.X255}
+	err := os.MkdirAll(pDir+"/"+paths[2], 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	enc, err := c.EncryptPaths(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cPaths []string
+	for _, r := range enc {
+		if r.Err() != nil {
+			t.Fatal(r.Err())
+		}
+		cPaths = append(cPaths, r.Result)
+	}
+	dec, err := c.DecryptPaths(cPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range dec {
+		if r.Result != paths[i] {
+			t.Errorf("want=%q got=%q (err=%v)", paths[i], r.Result, r.Err())
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
@@ -129,3 +130,40 @@ func BenchmarkCreate4kB(t *testing.B) {
 func BenchmarkCreate10kB(t *testing.B) {
 	createFiles(t, t.N, 10*1024)
 }
+
+// BenchmarkRmRf measures "rm -rf" performance. It creates a tree of t.N files,
+// 100 per directory, and deletes it. Every other file gets a long name to
+// exercise the removal of ".name" files.
+func BenchmarkRmRf(t *testing.B) {
+	dir := test_helpers.DefaultPlainDir + "/BenchmarkRmRf"
+	err := os.Mkdir(dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 200)
+	var sub string
+	for i := 0; i < t.N; i++ {
+		if i%100 == 0 {
+			sub = fmt.Sprintf("%s/%d", dir, i/100)
+			err = os.Mkdir(sub, 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		name := fmt.Sprintf("%s/%d", sub, i)
+		if i%2 == 1 {
+			name += long
+		}
+		var fh *os.File
+		fh, err = os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fh.Close()
+	}
+	t.ResetTimer()
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,8 @@ package fsck
 
 import (
 	"encoding/base64"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -83,3 +85,287 @@ func TestExampleFses(t *testing.T) {
 		}
 	}
 }
+
+// TestLongNameOrphan checks that an orphaned .name file, as left behind by an
+// interrupted rename, is reported but does not fail fsck.
+func TestLongNameOrphan(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	orphan := dir + "/gocryptfs.longname.0000000000000000000000000000000000000000000.name"
+	if err := ioutil.WriteFile(orphan, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	outBin, err := cmd.CombinedOutput()
+	out := string(outBin)
+	t.Log(out)
+	if err != nil {
+		t.Errorf("fsck failed: %v", err)
+	}
+	if !strings.Contains(out, "orphaned long name file") {
+		t.Error("orphan was not reported")
+	}
+}
+
+// TestLongNameNameless checks that a long name file whose .name file is
+// missing is reported as such, and fails fsck
+func TestLongNameNameless(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	nameless := dir + "/gocryptfs.longname.0000000000000000000000000000000000000000000"
+	if err := ioutil.WriteFile(nameless, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	outBin, err := cmd.Output()
+	out := string(outBin)
+	t.Log(out)
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, "long name file without .name file") {
+		t.Error("missing .name file was not reported")
+	}
+	if strings.Contains(out, "corrupt entry") {
+		t.Error("reported twice")
+	}
+}
+
+// TestReverse checks that "-fsck -reverse" accepts a clean plaintext tree
+// and reports a socket, which has no place in the encrypted view.
+func TestReverse(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-reverse", "-extpass", "echo test", dir)
+	outBin, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(outBin))
+		t.Errorf("fsck failed: %v", err)
+	}
+	l, err := net.Listen("unix", dir+"/sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-reverse", "-extpass", "echo test", dir)
+	outBin, err = cmd.CombinedOutput()
+	out := string(outBin)
+	t.Log(out)
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, `"sock"`) {
+		t.Error("socket was not reported")
+	}
+}
+
+// TestRepair checks that "-fsck -repair" moves the corrupt entries of
+// broken_fs_v1.4 into quarantine, so that a second fsck finds no problems.
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copy without the xattrs that TestBrokenFsV14 sets, -repair does not
+	// touch corrupt xattrs.
+	cmd := exec.Command("cp", "-r", "broken_fs_v1.4/.", dir)
+	if outBin, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("cp failed: %v\n%s", err, outBin)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-repair", "-extpass", "echo test", dir)
+	outBin, err := cmd.CombinedOutput()
+	t.Log(string(outBin))
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	// corrupt_file
+	if _, err = os.Stat(dir + "/gocryptfs.quarantine/vDKs8a7UtM3PmEKk9wlPcA"); err != nil {
+		t.Error(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	outBin, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(outBin))
+		t.Errorf("fsck after repair failed: %v", err)
+	}
+}
+
+// TestWorkers checks that "-fsck_workers" does not change the report
+func TestWorkers(t *testing.T) {
+	var outs []string
+	for _, w := range []string{"1", "4"} {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-fsck_workers", w, "-extpass", "echo test", "broken_fs_v1.4")
+		outBin, err := cmd.Output()
+		code := test_helpers.ExtractCmdExitCode(err)
+		if code != exitcodes.FsckErrors {
+			t.Errorf("wrong exit code with %s workers, have=%d want=%d", w, code, exitcodes.FsckErrors)
+		}
+		outs = append(outs, string(outBin))
+	}
+	if outs[0] != outs[1] {
+		t.Errorf("reports differ:\n%s\n%s", outs[0], outs[1])
+	}
+}
+
+// TestCheckpoint checks that "-fsck_resume" without a checkpoint file runs a
+// normal check, and that the checkpoint file is deleted at the end
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := dir + "/checkpoint"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-fsck_checkpoint", checkpoint, "-fsck_resume",
+		"-extpass", "echo test", "broken_fs_v1.4")
+	outBin, err := cmd.Output()
+	out := string(outBin)
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, "no checkpoint found") || !strings.Contains(out, "corrupt_file") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if _, err = os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint file has not been deleted: %v", err)
+	}
+	// A checkpoint of another CIPHERDIR must be rejected
+	err = ioutil.WriteFile(checkpoint, []byte(`{"Cipherdir": "/nonexistent", "Done": 1}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-fsck_checkpoint", checkpoint, "-fsck_resume",
+		"-extpass", "echo test", "broken_fs_v1.4")
+	_, err = cmd.Output()
+	code = test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.Usage {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.Usage)
+	}
+}
+
+// TestDirIV checks that wrong permissions on gocryptfs.diriv are reported
+// without failing fsck, and that -repair replaces a missing one
+func TestDirIV(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	diriv := dir + "/gocryptfs.diriv"
+	if err := os.Chmod(diriv, 0606); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	outBin, err := cmd.Output()
+	out := string(outBin)
+	t.Log(out)
+	if err != nil {
+		t.Errorf("fsck failed: %v", err)
+	}
+	if !strings.Contains(out, "has permissions 0606") {
+		t.Error("wrong permissions were not reported")
+	}
+	if err = os.Remove(diriv); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	outBin, err = cmd.Output()
+	out = string(outBin)
+	t.Log(out)
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, "missing gocryptfs.diriv") || !strings.Contains(out, "The directory is empty") {
+		t.Error("missing gocryptfs.diriv was not reported")
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-repair", "-extpass", "echo test", dir)
+	if outBin, err = cmd.Output(); test_helpers.ExtractCmdExitCode(err) != exitcodes.FsckErrors {
+		t.Errorf("repair: %v\n%s", err, outBin)
+	}
+	fi, err := os.Stat(diriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 16 || fi.Mode().Perm() != 0400 {
+		t.Errorf("new gocryptfs.diriv: size=%d mode=%v", fi.Size(), fi.Mode())
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	if outBin, err = cmd.CombinedOutput(); err != nil {
+		t.Errorf("fsck after repair failed: %v\n%s", err, outBin)
+	}
+}
+
+// TestFast checks that "-fsck_fast" finds broken headers, but not broken
+// file content
+func TestFast(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-fsck_fast", "-extpass", "echo test", "broken_fs_v1.4")
+	outBin, err := cmd.Output()
+	out := string(outBin)
+	t.Log(out)
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	// corrupt_file has a valid header, corrupt_file_2 has not
+	if strings.Contains(out, `"corrupt_file"`) {
+		t.Error("file content has been checked")
+	}
+	for _, name := range []string{"corrupt_file_2", "incomplete_file_1", "invalid_file_name_2", "corrupt_symlink"} {
+		if !strings.Contains(out, `"`+name+`"`) {
+			t.Errorf("%q was not reported", name)
+		}
+	}
+}
+
+// TestManifest checks that "-verify_manifest" finds a file whose content
+// has been replaced by other valid content, and a missing file
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("cp", "-a", "../example_filesystems/v1.3/.", dir)
+	if outBin, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("cp failed: %v\n%s", err, outBin)
+	}
+	manifest := dir + ".manifest"
+	defer os.Remove(manifest)
+	fsck := func(args ...string) (string, int) {
+		args = append([]string{"-fsck", "-extpass", "echo test"}, append(args, dir)...)
+		outBin, err := exec.Command(test_helpers.GocryptfsBinary, args...).CombinedOutput()
+		return string(outBin), test_helpers.ExtractCmdExitCode(err)
+	}
+	out, code := fsck("-write_manifest", manifest)
+	if code != 0 || !strings.Contains(out, "wrote the hashes of 2 files") {
+		t.Fatalf("writing the manifest failed with code %d:\n%s", code, out)
+	}
+	if out, code = fsck("-verify_manifest", manifest); code != 0 {
+		t.Errorf("unmodified filesystem: code %d\n%s", code, out)
+	}
+	// An empty file is valid, like an older version of the file would be
+	long := dir + "/gocryptfs.longname.QhUr5d9FHerwEs--muUs6_80cy6JRp89c1otLwp92Cs"
+	if err = os.Truncate(long, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(dir + "/mGj2_hdnHe34Sp0iIQUwuw"); err != nil {
+		t.Fatal(err)
+	}
+	out, code = fsck("-verify_manifest", manifest)
+	t.Log(out)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, "does not match the manifest") || !strings.Contains(out, `"mGj2_hdnHe34Sp0iIQUwuw" from the manifest is missing`) {
+		t.Error("changes were not reported")
+	}
+	// A manifest of another filesystem
+	if err = ioutil.WriteFile(manifest, []byte(`{"Check": "00", "Files": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, code = fsck("-verify_manifest", manifest); code != exitcodes.Other {
+		t.Errorf("foreign manifest: have code %d, want %d", code, exitcodes.Other)
+	}
+}
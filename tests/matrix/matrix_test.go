@@ -1,4 +1,4 @@
-// Tests run for (almost all) combinations of openssl, aessiv, plaintextnames.
+// Tests run for (almost all) combinations of openssl, aessiv, xchacha, plaintextnames.
 package matrix
 
 // File reading, writing, modification, truncate
@@ -37,21 +37,24 @@ type testcaseMatrix struct {
 	openssl        string
 	aessiv         bool
 	raw64          bool
+	xchacha        bool
 }
 
 var matrix = []testcaseMatrix{
 	// Normal
-	{false, "auto", false, false},
-	{false, "true", false, false},
-	{false, "false", false, false},
+	{false, "auto", false, false, false},
+	{false, "true", false, false, false},
+	{false, "false", false, false, false},
 	// Plaintextnames
-	{true, "true", false, false},
-	{true, "false", false, false},
+	{true, "true", false, false, false},
+	{true, "false", false, false, false},
 	// AES-SIV (does not use openssl, no need to test permutations)
-	{false, "auto", true, false},
-	{true, "auto", true, false},
+	{false, "auto", true, false, false},
+	{true, "auto", true, false, false},
 	// Raw64
-	{false, "auto", false, true},
+	{false, "auto", false, true, false},
+	// XChaCha20-Poly1305 (does not use openssl either)
+	{false, "auto", false, false, true},
 }
 
 // This is the entry point for the tests
@@ -71,6 +74,7 @@ func TestMain(m *testing.M) {
 		opts = append(opts, fmt.Sprintf("-plaintextnames=%v", testcase.plaintextnames))
 		opts = append(opts, fmt.Sprintf("-aessiv=%v", testcase.aessiv))
 		opts = append(opts, fmt.Sprintf("-raw64=%v", testcase.raw64))
+		opts = append(opts, fmt.Sprintf("-xchacha=%v", testcase.xchacha))
 		test_helpers.MountOrExit(test_helpers.DefaultCipherDir, test_helpers.DefaultPlainDir, opts...)
 		before := test_helpers.ListFds()
 		r := m.Run()
@@ -682,6 +686,60 @@ func TestLongLink(t *testing.T) {
 	}
 }
 
+// Build a farm of hard links, with short and long names, like git object
+// stores and the BackupPC pool do, and check that the link count is right
+// after every step. Renaming a link onto another link of the same file must
+// keep both names.
+func TestHardLinkFarm(t *testing.T) {
+	dir := test_helpers.DefaultPlainDir + "/TestHardLinkFarm"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	target := dir + "/target"
+	if err := ioutil.WriteFile(target, []byte("pool"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkNlink := func(want uint64) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(target, &st); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(st.Nlink) != want {
+			t.Fatalf("wrong link count %d, want %d", st.Nlink, want)
+		}
+	}
+	var names []string
+	for i := 0; i < 20; i++ {
+		n := fmt.Sprintf("%s/link%d", dir, i)
+		if i%2 == 1 {
+			n += string(bytes.Repeat([]byte("l"), 200))
+		}
+		if err := os.Link(target, n); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, n)
+	}
+	checkNlink(21)
+	// rename(2) between two links of the same file does nothing
+	if err := os.Rename(names[1], names[3]); err != nil {
+		t.Fatal(err)
+	}
+	checkNlink(21)
+	fi, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 21 {
+		t.Errorf("want 21 entries, have %d", len(fi))
+	}
+	for _, n := range names {
+		if err := syscall.Unlink(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkNlink(1)
+}
+
 func TestLchown(t *testing.T) {
 	name := test_helpers.DefaultPlainDir + "/symlink"
 	err := os.Symlink("/target/does/not/exist", name)
@@ -69,6 +69,13 @@ func TestFiltered(t *testing.T) {
 	if err == nil {
 		t.Errorf("should have failed but didn't")
 	}
+	// Renames and hard links must not give access to the config file either
+	if err = os.Rename(filteredFile, pDir+"/stolen"); err == nil {
+		t.Errorf("rename should have failed but didn't")
+	}
+	if err = os.Link(filteredFile, pDir+"/stolen"); err == nil {
+		t.Errorf("link should have failed but didn't")
+	}
 	err = ioutil.WriteFile(pDir+"/gocryptfs.diriv", []byte("foo"), 0777)
 	if err != nil {
 		t.Error(err)
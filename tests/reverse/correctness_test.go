@@ -1,17 +1,26 @@
 package reverse_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/pkg/xattr"
 	"golang.org/x/sys/unix"
 
-	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
@@ -42,6 +51,40 @@ func TestLongnameStat(t *testing.T) {
 	}
 }
 
+// The virtual gocryptfs.longname.*.name files must contain the full
+// encrypted name, which hashes to the file name
+func TestNameFileContent(t *testing.T) {
+	if plaintextnames {
+		t.Skip()
+	}
+	name := "namefile." + strings.Repeat("x", 240)
+	if err := ioutil.WriteFile(dirA+"/"+name, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(dirA + "/" + name)
+	matches, err := filepath.Glob(dirB + "/gocryptfs.longname.*.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 {
+		t.Fatal("no .name files")
+	}
+	for _, m := range matches {
+		content, err := ioutil.ReadFile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) <= unix.NAME_MAX {
+			t.Errorf("%q: content is too short: %q", m, content)
+		}
+		h := sha256.Sum256(content)
+		want := "gocryptfs.longname." + base64.RawURLEncoding.EncodeToString(h[:]) + ".name"
+		if filepath.Base(m) != want {
+			t.Errorf("%q: content hashes to %q", m, want)
+		}
+	}
+}
+
 func TestSymlinks(t *testing.T) {
 	target := "/"
 	os.Symlink(target, dirA+"/symlink")
@@ -142,6 +185,38 @@ func TestAccessVirtual(t *testing.T) {
 	}
 }
 
+// Check that the attributes of virtual files do not change when the parent
+// directory changes
+func TestVirtualStable(t *testing.T) {
+	if plaintextnames {
+		t.Skip("test makes no sense for plaintextnames")
+	}
+	fn := dirB + "/gocryptfs.diriv"
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Stat(fn, &st1); err != nil {
+		t.Fatal(err)
+	}
+	// Sleep so a changed mtime would be visible even with 1-second
+	// timestamp granularity and the attribute cache has expired
+	time.Sleep(1100 * time.Millisecond)
+	f, err := os.Create(dirA + "/TestVirtualStable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer syscall.Unlink(dirA + "/TestVirtualStable")
+	time.Sleep(1100 * time.Millisecond)
+	if err := syscall.Stat(fn, &st2); err != nil {
+		t.Fatal(err)
+	}
+	if st1.Ino != st2.Ino {
+		t.Errorf("inode number changed: %d -> %d", st1.Ino, st2.Ino)
+	}
+	if st1.Mtim != st2.Mtim || st1.Ctim != st2.Ctim {
+		t.Errorf("timestamps changed: mtime %v -> %v, ctime %v -> %v", st1.Mtim, st2.Mtim, st1.Ctim, st2.Ctim)
+	}
+}
+
 // Check that the access() syscall works on regular files
 func TestAccess(t *testing.T) {
 	f, err := os.Create(dirA + "/testaccess1")
@@ -207,3 +282,511 @@ func TestTooLongSymlink(t *testing.T) {
 			err2.Err)
 	}
 }
+
+// With "-cipherdf", the used space reported by statfs should include the
+// ciphertext size of the files in the plaintext directory.
+func TestCipherDf(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	const size = 10 * 1024 * 1024
+	err := ioutil.WriteFile(dir+"/file", make([]byte, size), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test", "-cipherdf")
+	defer test_helpers.UnmountPanic(mnt)
+	// The first statfs call starts a scan in the background. Poll until the
+	// result shows up.
+	var st syscall.Statfs_t
+	for i := 0; i < 50; i++ {
+		err = syscall.Statfs(mnt, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		used := (st.Blocks - st.Bfree) * uint64(st.Bsize)
+		if used >= size {
+			if used > 2*size {
+				t.Errorf("used space is too big: %d", used)
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("used space was never reported: blocks=%d bfree=%d", st.Blocks, st.Bfree)
+}
+
+// Without "-cipherdf", statfs should report the used space of the backing
+// filesystem plus the encryption overhead
+func TestStatfsScaled(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	var plain, cipher syscall.Statfs_t
+	if err := syscall.Statfs(dir, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Statfs(mnt, &cipher); err != nil {
+		t.Fatal(err)
+	}
+	plainUsed := plain.Blocks - plain.Bfree
+	cipherUsed := cipher.Blocks - cipher.Bfree
+	// Other processes may write to the backing filesystem in between, so
+	// allow some slack
+	if cipherUsed+1024 < plainUsed || cipherUsed > plainUsed+plainUsed/50+1024 {
+		t.Errorf("plaintext used=%d, ciphertext used=%d", plainUsed, cipherUsed)
+	}
+}
+
+// Check that "-follow_symlinks" presents symlinks as their targets and hides
+// dangling symlinks and symlinks that point to a parent directory.
+func TestFollowSymlinks(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	err := ioutil.WriteFile(dir+"/target", []byte("hello world"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("target", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("nowhere", dir+"/dangling"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(dir+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("..", dir+"/sub/loop"); err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test", "-follow_symlinks")
+	defer test_helpers.UnmountPanic(mnt)
+	// gocryptfs.conf, gocryptfs.diriv, target, link, sub
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Errorf("wrong number of entries: %d", len(entries))
+	}
+	var sizes []int64
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("%q is still a symlink", e.Name())
+		}
+		if e.Mode().IsRegular() && e.Name() != "gocryptfs.conf" && e.Name() != "gocryptfs.diriv" {
+			sizes = append(sizes, e.Size())
+		}
+	}
+	// "target" and "link" must have identical ciphertext sizes
+	if len(sizes) != 2 || sizes[0] != sizes[1] {
+		t.Errorf("unexpected file sizes: %v", sizes)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		// Only gocryptfs.diriv, "loop" must be hidden
+		subEntries, err := ioutil.ReadDir(mnt + "/" + e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subEntries) != 1 {
+			t.Errorf("wrong number of entries in sub: %d", len(subEntries))
+		}
+	}
+}
+
+// Reverse mode uses AES-SIV with nonces derived from the file path, so the
+// ciphertext must be identical across reads and remounts. Backup tools rely
+// on this to skip unchanged files.
+func TestDeterministic(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	err := ioutil.WriteFile(dir+"/file", bytes.Repeat([]byte("x"), 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	var contents [][]byte
+	for i := 0; i < 2; i++ {
+		test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test")
+		entries, err := ioutil.ReadDir(mnt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Name() == "gocryptfs.conf" || e.Name() == "gocryptfs.diriv" {
+				continue
+			}
+			c, err := ioutil.ReadFile(mnt + "/" + e.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents = append(contents, c)
+		}
+		test_helpers.UnmountPanic(mnt)
+	}
+	if len(contents) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(contents))
+	}
+	if !bytes.Equal(contents[0], contents[1]) {
+		t.Error("ciphertext changed between mounts")
+	}
+}
+
+// TestDeterministicHardlink checks that a file with two hard links has the
+// same ciphertext under both names, no matter which one is read first
+func TestDeterministicHardlink(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse", "-plaintextnames")
+	err := ioutil.WriteFile(dir+"/a", bytes.Repeat([]byte("x"), 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(dir+"/a", dir+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	var contents [][]byte
+	for _, order := range [][]string{{"a", "b"}, {"b", "a"}} {
+		test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test")
+		for _, name := range order {
+			c, err := ioutil.ReadFile(mnt + "/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents = append(contents, c)
+		}
+		test_helpers.UnmountPanic(mnt)
+	}
+	for i := 1; i < len(contents); i++ {
+		if !bytes.Equal(contents[0], contents[i]) {
+			t.Errorf("ciphertext #%d differs", i)
+		}
+	}
+}
+
+// TestExportTar checks that "-export_tar" writes the same files as a reverse
+// mount shows, and the same stream every time
+func TestExportTar(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	err := ioutil.WriteFile(dir+"/file", bytes.Repeat([]byte("x"), 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(dir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("file", dir+"/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	var streams [][]byte
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-reverse", "-export_tar", "-extpass", "echo test", dir)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, out)
+	}
+	if !bytes.Equal(streams[0], streams[1]) {
+		t.Error("tar stream changed between runs")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	tr := tar.NewReader(bytes.NewReader(streams[0]))
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		path := filepath.Join(mnt, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, _ := ioutil.ReadAll(tr)
+			if !bytes.Equal(have, want) {
+				t.Errorf("%q: content differs", hdr.Name)
+			}
+		case tar.TypeSymlink:
+			want, err := os.Readlink(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Linkname != want {
+				t.Errorf("%q: have target %q, want %q", hdr.Name, hdr.Linkname, want)
+			}
+		case tar.TypeDir:
+			if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+				t.Errorf("%q: not a directory in the mount: %v", hdr.Name, err)
+			}
+		}
+	}
+	// gocryptfs.conf, gocryptfs.diriv, file, dir, dir/gocryptfs.diriv,
+	// dir/link
+	if n != 6 {
+		t.Errorf("wrong number of entries: %d", n)
+	}
+}
+
+// TestDirCache checks that a cached directory listing is updated when the
+// plaintext directory changes
+func TestDirCache(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	if err := ioutil.WriteFile(dir+"/a", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// Recently changed directories are not cached
+	time.Sleep(2100 * time.Millisecond)
+	for i, want := range []int{3, 3, 4} {
+		if i == 2 {
+			if err := ioutil.WriteFile(dir+"/b", nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := ioutil.ReadDir(mnt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// gocryptfs.conf, gocryptfs.diriv and the files
+		if len(entries) != want {
+			t.Errorf("listing %d: have %d entries, want %d", i, len(entries), want)
+		}
+	}
+}
+
+// Check that "-exclude-from" hides the matching files and directories
+func TestExcludeFrom(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse", "-plaintextnames")
+	for _, f := range []string{"keep.txt", "x.log", "important.log", "sub/x.log", "sub/y", "cache/a"} {
+		if err := os.MkdirAll(dir+"/"+filepath.Dir(f), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/"+f, []byte(f), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludeFile := dir + ".exclude"
+	err := ioutil.WriteFile(excludeFile, []byte("*.log\n!important.log\ncache/\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(excludeFile)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test", "-exclude-from", excludeFile)
+	defer test_helpers.UnmountPanic(mnt)
+	var names []string
+	for _, d := range []string{"", "sub"} {
+		entries, err := ioutil.ReadDir(mnt + "/" + d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			names = append(names, filepath.Join(d, e.Name()))
+		}
+	}
+	want := "gocryptfs.conf important.log keep.txt sub sub/y"
+	if have := strings.Join(names, " "); have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	for _, f := range []string{"x.log", "sub/x.log", "cache", "cache/a"} {
+		if _, err := os.Stat(mnt + "/" + f); !os.IsNotExist(err) {
+			t.Errorf("%q: want ENOENT, have %v", f, err)
+		}
+	}
+}
+
+// TestXattr checks that xattrs set in the plaintext directory are visible
+// in the forward mount on top of the reverse mount.
+func TestXattr(t *testing.T) {
+	fn := "TestXattr"
+	if err := ioutil.WriteFile(dirA+"/"+fn, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	val := []byte("xxxxxxxxyyyyyyyyyyyyyyyzzzzzzzzzzzzz")
+	if err := xattr.LSet(dirA+"/"+fn, "user.foo", val); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	have, err := xattr.LGet(dirC+"/"+fn, "user.foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, val) {
+		t.Errorf("wrong value: have %q, want %q", have, val)
+	}
+	names, err := xattr.LList(dirC + "/" + fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "user.foo" {
+		t.Errorf("wrong names: %v", names)
+	}
+	// The encrypted value must be stable, like the file contents
+	cNames, err := xattr.LList(dirB + "/" + fn)
+	if err != nil || len(cNames) != 1 {
+		t.Fatalf("cNames=%v err=%v", cNames, err)
+	}
+	c1, err := xattr.LGet(dirB+"/"+fn, cNames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := xattr.LGet(dirB+"/"+fn, cNames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c1, c2) {
+		t.Error("encrypted xattr value is not deterministic")
+	}
+}
+
+// TestDirNlink checks that the link count of a directory counts the
+// subdirectories that are visible in the ciphertext view
+func TestDirNlink(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse", "-plaintextnames")
+	for _, d := range []string{"d/a", "d/b", "d/excluded"} {
+		if err := os.MkdirAll(dir+"/"+d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(dir+"/d/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	excludeFile := dir + ".exclude"
+	if err := ioutil.WriteFile(excludeFile, []byte("excluded/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(excludeFile)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test", "-exclude-from", excludeFile)
+	defer test_helpers.UnmountPanic(mnt)
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/d", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Nlink != 4 {
+		t.Errorf("wrong Nlink: have %d, want 4", st.Nlink)
+	}
+}
+
+// TestOneFileSystem checks that "-one_file_system" hides a filesystem that
+// is mounted inside the plaintext directory
+func TestOneFileSystem(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse", "-plaintextnames")
+	if err := ioutil.WriteFile(dir+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Use a forward gocryptfs mount as the nested filesystem
+	inner := test_helpers.InitFS(t)
+	if err := os.Mkdir(dir+"/inner", 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, inner, dir+"/inner", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(dir + "/inner")
+	if err := ioutil.WriteFile(dir+"/inner/secret", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test", "-one_file_system")
+	defer test_helpers.UnmountPanic(mnt)
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if have, want := strings.Join(names, " "), "file gocryptfs.conf"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	for _, f := range []string{"inner", "inner/secret"} {
+		if _, err := os.Stat(mnt + "/" + f); !os.IsNotExist(err) {
+			t.Errorf("%q: want ENOENT, have %v", f, err)
+		}
+	}
+}
+
+// TestWritable restores a copy of the ciphertext view through a "-writable"
+// mount and checks that the plaintext comes out unchanged
+func TestWritable(t *testing.T) {
+	src := test_helpers.InitFS(t, "-reverse")
+	longName := strings.Repeat("x", 200)
+	files := map[string]string{
+		"short":         "hello world",
+		"d/" + longName: strings.Repeat("long name ", 1000),
+		"d/empty":       "",
+		"d/sub/deep":    "deep",
+	}
+	for p, content := range files {
+		if err := os.MkdirAll(filepath.Dir(src+"/"+p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(src+"/"+p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("short", src+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	// Take a ciphertext backup
+	srcMnt := src + ".mnt"
+	test_helpers.MountOrFatal(t, src, srcMnt, "-reverse", "-extpass", "echo test")
+	backup := src + ".backup"
+	if out, err := exec.Command("cp", "-a", srcMnt, backup).CombinedOutput(); err != nil {
+		t.Fatalf("cp: %v\n%s", err, out)
+	}
+	test_helpers.UnmountPanic(srcMnt)
+	// Restore it into an empty directory that uses the same config file
+	dst := test_helpers.TmpDir + "/TestWritable.dst"
+	if err := os.Mkdir(dst, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ioutil.ReadFile(src + "/.gocryptfs.reverse.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dst+"/.gocryptfs.reverse.conf", conf, 0400); err != nil {
+		t.Fatal(err)
+	}
+	dstMnt := dst + ".mnt"
+	test_helpers.MountOrFatal(t, dst, dstMnt, "-reverse", "-extpass", "echo test", "-writable")
+	defer test_helpers.UnmountPanic(dstMnt)
+	if out, err := exec.Command("cp", "-a", backup+"/.", dstMnt).CombinedOutput(); err != nil {
+		t.Fatalf("cp: %v\n%s", err, out)
+	}
+	for p, want := range files {
+		have, err := ioutil.ReadFile(dst + "/" + p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(have) != want {
+			t.Errorf("%q: wrong content", p)
+		}
+	}
+	if target, err := os.Readlink(dst + "/link"); err != nil || target != "short" {
+		t.Errorf("link: have %q, %v", target, err)
+	}
+	// No pending files may be left behind
+	entries, err := ioutil.ReadDir(dst + "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".gocryptfs.pending.") {
+			t.Errorf("leftover pending file %q", e.Name())
+		}
+	}
+}
@@ -0,0 +1,60 @@
+#!/bin/bash
+#
+# Mount a gocryptfs filesystem with "-strict_posix" in /tmp and run the
+# pjdfstest POSIX test suite against it.
+#
+# Needs root, as pjdfstest switches between users and creates device
+# nodes. Pass the names of the test directories to run only those, like
+# "rename unlink".
+
+set -eu
+
+cd "$(dirname "$0")"
+MYNAME=$(basename $0)
+source ../fuse-unmount.bash
+
+if [ $(id -u) -ne 0 ]; then
+	echo "$MYNAME: pjdfstest must be run as root"
+	exit 1
+fi
+
+# pjdfstest checkout
+PJDFSTEST=$HOME/pjdfstest
+if [ ! -x $PJDFSTEST/pjdfstest ]
+then
+	echo "$MYNAME: pjdfstest binary not found at $PJDFSTEST/pjdfstest"
+	echo "Please clone and compile https://github.com/pjd/pjdfstest"
+	exit 1
+fi
+
+# Backing directory
+DIR=$(mktemp -d /tmp/$MYNAME.XXX)
+# Mountpoint
+MNT="$DIR.mnt"
+mkdir $MNT
+
+# Set the GOPATH variable to the default if it is empty
+GOPATH=$(go env GOPATH)
+
+echo "Recompile gocryptfs"
+cd $GOPATH/src/github.com/rfjakob/gocryptfs
+./build.bash
+$GOPATH/bin/gocryptfs -q -init -extpass "echo test" -scryptn=10 $DIR
+# -allow_other: pjdfstest accesses the mount as other users
+# -ko suid,dev: pjdfstest checks setuid bits and device nodes
+$GOPATH/bin/gocryptfs -q -extpass "echo test" -nosyslog -strict_posix \
+	-allow_other -ko suid,dev $DIR $MNT
+
+# Cleanup trap
+trap "cd / ; fuse-unmount -z $MNT ; rm -rf $DIR $MNT" EXIT
+
+TESTS=""
+for i in "$@"; do
+	TESTS="$TESTS $PJDFSTEST/tests/$i"
+done
+if [ -z "$TESTS" ]; then
+	TESTS=$PJDFSTEST/tests
+fi
+
+cd $MNT
+prove -r $TESTS
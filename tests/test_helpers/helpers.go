@@ -6,7 +6,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -17,7 +16,8 @@ import (
 	"testing"
 	"time"
 
-	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/gocryptfstest"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 )
 
@@ -52,6 +52,7 @@ func SwitchTestParentDir(newDir string) {
 }
 
 func init() {
+	gocryptfstest.Binary = GocryptfsBinary
 	doInit()
 }
 
@@ -130,18 +131,10 @@ func InitFS(t *testing.T, extraArgs ...string) string {
 			log.Panic(err)
 		}
 	}
-	args := []string{"-q", "-init", "-extpass", "echo test", "-scryptn=10"}
-	args = append(args, extraArgs...)
-	args = append(args, dir)
-
-	cmd := exec.Command(GocryptfsBinary, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
+	err = gocryptfstest.InitErr(dir, extraArgs...)
 	if err != nil {
 		if t != nil {
-			t.Fatalf("InitFS with args %v failed: %v", args, err)
+			t.Fatalf("InitFS: %v", err)
 		} else {
 			log.Panic(err)
 		}
@@ -153,42 +146,7 @@ func InitFS(t *testing.T, extraArgs ...string) string {
 // Mount CIPHERDIR "c" on PLAINDIR "p"
 // Creates "p" if it does not exist.
 func Mount(c string, p string, showOutput bool, extraArgs ...string) error {
-	var args []string
-	args = append(args, "-q", "-wpanic", "-nosyslog")
-	args = append(args, extraArgs...)
-	//args = append(args, "-fusedebug")
-	//args = append(args, "-d")
-	args = append(args, c)
-	args = append(args, p)
-
-	if _, err := os.Stat(p); err != nil {
-		err = os.Mkdir(p, 0777)
-		if err != nil {
-			return err
-		}
-	}
-
-	cmd := exec.Command(GocryptfsBinary, args...)
-	if showOutput {
-		// The Go test logic waits for our stdout to close, and when we share
-		// it with the subprocess, it will wait for it to close it as well.
-		// Use an intermediate pipe so the tests do not hang when unmouting
-		// fails.
-		pr, pw, err := os.Pipe()
-		if err != nil {
-			return err
-		}
-		// We can close the fd after cmd.Run() has executed
-		defer pw.Close()
-		cmd.Stderr = pw
-		cmd.Stdout = pw
-		go func() {
-			io.Copy(os.Stdout, pr)
-			pr.Close()
-		}()
-	}
-
-	return cmd.Run()
+	return gocryptfstest.MountErr(c, p, showOutput, extraArgs...)
 }
 
 // MountOrExit calls Mount() and exits on failure.
@@ -224,23 +182,9 @@ func UnmountPanic(dir string) {
 // UnmountErr tries to unmount "dir", retrying 10 times, and returns the
 // resulting error.
 func UnmountErr(dir string) (err error) {
-	max := 10
-	// When a new filesystem is mounted, Gnome tries to read files like
-	// .xdg-volume-info, autorun.inf, .Trash.
-	// If we try to unmount before Gnome is done, the unmount fails with
-	// "Device or resource busy", causing spurious test failures.
-	// Retry a few times to hide that problem.
-	for i := 1; i <= max; i++ {
-		cmd := exec.Command(UnmountScript, "-u", dir)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-		if err == nil {
-			return nil
-		}
-		code := ExtractCmdExitCode(err)
-		fmt.Printf("UnmountErr: got exit code %d, retrying (%d/%d)\n", code, i, max)
-		time.Sleep(100 * time.Millisecond)
+	err = gocryptfstest.UnmountErr(dir)
+	if err != nil {
+		fmt.Printf("UnmountErr: giving up: %v\n", err)
 	}
 	return err
 }
@@ -429,13 +373,7 @@ func QueryCtlSock(t *testing.T, socketPath string, req ctlsock.RequestStruct) (r
 // ExtractCmdExitCode extracts the exit code from an error value that was
 // returned from exec / cmd.Run()
 func ExtractCmdExitCode(err error) int {
-	if err == nil {
-		return 0
-	}
-	// OMG this is convoluted
-	err2 := err.(*exec.ExitError)
-	code := err2.Sys().(syscall.WaitStatus).ExitStatus()
-	return code
+	return gocryptfstest.ExtractCmdExitCode(err)
 }
 
 // ListFds lists our open file descriptors.
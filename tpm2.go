@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/tpm2"
+)
+
+// tpm2SealKey seals "masterkey" to the local TPM and stores the sealed
+// object in "confFile". The caller has to write the config file to disk.
+// Calls os.Exit on failure.
+func tpm2SealKey(args *argContainer, confFile *configfile.ConfFile, masterkey []byte) {
+	if confFile.IsFeatureFlagSet(configfile.FlagDualControl) || confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		// Unsealing from the TPM would bypass the second person or the token
+		tlog.Fatal.Printf("Dual control and FIDO2 filesystems do not support -tpm2")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Printf("Sealing master key to the TPM")
+	pub, priv, err := tpm2.Seal(tpm2Payload(confFile, masterkey), args.tpm2_pcrs)
+	if err != nil {
+		tlog.Fatal.Printf("TPM2 seal: %v", err)
+		os.Exit(exitcodes.TPM2)
+	}
+	confFile.TPM2Object = &configfile.TPM2Params{
+		Public:  pub,
+		Private: priv,
+		PCRs:    args.tpm2_pcrs,
+	}
+}
+
+// tpm2UnsealKey loads the config file and unseals the master key from the
+// local TPM. No password is needed.
+// Calls os.Exit on failure.
+func tpm2UnsealKey(args *argContainer) (masterkey []byte, confFile *configfile.ConfFile) {
+	_, confFile, err := configfile.LoadConfFile(args.config, nil)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	t := confFile.TPM2Object
+	if t == nil {
+		tlog.Fatal.Printf("The master key has not been sealed to the TPM. Use -passwd -tpm2 to do that.")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Printf("Unsealing master key from the TPM")
+	data, err := tpm2.Unseal(t.Public, t.Private, t.PCRs)
+	if err != nil {
+		tlog.Fatal.Printf("TPM2 unseal: %v", err)
+		os.Exit(exitcodes.TPM2)
+	}
+	masterkey, err = tpm2CheckPayload(confFile, data)
+	if err != nil {
+		tlog.Fatal.Printf("TPM2 unseal: %v", err)
+		os.Exit(exitcodes.TPM2)
+	}
+	return masterkey, confFile
+}
+
+// tpm2Reseal seals "masterkey" to the TPM again, with the same PCRs, after
+// the settings in confFile.KeyAD() have changed. Does nothing if the master
+// key has not been sealed to the TPM.
+// Calls os.Exit on failure.
+func tpm2Reseal(args *argContainer, confFile *configfile.ConfFile, masterkey []byte) {
+	if confFile.TPM2Object == nil {
+		return
+	}
+	args.tpm2_pcrs = confFile.TPM2Object.PCRs
+	tpm2SealKey(args, confFile, masterkey)
+}
+
+// tpm2Payload returns the data that is sealed to the TPM: the master key,
+// followed by a hash of confFile.KeyAD(). The TPM does not see the config
+// file, so the hash is what ties the "Sealed" flag and the expiry time to
+// the sealed copy.
+func tpm2Payload(confFile *configfile.ConfFile, masterkey []byte) []byte {
+	h := sha256.Sum256(confFile.KeyAD())
+	return append(append([]byte{}, masterkey...), h[:]...)
+}
+
+// tpm2CheckPayload checks unsealed "data" against "confFile" and returns
+// the master key
+func tpm2CheckPayload(confFile *configfile.ConfFile, data []byte) ([]byte, error) {
+	if len(data) != cryptocore.KeyLen+sha256.Size {
+		return nil, fmt.Errorf("got %d bytes, want %d", len(data), cryptocore.KeyLen+sha256.Size)
+	}
+	h := sha256.Sum256(confFile.KeyAD())
+	if !bytes.Equal(data[cryptocore.KeyLen:], h[:]) {
+		return nil, errors.New("the settings in the config file do not match the sealed master key. " +
+			"Mount with the password and run \"-passwd -tpm2\" to seal it again.")
+	}
+	return data[:cryptocore.KeyLen], nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+var keyTestPw = []byte("test")
+
+// keyTestConf creates a sealed config file with an expiry time in "dir" and
+// returns the master key and the loaded config
+func keyTestConf(t *testing.T, dir string) ([]byte, *configfile.ConfFile) {
+	path := filepath.Join(dir, configfile.ConfDefaultName)
+	err := configfile.CreateConfFile(&configfile.CreateArgs{Filename: path, Password: keyTestPw, LogN: 10,
+		Creator: "test", Expiry: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, confFile, err := configfile.LoadConfFile(path, keyTestPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confFile.SetSealed(masterkey, keyTestPw, true)
+	if err = confFile.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	return masterkey, confFile
+}
+
+// keyTestTamper removes the "Sealed" flag or moves the expiry time, like
+// somebody who can write gocryptfs.conf but does not know the password,
+// and writes the config file
+func keyTestTamper(t *testing.T, confFile *configfile.ConfFile, expiry bool) {
+	if expiry {
+		confFile.Expiry++
+	} else {
+		var flags []string
+		for _, f := range confFile.FeatureFlags {
+			if f != "Sealed" {
+				flags = append(flags, f)
+			}
+		}
+		confFile.FeatureFlags = flags
+	}
+	if err := confFile.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTPM2Payload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTPM2Payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, expiry := range []bool{false, true} {
+		masterkey, confFile := keyTestConf(t, dir)
+		data := tpm2Payload(confFile, masterkey)
+		have, err := tpm2CheckPayload(confFile, data)
+		if err != nil || string(have) != string(masterkey) {
+			t.Fatalf("have=%x err=%v", have, err)
+		}
+		keyTestTamper(t, confFile, expiry)
+		if _, err = tpm2CheckPayload(confFile, data); err == nil {
+			t.Errorf("expiry=%v: edited config file was accepted", expiry)
+		}
+		// Old format without the hash
+		if _, err = tpm2CheckPayload(confFile, masterkey); err == nil {
+			t.Error("payload without hash was accepted")
+		}
+	}
+}